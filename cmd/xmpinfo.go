@@ -19,14 +19,13 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 
 	_ "github.com/mholt/go-xmp/models"
 	"github.com/mholt/go-xmp/models/dc"
 	xmpbase "github.com/mholt/go-xmp/models/xmp_base"
 	"github.com/mholt/go-xmp/xmp"
+	"github.com/mholt/go-xmp/xmpfiles"
 )
 
 var (
@@ -99,29 +98,26 @@ func main() {
 		}
 		defer f.Close()
 
-		switch filepath.Ext(filename) {
-		case ".xmp":
-			b, err = ioutil.ReadAll(f)
-			if err != nil {
-				fail(err)
-			}
-
-		default:
+		if forig && fall {
+			// output every packet embedded anywhere in the file
 			bb, err := xmp.ScanPackets(f)
 			if err != nil && err != io.EOF {
 				fail(err)
 			}
-			if err == io.EOF {
-				return
+			for _, b := range bb {
+				out(b)
 			}
-			if forig && fall {
-				for _, b := range bb {
-					out(b)
-				}
-				return
-			}
-			b = bb[0]
+			return
+		}
+
+		l, err := xmpfiles.ReadPackets(f)
+		if err == xmpfiles.ErrNoXMP || err == nil && len(l) == 0 {
+			return
+		}
+		if err != nil {
+			fail(err)
 		}
+		b = l[0].Data
 
 	} else {
 		// fill the document with some info
@@ -0,0 +1,371 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package bmff reads and writes XMP packets stored in ISO base media files
+// (MP4, M4A, 3GP) and QuickTime movies as defined by XMP Specification Part 3.
+//
+// MP4 files keep XMP in a top-level uuid box with the extended type
+// BE7ACFCB-97A9-42E8-9C71-999491E3AFAC, QuickTime movies in a moov/udta/XMP_
+// atom. When a rewrite changes the position of media data, all chunk offsets
+// in stco and co64 tables are updated.
+//
+// ReadMetadata and WriteMetadata map native QuickTime user data, QuickTime
+// mdta metadata and iTunes ilst items to the qt and itunes models.
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+var (
+	UUIDXMP = []byte{0xBE, 0x7A, 0xCF, 0xCB, 0x97, 0xA9, 0x42, 0xE8, 0x9C, 0x71, 0x99, 0x94, 0x91, 0xE3, 0xAF, 0xAC}
+
+	ErrNoXMP   = errors.New("bmff: no XMP packet found")
+	ErrInvalid = errors.New("bmff: invalid file format")
+)
+
+// sanity limit for boxes we load into memory
+const maxBoxSize = 1 << 30
+
+// limit for inflated XMP packets in compressed items
+const maxPacketSize = 64 << 20
+
+func isXMPBox(b *Box) bool {
+	return b.Type == "uuid" && bytes.Equal(b.UUID, UUIDXMP)
+}
+
+func loadBox(r io.ReadSeeker, b *Box) error {
+	if b.Size > maxBoxSize {
+		return fmt.Errorf("bmff: '%s' box too large", b.Type)
+	}
+	return ReadBox(r, b)
+}
+
+// IsQuickTime returns true when the file uses the QuickTime brand or has
+// no ftyp box at all (classic QuickTime movies).
+func IsQuickTime(r io.ReadSeeker, top []*Box) (bool, error) {
+	for _, b := range top {
+		if b.Type != "ftyp" {
+			continue
+		}
+		if err := loadBox(r, b); err != nil {
+			return false, err
+		}
+		return len(b.Data) >= 4 && string(b.Data[:4]) == "qt  ", nil
+	}
+	return true, nil
+}
+
+// ReadPacket returns the XMP packet from a top-level uuid box, from the
+// moov/udta/XMP_ atom or from the XMP item of a HEIF meta box, whichever
+// comes first.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	top, err := ReadTopLevel(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range top {
+		switch {
+		case isXMPBox(b):
+			if err := loadBox(r, b); err != nil {
+				return nil, err
+			}
+			return b.Data, nil
+		case b.Type == "moov":
+			if err := loadBox(r, b); err != nil {
+				return nil, err
+			}
+			if x := b.Find("udta", "XMP_"); x != nil {
+				return x.Data, nil
+			}
+		case b.Type == "meta":
+			if err := loadBox(r, b); err != nil {
+				return nil, err
+			}
+			if !isImageMeta(b) {
+				continue
+			}
+			packet, err := readItemPacket(r, b)
+			if err != ErrNoXMP {
+				return packet, err
+			}
+		}
+	}
+	return nil, ErrNoXMP
+}
+
+// Read decodes the XMP packet stored in an MP4 or QuickTime file.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and stores packet in a uuid box
+// for MP4 files, in moov/udta/XMP_ for QuickTime movies or as metadata item
+// for HEIF image files.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	top, err := ReadTopLevel(r)
+	if err != nil {
+		return err
+	}
+	for _, b := range top {
+		if b.Type != "meta" {
+			continue
+		}
+		if err := loadBox(r, b); err != nil {
+			return err
+		}
+		if isImageMeta(b) {
+			return writeItemPacket(w, r, top, b, packet)
+		}
+	}
+	qt, err := IsQuickTime(r, top)
+	if err != nil {
+		return err
+	}
+	if qt {
+		var moov *Box
+		for _, b := range top {
+			if b.Type == "moov" {
+				moov = b
+				break
+			}
+		}
+		if moov == nil {
+			return fmt.Errorf("bmff: missing moov atom")
+		}
+		if err := loadBox(r, moov); err != nil {
+			return err
+		}
+		udta := moov.Find("udta")
+		if udta == nil {
+			udta = NewContainer("udta")
+			moov.Boxes = append(moov.Boxes, udta)
+		}
+		udta.Replace(NewBox("XMP_", packet))
+		return Rewrite(w, r, top, map[*Box]*Box{moov: moov})
+	}
+
+	box := NewBox("uuid", packet)
+	box.UUID = UUIDXMP
+	for _, b := range top {
+		if isXMPBox(b) {
+			return Rewrite(w, r, top, map[*Box]*Box{b: box})
+		}
+	}
+	return Rewrite(w, r, append(top, box), nil)
+}
+
+// Write copies the file from r to w and stores d as its XMP packet.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
+
+// Rewrite writes the list of top-level boxes to w. Boxes read from r are
+// copied unless they appear as key in replace, in which case the mapped box
+// is serialized instead (a nil value removes the box). New boxes without
+// file offset are serialized as well. When boxes change size, chunk offsets
+// in the moov box are adjusted so they keep pointing to the same media data.
+// A free box directly following a changed box absorbs size differences to
+// avoid moving media data when possible.
+func Rewrite(w io.Writer, r io.ReadSeeker, top []*Box, replace map[*Box]*Box) error {
+	if replace == nil {
+		replace = make(map[*Box]*Box)
+	}
+
+	// never append behind a box that extends to the end of file
+	for i, b := range top {
+		if b.open && i < len(top)-1 {
+			l := append([]*Box{}, top[:i]...)
+			l = append(l, top[i+1:]...)
+			top = append(l, b)
+			break
+		}
+	}
+
+	type part struct {
+		orig *Box // nil for new boxes
+		box  *Box // nil when copied unchanged
+		size int64
+		skip bool // removed from output
+	}
+	parts := make([]*part, 0, len(top))
+	for _, b := range top {
+		p := &part{orig: b, size: b.Size}
+		if b.Offset < 0 {
+			p.orig, p.box = nil, b
+		} else if x, ok := replace[b]; ok {
+			p.box, p.skip = x, x == nil
+		}
+		switch {
+		case p.skip:
+			p.size = 0
+		case p.box != nil:
+			p.size = p.box.EncodedSize()
+		}
+		parts = append(parts, p)
+	}
+
+	// absorb size changes with adjacent free space
+	for i, p := range parts {
+		if p.orig == nil || p.box == nil || i+1 >= len(parts) {
+			continue
+		}
+		next := parts[i+1]
+		if next.orig == nil || next.box != nil || next.skip || (next.orig.Type != "free" && next.orig.Type != "skip") {
+			continue
+		}
+		delta := p.size - p.orig.Size
+		free := next.orig.Size - delta
+		switch {
+		case delta == 0 || free > 0xFFFFFFFF:
+		case free == 0:
+			next.skip, next.size = true, 0
+		case free >= 8:
+			next.box, next.size = NewBox("free", make([]byte, free-8)), free
+		}
+	}
+
+	// collect size changes relative to original offsets
+	type shift struct {
+		end   int64 // original end offset of the changed range
+		delta int64
+	}
+	shifts := make([]shift, 0)
+	var pos, newPos int64
+	var moov *Box
+	for _, p := range parts {
+		if p.orig != nil {
+			if p.box == nil && p.orig.Type == "moov" {
+				moov = p.orig
+			}
+			if p.box != nil && p.box.Type == "moov" {
+				moov = p.box
+			}
+			if p.orig.Offset > pos {
+				pos = p.orig.Offset
+			}
+			pos += p.orig.Size
+		}
+		newPos += p.size
+		if d := newPos - pos; len(shifts) == 0 && d != 0 || len(shifts) > 0 && d != shifts[len(shifts)-1].delta {
+			shifts = append(shifts, shift{pos, d})
+		}
+	}
+
+	if len(shifts) > 0 && moov != nil {
+		if moov.Offset >= 0 && moov.Boxes == nil && moov.Data == nil {
+			if err := loadBox(r, moov); err != nil {
+				return err
+			}
+			for _, p := range parts {
+				if p.orig == moov {
+					p.box = moov
+				}
+			}
+		}
+		fn := func(off int64) int64 {
+			var d int64
+			for _, s := range shifts {
+				if off >= s.end {
+					d = s.delta
+				}
+			}
+			return off + d
+		}
+		if err := ShiftChunkOffsets(moov, fn); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range parts {
+		if p.skip {
+			continue
+		}
+		if p.box != nil {
+			if _, err := p.box.WriteTo(w); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := r.Seek(p.orig.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, p.orig.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShiftChunkOffsets rewrites all stco and co64 chunk offset tables inside
+// moov using fn.
+func ShiftChunkOffsets(moov *Box, fn func(int64) int64) error {
+	for _, trak := range moov.FindAll("trak") {
+		stbl := trak.Find("mdia", "minf", "stbl")
+		if stbl == nil {
+			continue
+		}
+		for _, b := range stbl.Boxes {
+			switch b.Type {
+			case "stco":
+				if len(b.Data) < 8 {
+					return fmt.Errorf("bmff: short stco box")
+				}
+				n := int(binary.BigEndian.Uint32(b.Data[4:]))
+				if len(b.Data) < 8+4*n {
+					return fmt.Errorf("bmff: short stco box")
+				}
+				for i := 0; i < n; i++ {
+					p := b.Data[8+4*i:]
+					v := fn(int64(binary.BigEndian.Uint32(p)))
+					if v > 0xFFFFFFFF {
+						return fmt.Errorf("bmff: chunk offset exceeds 32bit stco range")
+					}
+					binary.BigEndian.PutUint32(p, uint32(v))
+				}
+			case "co64":
+				if len(b.Data) < 8 {
+					return fmt.Errorf("bmff: short co64 box")
+				}
+				n := int(binary.BigEndian.Uint32(b.Data[4:]))
+				if len(b.Data) < 8+8*n {
+					return fmt.Errorf("bmff: short co64 box")
+				}
+				for i := 0; i < n; i++ {
+					p := b.Data[8+8*i:]
+					binary.BigEndian.PutUint64(p, uint64(fn(int64(binary.BigEndian.Uint64(p)))))
+				}
+			}
+		}
+	}
+	return nil
+}
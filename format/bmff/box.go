@@ -0,0 +1,329 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bmff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Box is a single ISO BMFF box or QuickTime atom. Container boxes keep
+// their children in Boxes, all other boxes keep their payload in Data.
+//
+// Boxes returned by ReadTopLevel only carry header information. Call
+// ReadBox to load their contents.
+type Box struct {
+	Type       string // FourCC
+	UUID       []byte // extended type of uuid boxes
+	Offset     int64  // file offset of the box header, -1 for new boxes
+	Size       int64  // total size including the header
+	HeaderSize int64
+	Prefix     []byte // full box version and flags preceding children
+	Data       []byte // payload of leaf boxes
+	Boxes      []*Box // children of container boxes
+	Trailer    []byte // trailing bytes after the last child
+	open       bool   // box extends to the end of file
+}
+
+// container box types we descend into
+var containers = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+	"udta": true,
+	"edts": true,
+	"dinf": true,
+	"mvex": true,
+	"moof": true,
+	"traf": true,
+	"mfra": true,
+	"tref": true,
+	"meta": true,
+	"iprp": true,
+	"ipco": true,
+	"jp2h": true,
+	"res ": true,
+	"uinf": true,
+	"ilst": true,
+}
+
+const maxDepth = 32
+
+func NewBox(typ string, data []byte) *Box {
+	return &Box{
+		Type:   typ,
+		Offset: -1,
+		Data:   data,
+	}
+}
+
+func NewContainer(typ string, boxes ...*Box) *Box {
+	return &Box{
+		Type:   typ,
+		Offset: -1,
+		Boxes:  boxes,
+	}
+}
+
+func (b *Box) IsContainer() bool {
+	return b.Boxes != nil || containers[b.Type]
+}
+
+// Find returns the first descendant box matching the path of box types.
+func (b *Box) Find(path ...string) *Box {
+	if len(path) == 0 {
+		return b
+	}
+	for _, v := range b.Boxes {
+		if v.Type == path[0] {
+			if x := v.Find(path[1:]...); x != nil {
+				return x
+			}
+		}
+	}
+	return nil
+}
+
+// FindAll returns all direct children of the given type.
+func (b *Box) FindAll(typ string) []*Box {
+	l := make([]*Box, 0)
+	for _, v := range b.Boxes {
+		if v.Type == typ {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// Replace replaces the first child of the same type or appends x.
+func (b *Box) Replace(x *Box) {
+	for i, v := range b.Boxes {
+		if v.Type == x.Type && bytes.Equal(v.UUID, x.UUID) {
+			b.Boxes[i] = x
+			return
+		}
+	}
+	b.Boxes = append(b.Boxes, x)
+}
+
+// Remove deletes all children of the given type.
+func (b *Box) Remove(typ string) {
+	l := b.Boxes[:0]
+	for _, v := range b.Boxes {
+		if v.Type != typ {
+			l = append(l, v)
+		}
+	}
+	b.Boxes = l
+}
+
+func (b *Box) payloadSize() int64 {
+	n := int64(len(b.Prefix) + len(b.Data) + len(b.Trailer))
+	for _, v := range b.Boxes {
+		n += v.EncodedSize()
+	}
+	return n
+}
+
+// EncodedSize returns the size of the box after serialization.
+func (b *Box) EncodedSize() int64 {
+	n := b.payloadSize() + 8 + int64(len(b.UUID))
+	if n > 0xFFFFFFFF {
+		n += 8
+	}
+	return n
+}
+
+// Bytes serializes the box and all its children.
+func (b *Box) Bytes() []byte {
+	var buf bytes.Buffer
+	b.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// WriteTo serializes the box and all its children to w.
+func (b *Box) WriteTo(w io.Writer) (int64, error) {
+	size := b.EncodedSize()
+	hdr := make([]byte, 16)
+	copy(hdr[4:], b.Type)
+	if size > 0xFFFFFFFF {
+		binary.BigEndian.PutUint32(hdr, 1)
+		binary.BigEndian.PutUint64(hdr[8:], uint64(size))
+	} else {
+		binary.BigEndian.PutUint32(hdr, uint32(size))
+		hdr = hdr[:8]
+	}
+	var n int64
+	for _, v := range [][]byte{hdr, b.UUID, b.Prefix, b.Data} {
+		c, err := w.Write(v)
+		n += int64(c)
+		if err != nil {
+			return n, err
+		}
+	}
+	for _, v := range b.Boxes {
+		c, err := v.WriteTo(w)
+		n += c
+		if err != nil {
+			return n, err
+		}
+	}
+	c, err := w.Write(b.Trailer)
+	return n + int64(c), err
+}
+
+// parseHeader decodes a box header from the start of b. The size of
+// open-ended boxes is set to remain.
+func parseHeader(b []byte, remain int64) (*Box, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("bmff: short box header")
+	}
+	x := &Box{
+		Type:       string(b[4:8]),
+		Size:       int64(binary.BigEndian.Uint32(b)),
+		HeaderSize: 8,
+	}
+	switch x.Size {
+	case 0:
+		x.Size = remain
+		x.open = true
+	case 1:
+		if len(b) < 16 {
+			return nil, fmt.Errorf("bmff: short box header")
+		}
+		x.Size = int64(binary.BigEndian.Uint64(b[8:]))
+		x.HeaderSize = 16
+	}
+	if x.Type == "uuid" {
+		if len(b) < int(x.HeaderSize)+16 {
+			return nil, fmt.Errorf("bmff: short uuid box header")
+		}
+		x.UUID = make([]byte, 16)
+		copy(x.UUID, b[x.HeaderSize:])
+		x.HeaderSize += 16
+	}
+	if x.Size < x.HeaderSize || x.Size > remain {
+		return nil, fmt.Errorf("bmff: invalid size %d for box '%s'", x.Size, x.Type)
+	}
+	return x, nil
+}
+
+// ParseBoxes decodes a sequence of boxes from b. Offset is the file offset
+// of b and is used to record box positions.
+func ParseBoxes(b []byte, offset int64) ([]*Box, error) {
+	l, _, err := parseBoxes(b, offset, 0)
+	return l, err
+}
+
+func parseBoxes(b []byte, offset int64, depth int) ([]*Box, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, fmt.Errorf("bmff: boxes nested too deep")
+	}
+	l := make([]*Box, 0)
+	for len(b) >= 8 {
+		x, err := parseHeader(b, int64(len(b)))
+		if err != nil {
+			return nil, nil, err
+		}
+		x.Offset = offset
+		x.parse(b[x.HeaderSize:x.Size], offset+x.HeaderSize, depth)
+		l = append(l, x)
+		b = b[x.Size:]
+		offset += x.Size
+	}
+	// QuickTime user data lists may end with a 32bit zero terminator
+	return l, b, nil
+}
+
+// parse decodes a box payload. Containers that fail to parse are kept
+// as leaf boxes so their contents survive unchanged.
+func (x *Box) parse(payload []byte, offset int64, depth int) {
+	if !containers[x.Type] {
+		x.Data = payload
+		return
+	}
+	var prefix []byte
+	if x.Type == "meta" && len(payload) >= 4 && binary.BigEndian.Uint32(payload) == 0 {
+		// ISO full box, QuickTime meta atoms have no version and flags
+		prefix, payload = payload[:4], payload[4:]
+		offset += 4
+	}
+	children, trailer, err := parseBoxes(payload, offset, depth+1)
+	if err != nil {
+		if prefix != nil {
+			payload = append(prefix, payload...)
+		}
+		x.Data = payload
+		return
+	}
+	x.Prefix = prefix
+	x.Boxes = children
+	if len(trailer) > 0 {
+		x.Trailer = trailer
+	}
+}
+
+// ReadTopLevel reads the headers of all top-level boxes without loading
+// their payload.
+func ReadTopLevel(r io.ReadSeeker) ([]*Box, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]*Box, 0)
+	var offset int64
+	hdr := make([]byte, 32)
+	for offset+8 <= size {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(r, hdr)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		x, err := parseHeader(hdr[:n], size-offset)
+		if err != nil {
+			return nil, fmt.Errorf("bmff: at offset %d: %v", offset, err)
+		}
+		x.Offset = offset
+		l = append(l, x)
+		offset += x.Size
+	}
+	if len(l) == 0 {
+		return nil, ErrInvalid
+	}
+	return l, nil
+}
+
+// ReadBox loads the payload of a box returned from ReadTopLevel and
+// decodes its children.
+func ReadBox(r io.ReadSeeker, x *Box) error {
+	if x.Offset < 0 {
+		return nil
+	}
+	if _, err := r.Seek(x.Offset+x.HeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+	payload := make([]byte, x.Size-x.HeaderSize)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	x.parse(payload, x.Offset+x.HeaderSize, 0)
+	return nil
+}
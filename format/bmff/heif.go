@@ -0,0 +1,624 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bmff
+
+// HEIF image files (HEIC, AVIF) keep XMP as a metadata item of type 'mime'
+// with content type application/rdf+xml. The item is declared in the
+// meta/iinf box and its data is located through meta/iloc, either in the
+// file (usually inside mdat) or in the meta/idat box. Items may consist of
+// several extents.
+//
+// Writers store the new packet at the end of the idat box and update the
+// item location. Because the meta box usually precedes mdat, all file based
+// item locations after meta are adjusted when meta changes size. Data of
+// a replaced item stored in mdat is left in place.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	mimeXMP = "application/rdf+xml"
+
+	// iloc construction methods
+	methodFile = 0
+	methodIdat = 1
+	methodItem = 2
+)
+
+// ItemInfo describes an entry of the HEIF item information box.
+type ItemInfo struct {
+	ID              uint32
+	Type            string // item type of version 2+ entries, e.g. hvc1, Exif, mime
+	Name            string
+	ContentType     string
+	ContentEncoding string
+	raw             []byte // original infe box
+}
+
+type itemExtent struct {
+	index  uint64
+	offset uint64
+	length uint64
+}
+
+type itemLocation struct {
+	id      uint32
+	method  uint8
+	dataRef uint16
+	base    uint64
+	extents []itemExtent
+}
+
+// itemLocations is the decoded content of an iloc box.
+type itemLocations struct {
+	version    uint8
+	offsetSize int
+	lengthSize int
+	baseSize   int
+	indexSize  int
+	items      []*itemLocation
+}
+
+// fieldReader decodes big endian fields of a full box payload.
+type fieldReader struct {
+	b   []byte
+	err error
+}
+
+func (r *fieldReader) uint(size int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < size {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	var v uint64
+	for _, c := range r.b[:size] {
+		v = v<<8 | uint64(c)
+	}
+	r.b = r.b[size:]
+	return v
+}
+
+func (r *fieldReader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	// the trailing null terminator is sometimes missing
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		s := string(r.b)
+		r.b = nil
+		return s
+	}
+	s := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return s
+}
+
+func putUint(buf *bytes.Buffer, v uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		buf.WriteByte(byte(v >> (8 * uint(i))))
+	}
+}
+
+func parseItemLocations(b []byte) (*itemLocations, error) {
+	r := &fieldReader{b: b}
+	l := &itemLocations{version: uint8(r.uint(1))}
+	r.uint(3)
+	if l.version > 2 {
+		return nil, fmt.Errorf("bmff: unsupported iloc version %d", l.version)
+	}
+	v := r.uint(1)
+	l.offsetSize, l.lengthSize = int(v>>4), int(v&15)
+	v = r.uint(1)
+	l.baseSize = int(v >> 4)
+	if l.version > 0 {
+		l.indexSize = int(v & 15)
+	}
+	for _, n := range []int{l.offsetSize, l.lengthSize, l.baseSize, l.indexSize} {
+		if n != 0 && n != 4 && n != 8 {
+			return nil, fmt.Errorf("bmff: invalid iloc field size %d", n)
+		}
+	}
+	idSize := 2
+	if l.version == 2 {
+		idSize = 4
+	}
+	count := int(r.uint(idSize))
+	for i := 0; i < count && r.err == nil; i++ {
+		x := &itemLocation{id: uint32(r.uint(idSize))}
+		if l.version > 0 {
+			x.method = uint8(r.uint(2) & 15)
+		}
+		x.dataRef = uint16(r.uint(2))
+		x.base = r.uint(l.baseSize)
+		n := int(r.uint(2))
+		for j := 0; j < n && r.err == nil; j++ {
+			var e itemExtent
+			e.index = r.uint(l.indexSize)
+			e.offset = r.uint(l.offsetSize)
+			e.length = r.uint(l.lengthSize)
+			x.extents = append(x.extents, e)
+		}
+		l.items = append(l.items, x)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("bmff: short iloc box")
+	}
+	return l, nil
+}
+
+func (l *itemLocations) find(id uint32) *itemLocation {
+	for _, x := range l.items {
+		if x.id == id {
+			return x
+		}
+	}
+	return nil
+}
+
+// fit selects version and field sizes large enough for all values.
+func (l *itemLocations) fit() {
+	need := func(size int, v uint64) int {
+		switch {
+		case v > 0xFFFFFFFF:
+			return 8
+		case v > 0 && size < 4:
+			return 4
+		}
+		return size
+	}
+	for _, x := range l.items {
+		if x.method != methodFile && l.version == 0 {
+			l.version = 1
+		}
+		if x.id > 0xFFFF {
+			l.version = 2
+		}
+		l.baseSize = need(l.baseSize, x.base)
+		for _, e := range x.extents {
+			l.indexSize = need(l.indexSize, e.index)
+			l.offsetSize = need(l.offsetSize, e.offset)
+			l.lengthSize = need(l.lengthSize, e.length)
+		}
+	}
+}
+
+func (l *itemLocations) bytes() []byte {
+	l.fit()
+	var buf bytes.Buffer
+	buf.Write([]byte{l.version, 0, 0, 0})
+	buf.WriteByte(byte(l.offsetSize<<4 | l.lengthSize))
+	buf.WriteByte(byte(l.baseSize<<4 | l.indexSize))
+	idSize := 2
+	if l.version == 2 {
+		idSize = 4
+	}
+	putUint(&buf, uint64(len(l.items)), idSize)
+	for _, x := range l.items {
+		putUint(&buf, uint64(x.id), idSize)
+		if l.version > 0 {
+			putUint(&buf, uint64(x.method), 2)
+		}
+		putUint(&buf, uint64(x.dataRef), 2)
+		putUint(&buf, x.base, l.baseSize)
+		putUint(&buf, uint64(len(x.extents)), 2)
+		for _, e := range x.extents {
+			putUint(&buf, e.index, l.indexSize)
+			putUint(&buf, e.offset, l.offsetSize)
+			putUint(&buf, e.length, l.lengthSize)
+		}
+	}
+	return buf.Bytes()
+}
+
+func parseItemInfoEntry(b *Box) (*ItemInfo, error) {
+	r := &fieldReader{b: b.Data}
+	version := r.uint(1)
+	r.uint(3)
+	x := &ItemInfo{raw: b.Bytes()}
+	switch version {
+	case 0, 1:
+		x.ID = uint32(r.uint(2))
+		r.uint(2) // protection index
+		x.Name = r.string()
+		x.ContentType = r.string()
+		x.ContentEncoding = r.string()
+	case 2, 3:
+		if version == 2 {
+			x.ID = uint32(r.uint(2))
+		} else {
+			x.ID = uint32(r.uint(4))
+		}
+		r.uint(2) // protection index
+		var typ [4]byte
+		binary.BigEndian.PutUint32(typ[:], uint32(r.uint(4)))
+		x.Type = string(typ[:])
+		x.Name = r.string()
+		if x.Type == "mime" {
+			x.ContentType = r.string()
+			x.ContentEncoding = r.string()
+		}
+	default:
+		return nil, fmt.Errorf("bmff: unsupported infe version %d", version)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("bmff: short infe box")
+	}
+	return x, nil
+}
+
+// parseItemInfo decodes all entries of an iinf box.
+func parseItemInfo(b []byte) ([]*ItemInfo, error) {
+	r := &fieldReader{b: b}
+	version := r.uint(1)
+	r.uint(3)
+	if version == 0 {
+		r.uint(2)
+	} else {
+		r.uint(4)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("bmff: short iinf box")
+	}
+	boxes, err := ParseBoxes(r.b, 0)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]*ItemInfo, 0, len(boxes))
+	for _, v := range boxes {
+		if v.Type != "infe" {
+			continue
+		}
+		x, err := parseItemInfoEntry(v)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, x)
+	}
+	return l, nil
+}
+
+func encodeItemInfo(l []*ItemInfo) []byte {
+	var buf bytes.Buffer
+	if len(l) > 0xFFFF {
+		buf.Write([]byte{1, 0, 0, 0})
+		putUint(&buf, uint64(len(l)), 4)
+	} else {
+		buf.Write([]byte{0, 0, 0, 0})
+		putUint(&buf, uint64(len(l)), 2)
+	}
+	for _, v := range l {
+		buf.Write(v.raw)
+	}
+	return buf.Bytes()
+}
+
+// newXMPItem creates an infe box for an XMP item.
+func newXMPItem(id uint32) *ItemInfo {
+	var buf bytes.Buffer
+	if id > 0xFFFF {
+		buf.Write([]byte{3, 0, 0, 0})
+		putUint(&buf, uint64(id), 4)
+	} else {
+		buf.Write([]byte{2, 0, 0, 0})
+		putUint(&buf, uint64(id), 2)
+	}
+	buf.Write([]byte{0, 0})
+	buf.WriteString("mime")
+	buf.WriteByte(0) // empty item name
+	buf.WriteString(mimeXMP)
+	buf.WriteByte(0)
+	return &ItemInfo{
+		ID:          id,
+		Type:        "mime",
+		ContentType: mimeXMP,
+		raw:         NewBox("infe", buf.Bytes()).Bytes(),
+	}
+}
+
+// isImageMeta returns true when b is a meta box with 'pict' handler as
+// used by HEIF image files.
+func isImageMeta(b *Box) bool {
+	hdlr := b.Find("hdlr")
+	return hdlr != nil && len(hdlr.Data) >= 12 && string(hdlr.Data[8:12]) == "pict"
+}
+
+// ReadItems returns the item information entries of a loaded HEIF meta box.
+func ReadItems(meta *Box) ([]*ItemInfo, error) {
+	iinf := meta.Find("iinf")
+	if iinf == nil {
+		return nil, ErrNoXMP
+	}
+	return parseItemInfo(iinf.Data)
+}
+
+// findXMPItem returns the first XMP item of a HEIF meta box.
+func findXMPItem(meta *Box) (*ItemInfo, error) {
+	items, err := ReadItems(meta)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range items {
+		if v.ContentType == mimeXMP && (v.Type == "mime" || v.Type == "") {
+			return v, nil
+		}
+	}
+	return nil, ErrNoXMP
+}
+
+// readItemData loads and concatenates all extents of an item.
+func readItemData(r io.ReadSeeker, meta *Box, loc *itemLocation) ([]byte, error) {
+	if loc.dataRef != 0 {
+		return nil, fmt.Errorf("bmff: external item data is not supported")
+	}
+	var buf bytes.Buffer
+	for _, e := range loc.extents {
+		offset := loc.base + e.offset
+		switch loc.method {
+		case methodFile:
+			size, err := r.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+			length := e.length
+			if length == 0 {
+				length = uint64(size) - offset
+			}
+			if offset > uint64(size) || length > uint64(size)-offset || length > maxBoxSize {
+				return nil, fmt.Errorf("bmff: item %d extent exceeds file size", loc.id)
+			}
+			if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
+				return nil, err
+			}
+			if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+				return nil, err
+			}
+		case methodIdat:
+			idat := meta.Find("idat")
+			if idat == nil {
+				return nil, fmt.Errorf("bmff: missing idat box")
+			}
+			length := e.length
+			if length == 0 {
+				length = uint64(len(idat.Data)) - offset
+			}
+			if offset > uint64(len(idat.Data)) || length > uint64(len(idat.Data))-offset {
+				return nil, fmt.Errorf("bmff: item %d extent exceeds idat size", loc.id)
+			}
+			buf.Write(idat.Data[offset : offset+length])
+		default:
+			return nil, fmt.Errorf("bmff: unsupported item construction method %d", loc.method)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// readItemPacket returns the XMP item data of a loaded HEIF meta box.
+func readItemPacket(r io.ReadSeeker, meta *Box) ([]byte, error) {
+	item, err := findXMPItem(meta)
+	if err != nil {
+		return nil, err
+	}
+	iloc := meta.Find("iloc")
+	if iloc == nil {
+		return nil, fmt.Errorf("bmff: missing iloc box")
+	}
+	locs, err := parseItemLocations(iloc.Data)
+	if err != nil {
+		return nil, err
+	}
+	loc := locs.find(item.ID)
+	if loc == nil {
+		return nil, fmt.Errorf("bmff: missing location for XMP item %d", item.ID)
+	}
+	data, err := readItemData(r, meta, loc)
+	if err != nil {
+		return nil, err
+	}
+	switch item.ContentEncoding {
+	case "":
+		return data, nil
+	case "deflate":
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		b, err := ioutil.ReadAll(io.LimitReader(zr, maxPacketSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxPacketSize {
+			return nil, fmt.Errorf("bmff: inflated XMP item exceeds %d bytes", maxPacketSize)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("bmff: unsupported item content encoding '%s'", item.ContentEncoding)
+	}
+}
+
+// addReference appends a reference of the given type from one item to
+// another to the iref box payload.
+func addReference(iref []byte, typ string, from, to uint32) []byte {
+	var buf bytes.Buffer
+	if iref == nil {
+		iref = []byte{0, 0, 0, 0}
+		if from > 0xFFFF || to > 0xFFFF {
+			iref[0] = 1
+		}
+	}
+	buf.Write(iref)
+	idSize := 2
+	if iref[0] == 1 {
+		idSize = 4
+	}
+	var ref bytes.Buffer
+	putUint(&ref, uint64(from), idSize)
+	putUint(&ref, 1, 2)
+	putUint(&ref, uint64(to), idSize)
+	buf.Write(NewBox(typ, ref.Bytes()).Bytes())
+	return buf.Bytes()
+}
+
+// primaryItem returns the ID of the primary item from the pitm box.
+func primaryItem(meta *Box) (uint32, bool) {
+	pitm := meta.Find("pitm")
+	if pitm == nil || len(pitm.Data) < 6 {
+		return 0, false
+	}
+	if pitm.Data[0] == 0 {
+		return uint32(binary.BigEndian.Uint16(pitm.Data[4:])), true
+	}
+	if len(pitm.Data) < 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(pitm.Data[4:]), true
+}
+
+// writeItemPacket copies the file from r to w and stores packet as XMP item
+// in the HEIF meta box.
+func writeItemPacket(w io.Writer, r io.ReadSeeker, top []*Box, meta *Box, packet []byte) error {
+	iinf, iloc := meta.Find("iinf"), meta.Find("iloc")
+	if iinf == nil || iloc == nil {
+		return fmt.Errorf("bmff: missing iinf or iloc box")
+	}
+	items, err := parseItemInfo(iinf.Data)
+	if err != nil {
+		return err
+	}
+	locs, err := parseItemLocations(iloc.Data)
+	if err != nil {
+		return err
+	}
+	idat := meta.Find("idat")
+	if idat == nil {
+		idat = NewBox("idat", []byte{})
+		meta.Boxes = append(meta.Boxes, idat)
+	}
+
+	// find or create the XMP item
+	var item *ItemInfo
+	var maxID uint32
+	for _, v := range items {
+		if v.ID > maxID {
+			maxID = v.ID
+		}
+		if item == nil && v.ContentType == mimeXMP && (v.Type == "mime" || v.Type == "") {
+			item = v
+		}
+	}
+	if item == nil {
+		item = newXMPItem(maxID + 1)
+		items = append(items, item)
+		iinf.Data = encodeItemInfo(items)
+		if id, ok := primaryItem(meta); ok {
+			// XMP describes the primary image
+			iref := meta.Find("iref")
+			if iref == nil {
+				iref = NewBox("iref", nil)
+				meta.Boxes = append(meta.Boxes, iref)
+			}
+			iref.Data = addReference(iref.Data, "cdsc", item.ID, id)
+		}
+	}
+	loc := locs.find(item.ID)
+	if loc == nil {
+		loc = &itemLocation{id: item.ID}
+		locs.items = append(locs.items, loc)
+	} else if loc.method == methodIdat && len(loc.extents) == 1 {
+		// drop the old packet when it is stored at the end of idat
+		e := loc.extents[0]
+		if start := loc.base + e.offset; e.length > 0 && start+e.length == uint64(len(idat.Data)) {
+			idat.Data = idat.Data[:start]
+		}
+	}
+	if item.ContentEncoding != "" {
+		// replace the entry to drop the content encoding
+		for i, v := range items {
+			if v == item {
+				items[i] = newXMPItem(item.ID)
+			}
+		}
+		iinf.Data = encodeItemInfo(items)
+	}
+	loc.method, loc.dataRef, loc.base = methodIdat, 0, 0
+	loc.extents = []itemExtent{{offset: uint64(len(idat.Data)), length: uint64(len(packet))}}
+	idat.Data = append(idat.Data[:len(idat.Data):len(idat.Data)], packet...)
+
+	// adjust file based locations behind meta by the size difference;
+	// field sizes may grow, so repeat until the meta size is stable
+	end := uint64(meta.Offset + meta.Size)
+	orig := make(map[*itemLocation]uint64)
+	for _, x := range locs.items {
+		orig[x] = x.base
+	}
+	origExtents := make(map[*itemLocation][]itemExtent)
+	for _, x := range locs.items {
+		origExtents[x] = append([]itemExtent{}, x.extents...)
+	}
+	var delta int64
+	for i := 0; i < 4; i++ {
+		for _, x := range locs.items {
+			if x.method != methodFile {
+				continue
+			}
+			if x.base = orig[x]; x.base >= end {
+				x.base = uint64(int64(x.base) + delta)
+			}
+			for j, e := range origExtents[x] {
+				if x.base == 0 && e.offset >= end {
+					e.offset = uint64(int64(e.offset) + delta)
+				}
+				x.extents[j] = e
+			}
+		}
+		iloc.Data = locs.bytes()
+		d := shiftAfter(top, meta, meta.EncodedSize()-meta.Size)
+		if d == delta {
+			break
+		}
+		delta = d
+	}
+	return Rewrite(w, r, top, map[*Box]*Box{meta: meta})
+}
+
+// shiftAfter returns the offset change of data following box b when it
+// changes size by delta. Rewrite absorbs size changes with an adjacent free
+// box when possible.
+func shiftAfter(top []*Box, b *Box, delta int64) int64 {
+	for i, v := range top {
+		if v != b || i+1 >= len(top) {
+			continue
+		}
+		next := top[i+1]
+		if next.Type != "free" && next.Type != "skip" {
+			break
+		}
+		free := next.Size - delta
+		if delta == 0 || free <= 0xFFFFFFFF && (free == 0 || free >= 8) {
+			return 0
+		}
+	}
+	return delta
+}
@@ -0,0 +1,758 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package bmff
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/mholt/go-xmp/models/itunes"
+	"github.com/mholt/go-xmp/models/qt"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Native QuickTime and iTunes metadata is stored in three places:
+//
+//	moov/udta/<FourCC>       QuickTime user data atoms (qt.QtUserdata)
+//	moov/udta/meta/ilst      iTunes items with 'mdir' handler (itunes.ITunesMetadata)
+//	moov/meta/keys+ilst      QuickTime metadata with 'mdta' handler (qt.QtMetadata)
+//
+// Atoms are mapped to model fields through the model's native struct tags.
+// Tags starting with © refer to atoms starting with byte 0xA9, tags that
+// are not FourCC codes refer to iTunes freeform '----' items.
+
+// well-known data types of ilst 'data' atoms
+const (
+	dataImplicit = 0
+	dataUTF8     = 1
+	dataUTF16    = 2
+	dataJPEG     = 13
+	dataPNG      = 14
+	dataInt      = 21
+	dataUint     = 22
+	dataFloat32  = 23
+	dataFloat64  = 24
+	dataBMP      = 27
+)
+
+const (
+	freeformMean = "com.apple.iTunes"
+	langUnd      = 0x55C4 // packed ISO 639-2 'und'
+)
+
+// byte sizes of integer items
+var intItems = map[string]int{
+	"akID": 1,
+	"cpil": 1,
+	"hdvd": 1,
+	"pcst": 1,
+	"pgap": 1,
+	"rtng": 1,
+	"stik": 1,
+	"tmpo": 2,
+	"atID": 4,
+	"cnID": 4,
+	"geID": 4,
+	"sfID": 4,
+	"tven": 4,
+	"tvsn": 4,
+	"plID": 8,
+}
+
+// items holding images or other binary data, exposed as base64 strings
+var binaryItems = map[string]bool{
+	"covr":                        true,
+	"com.apple.quicktime.artwork": true,
+}
+
+// Metadata holds native QuickTime and iTunes metadata of a movie. Models
+// are nil when the file contains no atoms of the respective kind.
+type Metadata struct {
+	Udta   *qt.QtUserdata
+	Mdta   *qt.QtMetadata
+	ITunes *itunes.ITunesMetadata
+}
+
+type atomField struct {
+	name string
+	kind reflect.Kind
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// atomFields lists all model fields that have a native tag and can be
+// converted to and from text.
+func atomFields(m xmp.Model) []atomField {
+	ns := m.Namespaces()[0].GetName()
+	typ := reflect.TypeOf(m).Elem()
+	l := make([]atomField, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get(ns), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		t := f.Type
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct, reflect.Map, reflect.Array:
+			if !reflect.PtrTo(t).Implements(textMarshalerType) {
+				continue
+			}
+		case reflect.Slice:
+			if t.Elem().Kind() != reflect.Uint8 {
+				continue
+			}
+		}
+		l = append(l, atomField{name, t.Kind()})
+	}
+	return l
+}
+
+func (f atomField) isInt() bool {
+	switch f.kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func (f atomField) isBytes() bool {
+	return f.kind == reflect.Slice
+}
+
+// fourCC converts a native tag name into an atom type.
+func fourCC(name string) string {
+	if strings.HasPrefix(name, "©") {
+		return "\xa9" + name[len("©"):]
+	}
+	return name
+}
+
+// ReadMetadata reads native QuickTime and iTunes metadata from the moov box.
+func ReadMetadata(r io.ReadSeeker) (*Metadata, error) {
+	top, err := ReadTopLevel(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range top {
+		if b.Type != "moov" {
+			continue
+		}
+		if err := loadBox(r, b); err != nil {
+			return nil, err
+		}
+		return DecodeMetadata(b)
+	}
+	return nil, fmt.Errorf("bmff: missing moov atom")
+}
+
+// WriteMetadata copies the file from r to w and replaces all atoms that
+// correspond to fields of the non-nil models in m. Empty fields remove
+// their atom, atoms unknown to the models or of a form the reader cannot
+// convert, e.g. unknown data types or invalid UTF-8 text, are kept.
+func WriteMetadata(w io.Writer, r io.ReadSeeker, m *Metadata) error {
+	top, err := ReadTopLevel(r)
+	if err != nil {
+		return err
+	}
+	for _, b := range top {
+		if b.Type != "moov" {
+			continue
+		}
+		if err := loadBox(r, b); err != nil {
+			return err
+		}
+		if err := EncodeMetadata(b, m); err != nil {
+			return err
+		}
+		return Rewrite(w, r, top, map[*Box]*Box{b: b})
+	}
+	return fmt.Errorf("bmff: missing moov atom")
+}
+
+// DecodeMetadata extracts native metadata from a loaded moov box.
+func DecodeMetadata(moov *Box) (*Metadata, error) {
+	m := &Metadata{}
+	if udta := moov.Find("udta"); udta != nil {
+		m.Udta = &qt.QtUserdata{}
+		if err := decodeUserdata(udta, m.Udta); err != nil {
+			return nil, err
+		}
+		if ilst := udta.Find("meta", "ilst"); ilst != nil {
+			m.ITunes = &itunes.ITunesMetadata{}
+			if err := decodeItems(ilst, nil, m.ITunes); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if meta := moov.Find("meta"); meta != nil {
+		keys, ilst := meta.Find("keys"), meta.Find("ilst")
+		if keys != nil && ilst != nil {
+			names, err := parseKeys(keys.Data)
+			if err != nil {
+				return nil, err
+			}
+			m.Mdta = &qt.QtMetadata{}
+			if err := decodeItems(ilst, names, m.Mdta); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// EncodeMetadata stores all non-nil models of m into a loaded moov box.
+func EncodeMetadata(moov *Box, m *Metadata) error {
+	if m.Udta != nil {
+		if err := encodeUserdata(findOrCreate(moov, "udta"), m.Udta); err != nil {
+			return err
+		}
+	}
+	if m.ITunes != nil {
+		udta := findOrCreate(moov, "udta")
+		meta := udta.Find("meta")
+		if meta == nil {
+			meta = NewContainer("meta", NewBox("hdlr", makeHandler("mdir", "appl")))
+			meta.Prefix = make([]byte, 4)
+			udta.Boxes = append(udta.Boxes, meta)
+		}
+		if err := encodeItems(findOrCreate(meta, "ilst"), nil, m.ITunes); err != nil {
+			return err
+		}
+	}
+	if m.Mdta != nil {
+		meta := moov.Find("meta")
+		if meta == nil {
+			meta = NewContainer("meta", NewBox("hdlr", makeHandler("mdta", "")))
+			moov.Boxes = append(moov.Boxes, meta)
+		}
+		keys := meta.Find("keys")
+		if keys == nil {
+			keys = NewBox("keys", make([]byte, 8))
+			meta.Boxes = append(meta.Boxes, keys)
+		}
+		names, err := parseKeys(keys.Data)
+		if err != nil {
+			return err
+		}
+		if err := encodeItems(findOrCreate(meta, "ilst"), &names, m.Mdta); err != nil {
+			return err
+		}
+		keys.Data = makeKeys(names)
+	}
+	return nil
+}
+
+func findOrCreate(b *Box, typ string) *Box {
+	if x := b.Find(typ); x != nil {
+		return x
+	}
+	x := NewContainer(typ)
+	b.Boxes = append(b.Boxes, x)
+	return x
+}
+
+func makeHandler(typ, manufacturer string) []byte {
+	b := make([]byte, 25)
+	copy(b[8:], typ)
+	copy(b[12:], manufacturer)
+	return b
+}
+
+// parseKeys decodes the key table of a QuickTime 'mdta' metadata box.
+func parseKeys(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("bmff: short keys atom")
+	}
+	n := int(binary.BigEndian.Uint32(b[4:]))
+	b = b[8:]
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("bmff: short keys atom")
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			return nil, fmt.Errorf("bmff: invalid key size %d", size)
+		}
+		names = append(names, string(b[8:size]))
+		b = b[size:]
+	}
+	return names, nil
+}
+
+func makeKeys(names []string) []byte {
+	var buf bytes.Buffer
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[4:], uint32(len(names)))
+	buf.Write(b[:])
+	for _, v := range names {
+		binary.BigEndian.PutUint32(b[:], uint32(len(v)+8))
+		copy(b[4:], "mdta")
+		buf.Write(b[:])
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+// itemName returns the native tag name of an ilst item. Items of 'mdta'
+// lists are named by their 1-based index into the key table.
+func itemName(item *Box, keys []string) string {
+	if keys != nil {
+		idx := int(binary.BigEndian.Uint32([]byte(item.Type)))
+		if idx < 1 || idx > len(keys) {
+			return ""
+		}
+		return keys[idx-1]
+	}
+	if item.Type == "----" {
+		for _, v := range item.Boxes {
+			if v.Type == "name" && len(v.Data) >= 4 {
+				return string(v.Data[4:])
+			}
+		}
+		return ""
+	}
+	if strings.HasPrefix(item.Type, "\xa9") {
+		return "©" + item.Type[1:]
+	}
+	return item.Type
+}
+
+// itemData returns the data type and payload of the first data atom.
+func itemData(item *Box) (uint32, []byte, bool) {
+	for _, v := range item.Boxes {
+		if v.Type == "data" && len(v.Data) >= 8 {
+			return binary.BigEndian.Uint32(v.Data) & 0xFFFFFF, v.Data[8:], true
+		}
+	}
+	return 0, nil, false
+}
+
+// parseItem decodes the child atoms of an ilst item, which are not known
+// to the generic box parser.
+func parseItem(item *Box) error {
+	if item.Boxes != nil {
+		return nil
+	}
+	l, err := ParseBoxes(item.Data, item.Offset+item.HeaderSize)
+	if err != nil {
+		return err
+	}
+	item.Boxes, item.Data = l, nil
+	return nil
+}
+
+func decodeItems(ilst *Box, keys []string, m xmp.Model) error {
+	items := make(map[string]*Box)
+	for _, v := range ilst.Boxes {
+		if err := parseItem(v); err != nil {
+			xmp.Log.Warnf("bmff: skipping malformed ilst item '%s': %v", v.Type, err)
+			continue
+		}
+		if name := itemName(v, keys); name != "" {
+			if _, ok := items[name]; !ok {
+				items[name] = v
+			}
+		}
+	}
+	for _, f := range atomFields(m) {
+		if item, ok := items[f.name]; ok {
+			setField(m, f, itemString(item, f))
+		}
+	}
+	return nil
+}
+
+// itemString returns the text of an ilst item for field f or an empty
+// string when the item cannot be converted.
+func itemString(item *Box, f atomField) string {
+	typ, data, ok := itemData(item)
+	if !ok {
+		return ""
+	}
+	return dataString(typ, fourCC(f.name), data, f)
+}
+
+// converts returns true when the reader sets field f of a model like m
+// from an atom with text value. Atoms it cannot convert are never part of
+// the model, so an empty field does not remove them.
+func converts(m xmp.Model, f atomField, value string) bool {
+	if value == "" {
+		return false
+	}
+	x := reflect.New(reflect.TypeOf(m).Elem()).Interface().(xmp.Model)
+	return xmp.SetNativeField(x, f.name, value) == nil
+}
+
+func setField(m xmp.Model, f atomField, value string) {
+	if value == "" {
+		return
+	}
+	if err := xmp.SetNativeField(m, f.name, value); err != nil {
+		xmp.Log.Warnf("bmff: %s: %v", f.name, err)
+	}
+}
+
+// dataString converts a typed data atom payload into the text form used by
+// native model fields. It returns an empty string for payloads it cannot
+// convert.
+func dataString(typ uint32, name string, b []byte, f atomField) string {
+	switch typ {
+	case dataUTF8:
+		if !utf8.Valid(b) {
+			return ""
+		}
+		return string(b)
+	case dataUTF16:
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	case dataInt:
+		if v, ok := readInt(b); ok {
+			return strconv.FormatInt(v, 10)
+		}
+	case dataUint:
+		if v, ok := readInt(b); ok {
+			return strconv.FormatUint(uint64(v)&(1<<(8*uint(len(b)))-1), 10)
+		}
+	case dataFloat32:
+		if len(b) == 4 {
+			return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(b))), 'f', -1, 32)
+		}
+	case dataFloat64:
+		if len(b) == 8 {
+			return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(b)), 'f', -1, 64)
+		}
+	case dataImplicit:
+		switch name {
+		case "trkn", "disk":
+			// reserved, number, total
+			if len(b) >= 6 {
+				n, total := binary.BigEndian.Uint16(b[2:]), binary.BigEndian.Uint16(b[4:])
+				if f.isInt() {
+					return strconv.Itoa(int(n))
+				}
+				return fmt.Sprintf("%d/%d", n, total)
+			}
+		case "gnre":
+			if len(b) == 2 {
+				return strconv.Itoa(int(binary.BigEndian.Uint16(b)))
+			}
+		}
+		if f.isInt() {
+			if v, ok := readInt(b); ok {
+				return strconv.FormatInt(v, 10)
+			}
+		}
+	}
+	if f.isBytes() {
+		return string(b)
+	}
+	switch typ {
+	case dataImplicit, dataJPEG, dataPNG, dataBMP:
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return ""
+}
+
+func readInt(b []byte) (int64, bool) {
+	switch len(b) {
+	case 1:
+		return int64(int8(b[0])), true
+	case 2:
+		return int64(int16(binary.BigEndian.Uint16(b))), true
+	case 4:
+		return int64(int32(binary.BigEndian.Uint32(b))), true
+	case 8:
+		return int64(binary.BigEndian.Uint64(b)), true
+	}
+	return 0, false
+}
+
+func putInt(v int64, size int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b[8-size:]
+}
+
+// makeData encodes the text value of field f into a typed data atom payload.
+func makeData(name, value string, f atomField) ([]byte, error) {
+	typ, payload := uint32(dataUTF8), []byte(value)
+	switch {
+	case name == "trkn" || name == "disk":
+		var n, total int
+		if _, err := fmt.Sscanf(value, "%d/%d", &n, &total); err != nil {
+			if n, err = strconv.Atoi(value); err != nil {
+				return nil, err
+			}
+		}
+		typ, payload = dataImplicit, make([]byte, 6, 8)
+		binary.BigEndian.PutUint16(payload[2:], uint16(n))
+		binary.BigEndian.PutUint16(payload[4:], uint16(total))
+		if name == "trkn" {
+			payload = payload[:8]
+		}
+	case name == "gnre":
+		v, err := strconv.ParseInt(value, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		typ, payload = dataImplicit, putInt(v, 2)
+	case binaryItems[name]:
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		typ, payload = dataImplicit, b
+		switch {
+		case bytes.HasPrefix(b, []byte{0xFF, 0xD8}):
+			typ = dataJPEG
+		case bytes.HasPrefix(b, []byte("\x89PNG")):
+			typ = dataPNG
+		case bytes.HasPrefix(b, []byte("BM")):
+			typ = dataBMP
+		}
+	case f.isInt() || intItems[name] > 0:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		size, ok := intItems[name]
+		if !ok {
+			size = 4
+			if v > math.MaxInt32 || v < math.MinInt32 {
+				size = 8
+			}
+		}
+		typ, payload = dataInt, putInt(v, size)
+	case f.kind == reflect.Float32 || f.kind == reflect.Float64:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		typ, payload = dataFloat64, make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, math.Float64bits(v))
+	case f.isBytes():
+		typ = dataImplicit
+	}
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, typ)
+	return append(b, payload...), nil
+}
+
+func makeItem(typ, name string, data []byte) *Box {
+	item := NewContainer(typ)
+	if typ == "----" {
+		item.Boxes = append(item.Boxes,
+			NewBox("mean", append(make([]byte, 4), freeformMean...)),
+			NewBox("name", append(make([]byte, 4), name...)),
+		)
+	}
+	item.Boxes = append(item.Boxes, NewBox("data", data))
+	return item
+}
+
+// encodeItems updates ilst from the fields of m. For 'mdta' lists keys
+// points to the key table which receives new names as needed.
+func encodeItems(ilst *Box, keys *[]string, m xmp.Model) error {
+	var names []string
+	if keys != nil {
+		names = *keys
+	}
+	for _, v := range ilst.Boxes {
+		if err := parseItem(v); err != nil {
+			xmp.Log.Warnf("bmff: keeping malformed ilst item '%s': %v", v.Type, err)
+		}
+	}
+	for _, f := range atomFields(m) {
+		value, err := xmp.GetNativeField(m, f.name)
+		if err != nil {
+			xmp.Log.Warnf("bmff: %s: %v", f.name, err)
+			continue
+		}
+
+		// find existing item
+		idx := -1
+		for i, v := range ilst.Boxes {
+			if itemName(v, names) == f.name {
+				idx = i
+				break
+			}
+		}
+
+		if value == "" {
+			if idx >= 0 && converts(m, f, itemString(ilst.Boxes[idx], f)) {
+				ilst.Boxes = append(ilst.Boxes[:idx], ilst.Boxes[idx+1:]...)
+			}
+			continue
+		}
+
+		data, err := makeData(fourCC(f.name), value, f)
+		if err != nil {
+			return fmt.Errorf("bmff: %s: %v", f.name, err)
+		}
+		var typ string
+		switch {
+		case keys != nil:
+			k := -1
+			for i, v := range names {
+				if v == f.name {
+					k = i
+					break
+				}
+			}
+			if k < 0 {
+				names = append(names, f.name)
+				k = len(names) - 1
+			}
+			typ = string(putInt(int64(k+1), 4))
+		case len(fourCC(f.name)) == 4:
+			typ = fourCC(f.name)
+		default:
+			typ = "----"
+		}
+		item := makeItem(typ, f.name, data)
+		if idx >= 0 {
+			ilst.Boxes[idx] = item
+		} else {
+			ilst.Boxes = append(ilst.Boxes, item)
+		}
+	}
+	if keys != nil {
+		*keys = names
+	}
+	return nil
+}
+
+func decodeUserdata(udta *Box, m *qt.QtUserdata) error {
+	for _, f := range atomFields(m) {
+		b := udta.Find(fourCC(f.name))
+		if b == nil || b.Data == nil {
+			continue
+		}
+		setField(m, f, userdataString(b, f))
+	}
+	return nil
+}
+
+// userdataString converts the payload of a udta atom into text. Atoms
+// starting with © carry a list of language-tagged strings of which the
+// first is used. Some writers use iTunes-style data atoms instead.
+func userdataString(b *Box, f atomField) string {
+	data := b.Data
+	if len(data) >= 16 && string(data[4:8]) == "data" {
+		if l, err := ParseBoxes(data, 0); err == nil {
+			if typ, payload, ok := itemData(&Box{Boxes: l}); ok {
+				return dataString(typ, b.Type, payload, f)
+			}
+		}
+	}
+	switch {
+	case strings.HasPrefix(b.Type, "\xa9"):
+		if len(data) >= 4 {
+			if n := int(binary.BigEndian.Uint16(data)); n+4 <= len(data) {
+				return validString(bytes.TrimRight(data[4:4+n], "\x00"))
+			}
+		}
+	case b.Type == "WLOC":
+		if len(data) == 4 {
+			return fmt.Sprintf("%d,%d", binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:]))
+		}
+	case f.isInt():
+		if len(data) == 6 {
+			// 3GPP full box with 16bit value
+			return strconv.Itoa(int(binary.BigEndian.Uint16(data[4:])))
+		}
+		if v, ok := readInt(data); ok {
+			return strconv.FormatInt(v, 10)
+		}
+		return ""
+	case f.isBytes():
+		return string(data)
+	}
+	return validString(bytes.TrimRight(data, "\x00"))
+}
+
+// validString returns b as string or an empty string when b is not valid
+// UTF-8.
+func validString(b []byte) string {
+	if !utf8.Valid(b) {
+		return ""
+	}
+	return string(b)
+}
+
+func encodeUserdata(udta *Box, m *qt.QtUserdata) error {
+	for _, f := range atomFields(m) {
+		value, err := xmp.GetNativeField(m, f.name)
+		if err != nil {
+			xmp.Log.Warnf("bmff: %s: %v", f.name, err)
+			continue
+		}
+		typ := fourCC(f.name)
+		if value == "" {
+			if old := udta.Find(typ); old != nil && old.Data != nil && converts(m, f, userdataString(old, f)) {
+				udta.Remove(typ)
+			}
+			continue
+		}
+		var data []byte
+		switch {
+		case strings.HasPrefix(typ, "\xa9"):
+			lang := uint16(langUnd)
+			if old := udta.Find(typ); old != nil && len(old.Data) >= 4 {
+				lang = binary.BigEndian.Uint16(old.Data[2:])
+			}
+			data = make([]byte, 4, 4+len(value))
+			binary.BigEndian.PutUint16(data, uint16(len(value)))
+			binary.BigEndian.PutUint16(data[2:], lang)
+			data = append(data, value...)
+		case typ == "WLOC":
+			var x, y int
+			if _, err := fmt.Sscanf(value, "%d,%d", &x, &y); err != nil {
+				return fmt.Errorf("bmff: %s: %v", f.name, err)
+			}
+			data = append(putInt(int64(x), 2), putInt(int64(y), 2)...)
+		case f.isInt():
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("bmff: %s: %v", f.name, err)
+			}
+			// 3GPP full box with 16bit value
+			data = append(make([]byte, 4), putInt(v, 2)...)
+		default:
+			data = []byte(value)
+		}
+		udta.Replace(NewBox(typ, data))
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package gif reads and writes XMP packets stored in the 'XMP DataXMP'
+// application extension of GIF89a files as defined by XMP Specification
+// Part 3.
+//
+// The packet is stored as raw UTF-8 text instead of data sub-blocks and is
+// followed by a 258 byte "magic trailer" that makes GIF decoders that read
+// the packet bytes as sub-block sizes skip to the end of the extension.
+// New extensions are placed before the GIF trailer; GIF87a files are
+// upgraded to GIF89a.
+package gif
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const (
+	blockExtension = 0x21
+	blockImage     = 0x2c
+	blockTrailer   = 0x3b
+	labelApp       = 0xff
+
+	appID = "XMP DataXMP"
+
+	// sanity limit for packets we keep in memory
+	maxPacketSize = 1 << 28
+)
+
+var (
+	ErrNoXMP   = errors.New("gif: no XMP packet found")
+	ErrInvalid = errors.New("gif: invalid file format")
+)
+
+// magicTrailer returns the 257 trailer bytes 0x01, 0xff .. 0x00 that end
+// the packet, followed by the block terminator.
+func magicTrailer() []byte {
+	b := make([]byte, 258)
+	b[0] = 0x01
+	for i := 0; i < 256; i++ {
+		b[i+1] = byte(0xff - i)
+	}
+	return b
+}
+
+var trailer = magicTrailer()
+
+// reader tracks the stream offset while parsing blocks.
+type reader struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func (r *reader) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.pos++
+	}
+	return c, err
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *reader) skip(n int) error {
+	m, err := r.r.Discard(n)
+	r.pos += int64(m)
+	return err
+}
+
+// skipSubBlocks skips a chain of data sub-blocks including the terminator.
+func (r *reader) skipSubBlocks() error {
+	for {
+		n, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if err := r.skip(int(n)); err != nil {
+			return err
+		}
+	}
+}
+
+// readXMP reads the packet and the magic trailer following the application
+// identifier.
+func (r *reader) readXMP() ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("gif: unterminated XMP extension")
+		}
+		buf.WriteByte(c)
+		if c == 0 && buf.Len() >= len(trailer) && bytes.HasSuffix(buf.Bytes(), trailer) {
+			return buf.Bytes()[:buf.Len()-len(trailer)], nil
+		}
+		if buf.Len() > maxPacketSize {
+			return nil, fmt.Errorf("gif: XMP extension too large")
+		}
+	}
+}
+
+// span is a byte range of the input file.
+type span struct {
+	start, end int64
+}
+
+type file struct {
+	header  string // GIF87a or GIF89a
+	packet  []byte
+	xmp     span  // position of the XMP extension, zero when missing
+	trailer int64 // offset of the trailer byte
+}
+
+func parse(rd io.Reader) (*file, error) {
+	r := &reader{r: bufio.NewReader(rd)}
+	var hdr [13]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, ErrInvalid
+	}
+	f := &file{header: string(hdr[:6]), trailer: -1}
+	if f.header != "GIF87a" && f.header != "GIF89a" {
+		return nil, ErrInvalid
+	}
+	// global color table
+	if hdr[10]&0x80 != 0 {
+		if err := r.skip(3 << (hdr[10]&7 + 1)); err != nil {
+			return nil, ErrInvalid
+		}
+	}
+	for {
+		start := r.pos
+		c, err := r.ReadByte()
+		if err != nil {
+			// missing trailer, writers append one
+			xmp.Log.Warnf("gif: missing trailer")
+			f.trailer = start
+			return f, nil
+		}
+		switch c {
+		case blockTrailer:
+			f.trailer = start
+			return f, nil
+		case blockImage:
+			var desc [9]byte
+			if _, err := io.ReadFull(r, desc[:]); err != nil {
+				return nil, ErrInvalid
+			}
+			if desc[8]&0x80 != 0 {
+				if err := r.skip(3 << (desc[8]&7 + 1)); err != nil {
+					return nil, ErrInvalid
+				}
+			}
+			// LZW minimum code size
+			if _, err := r.ReadByte(); err != nil {
+				return nil, ErrInvalid
+			}
+			if err := r.skipSubBlocks(); err != nil {
+				return nil, ErrInvalid
+			}
+		case blockExtension:
+			label, err := r.ReadByte()
+			if err != nil {
+				return nil, ErrInvalid
+			}
+			if label == labelApp {
+				// the first sub-block holds the application identifier
+				n, err := r.ReadByte()
+				if err != nil {
+					return nil, ErrInvalid
+				}
+				id := make([]byte, n)
+				if _, err := io.ReadFull(r, id); err != nil {
+					return nil, ErrInvalid
+				}
+				if string(id) == appID {
+					if f.packet != nil {
+						xmp.Log.Warnf("gif: ignoring duplicate XMP extension")
+					}
+					packet, err := r.readXMP()
+					if err != nil {
+						return nil, err
+					}
+					if f.packet == nil {
+						f.packet = packet
+						f.xmp = span{start, r.pos}
+					}
+					continue
+				}
+				if n == 0 {
+					continue
+				}
+			}
+			if err := r.skipSubBlocks(); err != nil {
+				return nil, ErrInvalid
+			}
+		default:
+			return nil, fmt.Errorf("gif: invalid block 0x%02x at offset %d", c, start)
+		}
+	}
+}
+
+// ReadPacket returns the XMP packet stored in the XMP application
+// extension.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.packet == nil {
+		return nil, ErrNoXMP
+	}
+	return f.packet, nil
+}
+
+// Read decodes the XMP packet stored in the XMP application extension.
+func Read(r io.Reader) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and stores packet in the XMP
+// application extension. An existing extension is replaced in place. A nil
+// packet removes the extension. Packets must be UTF-8 encoded because a zero
+// byte would end the extension early.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	if bytes.IndexByte(packet, 0) > -1 {
+		return fmt.Errorf("gif: XMP packet must not contain zero bytes")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f, err := parse(r)
+	if err != nil {
+		return err
+	}
+
+	// insert position and range of input bytes to drop
+	at, drop := f.trailer, span{f.trailer, f.trailer}
+	if f.packet != nil {
+		at, drop = f.xmp.start, f.xmp
+	}
+
+	// extensions require GIF89a
+	if _, err := r.Seek(6, io.SeekStart); err != nil {
+		return err
+	}
+	header := f.header
+	if packet != nil {
+		header = "GIF89a"
+	}
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, r, at-6); err != nil {
+		return err
+	}
+	if packet != nil {
+		var buf bytes.Buffer
+		buf.Write([]byte{blockExtension, labelApp, byte(len(appID))})
+		buf.WriteString(appID)
+		buf.Write(packet)
+		buf.Write(trailer)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if _, err := r.Seek(drop.end, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n == 0 && drop.end >= f.trailer {
+		// add a missing trailer
+		_, err = w.Write([]byte{blockTrailer})
+	}
+	return err
+}
+
+// Write copies the file from r to w and stores d in the XMP application
+// extension.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
@@ -0,0 +1,401 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package id3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	id3model "github.com/mholt/go-xmp/models/id3"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// text encodings
+const (
+	encLatin1  = 0
+	encUTF16   = 1 // with byte order mark
+	encUTF16BE = 2 // v2.4
+	encUTF8    = 3 // v2.4
+)
+
+func upgradeID(id string) (string, bool) {
+	if len(id) == 4 {
+		return id, true
+	}
+	v, ok := id3model.V22_TO_V24_TAGS[id]
+	return v, ok
+}
+
+// upgradePicture converts a v2.2 PIC frame into the APIC layout by
+// replacing the three character image format with a mime type.
+func upgradePicture(b []byte) []byte {
+	if len(b) < 4 {
+		return b
+	}
+	var mime string
+	switch format := strings.ToUpper(string(b[1:4])); format {
+	case "JPG":
+		mime = "image/jpeg"
+	case "-->":
+		mime = "-->"
+	default:
+		mime = "image/" + strings.ToLower(format)
+	}
+	out := make([]byte, 0, len(b)+len(mime))
+	out = append(out, b[0])
+	out = append(out, mime...)
+	out = append(out, 0)
+	return append(out, b[4:]...)
+}
+
+func termSize(enc byte) int {
+	if enc == encUTF16 || enc == encUTF16BE {
+		return 2
+	}
+	return 1
+}
+
+// splitString splits b after the first string terminator of the given
+// encoding. Without terminator, the whole buffer is returned as string.
+func splitString(enc byte, b []byte) ([]byte, []byte) {
+	if termSize(enc) == 1 {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			return b[:i], b[i+1:]
+		}
+		return b, nil
+	}
+	for i := 0; i+1 < len(b); i += 2 {
+		if b[i] == 0 && b[i+1] == 0 {
+			return b[:i], b[i+2:]
+		}
+	}
+	return b, nil
+}
+
+func decodeString(enc byte, b []byte) string {
+	switch enc {
+	case encLatin1:
+		r := make([]rune, len(b))
+		for i, v := range b {
+			r[i] = rune(v)
+		}
+		return string(r)
+	case encUTF16, encUTF16BE:
+		var order binary.ByteOrder = binary.BigEndian
+		if len(b) >= 2 && enc == encUTF16 {
+			switch {
+			case b[0] == 0xFF && b[1] == 0xFE:
+				order, b = binary.LittleEndian, b[2:]
+			case b[0] == 0xFE && b[1] == 0xFF:
+				b = b[2:]
+			}
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = order.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	default:
+		return string(b)
+	}
+}
+
+// decodeStrings decodes a list of terminated strings as used for
+// multi-value text frames.
+func decodeStrings(enc byte, b []byte) []string {
+	l := make([]string, 0)
+	for len(b) > 0 {
+		var s []byte
+		s, b = splitString(enc, b)
+		l = append(l, decodeString(enc, s))
+	}
+	return l
+}
+
+func encodeString(enc byte, s string, term bool) []byte {
+	var b []byte
+	switch enc {
+	case encLatin1:
+		b = make([]byte, 0, len(s)+1)
+		for _, r := range s {
+			if r > 0xFF {
+				r = '?'
+			}
+			b = append(b, byte(r))
+		}
+	case encUTF16, encUTF16BE:
+		u := utf16.Encode([]rune(s))
+		b = make([]byte, 0, 2*len(u)+4)
+		if enc == encUTF16 {
+			b = append(b, 0xFF, 0xFE)
+		}
+		for _, v := range u {
+			if enc == encUTF16 {
+				b = append(b, byte(v), byte(v>>8))
+			} else {
+				b = append(b, byte(v>>8), byte(v))
+			}
+		}
+	default:
+		b = []byte(s)
+	}
+	if term {
+		b = append(b, make([]byte, termSize(enc))...)
+	}
+	return b
+}
+
+// pickEncoding selects Latin-1 when possible, otherwise the preferred
+// Unicode encoding of the tag version.
+func (t *Tag) pickEncoding(s ...string) byte {
+	for _, v := range s {
+		for _, r := range v {
+			if r > 0xFF || r == utf8.RuneError {
+				if t.Version == 4 {
+					return encUTF8
+				}
+				return encUTF16
+			}
+		}
+	}
+	return encLatin1
+}
+
+// textField is a model field stored in a text or URL frame.
+type textField struct {
+	id     string
+	minVer int
+	maxVer int
+}
+
+func textFields() []textField {
+	typ := reflect.TypeOf(id3model.ID3{})
+	l := make([]textField, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		tokens := strings.Split(typ.Field(i).Tag.Get(id3model.NsID3.GetName()), ",")
+		id := tokens[0]
+		if len(id) != 4 || id == "TXXX" || id == "WXXX" || (id[0] != 'T' && id[0] != 'W') {
+			continue
+		}
+		f := textField{id: id, minVer: 2, maxVer: 4}
+		for _, v := range tokens[1:] {
+			switch v {
+			case "v2.3-":
+				f.maxVer = 3
+			case "v2.4+":
+				f.minVer = 4
+			}
+		}
+		l = append(l, f)
+	}
+	return l
+}
+
+// Model decodes text, URL, comment, lyrics, picture and private frames
+// into an ID3 model. Frames of v2.2 tags are mapped to their v2.4
+// equivalents. The private frame carrying XMP is excluded, use ReadPacket
+// to access its contents.
+func (t *Tag) Model() *id3model.ID3 {
+	m := &id3model.ID3{}
+	for _, f := range t.Frames {
+		if t.raw(f) || len(f.Data) == 0 {
+			continue
+		}
+		id := f.ID
+		data := f.Data
+		if t.Version == 2 {
+			var ok bool
+			if id, ok = upgradeID(id); !ok {
+				continue
+			}
+			if f.ID == "PIC" {
+				data = upgradePicture(data)
+			}
+		}
+		switch {
+		case id == "TXXX":
+			enc := data[0]
+			desc, val := splitString(enc, data[1:])
+			value := strings.Join(decodeStrings(enc, val), "/")
+			if key := decodeString(enc, desc); key == "" {
+				m.UserText = value
+			} else {
+				m.Extension = append(m.Extension, xmp.Tag{Key: key, Value: value})
+			}
+		case id == "WXXX":
+			enc := data[0]
+			_, url := splitString(enc, data[1:])
+			url, _ = splitString(encLatin1, url)
+			m.UserURL = xmp.Url(decodeString(encLatin1, url))
+		case id == "COMM" || id == "USLT":
+			if len(data) < 4 {
+				continue
+			}
+			enc := data[0]
+			desc, text := splitString(enc, data[4:])
+			value := strings.TrimRight(decodeString(enc, text), "\x00")
+			if id == "USLT" {
+				m.UnsynchronizedLyrics = append(m.UnsynchronizedLyrics, value)
+			} else if decodeString(enc, desc) == "" && m.Comments == "" {
+				m.Comments = value
+			}
+		case id == "APIC":
+			enc := data[0]
+			mime, rest := splitString(encLatin1, data[1:])
+			if len(rest) == 0 {
+				continue
+			}
+			typ := rest[0]
+			desc, img := splitString(enc, rest[1:])
+			m.AttachedPicture = append(m.AttachedPicture, id3model.AttachedPicture{
+				Mimetype:    decodeString(encLatin1, mime),
+				Type:        id3model.PictureType(typ),
+				Description: decodeString(enc, desc),
+				Data:        img,
+			})
+		case id == "PRIV":
+			owner, priv := splitString(encLatin1, data)
+			if string(owner) == ownerXMP {
+				continue
+			}
+			m.Private = append(m.Private, id3model.PrivateData{
+				Owner: decodeString(encLatin1, owner),
+				Data:  priv,
+			})
+		case id[0] == 'W':
+			url, _ := splitString(encLatin1, data)
+			if err := m.SetTag(id, decodeString(encLatin1, url)); err != nil {
+				xmp.Log.Debugf("id3: frame '%s': %v", f.ID, err)
+			}
+		case id[0] == 'T':
+			sep := "/"
+			if id == "TCON" {
+				sep = ", "
+			}
+			value := strings.Join(decodeStrings(data[0], data[1:]), sep)
+			if value == "" {
+				continue
+			}
+			if err := m.SetTag(id, value); err != nil {
+				xmp.Log.Debugf("id3: frame '%s': %v", f.ID, err)
+			}
+		}
+	}
+	return m
+}
+
+// SetModel replaces text, URL, comment, lyrics, picture and private frames
+// with the contents of m. Comments with a description, frames the model
+// cannot represent and the private frame carrying XMP are kept. Tags of
+// version 2.2 are converted to version 2.4 first.
+func (t *Tag) SetModel(m *id3model.ID3) error {
+	t.upgrade()
+	owned := map[string]bool{
+		"TXXX": true,
+		"WXXX": true,
+		"USLT": true,
+		"APIC": true,
+	}
+	frames := make([]*Frame, 0)
+	for _, v := range textFields() {
+		if t.Version < v.minVer || t.Version > v.maxVer {
+			continue
+		}
+		owned[v.id] = true
+		value, err := m.GetTag(v.id)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			continue
+		}
+		if v.id[0] == 'W' {
+			frames = append(frames, &Frame{ID: v.id, Data: encodeString(encLatin1, value, false)})
+			continue
+		}
+		enc := t.pickEncoding(value)
+		frames = append(frames, &Frame{
+			ID:   v.id,
+			Data: append([]byte{enc}, encodeString(enc, value, false)...),
+		})
+	}
+	if m.UserText != "" {
+		frames = append(frames, t.userTextFrame("", m.UserText))
+	}
+	for _, v := range m.Extension {
+		frames = append(frames, t.userTextFrame(v.Key, v.Value))
+	}
+	if m.UserURL != "" {
+		frames = append(frames, &Frame{
+			ID:   "WXXX",
+			Data: append([]byte{encLatin1, 0}, encodeString(encLatin1, string(m.UserURL), false)...),
+		})
+	}
+	if m.Comments != "" {
+		frames = append(frames, t.commentFrame("COMM", m.Comments))
+	}
+	for _, v := range m.UnsynchronizedLyrics {
+		frames = append(frames, t.commentFrame("USLT", v))
+	}
+	for _, v := range m.AttachedPicture {
+		enc := t.pickEncoding(v.Description)
+		var buf bytes.Buffer
+		buf.WriteByte(enc)
+		buf.Write(encodeString(encLatin1, v.Mimetype, true))
+		buf.WriteByte(byte(v.Type))
+		buf.Write(encodeString(enc, v.Description, true))
+		buf.Write(v.Data)
+		frames = append(frames, &Frame{ID: "APIC", Data: buf.Bytes()})
+	}
+	for _, v := range m.Private {
+		if v.Owner == ownerXMP {
+			continue
+		}
+		data := append(encodeString(encLatin1, v.Owner, true), v.Data...)
+		frames = append(frames, &Frame{ID: "PRIV", Data: data})
+	}
+	t.Remove(func(f *Frame) bool {
+		switch f.ID {
+		case "COMM":
+			if len(f.Data) < 4 {
+				return true
+			}
+			desc, _ := splitString(f.Data[0], f.Data[4:])
+			return decodeString(f.Data[0], desc) == ""
+		case "PRIV":
+			return !isXMPFrame(f)
+		}
+		return owned[f.ID]
+	})
+	t.Frames = append(t.Frames, frames...)
+	return nil
+}
+
+func (t *Tag) userTextFrame(desc, value string) *Frame {
+	enc := t.pickEncoding(desc, value)
+	data := append([]byte{enc}, encodeString(enc, desc, true)...)
+	return &Frame{ID: "TXXX", Data: append(data, encodeString(enc, value, false)...)}
+}
+
+func (t *Tag) commentFrame(id, text string) *Frame {
+	enc := t.pickEncoding(text)
+	data := append([]byte{enc}, "XXX"...)
+	data = append(data, encodeString(enc, "", true)...)
+	return &Frame{ID: id, Data: append(data, encodeString(enc, text, false)...)}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package id3 reads and writes ID3v2 tags at the start of MP3 files.
+//
+// The reader supports tag versions 2.2, 2.3 and 2.4 including
+// unsynchronisation, extended headers, compressed frames and all text
+// encodings. Text, URL, comment, lyrics, picture and private frames map to
+// the models/id3 model. XMP packets are stored in a private frame with
+// owner "XMP" as defined by the XMP specification part 3.
+//
+// Tags are always written without extended header and compression. Version
+// 2.2 tags are upgraded to version 2.4 on write. When the new tag is not
+// larger than the original tag, padding keeps the audio data in place.
+package id3
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	id3model "github.com/mholt/go-xmp/models/id3"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const ownerXMP = "XMP"
+
+var (
+	ErrNoTag   = errors.New("id3: no ID3v2 tag found")
+	ErrNoXMP   = errors.New("id3: no XMP packet found")
+	ErrInvalid = errors.New("id3: invalid tag format")
+)
+
+func isXMPFrame(f *Frame) bool {
+	return f.ID == "PRIV" && bytes.HasPrefix(f.Data, []byte(ownerXMP+"\x00"))
+}
+
+// ReadPacket returns the XMP packet stored in the private frame of an
+// ID3v2 tag.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	t, err := ReadTag(r)
+	if err != nil {
+		if err == ErrNoTag {
+			return nil, ErrNoXMP
+		}
+		return nil, err
+	}
+	for _, f := range t.Frames {
+		if isXMPFrame(f) {
+			return f.Data[len(ownerXMP)+1:], nil
+		}
+	}
+	return nil, ErrNoXMP
+}
+
+// Read decodes the XMP packet stored in an ID3v2 tag.
+func Read(r io.Reader) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and stores packet in the private
+// XMP frame of its ID3v2 tag. A version 2.3 tag is created when the file
+// has no tag.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	return update(w, r, func(t *Tag) error {
+		data := append([]byte(ownerXMP+"\x00"), packet...)
+		for _, f := range t.Frames {
+			if isXMPFrame(f) {
+				f.Data = data
+				return nil
+			}
+		}
+		t.Frames = append(t.Frames, &Frame{ID: "PRIV", Data: data})
+		return nil
+	})
+}
+
+// Write copies the file from r to w and stores d as its XMP packet.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
+
+// ReadMetadata decodes the ID3v2 tag at the start of r into a model.
+func ReadMetadata(r io.Reader) (*id3model.ID3, error) {
+	t, err := ReadTag(r)
+	if err != nil {
+		return nil, err
+	}
+	return t.Model(), nil
+}
+
+// WriteMetadata copies the file from r to w and replaces the frames
+// represented by m. A version 2.3 tag is created when the file has no tag.
+func WriteMetadata(w io.Writer, r io.Reader, m *id3model.ID3) error {
+	return update(w, r, func(t *Tag) error {
+		return t.SetModel(m)
+	})
+}
+
+func update(w io.Writer, r io.Reader, fn func(*Tag) error) error {
+	br := bufio.NewReader(r)
+	t, err := readTag(br)
+	switch err {
+	case nil:
+	case ErrNoTag:
+		t = NewTag(3)
+	default:
+		return err
+	}
+	if err := fn(t); err != nil {
+		return err
+	}
+	b, err := t.Bytes(int(t.Size))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
@@ -0,0 +1,429 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package id3
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// tag header flags
+const (
+	flagUnsync     = 0x80
+	flagExtended   = 0x40 // v2.3+, compression in v2.2
+	flagFooter     = 0x10 // v2.4
+	headerSize     = 10
+	maxTagSize     = 1<<28 - 1
+	maxFrameBuffer = 1 << 28
+)
+
+// frame format flags
+const (
+	v23Compressed = 0x0080
+	v23Encrypted  = 0x0040
+	v23Grouping   = 0x0020
+	v24Grouping   = 0x0040
+	v24Compressed = 0x0008
+	v24Encrypted  = 0x0004
+	v24Unsync     = 0x0002
+	v24DataLength = 0x0001
+)
+
+// Tag is an ID3v2 tag. Frames keep their content with unsynchronisation,
+// data length indicators and compression removed. Encrypted and grouped
+// frames are kept as stored.
+type Tag struct {
+	Version  int  // major version 2, 3 or 4
+	Revision int  // minor version
+	Unsync   bool // apply unsynchronisation when writing
+	Size     int64
+	Frames   []*Frame
+}
+
+// Frame is a single ID3v2 frame. IDs have three characters in v2.2 tags
+// and four characters in v2.3 and v2.4 tags.
+type Frame struct {
+	ID    string
+	Flags uint16
+	Data  []byte
+}
+
+// NewTag creates an empty tag of the given major version.
+func NewTag(version int) *Tag {
+	return &Tag{Version: version}
+}
+
+// Find returns the first frame with the given ID.
+func (t *Tag) Find(id string) *Frame {
+	for _, f := range t.Frames {
+		if f.ID == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// FindAll returns all frames with the given ID.
+func (t *Tag) FindAll(id string) []*Frame {
+	l := make([]*Frame, 0)
+	for _, f := range t.Frames {
+		if f.ID == id {
+			l = append(l, f)
+		}
+	}
+	return l
+}
+
+// Remove deletes all frames for which fn returns true.
+func (t *Tag) Remove(fn func(*Frame) bool) {
+	l := t.Frames[:0]
+	for _, f := range t.Frames {
+		if !fn(f) {
+			l = append(l, f)
+		}
+	}
+	t.Frames = l
+}
+
+func (t *Tag) raw(f *Frame) bool {
+	switch t.Version {
+	case 3:
+		return f.Flags&(v23Encrypted|v23Grouping) > 0
+	case 4:
+		return f.Flags&(v24Encrypted|v24Grouping) > 0
+	}
+	return false
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func putSyncsafe(b []byte, v int) {
+	b[0] = byte(v>>21) & 0x7f
+	b[1] = byte(v>>14) & 0x7f
+	b[2] = byte(v>>7) & 0x7f
+	b[3] = byte(v) & 0x7f
+}
+
+// removeUnsync reverts unsynchronisation by dropping the zero byte
+// following every 0xFF.
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xFF && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
+
+// applyUnsync inserts a zero byte after every 0xFF that is followed by a
+// byte that could be mistaken for an MPEG sync pattern or by zero.
+func applyUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(b)/64)
+	for i, v := range b {
+		out = append(out, v)
+		if v == 0xFF && (i+1 == len(b) || b[i+1] >= 0xE0 || b[i+1] == 0) {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+func validID(id []byte) bool {
+	for _, c := range id {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadTag reads an ID3v2 tag from the start of r. It returns ErrNoTag
+// when r does not start with a tag.
+func ReadTag(r io.Reader) (*Tag, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return readTag(br)
+}
+
+func readTag(r *bufio.Reader) (*Tag, error) {
+	hdr, err := r.Peek(headerSize)
+	if err != nil || string(hdr[:3]) != "ID3" {
+		return nil, ErrNoTag
+	}
+	t := &Tag{
+		Version:  int(hdr[3]),
+		Revision: int(hdr[4]),
+	}
+	flags := hdr[5]
+	size := syncsafe(hdr[6:])
+	if t.Version < 2 || t.Version > 4 {
+		return nil, fmt.Errorf("id3: unsupported version 2.%d", t.Version)
+	}
+	if _, err := r.Discard(headerSize); err != nil {
+		return nil, err
+	}
+	// grow the body while reading, so a corrupt size cannot force a large
+	// allocation for a short file
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("id3: short tag: %v", err)
+	}
+	body := buf.Bytes()
+	t.Size = int64(headerSize + size)
+	if t.Version == 4 && flags&flagFooter > 0 {
+		if _, err := r.Discard(headerSize); err != nil {
+			return nil, fmt.Errorf("id3: short tag footer: %v", err)
+		}
+		t.Size += headerSize
+	}
+	if t.Version < 4 && flags&flagUnsync > 0 {
+		body = removeUnsync(body)
+	}
+	if flags&flagExtended > 0 {
+		switch t.Version {
+		case 2:
+			return nil, fmt.Errorf("id3: compressed v2.2 tags are not supported")
+		case 3:
+			if len(body) < 4 {
+				return nil, ErrInvalid
+			}
+			n := 4 + int(binary.BigEndian.Uint32(body))
+			if n > len(body) {
+				return nil, ErrInvalid
+			}
+			body = body[n:]
+		case 4:
+			if len(body) < 4 {
+				return nil, ErrInvalid
+			}
+			n := syncsafe(body)
+			if n < 6 || n > len(body) {
+				return nil, ErrInvalid
+			}
+			body = body[n:]
+		}
+	}
+	if err := t.parseFrames(body, flags&flagUnsync > 0); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tag) parseFrames(b []byte, unsync bool) error {
+	idLen, hdrLen := 4, 10
+	if t.Version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	for len(b) >= hdrLen {
+		if b[0] == 0 {
+			// padding
+			break
+		}
+		if !validID(b[:idLen]) {
+			xmp.Log.Warnf("id3: invalid frame id %q, skipping remaining frames", b[:idLen])
+			break
+		}
+		f := &Frame{ID: string(b[:idLen])}
+		var size int
+		switch t.Version {
+		case 2:
+			size = int(b[3])<<16 | int(b[4])<<8 | int(b[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(b[4:]))
+			f.Flags = binary.BigEndian.Uint16(b[8:])
+		case 4:
+			size = syncsafe(b[4:])
+			// some writers use plain integers in v2.4 tags
+			if plain := int(binary.BigEndian.Uint32(b[4:])); plain != size && !t.nextFrameAt(b, hdrLen+size) && t.nextFrameAt(b, hdrLen+plain) {
+				size = plain
+			}
+			f.Flags = binary.BigEndian.Uint16(b[8:])
+		}
+		if size > len(b)-hdrLen {
+			return fmt.Errorf("id3: frame '%s' exceeds tag size", f.ID)
+		}
+		f.Data = b[hdrLen : hdrLen+size]
+		b = b[hdrLen+size:]
+		if err := t.decodeFrame(f, unsync); err != nil {
+			xmp.Log.Warnf("id3: skipping frame '%s': %v", f.ID, err)
+			continue
+		}
+		t.Frames = append(t.Frames, f)
+	}
+	return nil
+}
+
+// nextFrameAt checks whether a valid frame header or padding starts at
+// offset i.
+func (t *Tag) nextFrameAt(b []byte, i int) bool {
+	if i == len(b) {
+		return true
+	}
+	if i > len(b) || i+4 > len(b) {
+		return false
+	}
+	return b[i] == 0 || validID(b[i:i+4])
+}
+
+// decodeFrame removes transport encodings from frame content.
+func (t *Tag) decodeFrame(f *Frame, unsync bool) error {
+	switch t.Version {
+	case 3:
+		if t.raw(f) || f.Flags&v23Compressed == 0 {
+			return nil
+		}
+		if len(f.Data) < 4 {
+			return fmt.Errorf("short compressed frame")
+		}
+		b, err := inflate(f.Data[4:], int(binary.BigEndian.Uint32(f.Data)))
+		if err != nil {
+			return err
+		}
+		f.Data, f.Flags = b, f.Flags&^v23Compressed
+	case 4:
+		if unsync || f.Flags&v24Unsync > 0 {
+			f.Data = removeUnsync(f.Data)
+			f.Flags &^= v24Unsync
+		}
+		if t.raw(f) {
+			return nil
+		}
+		size := -1
+		if f.Flags&v24DataLength > 0 {
+			if len(f.Data) < 4 {
+				return fmt.Errorf("short data length indicator")
+			}
+			size = syncsafe(f.Data)
+			f.Data = f.Data[4:]
+			f.Flags &^= v24DataLength
+		}
+		if f.Flags&v24Compressed > 0 {
+			b, err := inflate(f.Data, size)
+			if err != nil {
+				return err
+			}
+			f.Data, f.Flags = b, f.Flags&^v24Compressed
+		}
+	}
+	return nil
+}
+
+func inflate(b []byte, size int) ([]byte, error) {
+	if size > maxFrameBuffer {
+		return nil, fmt.Errorf("compressed frame too large")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	buf := bytes.NewBuffer(make([]byte, 0, size+1))
+	if _, err := io.Copy(buf, io.LimitReader(zr, maxFrameBuffer+1)); err != nil {
+		return nil, err
+	}
+	if buf.Len() > maxFrameBuffer {
+		return nil, fmt.Errorf("inflated frame exceeds %d bytes", maxFrameBuffer)
+	}
+	return buf.Bytes(), nil
+}
+
+// upgrade converts a v2.2 tag into a v2.4 tag. Frames without v2.4
+// equivalent are dropped.
+func (t *Tag) upgrade() {
+	if t.Version != 2 {
+		return
+	}
+	l := make([]*Frame, 0, len(t.Frames))
+	for _, f := range t.Frames {
+		id, ok := upgradeID(f.ID)
+		if !ok {
+			xmp.Log.Warnf("id3: dropping v2.2 frame '%s' without v2.4 equivalent", f.ID)
+			continue
+		}
+		data := f.Data
+		if f.ID == "PIC" {
+			data = upgradePicture(data)
+		}
+		l = append(l, &Frame{ID: id, Data: data})
+	}
+	t.Version, t.Revision, t.Frames = 4, 0, l
+}
+
+// Bytes serializes the tag. Tags of version 2.2 are written as version
+// 2.4. When the result is smaller than minSize, zero padding is added.
+func (t *Tag) Bytes(minSize int) ([]byte, error) {
+	t.upgrade()
+	if t.Version != 3 && t.Version != 4 {
+		return nil, fmt.Errorf("id3: unsupported version 2.%d", t.Version)
+	}
+	var body bytes.Buffer
+	for _, f := range t.Frames {
+		data, flags := f.Data, f.Flags
+		if t.Version == 4 && t.Unsync {
+			if u := applyUnsync(data); len(u) != len(data) {
+				data, flags = u, flags|v24Unsync
+			}
+		}
+		hdr := make([]byte, 10)
+		copy(hdr, f.ID)
+		if t.Version == 4 {
+			if len(data) > maxTagSize {
+				return nil, fmt.Errorf("id3: frame '%s' too large", f.ID)
+			}
+			putSyncsafe(hdr[4:], len(data))
+		} else {
+			binary.BigEndian.PutUint32(hdr[4:], uint32(len(data)))
+		}
+		binary.BigEndian.PutUint16(hdr[8:], flags)
+		body.Write(hdr)
+		body.Write(data)
+	}
+	frames := body.Bytes()
+	var flags byte
+	if t.Unsync {
+		flags |= flagUnsync
+		if t.Version == 3 {
+			frames = applyUnsync(frames)
+		}
+	}
+	size := len(frames)
+	if size+headerSize < minSize {
+		size = minSize - headerSize
+	}
+	if size > maxTagSize {
+		return nil, fmt.Errorf("id3: tag too large")
+	}
+	b := make([]byte, headerSize+size)
+	copy(b, "ID3")
+	b[3], b[4], b[5] = byte(t.Version), byte(t.Revision), flags
+	putSyncsafe(b[6:], size)
+	copy(b[headerSize:], frames)
+	return b, nil
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package jp2 reads and writes XMP packets stored in JPEG 2000 files (JP2,
+// JPX, JPM) as defined by XMP Specification Part 3.
+//
+// XMP is kept in a top-level uuid box with the extended type
+// BE7ACFCB-97A9-42E8-9C71-999491E3AFAC. Some older writers used an 'xml '
+// box instead, which is read as fallback and replaced on write. New boxes
+// are placed in front of the first contiguous codestream box so streaming
+// readers see metadata before image data. All other boxes are copied
+// unchanged.
+package jp2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mholt/go-xmp/format/bmff"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// sanity limit for boxes we load into memory
+const maxBoxSize = 1 << 30
+
+var (
+	signature = []byte("\x00\x00\x00\x0cjP  \r\n\x87\n")
+
+	ErrNoXMP   = errors.New("jp2: no XMP packet found")
+	ErrInvalid = errors.New("jp2: invalid file format")
+)
+
+func isXMPBox(b *bmff.Box) bool {
+	return b.Type == "uuid" && bytes.Equal(b.UUID, bmff.UUIDXMP)
+}
+
+func isXMP(b []byte) bool {
+	return bytes.Contains(b, []byte("<x:xmpmeta")) || bytes.Contains(b, []byte("<?xpacket begin"))
+}
+
+func loadBox(r io.ReadSeeker, b *bmff.Box) error {
+	if b.Size > maxBoxSize {
+		return fmt.Errorf("jp2: '%s' box too large", b.Type)
+	}
+	return bmff.ReadBox(r, b)
+}
+
+// Boxes returns the list of top-level boxes in a JPEG 2000 file.
+func Boxes(r io.ReadSeeker) ([]*bmff.Box, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	sig := make([]byte, len(signature))
+	if _, err := io.ReadFull(r, sig); err != nil || !bytes.Equal(sig, signature) {
+		return nil, ErrInvalid
+	}
+	top, err := bmff.ReadTopLevel(r)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return top, nil
+}
+
+// ReadPacket returns the XMP packet from the XMP uuid box or, when missing,
+// from the first 'xml ' box that contains XMP.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	top, err := Boxes(r)
+	if err != nil {
+		return nil, err
+	}
+	var fallback []byte
+	for _, b := range top {
+		switch {
+		case isXMPBox(b):
+			if err := loadBox(r, b); err != nil {
+				return nil, err
+			}
+			return b.Data, nil
+		case b.Type == "xml " && fallback == nil:
+			if err := loadBox(r, b); err != nil {
+				return nil, err
+			}
+			if isXMP(b.Data) {
+				fallback = b.Data
+			}
+		}
+	}
+	if fallback == nil {
+		return nil, ErrNoXMP
+	}
+	return fallback, nil
+}
+
+// Read decodes the XMP packet stored in a JPEG 2000 file.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and stores packet in the XMP uuid
+// box. An existing box is replaced in place, 'xml ' boxes holding XMP are
+// removed.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	top, err := Boxes(r)
+	if err != nil {
+		return err
+	}
+	box := bmff.NewBox("uuid", packet)
+	box.UUID = bmff.UUIDXMP
+	replace := make(map[*bmff.Box]*bmff.Box)
+	for _, b := range top {
+		switch {
+		case isXMPBox(b):
+			if hasBox(replace, box) {
+				replace[b] = nil
+			} else {
+				replace[b] = box
+			}
+		case b.Type == "xml ":
+			if err := loadBox(r, b); err != nil {
+				return err
+			}
+			if isXMP(b.Data) {
+				replace[b] = nil
+			}
+		}
+	}
+	if !hasBox(replace, box) {
+		top = insertBefore(top, box, "jp2c")
+	}
+	return bmff.Rewrite(w, r, top, replace)
+}
+
+// Write copies the file from r to w and stores d in the XMP uuid box.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
+
+func hasBox(m map[*bmff.Box]*bmff.Box, b *bmff.Box) bool {
+	for _, v := range m {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
+
+// insertBefore inserts b in front of the first box of the given type or
+// appends it.
+func insertBefore(top []*bmff.Box, b *bmff.Box, typ string) []*bmff.Box {
+	for i, v := range top {
+		if v.Type == typ {
+			l := append([]*bmff.Box{}, top[:i]...)
+			l = append(l, b)
+			return append(l, top[i:]...)
+		}
+	}
+	return append(top, b)
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package jpeg
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	_ "github.com/mholt/go-xmp/models/xmp_note"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Extended XMP segments carry a 32 byte GUID, the full length of the
+// extended packet and the offset of the chunk as big endian uint32.
+//
+//	namespace  35 bytes "http://ns.adobe.com/xmp/extension/\0"
+//	GUID       32 bytes uppercase hex MD5 of the full extended packet
+//	length      4 bytes
+//	offset      4 bytes
+//	data        up to 65458 bytes
+const (
+	guidSize         = 32
+	extHeaderSize    = guidSize + 8
+	MaxExtensionSize = maxSegmentSize - 35 - extHeaderSize
+
+	// limit for reassembled extended packets
+	maxExtendedSize = 64 << 20
+)
+
+var pathHasExtendedXMP = xmp.Path("xmpNote:HasExtendedXMP")
+
+// ExtendedXMP collects extension chunks found in a file by GUID.
+type ExtendedXMP map[string]*ExtendedPacket
+
+type ExtendedPacket struct {
+	Size   uint32
+	chunks []extChunk
+}
+
+type extChunk struct {
+	offset uint32
+	data   []byte
+}
+
+func (x ExtendedXMP) add(b []byte) error {
+	if len(b) < extHeaderSize {
+		return fmt.Errorf("jpeg: short extended XMP segment")
+	}
+	guid := string(b[:guidSize])
+	size := binary.BigEndian.Uint32(b[guidSize:])
+	offset := binary.BigEndian.Uint32(b[guidSize+4:])
+	p, ok := x[guid]
+	if !ok {
+		p = &ExtendedPacket{Size: size}
+		x[guid] = p
+	}
+	if p.Size != size {
+		return fmt.Errorf("jpeg: inconsistent extended XMP size for GUID %s", guid)
+	}
+	p.chunks = append(p.chunks, extChunk{offset: offset, data: b[extHeaderSize:]})
+	return nil
+}
+
+// Bytes reassembles the extended packet from its chunks and verifies the
+// result against guid.
+func (p *ExtendedPacket) Bytes(guid string) ([]byte, error) {
+	if p.Size > maxExtendedSize {
+		return nil, fmt.Errorf("jpeg: extended XMP packet exceeds %d bytes", maxExtendedSize)
+	}
+	sort.Slice(p.chunks, func(i, j int) bool { return p.chunks[i].offset < p.chunks[j].offset })
+
+	// the chunks must cover the packet exactly before it is allocated
+	var next uint64
+	for _, c := range p.chunks {
+		if uint64(c.offset) != next || next+uint64(len(c.data)) > uint64(p.Size) {
+			return nil, fmt.Errorf("jpeg: missing or overlapping extended XMP chunk at offset %d", next)
+		}
+		next += uint64(len(c.data))
+	}
+	if next != uint64(p.Size) {
+		return nil, fmt.Errorf("jpeg: incomplete extended XMP packet (%d of %d bytes)", next, p.Size)
+	}
+	buf := make([]byte, 0, p.Size)
+	for _, c := range p.chunks {
+		buf = append(buf, c.data...)
+	}
+	if sum := md5.Sum(buf); !strings.EqualFold(hex.EncodeToString(sum[:]), guid) {
+		return nil, ErrChecksum
+	}
+	return buf, nil
+}
+
+// mergeExtended merges the extended packet referenced from d into d and
+// removes the reference. Extended packets without a reference are ignored.
+func mergeExtended(d *xmp.Document, ext ExtendedXMP) error {
+	guid, _ := d.GetPath(pathHasExtendedXMP)
+	if guid == "" {
+		return nil
+	}
+	p, ok := ext[guid]
+	if !ok {
+		xmp.Log.Warnf("jpeg: extended XMP packet %s not found", guid)
+		return nil
+	}
+	b, err := p.Bytes(guid)
+	if err != nil {
+		return err
+	}
+	x := xmp.NewDocument()
+	defer x.Close()
+	if err := xmp.Unmarshal(b, x); err != nil {
+		return fmt.Errorf("jpeg: extended XMP: %v", err)
+	}
+	if err := d.Merge(x, xmp.MERGE); err != nil {
+		return fmt.Errorf("jpeg: merging extended XMP: %v", err)
+	}
+	return d.SetPath(xmp.PathValue{
+		Path:  pathHasExtendedXMP,
+		Flags: xmp.DELETE,
+	})
+}
+
+func makeExtendedSegments(ext []byte, guid string) []*segment {
+	segs := make([]*segment, 0, len(ext)/MaxExtensionSize+1)
+	for offset := 0; offset < len(ext); offset += MaxExtensionSize {
+		end := offset + MaxExtensionSize
+		if end > len(ext) {
+			end = len(ext)
+		}
+		hdr := make([]byte, len(nsXMPExt)+extHeaderSize)
+		copy(hdr, nsXMPExt)
+		copy(hdr[len(nsXMPExt):], guid)
+		binary.BigEndian.PutUint32(hdr[len(nsXMPExt)+guidSize:], uint32(len(ext)))
+		binary.BigEndian.PutUint32(hdr[len(nsXMPExt)+guidSize+4:], uint32(offset))
+		segs = append(segs, makeSegment(markerAPP1, hdr, ext[offset:end]))
+	}
+	return segs
+}
+
+// splitExtended moves entire namespaces from the main packet into the
+// extended packet until the main packet fits into a single APP1 segment.
+// Following XMP Specification Part 3 the Camera Raw namespace is moved
+// first, remaining namespaces are moved in order of decreasing size.
+func splitExtended(d *xmp.Document) ([]byte, []byte, string, error) {
+	full, err := encode(d, 0)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	main, err := decode(full)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer main.Close()
+
+	// size all top-level namespaces
+	type nsSize struct {
+		ns   *xmp.Namespace
+		size int
+	}
+	sizes := make([]nsSize, 0)
+	for _, n := range main.Nodes() {
+		ns := main.FindNs(n.Name(), "")
+		if ns == nil {
+			continue
+		}
+		x, err := decode(full)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		x.FilterNamespaces(xmp.NamespaceList{ns})
+		b, err := encode(x, 0)
+		x.Close()
+		if err != nil {
+			return nil, nil, "", err
+		}
+		size := len(b)
+		if ns.GetName() == "crs" {
+			size = int(^uint(0) >> 1)
+		}
+		sizes = append(sizes, nsSize{ns, size})
+	}
+	sort.SliceStable(sizes, func(i, j int) bool { return sizes[i].size > sizes[j].size })
+
+	// move namespaces until the main packet fits, use a placeholder GUID
+	// to account for the extra property
+	placeholder := strings.Repeat("0", guidSize)
+	moved := make(xmp.NamespaceList, 0)
+	for {
+		if err := setGUID(main, placeholder); err != nil {
+			return nil, nil, "", err
+		}
+		b, err := encode(main, xmp.Xpacket)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if len(b) <= MaxPacketSize {
+			break
+		}
+		if len(sizes) == 0 {
+			return nil, nil, "", fmt.Errorf("jpeg: cannot split XMP packet into main and extended part")
+		}
+		main.RemoveNamespace(sizes[0].ns)
+		moved = append(moved, sizes[0].ns)
+		sizes = sizes[1:]
+	}
+
+	ext, err := decode(full)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer ext.Close()
+	ext.FilterNamespaces(moved)
+	extBytes, err := encode(ext, 0)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	sum := md5.Sum(extBytes)
+	guid := strings.ToUpper(hex.EncodeToString(sum[:]))
+	if err := setGUID(main, guid); err != nil {
+		return nil, nil, "", err
+	}
+	packet, err := encode(main, xmp.Xpacket)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return packet, extBytes, guid, nil
+}
+
+func setGUID(d *xmp.Document, guid string) error {
+	return d.SetPath(xmp.PathValue{
+		Path:  pathHasExtendedXMP,
+		Value: guid,
+		Flags: xmp.CREATE | xmp.REPLACE,
+	})
+}
+
+func encode(d *xmp.Document, flags int) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := xmp.NewEncoder(&buf)
+	enc.SetFlags(flags)
+	if err := enc.Encode(d); err != nil {
+		return nil, fmt.Errorf("jpeg: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(b []byte) (*xmp.Document, error) {
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(b, d); err != nil {
+		return nil, fmt.Errorf("jpeg: %v", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package jpeg reads and writes XMP packets embedded in JPEG APP1 segments
+// as defined by XMP Specification Part 3.
+package jpeg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const (
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOS  = 0xDA
+	markerAPP0 = 0xE0
+	markerAPP1 = 0xE1
+	markerTEM  = 0x01
+	markerRST0 = 0xD0
+	markerRST7 = 0xD7
+
+	// a segment's length field includes its own two bytes
+	maxSegmentSize = 0xFFFF - 2
+
+	// largest packet that fits into a single APP1 segment
+	MaxPacketSize = maxSegmentSize - 29
+)
+
+var (
+	nsXMP    = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	nsXMPExt = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	nsExif   = []byte("Exif\x00")
+
+	ErrNoXMP    = errors.New("jpeg: no XMP packet found")
+	ErrInvalid  = errors.New("jpeg: invalid file format")
+	ErrChecksum = errors.New("jpeg: extended XMP checksum mismatch")
+)
+
+type segment struct {
+	marker byte
+	offset int64  // file offset of the first byte in raw
+	raw    []byte // unmodified segment bytes incl. fill bytes, marker and length
+	data   []byte // payload without marker and length
+}
+
+func (s *segment) isXMP() bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.data, nsXMP)
+}
+
+func (s *segment) isExtendedXMP() bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.data, nsXMPExt)
+}
+
+func (s *segment) isExif() bool {
+	return s.marker == markerAPP1 && bytes.HasPrefix(s.data, nsExif)
+}
+
+func hasLength(marker byte) bool {
+	switch {
+	case marker == markerSOI, marker == markerEOI, marker == markerTEM:
+		return false
+	case marker >= markerRST0 && marker <= markerRST7:
+		return false
+	default:
+		return true
+	}
+}
+
+// readSegments parses all segments up to and including the first SOS header.
+// The reader is left at the start of entropy coded image data.
+func readSegments(r *bufio.Reader) ([]*segment, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return nil, ErrInvalid
+	}
+	if soi[0] != 0xFF || soi[1] != markerSOI {
+		return nil, ErrInvalid
+	}
+	offset := int64(2)
+	segs := make([]*segment, 0)
+	for {
+		raw := make([]byte, 0, 4)
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("jpeg: reading segment at offset %d: %v", offset, err)
+		}
+		if b != 0xFF {
+			return nil, fmt.Errorf("jpeg: missing marker at offset %d", offset)
+		}
+		raw = append(raw, b)
+
+		// skip optional fill bytes
+		var marker byte
+		for {
+			if marker, err = r.ReadByte(); err != nil {
+				return nil, fmt.Errorf("jpeg: reading marker at offset %d: %v", offset, err)
+			}
+			raw = append(raw, marker)
+			if marker != 0xFF {
+				break
+			}
+		}
+
+		seg := &segment{
+			marker: marker,
+			offset: offset,
+		}
+		if hasLength(marker) {
+			var l [2]byte
+			if _, err := io.ReadFull(r, l[:]); err != nil {
+				return nil, fmt.Errorf("jpeg: reading segment length at offset %d: %v", offset, err)
+			}
+			size := int(binary.BigEndian.Uint16(l[:]))
+			if size < 2 {
+				return nil, fmt.Errorf("jpeg: invalid segment length %d at offset %d", size, offset)
+			}
+			buf := make([]byte, len(raw)+size)
+			copy(buf, raw)
+			copy(buf[len(raw):], l[:])
+			if _, err := io.ReadFull(r, buf[len(raw)+2:]); err != nil {
+				return nil, fmt.Errorf("jpeg: reading segment at offset %d: %v", offset, err)
+			}
+			seg.data = buf[len(raw)+2:]
+			raw = buf
+		}
+		seg.raw = raw
+		offset += int64(len(raw))
+		segs = append(segs, seg)
+
+		if marker == markerSOS || marker == markerEOI {
+			return segs, nil
+		}
+	}
+}
+
+// ReadPacket returns the XMP packet stored in the standard APP1 segment.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	packet, _, err := ReadPackets(r)
+	return packet, err
+}
+
+// ReadPackets returns the standard XMP packet and all extended XMP
+// segments found in the file, grouped by their GUID.
+func ReadPackets(r io.Reader) ([]byte, ExtendedXMP, error) {
+	segs, err := readSegments(bufio.NewReader(r))
+	if err != nil {
+		return nil, nil, err
+	}
+	var packet []byte
+	ext := make(ExtendedXMP)
+	for _, s := range segs {
+		switch {
+		case s.isXMP():
+			if packet == nil {
+				packet = s.data[len(nsXMP):]
+			}
+		case s.isExtendedXMP():
+			if err := ext.add(s.data[len(nsXMPExt):]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if packet == nil {
+		return nil, nil, ErrNoXMP
+	}
+	return packet, ext, nil
+}
+
+// Read decodes the XMP packet stored in a JPEG file. When the main packet
+// refers to an extended packet, its contents are verified and merged.
+func Read(r io.Reader) (*xmp.Document, error) {
+	packet, ext, err := ReadPackets(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	if err := mergeExtended(d, ext); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the JPEG file from r to w and replaces the XMP segment
+// with packet. When the file has no XMP segment yet, a new one is inserted
+// after any leading JFIF and Exif segments. Existing extended XMP segments
+// are removed. All other segments and the image data remain byte-identical.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	return writePackets(w, r, packet, nil, "")
+}
+
+func writePackets(w io.Writer, r io.Reader, packet, ext []byte, guid string) error {
+	if len(packet) > MaxPacketSize {
+		return fmt.Errorf("jpeg: packet size %d exceeds APP1 limit of %d bytes", len(packet), MaxPacketSize)
+	}
+	br := bufio.NewReader(r)
+	segs, err := readSegments(br)
+	if err != nil {
+		return err
+	}
+
+	xmpSegs := append([]*segment{makeSegment(markerAPP1, nsXMP, packet)}, makeExtendedSegments(ext, guid)...)
+	out := make([]*segment, 0, len(segs)+len(xmpSegs))
+	pos := -1
+	for _, s := range segs {
+		if s.isXMP() || s.isExtendedXMP() {
+			if pos < 0 {
+				pos = len(out)
+				out = append(out, xmpSegs...)
+			}
+			continue
+		}
+		out = append(out, s)
+	}
+	if pos < 0 {
+		pos = 0
+		for pos < len(out) && (out[pos].marker == markerAPP0 || out[pos].isExif()) {
+			pos++
+		}
+		out = append(out[:pos], append(xmpSegs, out[pos:]...)...)
+	}
+
+	if _, err := w.Write([]byte{0xFF, markerSOI}); err != nil {
+		return err
+	}
+	for _, s := range out {
+		if _, err := w.Write(s.raw); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
+
+// Write copies the JPEG file from r to w and stores d as its XMP packet.
+// Documents that exceed the size of a single APP1 segment are split into
+// a main packet and an extended packet as defined by XMP Specification
+// Part 3.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	var buf bytes.Buffer
+	enc := xmp.NewEncoder(&buf)
+	enc.SetMaxSize(MaxPacketSize)
+	switch err := enc.Encode(d); err {
+	case nil:
+		return WritePacket(w, r, buf.Bytes())
+	case xmp.ErrOverflow:
+		packet, ext, guid, err := splitExtended(d)
+		if err != nil {
+			return err
+		}
+		return writePackets(w, r, packet, ext, guid)
+	default:
+		return fmt.Errorf("jpeg: %v", err)
+	}
+}
+
+func makeSegment(marker byte, ns, payload []byte) *segment {
+	size := 2 + len(ns) + len(payload)
+	raw := make([]byte, 0, 2+size)
+	raw = append(raw, 0xFF, marker, byte(size>>8), byte(size))
+	raw = append(raw, ns...)
+	raw = append(raw, payload...)
+	return &segment{
+		marker: marker,
+		raw:    raw,
+		data:   raw[4:],
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package jxl reads and writes XMP packets stored in the 'xml ' box of JPEG
+// XL container files as defined by ISO/IEC 18181-2.
+//
+// Metadata boxes may be Brotli compressed inside a 'brob' box. The standard
+// library lacks a Brotli decoder, so compressed boxes can only be read after
+// setting BrotliReader. Writers always store the packet uncompressed in
+// front of the codestream and remove all other XMP boxes. Bare codestream
+// files are wrapped into a container.
+package jxl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/mholt/go-xmp/format/bmff"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// sanity limit for boxes we load into memory
+const maxBoxSize = 1 << 30
+
+var (
+	signature  = []byte("\x00\x00\x00\x0cJXL \r\n\x87\n")
+	codestream = []byte{0xff, 0x0a}
+
+	ErrNoXMP   = errors.New("jxl: no XMP packet found")
+	ErrInvalid = errors.New("jxl: invalid file format")
+	ErrBrotli  = errors.New("jxl: brob box requires a Brotli decoder")
+)
+
+// BrotliReader returns a reader that decompresses Brotli data from r. It is
+// nil by default. Set it to read 'brob' compressed XMP boxes, for example
+// using github.com/andybalholm/brotli:
+//
+//	jxl.BrotliReader = func(r io.Reader) io.Reader { return brotli.NewReader(r) }
+var BrotliReader func(r io.Reader) io.Reader
+
+func isXMP(b []byte) bool {
+	return bytes.Contains(b, []byte("<x:xmpmeta")) || bytes.Contains(b, []byte("<?xpacket begin"))
+}
+
+func loadBox(r io.ReadSeeker, b *bmff.Box) error {
+	if b.Size > maxBoxSize {
+		return fmt.Errorf("jxl: '%s' box too large", b.Type)
+	}
+	return bmff.ReadBox(r, b)
+}
+
+// isCompressedXML returns true for brob boxes wrapping an 'xml ' box.
+func isCompressedXML(b *bmff.Box) bool {
+	return b.Type == "brob" && len(b.Data) >= 4 && string(b.Data[:4]) == "xml "
+}
+
+// decompress returns the contents of a loaded brob box.
+func decompress(b *bmff.Box) ([]byte, error) {
+	if BrotliReader == nil {
+		return nil, ErrBrotli
+	}
+	return ioutil.ReadAll(io.LimitReader(BrotliReader(bytes.NewReader(b.Data[4:])), maxBoxSize))
+}
+
+// Boxes returns the list of top-level boxes in a JPEG XL container file.
+// Bare codestream files have no boxes and return a nil list.
+func Boxes(r io.ReadSeeker) ([]*bmff.Box, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	sig := make([]byte, len(signature))
+	n, _ := io.ReadFull(r, sig)
+	switch {
+	case bytes.Equal(sig, signature):
+	case n >= 2 && bytes.Equal(sig[:2], codestream):
+		return nil, nil
+	default:
+		return nil, ErrInvalid
+	}
+	top, err := bmff.ReadTopLevel(r)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return top, nil
+}
+
+// ReadPacket returns the XMP packet from the first 'xml ' box holding XMP.
+// Compressed boxes are only considered when BrotliReader is set, otherwise
+// ErrBrotli is returned when no uncompressed packet exists.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	top, err := Boxes(r)
+	if err != nil {
+		return nil, err
+	}
+	var compressed bool
+	for _, b := range top {
+		switch {
+		case b.Type == "xml ":
+			if err := loadBox(r, b); err != nil {
+				return nil, err
+			}
+			if isXMP(b.Data) {
+				return b.Data, nil
+			}
+		case b.Type == "brob":
+			if err := loadBox(r, b); err != nil {
+				return nil, err
+			}
+			if !isCompressedXML(b) {
+				continue
+			}
+			data, err := decompress(b)
+			if err == ErrBrotli {
+				compressed = true
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("jxl: brob box: %v", err)
+			}
+			if isXMP(data) {
+				return data, nil
+			}
+		}
+	}
+	if compressed {
+		return nil, ErrBrotli
+	}
+	return nil, ErrNoXMP
+}
+
+// Read decodes the XMP packet stored in a JPEG XL file.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and stores packet in an 'xml '
+// box. Existing XMP boxes are removed, including compressed 'xml ' boxes
+// that cannot be inspected.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	top, err := Boxes(r)
+	if err != nil {
+		return err
+	}
+	box := bmff.NewBox("xml ", packet)
+	if top == nil {
+		return wrap(w, r, box)
+	}
+	replace := make(map[*bmff.Box]*bmff.Box)
+	l := make([]*bmff.Box, 0, len(top)+1)
+	for _, b := range top {
+		switch b.Type {
+		case "xml ":
+			if err := loadBox(r, b); err != nil {
+				return err
+			}
+			if isXMP(b.Data) {
+				replace[b] = nil
+			}
+		case "brob":
+			if err := loadBox(r, b); err != nil {
+				return err
+			}
+			if isCompressedXML(b) {
+				if data, err := decompress(b); err != nil || isXMP(data) {
+					replace[b] = nil
+				}
+			}
+		case "jxlc", "jxlp":
+			if box != nil {
+				l = append(l, box)
+				box = nil
+			}
+		}
+		l = append(l, b)
+	}
+	if box != nil {
+		l = append(l, box)
+	}
+	return bmff.Rewrite(w, r, l, replace)
+}
+
+// wrap writes a container with the packet and the bare codestream from r.
+// The codestream box extends to the end of file.
+func wrap(w io.Writer, r io.ReadSeeker, box *bmff.Box) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Write(signature)
+	buf.Write(bmff.NewBox("ftyp", []byte("jxl \x00\x00\x00\x00jxl ")).Bytes())
+	buf.Write(box.Bytes())
+	buf.Write([]byte("\x00\x00\x00\x00jxlc"))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// Write copies the file from r to w and stores d in an 'xml ' box.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
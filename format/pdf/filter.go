@@ -0,0 +1,161 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// decode applies all stream filters. Only FlateDecode with optional PNG
+// predictors is supported.
+func (s *stream) decode() ([]byte, error) {
+	var filters array
+	var params array
+	switch v := s.dict["Filter"].(type) {
+	case name:
+		filters = array{v}
+		params = array{s.dict["DecodeParms"]}
+	case array:
+		filters = v
+		params, _ = s.dict["DecodeParms"].(array)
+	}
+	data := s.data
+	for i, f := range filters {
+		var p dict
+		if i < len(params) {
+			p, _ = params[i].(dict)
+		}
+		switch f {
+		case name("FlateDecode"), name("Fl"):
+			b, err := inflate(data)
+			if err != nil {
+				return nil, fmt.Errorf("pdf: FlateDecode: %v", err)
+			}
+			if data, err = unpredict(b, p); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("pdf: unsupported stream filter %v", f)
+		}
+	}
+	return data, nil
+}
+
+func inflate(b []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(zr, maxDecodeSize+1))
+	// accept streams with missing or broken checksums
+	if err == io.ErrUnexpectedEOF || err == zlib.ErrChecksum {
+		err = nil
+	}
+	if len(out) > maxDecodeSize {
+		return nil, fmt.Errorf("inflated stream exceeds %d bytes", maxDecodeSize)
+	}
+	return out, err
+}
+
+// predictor parameter limits, rows stay below 2 MB
+const (
+	maxColors  = 32
+	maxColumns = 1 << 15
+)
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// unpredict reverses PNG predictors as used by cross-reference streams.
+func unpredict(b []byte, p dict) ([]byte, error) {
+	predictor, _ := toInt(p["Predictor"])
+	if predictor <= 1 {
+		return b, nil
+	}
+	if predictor < 10 {
+		return nil, fmt.Errorf("pdf: unsupported predictor %d", predictor)
+	}
+	colors, bpc, columns := int64(1), int64(8), int64(1)
+	if v, ok := p["Colors"]; ok {
+		if colors, ok = toInt(v); !ok || colors < 1 || colors > maxColors {
+			return nil, fmt.Errorf("pdf: invalid predictor colors %v", v)
+		}
+	}
+	if v, ok := p["BitsPerComponent"]; ok {
+		switch bpc, _ = toInt(v); bpc {
+		case 1, 2, 4, 8, 16:
+		default:
+			return nil, fmt.Errorf("pdf: invalid predictor bits per component %v", v)
+		}
+	}
+	if v, ok := p["Columns"]; ok {
+		if columns, ok = toInt(v); !ok || columns < 1 || columns > maxColumns {
+			return nil, fmt.Errorf("pdf: invalid predictor columns %v", v)
+		}
+	}
+	bpp := int((colors*bpc + 7) / 8)
+	rowLen := int((colors*bpc*columns + 7) / 8)
+	out := make([]byte, 0, len(b))
+	prev := make([]byte, rowLen)
+	for len(b) > rowLen {
+		typ, row := b[0], b[1:rowLen+1]
+		b = b[rowLen+1:]
+		cur := make([]byte, rowLen)
+		for i := range row {
+			var a, c byte
+			if i >= bpp {
+				a, c = cur[i-bpp], prev[i-bpp]
+			}
+			switch typ {
+			case 0:
+				cur[i] = row[i]
+			case 1:
+				cur[i] = row[i] + a
+			case 2:
+				cur[i] = row[i] + prev[i]
+			case 3:
+				cur[i] = row[i] + byte((int(a)+int(prev[i]))/2)
+			case 4:
+				cur[i] = row[i] + paeth(a, prev[i], c)
+			default:
+				return nil, fmt.Errorf("pdf: invalid PNG predictor row type %d", typ)
+			}
+		}
+		out = append(out, cur...)
+		prev = cur
+	}
+	return out, nil
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pdf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	pdfmodel "github.com/mholt/go-xmp/models/pdf"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// PDFDocEncoding code points that differ from Latin-1
+var pdfDocEncoding = map[byte]rune{
+	0x18: '˘', 0x19: 'ˇ', 0x1a: 'ˆ', 0x1b: '˙',
+	0x1c: '˝', 0x1d: '˛', 0x1e: '˚', 0x1f: '˜',
+	0x80: '•', 0x81: '†', 0x82: '‡', 0x83: '…',
+	0x84: '—', 0x85: '–', 0x86: 'ƒ', 0x87: '⁄',
+	0x88: '‹', 0x89: '›', 0x8a: '−', 0x8b: '‰',
+	0x8c: '„', 0x8d: '“', 0x8e: '”', 0x8f: '‘',
+	0x90: '’', 0x91: '‚', 0x92: '™', 0x93: 'ﬁ',
+	0x94: 'ﬂ', 0x95: 'Ł', 0x96: 'Œ', 0x97: 'Š',
+	0x98: 'Ÿ', 0x99: 'Ž', 0x9a: 'ı', 0x9b: 'ł',
+	0x9c: 'œ', 0x9d: 'š', 0x9e: 'ž', 0xa0: '€',
+}
+
+// decodeText decodes a PDF text string stored as UTF-16BE with byte order
+// mark, UTF-8 with byte order mark (PDF 2.0) or PDFDocEncoding.
+func decodeText(b []byte) string {
+	switch {
+	case len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff:
+		u := make([]uint16, (len(b)-2)/2)
+		for i := range u {
+			u[i] = uint16(b[2+2*i])<<8 | uint16(b[3+2*i])
+		}
+		return string(utf16.Decode(u))
+	case len(b) >= 3 && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf:
+		return string(b[3:])
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		if v, ok := pdfDocEncoding[c]; ok {
+			r[i] = v
+		} else {
+			r[i] = rune(c)
+		}
+	}
+	return string(r)
+}
+
+// encodeText stores ASCII strings as is and all other strings as UTF-16BE.
+func encodeText(s string) str {
+	ascii := true
+	for _, r := range s {
+		if r >= 0x80 || r < ' ' && r != '\t' && r != '\n' && r != '\r' {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return str(s)
+	}
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2, 2+2*len(u))
+	b[0], b[1] = 0xfe, 0xff
+	for _, v := range u {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return str(b)
+}
+
+// parseDate parses PDF dates in the form D:YYYYMMDDHHmmSSOHH'mm'. All
+// fields after the year are optional.
+func parseDate(s string) (xmp.Date, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(s), "D:")
+	i := 0
+	for i < len(v) && i < 14 && v[i] >= '0' && v[i] <= '9' {
+		i++
+	}
+	if i < 4 || i%2 == 1 {
+		return xmp.Date{}, fmt.Errorf("pdf: invalid date '%s'", s)
+	}
+	fields := [6]int{0, 1, 1, 0, 0, 0}
+	for n, j := 0, 0; j < i; n++ {
+		w := 2
+		if n == 0 {
+			w = 4
+		}
+		fields[n], _ = strconv.Atoi(v[j : j+w])
+		j += w
+	}
+	loc := time.UTC
+	if tz := strings.Replace(v[i:], "'", "", -1); len(tz) > 0 && tz[0] != 'Z' {
+		sign := 1
+		if tz[0] == '-' {
+			sign = -1
+		} else if tz[0] != '+' {
+			return xmp.Date{}, fmt.Errorf("pdf: invalid date '%s'", s)
+		}
+		tz = tz[1:]
+		var hh, mm int
+		if len(tz) >= 2 {
+			hh, _ = strconv.Atoi(tz[:2])
+		}
+		if len(tz) >= 4 {
+			mm, _ = strconv.Atoi(tz[2:4])
+		}
+		loc = time.FixedZone("", sign*(hh*3600+mm*60))
+	}
+	t := time.Date(fields[0], time.Month(fields[1]), fields[2], fields[3], fields[4], fields[5], 0, loc)
+	return xmp.NewDate(t), nil
+}
+
+func formatDate(d xmp.Date) str {
+	t := d.Value()
+	_, offset := t.Zone()
+	s := "D:" + t.Format("20060102150405")
+	switch {
+	case offset == 0:
+		s += "Z"
+	case offset < 0:
+		s += fmt.Sprintf("-%02d'%02d'", -offset/3600, -offset%3600/60)
+	default:
+		s += fmt.Sprintf("+%02d'%02d'", offset/3600, offset%3600/60)
+	}
+	return str(s)
+}
+
+func (f *file) text(d dict, key name) string {
+	o, err := f.resolve(d[key])
+	if err != nil {
+		return ""
+	}
+	if s, ok := o.(str); ok {
+		return strings.TrimSpace(decodeText(s))
+	}
+	return ""
+}
+
+func (f *file) decodeInfo(d dict) *pdfmodel.PDFInfo {
+	m := &pdfmodel.PDFInfo{
+		Title:    xmp.NewAltString(f.text(d, "Title")),
+		Subject:  xmp.NewAltString(f.text(d, "Subject")),
+		Keywords: f.text(d, "Keywords"),
+		Creator:  xmp.AgentName(f.text(d, "Creator")),
+		Producer: xmp.AgentName(f.text(d, "Producer")),
+	}
+	if s := f.text(d, "Author"); s != "" {
+		m.Author = xmp.StringList{s}
+	}
+	for key, date := range map[name]*xmp.Date{
+		"CreationDate": &m.CreationDate,
+		"ModDate":      &m.ModifyDate,
+	} {
+		if s := f.text(d, key); s != "" {
+			if v, err := parseDate(s); err == nil {
+				*date = v
+			} else {
+				xmp.Log.Debugf("%v", err)
+			}
+		}
+	}
+	switch v := d["Trapped"].(type) {
+	case name:
+		m.Trapped = xmp.Bool(v == "True")
+	case bool:
+		m.Trapped = xmp.Bool(v)
+	}
+	return m
+}
+
+func defaultText(a xmp.AltString) string {
+	if s := a.Default(); s != "" || len(a) == 0 {
+		return s
+	}
+	return a[0].Value
+}
+
+// encodeInfo updates a copy of the Info dictionary d with the contents of
+// m. Keys unknown to the model are kept.
+func encodeInfo(m *pdfmodel.PDFInfo, d dict) dict {
+	info := make(dict)
+	for k, v := range d {
+		info[k] = v
+	}
+	set := func(key name, value string) {
+		if value == "" {
+			delete(info, key)
+		} else {
+			info[key] = encodeText(value)
+		}
+	}
+	set("Title", defaultText(m.Title))
+	set("Author", strings.Join(m.Author, "; "))
+	set("Subject", defaultText(m.Subject))
+	set("Keywords", m.Keywords)
+	set("Creator", string(m.Creator))
+	set("Producer", string(m.Producer))
+	delete(info, "CreationDate")
+	if !m.CreationDate.IsZero() {
+		info["CreationDate"] = formatDate(m.CreationDate)
+	}
+	delete(info, "ModDate")
+	if !m.ModifyDate.IsZero() {
+		info["ModDate"] = formatDate(m.ModifyDate)
+	}
+	if m.Trapped {
+		info["Trapped"] = name("True")
+	} else if info.name("Trapped") == "True" || info["Trapped"] == true {
+		// a false value cannot be distinguished from unknown
+		info["Trapped"] = name("False")
+	}
+	return info
+}
@@ -0,0 +1,511 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pdf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// PDF objects are represented by nil, bool, int64, float64, name, str,
+// array, dict, ref and *stream values.
+type object interface{}
+
+type name string
+
+type str []byte
+
+type array []object
+
+type dict map[name]object
+
+type ref struct {
+	num int
+	gen int
+}
+
+type stream struct {
+	dict   dict
+	offset int64 // file offset of stream data
+	data   []byte
+}
+
+func (d dict) name(key name) name {
+	n, _ := d[key].(name)
+	return n
+}
+
+func toInt(o object) (int64, bool) {
+	switch v := o.(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+const (
+	tokEOF = iota
+	tokKeyword
+	tokNumber
+	tokName
+	tokString
+	tokArrayOpen
+	tokArrayClose
+	tokDictOpen
+	tokDictClose
+)
+
+type token struct {
+	kind int
+	s    string
+	pos  int64
+}
+
+// lexer splits PDF syntax into tokens and keeps track of the absolute
+// file position of the underlying reader.
+type lexer struct {
+	r    *bufio.Reader
+	pos  int64
+	back []token
+}
+
+func newLexer(r io.Reader, pos int64) *lexer {
+	return &lexer{r: bufio.NewReader(r), pos: pos}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isDelim(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := 0
+	for i, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.':
+		case (c == '+' || c == '-') && i == 0:
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+func (l *lexer) readByte() (byte, error) {
+	c, err := l.r.ReadByte()
+	if err == nil {
+		l.pos++
+	}
+	return c, err
+}
+
+func (l *lexer) unreadByte() {
+	if l.r.UnreadByte() == nil {
+		l.pos--
+	}
+}
+
+func (l *lexer) unread(t token) {
+	l.back = append(l.back, t)
+}
+
+func (l *lexer) next() (token, error) {
+	if n := len(l.back); n > 0 {
+		t := l.back[n-1]
+		l.back = l.back[:n-1]
+		return t, nil
+	}
+	var c byte
+	var err error
+	for {
+		if c, err = l.readByte(); err != nil {
+			return token{kind: tokEOF, pos: l.pos}, nil
+		}
+		if c == '%' {
+			for c != '\r' && c != '\n' {
+				if c, err = l.readByte(); err != nil {
+					return token{kind: tokEOF, pos: l.pos}, nil
+				}
+			}
+			continue
+		}
+		if !isSpace(c) {
+			break
+		}
+	}
+	pos := l.pos - 1
+	switch c {
+	case '[':
+		return token{kind: tokArrayOpen, pos: pos}, nil
+	case ']':
+		return token{kind: tokArrayClose, pos: pos}, nil
+	case '<':
+		if c, err = l.readByte(); err == nil && c == '<' {
+			return token{kind: tokDictOpen, pos: pos}, nil
+		} else if err == nil {
+			l.unreadByte()
+		}
+		return l.hexString(pos)
+	case '>':
+		if c, err = l.readByte(); err == nil && c == '>' {
+			return token{kind: tokDictClose, pos: pos}, nil
+		}
+		return token{}, fmt.Errorf("pdf: unexpected '>' at offset %d", pos)
+	case '(':
+		return l.literalString(pos)
+	case '/':
+		return l.name(pos)
+	case ')', '{', '}':
+		return token{kind: tokKeyword, s: string(c), pos: pos}, nil
+	}
+	buf := []byte{c}
+	for {
+		if c, err = l.readByte(); err != nil {
+			break
+		}
+		if isSpace(c) || isDelim(c) {
+			l.unreadByte()
+			break
+		}
+		buf = append(buf, c)
+	}
+	t := token{kind: tokKeyword, s: string(buf), pos: pos}
+	if isNumber(t.s) {
+		t.kind = tokNumber
+	}
+	return t, nil
+}
+
+func unhex(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
+
+func (l *lexer) name(pos int64) (token, error) {
+	buf := make([]byte, 0, 16)
+	for {
+		c, err := l.readByte()
+		if err != nil {
+			break
+		}
+		if isSpace(c) || isDelim(c) {
+			l.unreadByte()
+			break
+		}
+		if c == '#' {
+			h, _ := l.r.Peek(2)
+			if len(h) == 2 && unhex(h[0]) >= 0 && unhex(h[1]) >= 0 {
+				l.readByte()
+				l.readByte()
+				c = byte(unhex(h[0])<<4 | unhex(h[1]))
+			}
+		}
+		buf = append(buf, c)
+	}
+	return token{kind: tokName, s: string(buf), pos: pos}, nil
+}
+
+func (l *lexer) hexString(pos int64) (token, error) {
+	buf := make([]byte, 0, 32)
+	hi := -1
+	for {
+		c, err := l.readByte()
+		if err != nil {
+			return token{}, fmt.Errorf("pdf: unterminated hex string at offset %d", pos)
+		}
+		if c == '>' {
+			break
+		}
+		if isSpace(c) {
+			continue
+		}
+		v := unhex(c)
+		if v < 0 {
+			return token{}, fmt.Errorf("pdf: invalid hex string at offset %d", pos)
+		}
+		if hi < 0 {
+			hi = v
+		} else {
+			buf = append(buf, byte(hi<<4|v))
+			hi = -1
+		}
+	}
+	if hi >= 0 {
+		buf = append(buf, byte(hi<<4))
+	}
+	return token{kind: tokString, s: string(buf), pos: pos}, nil
+}
+
+func (l *lexer) literalString(pos int64) (token, error) {
+	buf := make([]byte, 0, 32)
+	depth := 1
+	for {
+		c, err := l.readByte()
+		if err != nil {
+			return token{}, fmt.Errorf("pdf: unterminated string at offset %d", pos)
+		}
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return token{kind: tokString, s: string(buf), pos: pos}, nil
+			}
+		case '\r':
+			// end of line markers are stored as single LF
+			if c, err = l.readByte(); err == nil && c != '\n' {
+				l.unreadByte()
+			}
+			c = '\n'
+		case '\\':
+			if c, err = l.readByte(); err != nil {
+				continue
+			}
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if c, err = l.readByte(); err == nil && c != '\n' {
+					l.unreadByte()
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := int(c - '0')
+					for i := 0; i < 2; i++ {
+						if c, err = l.readByte(); err != nil {
+							break
+						}
+						if c < '0' || c > '7' {
+							l.unreadByte()
+							break
+						}
+						v = v<<3 | int(c-'0')
+					}
+					c = byte(v)
+				}
+			}
+		}
+		buf = append(buf, c)
+	}
+}
+
+// object parses the next direct object. References are recognized by
+// looking ahead two tokens.
+func (l *lexer) object() (object, error) {
+	t, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+	switch t.kind {
+	case tokEOF:
+		return nil, io.ErrUnexpectedEOF
+	case tokNumber:
+		t2, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if t2.kind == tokNumber && isInt(t.s) && isInt(t2.s) {
+			t3, err := l.next()
+			if err != nil {
+				return nil, err
+			}
+			if t3.kind == tokKeyword && t3.s == "R" {
+				num, _ := strconv.Atoi(t.s)
+				gen, _ := strconv.Atoi(t2.s)
+				return ref{num, gen}, nil
+			}
+			l.unread(t3)
+		}
+		l.unread(t2)
+		return parseNumber(t.s), nil
+	case tokName:
+		return name(t.s), nil
+	case tokString:
+		return str(t.s), nil
+	case tokArrayOpen:
+		a := make(array, 0)
+		for {
+			t, err := l.next()
+			if err != nil {
+				return nil, err
+			}
+			if t.kind == tokArrayClose {
+				return a, nil
+			}
+			l.unread(t)
+			o, err := l.object()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, o)
+		}
+	case tokDictOpen:
+		d := make(dict)
+		for {
+			t, err := l.next()
+			if err != nil {
+				return nil, err
+			}
+			if t.kind == tokDictClose {
+				return d, nil
+			}
+			if t.kind != tokName {
+				return nil, fmt.Errorf("pdf: invalid dictionary key at offset %d", t.pos)
+			}
+			o, err := l.object()
+			if err != nil {
+				return nil, err
+			}
+			if o != nil {
+				d[name(t.s)] = o
+			}
+		}
+	case tokKeyword:
+		switch t.s {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("pdf: unexpected token '%s' at offset %d", t.s, t.pos)
+}
+
+func isInt(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func parseNumber(s string) object {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// writeObject serializes o in PDF syntax. Dictionary keys are sorted to
+// produce deterministic output.
+func writeObject(buf *bytes.Buffer, o object) {
+	switch v := o.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int:
+		buf.WriteString(strconv.Itoa(v))
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case name:
+		buf.WriteByte('/')
+		for i := 0; i < len(v); i++ {
+			c := v[i]
+			if c < '!' || c > '~' || c == '#' || isDelim(c) {
+				fmt.Fprintf(buf, "#%02X", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	case str:
+		buf.WriteByte('(')
+		for _, c := range v {
+			switch c {
+			case '(', ')', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\n':
+				buf.WriteString(`\n`)
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		buf.WriteByte(')')
+	case array:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			writeObject(buf, e)
+		}
+		buf.WriteByte(']')
+	case dict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		buf.WriteString("<<")
+		for _, k := range keys {
+			writeObject(buf, name(k))
+			buf.WriteByte(' ')
+			writeObject(buf, v[name(k)])
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(">>")
+	case ref:
+		fmt.Fprintf(buf, "%d %d R", v.num, v.gen)
+	}
+}
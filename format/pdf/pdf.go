@@ -0,0 +1,409 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package pdf reads and writes the XMP metadata stream and the document
+// information dictionary of PDF files.
+//
+// The reader contains a minimal PDF object parser that follows the
+// cross-reference chain including cross-reference and object streams, so
+// only the metadata stream referenced from the current document catalog is
+// returned. Packets of earlier revisions that remain in a file after
+// incremental updates are ignored. Damaged cross-reference tables are
+// rebuilt by scanning the file for object headers.
+//
+// Changes are written as incremental update: the original file is copied
+// unchanged and new versions of the modified objects are appended together
+// with a new cross-reference section. Metadata streams are written
+// uncompressed as recommended by the XMP specification part 3.
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	pdfmodel "github.com/mholt/go-xmp/models/pdf"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+var (
+	ErrNoXMP     = errors.New("pdf: no XMP packet found")
+	ErrInvalid   = errors.New("pdf: invalid file format")
+	ErrEncrypted = errors.New("pdf: encrypted files are not supported")
+)
+
+func (f *file) catalog() (dict, error) {
+	o, err := f.resolve(f.trailer["Root"])
+	if err != nil {
+		return nil, err
+	}
+	d, ok := o.(dict)
+	if !ok {
+		return nil, fmt.Errorf("pdf: invalid document catalog")
+	}
+	return d, nil
+}
+
+func (f *file) encrypted() bool {
+	return f.trailer["Encrypt"] != nil
+}
+
+func (f *file) readPacket() ([]byte, error) {
+	cat, err := f.catalog()
+	if err != nil {
+		return nil, err
+	}
+	if cat["Metadata"] == nil {
+		return nil, ErrNoXMP
+	}
+	if f.encrypted() {
+		enc, _ := f.resolve(f.trailer["Encrypt"])
+		if d, ok := enc.(dict); !ok || d["EncryptMetadata"] != false {
+			return nil, ErrEncrypted
+		}
+	}
+	o, err := f.resolve(cat["Metadata"])
+	if err != nil {
+		return nil, err
+	}
+	s, ok := o.(*stream)
+	if !ok {
+		return nil, ErrNoXMP
+	}
+	return s.decode()
+}
+
+// ReadPacket returns the XMP packet of the current document catalog.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.readPacket()
+}
+
+// Read decodes the XMP packet of the current document catalog.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and appends an incremental update
+// that stores packet as document metadata stream.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	return WriteMetadata(w, r, &Metadata{XMP: packet})
+}
+
+// Write copies the file from r to w and appends an incremental update that
+// stores d as document metadata stream.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
+
+// Metadata holds the XMP packet and the document information dictionary.
+// Fields are nil when the file lacks the respective entry.
+type Metadata struct {
+	XMP  []byte
+	Info *pdfmodel.PDFInfo
+}
+
+// ReadMetadata reads the XMP packet and the document information
+// dictionary. Info is not available for encrypted files.
+func ReadMetadata(r io.ReadSeeker) (*Metadata, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if m.XMP, err = f.readPacket(); err != nil && err != ErrNoXMP && err != ErrEncrypted {
+		return nil, err
+	}
+	if f.encrypted() {
+		return m, nil
+	}
+	o, err := f.resolve(f.trailer["Info"])
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := o.(dict); ok {
+		m.Info = f.decodeInfo(d)
+		m.Info.PDFVersion = f.version
+		// the catalog may override the header version
+		if cat, err := f.catalog(); err == nil && cat.name("Version") > name(f.version) {
+			m.Info.PDFVersion = string(cat.name("Version"))
+		}
+	}
+	return m, nil
+}
+
+// WriteMetadata copies the file from r to w and appends an incremental
+// update with all non-nil fields of m. Unknown entries of the information
+// dictionary are kept.
+func WriteMetadata(w io.Writer, r io.ReadSeeker, m *Metadata) error {
+	f, err := parse(r)
+	if err != nil {
+		return err
+	}
+	if f.encrypted() {
+		return ErrEncrypted
+	}
+	u := &update{
+		file:    f,
+		trailer: dict{"Root": f.trailer["Root"]},
+		next:    f.nextNum(),
+	}
+	if id, ok := f.trailer["ID"]; ok {
+		u.trailer["ID"] = id
+	}
+	if info, ok := f.trailer["Info"]; ok {
+		u.trailer["Info"] = info
+	}
+	if m.XMP != nil {
+		s := &stream{
+			dict: dict{
+				"Type":    name("Metadata"),
+				"Subtype": name("XML"),
+			},
+			data: m.XMP,
+		}
+		cat, err := f.catalog()
+		if err != nil {
+			return err
+		}
+		if mref, ok := cat["Metadata"].(ref); ok {
+			u.add(mref, s)
+		} else {
+			c := make(dict)
+			for k, v := range cat {
+				c[k] = v
+			}
+			c["Metadata"] = u.add(u.alloc(), s)
+			u.add(f.trailer["Root"].(ref), c)
+		}
+	}
+	if m.Info != nil {
+		o, err := f.resolve(f.trailer["Info"])
+		if err != nil {
+			return err
+		}
+		old, _ := o.(dict)
+		iref, ok := f.trailer["Info"].(ref)
+		if !ok {
+			iref = u.alloc()
+		}
+		u.trailer["Info"] = u.add(iref, encodeInfo(m.Info, old))
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if len(u.objects) == 0 {
+		return nil
+	}
+	return u.write(w)
+}
+
+func (f *file) nextNum() int {
+	next := 1
+	if n, ok := toInt(f.trailer["Size"]); ok {
+		next = int(n)
+	}
+	for num := range f.xref {
+		if num >= next {
+			next = num + 1
+		}
+	}
+	return next
+}
+
+type indirect struct {
+	ref ref
+	obj object
+}
+
+// update collects the objects of an incremental update.
+type update struct {
+	file    *file
+	trailer dict
+	next    int
+	objects []indirect
+	offsets map[int]int64
+}
+
+func (u *update) alloc() ref {
+	u.next++
+	return ref{u.next - 1, 0}
+}
+
+func (u *update) add(r ref, o object) ref {
+	u.objects = append(u.objects, indirect{r, o})
+	return r
+}
+
+func (u *update) write(w io.Writer) error {
+	f := u.file
+	var buf bytes.Buffer
+	// make sure the original file ends with an end of line marker
+	last := make([]byte, 1)
+	if _, err := f.r.ReadAt(last, f.size-1); err != nil || (last[0] != '\n' && last[0] != '\r') {
+		buf.WriteByte('\n')
+	}
+	u.offsets = make(map[int]int64)
+	for _, v := range u.objects {
+		u.offsets[v.ref.num] = f.size + int64(buf.Len())
+		writeIndirect(&buf, v.ref, v.obj)
+	}
+	u.trailer["Size"] = int64(u.next)
+	if !f.rebuilt {
+		u.trailer["Prev"] = f.startxref
+	}
+	compressed := false
+	if f.rebuilt {
+		for _, e := range f.xref {
+			compressed = compressed || e.typ == xrefCompressed
+		}
+	}
+	start := f.size + int64(buf.Len())
+	if f.xrefStream || compressed {
+		u.writeStream(&buf, start)
+	} else {
+		u.writeTable(&buf)
+	}
+	fmt.Fprintf(&buf, "startxref\n%d\n%%%%EOF\n", start)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeIndirect(buf *bytes.Buffer, r ref, o object) {
+	fmt.Fprintf(buf, "%d %d obj\n", r.num, r.gen)
+	if s, ok := o.(*stream); ok {
+		d := make(dict)
+		for k, v := range s.dict {
+			d[k] = v
+		}
+		d["Length"] = int64(len(s.data))
+		writeObject(buf, d)
+		buf.WriteString("\nstream\n")
+		buf.Write(s.data)
+		buf.WriteString("\nendstream")
+	} else {
+		writeObject(buf, o)
+	}
+	buf.WriteString("\nendobj\n")
+}
+
+// entries returns all cross-reference entries of the update in object
+// number order. Rebuilt files get a full table.
+func (u *update) entries() ([]int, map[int]xrefEntry) {
+	m := make(map[int]xrefEntry)
+	if u.file.rebuilt {
+		m[0] = xrefEntry{typ: xrefFree, gen: 65535}
+		for num, e := range u.file.xref {
+			m[num] = e
+		}
+	}
+	for _, v := range u.objects {
+		m[v.ref.num] = xrefEntry{typ: xrefUsed, offset: u.offsets[v.ref.num], gen: v.ref.gen}
+	}
+	nums := make([]int, 0, len(m))
+	for num := range m {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	return nums, m
+}
+
+// subsections splits sorted object numbers into runs of consecutive
+// numbers.
+func subsections(nums []int) [][]int {
+	l := make([][]int, 0)
+	for i := 0; i < len(nums); {
+		j := i + 1
+		for j < len(nums) && nums[j] == nums[j-1]+1 {
+			j++
+		}
+		l = append(l, nums[i:j])
+		i = j
+	}
+	return l
+}
+
+func (u *update) writeTable(buf *bytes.Buffer) {
+	nums, entries := u.entries()
+	buf.WriteString("xref\n")
+	for _, sub := range subsections(nums) {
+		fmt.Fprintf(buf, "%d %d\n", sub[0], len(sub))
+		for _, num := range sub {
+			e := entries[num]
+			typ := 'n'
+			if e.typ == xrefFree {
+				typ = 'f'
+			}
+			fmt.Fprintf(buf, "%010d %05d %c\r\n", e.offset, e.gen, typ)
+		}
+	}
+	buf.WriteString("trailer\n")
+	writeObject(buf, u.trailer)
+	buf.WriteByte('\n')
+}
+
+func (u *update) writeStream(buf *bytes.Buffer, offset int64) {
+	self := u.alloc()
+	u.trailer["Size"] = int64(u.next)
+	u.offsets[self.num] = offset
+	u.objects = append(u.objects, indirect{ref: self})
+	nums, entries := u.entries()
+	width := 4
+	if offset > 0xFFFFFFFF {
+		width = 8
+	}
+	var data bytes.Buffer
+	index := make(array, 0)
+	for _, sub := range subsections(nums) {
+		index = append(index, int64(sub[0]), int64(len(sub)))
+		for _, num := range sub {
+			e := entries[num]
+			data.WriteByte(byte(e.typ))
+			for i := width - 1; i >= 0; i-- {
+				data.WriteByte(byte(e.offset >> (8 * uint(i))))
+			}
+			data.WriteByte(byte(e.gen >> 8))
+			data.WriteByte(byte(e.gen))
+		}
+	}
+	d := dict{
+		"Type":  name("XRef"),
+		"W":     array{int64(1), int64(width), int64(2)},
+		"Index": index,
+	}
+	for k, v := range u.trailer {
+		d[k] = v
+	}
+	writeIndirect(buf, self, &stream{dict: d, data: data.Bytes()})
+}
@@ -0,0 +1,546 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const (
+	xrefFree       = 0
+	xrefUsed       = 1
+	xrefCompressed = 2
+
+	// sanity limits
+	maxStreamSize = 1 << 30
+	maxDecodeSize = 64 << 20 // limit for inflated stream data
+	maxResolve    = 32
+	tailSize      = 1024
+)
+
+var (
+	versionRegexp   = regexp.MustCompile(`^%PDF-(\d\.\d)`)
+	startxrefRegexp = regexp.MustCompile(`^startxref\s+(\d+)`)
+	objRegexp       = regexp.MustCompile(`(?:^|\s)(\d+)\s+(\d+)\s+obj\b`)
+)
+
+type xrefEntry struct {
+	typ    int
+	offset int64 // file offset or object stream number
+	gen    int   // generation or index inside object stream
+}
+
+// file is a parsed PDF file with its merged cross-reference table.
+type file struct {
+	r          io.ReaderAt
+	size       int64
+	version    string
+	xref       map[int]xrefEntry
+	trailer    dict
+	startxref  int64
+	xrefStream bool
+	rebuilt    bool
+	objstm     map[int]map[int]int64 // objstm -> object -> offset
+	objstmData map[int][]byte
+	active     map[int]bool // objects being resolved
+}
+
+type readerAt struct {
+	r io.ReadSeeker
+}
+
+func (r readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := r.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r.r, p)
+}
+
+func parse(r io.ReadSeeker) (*file, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		ra = readerAt{r}
+	}
+	f := &file{
+		r:          ra,
+		size:       size,
+		xref:       make(map[int]xrefEntry),
+		objstm:     make(map[int]map[int]int64),
+		objstmData: make(map[int][]byte),
+		active:     make(map[int]bool),
+	}
+	head := make([]byte, 1024)
+	n, _ := ra.ReadAt(head, 0)
+	i := bytes.Index(head[:n], []byte("%PDF-"))
+	if i < 0 {
+		return nil, ErrInvalid
+	}
+	if m := versionRegexp.FindSubmatch(head[i:n]); m != nil {
+		f.version = string(m[1])
+	}
+	if err := f.loadXref(); err != nil {
+		xmp.Log.Debugf("pdf: %v, reconstructing cross-reference table", err)
+		if err := f.reconstruct(); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := f.trailer["Root"].(ref); !ok {
+		return nil, fmt.Errorf("pdf: missing document catalog")
+	}
+	return f, nil
+}
+
+func (f *file) lexerAt(off int64) *lexer {
+	return newLexer(io.NewSectionReader(f.r, off, f.size-off), off)
+}
+
+// loadXref reads all cross-reference sections starting at the last
+// startxref position. Entries of newer sections take precedence.
+func (f *file) loadXref() error {
+	tail := tailSize
+	if int64(tail) > f.size {
+		tail = int(f.size)
+	}
+	buf := make([]byte, tail)
+	if _, err := f.r.ReadAt(buf, f.size-int64(tail)); err != nil && err != io.EOF {
+		return err
+	}
+	i := bytes.LastIndex(buf, []byte("startxref"))
+	if i < 0 {
+		return fmt.Errorf("missing startxref")
+	}
+	m := startxrefRegexp.FindSubmatch(buf[i:])
+	if m == nil {
+		return fmt.Errorf("invalid startxref")
+	}
+	f.startxref, _ = strconv.ParseInt(string(m[1]), 10, 64)
+	seen := make(map[int64]bool)
+	for off := f.startxref; off > 0 || len(seen) == 0; {
+		if seen[off] || off >= f.size {
+			return fmt.Errorf("invalid xref offset %d", off)
+		}
+		seen[off] = true
+		trailer, err := f.loadSection(off, len(seen) == 1)
+		if err != nil {
+			return err
+		}
+		if f.trailer == nil {
+			f.trailer = trailer
+		}
+		// hybrid files store additional entries in a cross-reference stream
+		if stm, ok := toInt(trailer["XRefStm"]); ok && !seen[stm] {
+			seen[stm] = true
+			if _, err := f.loadSection(stm, false); err != nil {
+				return err
+			}
+		}
+		prev, ok := toInt(trailer["Prev"])
+		if !ok {
+			break
+		}
+		off = prev
+	}
+	return nil
+}
+
+func (f *file) addEntry(num int, e xrefEntry) {
+	if _, ok := f.xref[num]; !ok {
+		f.xref[num] = e
+	}
+}
+
+func (f *file) loadSection(off int64, first bool) (dict, error) {
+	l := f.lexerAt(off)
+	t, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind == tokKeyword && t.s == "xref" {
+		return f.loadTable(l)
+	}
+	l.unread(t)
+	_, _, o, err := f.readIndirect(l)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := o.(*stream)
+	if !ok || s.dict.name("Type") != "XRef" {
+		return nil, fmt.Errorf("no cross-reference section at offset %d", off)
+	}
+	if first {
+		f.xrefStream = true
+	}
+	return s.dict, f.loadStream(s)
+}
+
+func (f *file) loadTable(l *lexer) (dict, error) {
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == tokKeyword && t.s == "trailer" {
+			break
+		}
+		t2, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		start, err1 := strconv.Atoi(t.s)
+		count, err2 := strconv.Atoi(t2.s)
+		if err1 != nil || err2 != nil || count < 0 {
+			return nil, fmt.Errorf("invalid xref subsection at offset %d", t.pos)
+		}
+		for i := 0; i < count; i++ {
+			var tok [3]token
+			for j := range tok {
+				if tok[j], err = l.next(); err != nil {
+					return nil, err
+				}
+			}
+			offset, err1 := strconv.ParseInt(tok[0].s, 10, 64)
+			gen, err2 := strconv.Atoi(tok[1].s)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("invalid xref entry at offset %d", tok[0].pos)
+			}
+			e := xrefEntry{typ: xrefFree, offset: offset, gen: gen}
+			if tok[2].s == "n" {
+				e.typ = xrefUsed
+			}
+			f.addEntry(start+i, e)
+		}
+	}
+	o, err := l.object()
+	if err != nil {
+		return nil, err
+	}
+	d, ok := o.(dict)
+	if !ok {
+		return nil, fmt.Errorf("invalid trailer")
+	}
+	return d, nil
+}
+
+func (f *file) loadStream(s *stream) error {
+	data, err := s.decode()
+	if err != nil {
+		return err
+	}
+	w, _ := s.dict["W"].(array)
+	if len(w) != 3 {
+		return fmt.Errorf("invalid cross-reference stream widths")
+	}
+	var widths [3]int
+	rowLen := 0
+	for i, v := range w {
+		n, ok := toInt(v)
+		if !ok || n < 0 || n > 8 {
+			return fmt.Errorf("invalid cross-reference stream widths")
+		}
+		widths[i] = int(n)
+		rowLen += int(n)
+	}
+	if rowLen == 0 {
+		return fmt.Errorf("invalid cross-reference stream widths")
+	}
+	index, _ := s.dict["Index"].(array)
+	if index == nil {
+		size, _ := toInt(s.dict["Size"])
+		index = array{int64(0), size}
+	}
+	field := func(b []byte, def int64) int64 {
+		if len(b) == 0 {
+			return def
+		}
+		var v int64
+		for _, c := range b {
+			v = v<<8 | int64(c)
+		}
+		return v
+	}
+	for i := 0; i+1 < len(index); i += 2 {
+		start, _ := toInt(index[i])
+		count, _ := toInt(index[i+1])
+		for j := int64(0); j < count; j++ {
+			if len(data) < rowLen {
+				return fmt.Errorf("short cross-reference stream")
+			}
+			row := data[:rowLen]
+			data = data[rowLen:]
+			typ := field(row[:widths[0]], 1)
+			e := xrefEntry{
+				typ:    int(typ),
+				offset: field(row[widths[0]:widths[0]+widths[1]], 0),
+				gen:    int(field(row[widths[0]+widths[1]:], 0)),
+			}
+			if typ > xrefCompressed {
+				continue
+			}
+			f.addEntry(int(start+j), e)
+		}
+	}
+	return nil
+}
+
+// reconstruct rebuilds the cross-reference table by scanning the file for
+// object headers. It is used when the table is damaged or offsets are
+// wrong.
+func (f *file) reconstruct() error {
+	if f.size > maxStreamSize {
+		return ErrInvalid
+	}
+	buf := make([]byte, f.size)
+	if _, err := f.r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	f.xref = make(map[int]xrefEntry)
+	f.trailer = nil
+	f.startxref = 0
+	f.xrefStream = false
+	f.rebuilt = true
+	for _, m := range objRegexp.FindAllSubmatchIndex(buf, -1) {
+		num, _ := strconv.Atoi(string(buf[m[2]:m[3]]))
+		gen, _ := strconv.Atoi(string(buf[m[4]:m[5]]))
+		// later definitions replace earlier ones
+		f.xref[num] = xrefEntry{typ: xrefUsed, offset: int64(m[2]), gen: gen}
+	}
+	if i := bytes.LastIndex(buf, []byte("trailer")); i >= 0 {
+		l := newLexer(bytes.NewReader(buf[i+7:]), int64(i+7))
+		if o, err := l.object(); err == nil {
+			f.trailer, _ = o.(dict)
+		}
+	}
+	if f.trailer == nil {
+		// use the newest cross-reference stream dictionary
+		var last int64 = -1
+		for num, e := range f.xref {
+			o, err := f.resolve(ref{num, e.gen})
+			if s, ok := o.(*stream); err == nil && ok && s.dict.name("Type") == "XRef" {
+				if _, ok := s.dict["Root"]; ok && e.offset > last {
+					f.trailer, last = s.dict, e.offset
+				}
+			}
+		}
+	}
+	if f.trailer == nil {
+		return ErrInvalid
+	}
+	delete(f.trailer, "Prev")
+	delete(f.trailer, "XRefStm")
+	return nil
+}
+
+// readIndirect parses an indirect object definition including stream data.
+func (f *file) readIndirect(l *lexer) (int, int, object, error) {
+	var tok [3]token
+	for i := range tok {
+		var err error
+		if tok[i], err = l.next(); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	num, err1 := strconv.Atoi(tok[0].s)
+	gen, err2 := strconv.Atoi(tok[1].s)
+	if err1 != nil || err2 != nil || tok[2].s != "obj" {
+		return 0, 0, nil, fmt.Errorf("pdf: missing object header at offset %d", tok[0].pos)
+	}
+	o, err := l.object()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	t, err := l.next()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	d, ok := o.(dict)
+	if !ok || t.kind != tokKeyword || t.s != "stream" {
+		return num, gen, o, nil
+	}
+	// stream keyword must be followed by CRLF or LF
+	if c, err := l.readByte(); err == nil && c == '\r' {
+		if c, err = l.readByte(); err == nil && c != '\n' {
+			l.unreadByte()
+		}
+	} else if err == nil && c != '\n' {
+		l.unreadByte()
+	}
+	s := &stream{dict: d, offset: l.pos}
+	if s.data, err = f.readStreamData(s); err != nil {
+		return 0, 0, nil, err
+	}
+	return num, gen, s, nil
+}
+
+func (f *file) readStreamData(s *stream) ([]byte, error) {
+	length := int64(-1)
+	if n, ok := toInt(s.dict["Length"]); ok {
+		length = n
+	} else if r, ok := s.dict["Length"].(ref); ok {
+		if o, err := f.resolve(r); err == nil {
+			if n, ok := toInt(o); ok {
+				length = n
+			}
+		}
+	}
+	if length >= 0 && s.offset+length <= f.size {
+		l := f.lexerAt(s.offset + length)
+		if t, _ := l.next(); t.kind == tokKeyword && t.s == "endstream" {
+			return f.read(s.offset, length)
+		}
+	}
+	// find the end of stream when /Length is missing or wrong
+	end, err := f.find(s.offset, []byte("endstream"))
+	if err != nil {
+		return nil, fmt.Errorf("pdf: unterminated stream at offset %d", s.offset)
+	}
+	b, err := f.read(s.offset, end-s.offset)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		b = b[:len(b)-2]
+	} else if bytes.HasSuffix(b, []byte("\n")) || bytes.HasSuffix(b, []byte("\r")) {
+		b = b[:len(b)-1]
+	}
+	return b, nil
+}
+
+func (f *file) read(off, n int64) ([]byte, error) {
+	if n > maxStreamSize {
+		return nil, fmt.Errorf("pdf: stream too large")
+	}
+	b := make([]byte, n)
+	if _, err := f.r.ReadAt(b, off); err != nil && !(err == io.EOF && off+n <= f.size) {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (f *file) find(off int64, pattern []byte) (int64, error) {
+	buf := make([]byte, 4096+len(pattern))
+	for off < f.size {
+		n, err := f.r.ReadAt(buf, off)
+		if i := bytes.Index(buf[:n], pattern); i >= 0 {
+			return off + int64(i), nil
+		}
+		if err != nil {
+			break
+		}
+		off += int64(n - len(pattern))
+	}
+	return 0, io.EOF
+}
+
+// resolve returns the object a reference points to. Other objects are
+// returned as is. Missing objects resolve to nil.
+func (f *file) resolve(o object) (object, error) {
+	for i := 0; i < maxResolve; i++ {
+		r, ok := o.(ref)
+		if !ok {
+			return o, nil
+		}
+		e, ok := f.xref[r.num]
+		if !ok {
+			return nil, nil
+		}
+		// a stream /Length may refer to its own object
+		if f.active[r.num] {
+			return nil, fmt.Errorf("pdf: cyclic reference to object %d", r.num)
+		}
+		f.active[r.num] = true
+		var err error
+		switch e.typ {
+		case xrefUsed:
+			var num int
+			num, _, o, err = f.readIndirect(f.lexerAt(e.offset))
+			if err == nil && num != r.num {
+				err = fmt.Errorf("pdf: object %d not found at offset %d", r.num, e.offset)
+			}
+		case xrefCompressed:
+			o, err = f.compressed(int(e.offset), r.num)
+		default:
+			delete(f.active, r.num)
+			return nil, nil
+		}
+		delete(f.active, r.num)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("pdf: reference chain too long")
+}
+
+// compressed loads object num from object stream stm.
+func (f *file) compressed(stm, num int) (object, error) {
+	offsets, ok := f.objstm[stm]
+	if !ok {
+		e := f.xref[stm]
+		if e.typ != xrefUsed || f.active[stm] {
+			return nil, fmt.Errorf("pdf: missing object stream %d", stm)
+		}
+		f.active[stm] = true
+		_, _, o, err := f.readIndirect(f.lexerAt(e.offset))
+		delete(f.active, stm)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := o.(*stream)
+		if !ok {
+			return nil, fmt.Errorf("pdf: invalid object stream %d", stm)
+		}
+		data, err := s.decode()
+		if err != nil {
+			return nil, err
+		}
+		n, _ := toInt(s.dict["N"])
+		first, _ := toInt(s.dict["First"])
+		if first < 0 || first > int64(len(data)) {
+			return nil, fmt.Errorf("pdf: invalid object stream %d", stm)
+		}
+		l := newLexer(bytes.NewReader(data[:first]), 0)
+		offsets = make(map[int]int64)
+		for i := int64(0); i < n; i++ {
+			a, _ := l.object()
+			b, _ := l.object()
+			objnum, ok1 := toInt(a)
+			off, ok2 := toInt(b)
+			if !ok1 || !ok2 {
+				break
+			}
+			if off < 0 || first+off > int64(len(data)) {
+				return nil, fmt.Errorf("pdf: invalid object stream %d", stm)
+			}
+			offsets[int(objnum)] = first + off
+		}
+		f.objstm[stm] = offsets
+		f.objstmData[stm] = data
+	}
+	off, ok := offsets[num]
+	data := f.objstmData[stm]
+	if !ok || off > int64(len(data)) {
+		return nil, fmt.Errorf("pdf: object %d not found in object stream %d", num, stm)
+	}
+	return newLexer(bytes.NewReader(data[off:]), off).object()
+}
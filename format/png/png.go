@@ -0,0 +1,309 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package png reads and writes XMP packets stored in PNG iTXt chunks with
+// keyword XML:com.adobe.xmp as defined by XMP Specification Part 3.
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const (
+	keyword = "XML:com.adobe.xmp"
+
+	// sanity limit for chunks we keep in memory
+	maxChunkSize = 1 << 30
+
+	// limit for inflated XMP packets in compressed iTXt chunks
+	maxPacketSize = 64 << 20
+)
+
+var (
+	signature = []byte("\x89PNG\r\n\x1a\n")
+
+	ErrNoXMP    = errors.New("png: no XMP packet found")
+	ErrInvalid  = errors.New("png: invalid file format")
+	ErrChecksum = errors.New("png: chunk CRC mismatch")
+)
+
+type chunkHeader struct {
+	size uint32
+	typ  string
+}
+
+func readHeader(r io.Reader) (chunkHeader, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return chunkHeader{}, err
+	}
+	return chunkHeader{
+		size: binary.BigEndian.Uint32(b[:4]),
+		typ:  string(b[4:]),
+	}, nil
+}
+
+// readChunk reads chunk data and CRC following the chunk header. The
+// buffer grows with the data actually read, so a corrupt chunk length
+// cannot allocate more memory than the input holds.
+func readChunk(r io.Reader, h chunkHeader) ([]byte, error) {
+	if h.size > maxChunkSize {
+		return nil, fmt.Errorf("png: %s chunk too large", h.typ)
+	}
+	var buf bytes.Buffer
+	if n, err := io.CopyN(&buf, r, int64(h.size)+4); err != nil {
+		if err == io.EOF && n < int64(h.size)+4 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	b := buf.Bytes()
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(h.typ))
+	crc.Write(b[:h.size])
+	if crc.Sum32() != binary.BigEndian.Uint32(b[h.size:]) {
+		return nil, ErrChecksum
+	}
+	return b[:h.size], nil
+}
+
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(len(data)))
+	copy(b[4:], typ)
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(b[4:])
+	crc.Write(data)
+	binary.BigEndian.PutUint32(b[:4], crc.Sum32())
+	_, err := w.Write(b[:4])
+	return err
+}
+
+func readSignature(r io.Reader) error {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil || !bytes.Equal(b[:], signature) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// parseXMP returns the packet and compression flag when data is an iTXt
+// chunk carrying XMP.
+func parseXMP(data []byte) ([]byte, bool, error) {
+	// keyword, compression flag and method, language tag, translated keyword
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || string(data[:i]) != keyword {
+		return nil, false, nil
+	}
+	data = data[i+1:]
+	if len(data) < 2 {
+		return nil, false, fmt.Errorf("png: short iTXt chunk")
+	}
+	compressed := data[0] == 1
+	if compressed && data[1] != 0 {
+		return nil, false, fmt.Errorf("png: unsupported iTXt compression method %d", data[1])
+	}
+	data = data[2:]
+	for n := 0; n < 2; n++ {
+		if i = bytes.IndexByte(data, 0); i < 0 {
+			return nil, false, fmt.Errorf("png: malformed iTXt chunk")
+		}
+		data = data[i+1:]
+	}
+	if !compressed {
+		return data, false, nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("png: %v", err)
+	}
+	defer zr.Close()
+	b, err := io.ReadAll(io.LimitReader(zr, maxPacketSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("png: %v", err)
+	}
+	if len(b) > maxPacketSize {
+		return nil, false, fmt.Errorf("png: inflated XMP packet exceeds %d bytes", maxPacketSize)
+	}
+	return b, true, nil
+}
+
+func makeXMP(packet []byte, compress bool) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(keyword)
+	b.WriteByte(0)
+	if compress {
+		b.Write([]byte{1, 0, 0, 0})
+		zw := zlib.NewWriter(&b)
+		if _, err := zw.Write(packet); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	} else {
+		b.Write([]byte{0, 0, 0, 0})
+		b.Write(packet)
+	}
+	return b.Bytes(), nil
+}
+
+// ReadPacket returns the XMP packet stored in the first iTXt chunk with
+// keyword XML:com.adobe.xmp. Compressed chunks are inflated.
+func ReadPacket(r io.Reader) ([]byte, error) {
+	if err := readSignature(r); err != nil {
+		return nil, err
+	}
+	for {
+		h, err := readHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		switch h.typ {
+		case "iTXt":
+			data, err := readChunk(r, h)
+			if err != nil {
+				return nil, err
+			}
+			packet, _, err := parseXMP(data)
+			if err != nil {
+				return nil, err
+			}
+			if packet != nil {
+				return packet, nil
+			}
+		case "IEND":
+			return nil, ErrNoXMP
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(h.size)+4); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Read decodes the XMP packet stored in a PNG file.
+func Read(r io.Reader) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the PNG file from r to w and stores packet in an iTXt
+// chunk. An existing XMP chunk located before the image data is replaced in
+// place and keeps its compression flag, otherwise an uncompressed chunk is
+// inserted before the first IDAT chunk. All other chunks are copied as is.
+func WritePacket(w io.Writer, r io.Reader, packet []byte) error {
+	if err := readSignature(r); err != nil {
+		return err
+	}
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+	var done bool
+	for {
+		h, err := readHeader(r)
+		if err != nil {
+			return err
+		}
+		switch h.typ {
+		case "iTXt":
+			data, err := readChunk(r, h)
+			if err != nil {
+				return err
+			}
+			old, compressed, err := parseXMP(data)
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				if err := writeChunk(w, h.typ, data); err != nil {
+					return err
+				}
+				break
+			}
+			if done {
+				break
+			}
+			if err := writeXMP(w, packet, compressed); err != nil {
+				return err
+			}
+			done = true
+
+		case "IDAT", "IEND":
+			if !done {
+				if err := writeXMP(w, packet, false); err != nil {
+					return err
+				}
+				done = true
+			}
+			fallthrough
+
+		default:
+			var b [8]byte
+			binary.BigEndian.PutUint32(b[:4], h.size)
+			copy(b[4:], h.typ)
+			if _, err := w.Write(b[:]); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, int64(h.size)+4); err != nil {
+				return err
+			}
+		}
+		if h.typ == "IEND" {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+func writeXMP(w io.Writer, packet []byte, compress bool) error {
+	data, err := makeXMP(packet, compress)
+	if err != nil {
+		return err
+	}
+	return writeChunk(w, "iTXt", data)
+}
+
+// Write copies the PNG file from r to w and stores d as its XMP packet.
+func Write(w io.Writer, r io.Reader, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
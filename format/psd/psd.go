@@ -0,0 +1,330 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package psd reads and writes metadata in the image resource section of
+// Photoshop PSD and PSB files.
+//
+// XMP is stored in image resource 1060 and IPTC-IIM records in resource
+// 1028. Photoshop detects IPTC changes made by other applications by
+// comparing the MD5 digest of the IIM records with photoshop:LegacyIPTCDigest
+// in XMP and with image resource 1061. Writers in this package keep all
+// three in sync. All other sections of the file are copied unchanged.
+package psd
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mholt/go-xmp/models/ps"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const (
+	headerSize = 26
+
+	// sanity limit for image resource sections
+	maxResourceSize = 1 << 30
+)
+
+var (
+	ErrNoXMP   = errors.New("psd: no XMP packet found")
+	ErrInvalid = errors.New("psd: invalid file format")
+)
+
+// file describes the layout of a PSD file up to the image resource section.
+type file struct {
+	version   int   // 1 PSD, 2 PSB
+	resOffset int64 // offset of the image resource section length field
+	resSize   int64
+	resources []*Resource
+}
+
+func parse(r io.ReadSeeker) (*file, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var hdr [headerSize + 4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil || string(hdr[:4]) != "8BPS" {
+		return nil, ErrInvalid
+	}
+	f := &file{version: int(binary.BigEndian.Uint16(hdr[4:]))}
+	if f.version != 1 && f.version != 2 {
+		return nil, fmt.Errorf("psd: unsupported version %d", f.version)
+	}
+	// skip color mode data
+	colorSize := int64(binary.BigEndian.Uint32(hdr[headerSize:]))
+	f.resOffset = headerSize + 4 + colorSize
+	if _, err := r.Seek(f.resOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, ErrInvalid
+	}
+	f.resSize = int64(binary.BigEndian.Uint32(size[:]))
+	if f.resSize > maxResourceSize {
+		return nil, fmt.Errorf("psd: image resource section too large")
+	}
+	// the section must fit into the remaining file
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if f.resSize > end-f.resOffset-4 {
+		return nil, ErrInvalid
+	}
+	if _, err := r.Seek(f.resOffset+4, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, f.resSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, ErrInvalid
+	}
+	if f.resources, err = ParseResources(buf); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ReadResources returns all image resources of a PSD or PSB file.
+func ReadResources(r io.ReadSeeker) ([]*Resource, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.resources, nil
+}
+
+// ReadPacket returns the XMP packet stored in image resource 1060.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	res := FindResource(f.resources, ResourceXMP)
+	if res == nil {
+		return nil, ErrNoXMP
+	}
+	return res.Data, nil
+}
+
+// Read decodes the XMP packet stored in image resource 1060.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and stores packet in image
+// resource 1060. When the file contains IPTC-IIM records, the legacy IPTC
+// digest in packet is updated to match them.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	return WriteMetadata(w, r, &Metadata{XMP: packet})
+}
+
+// Write copies the file from r to w and stores d in image resource 1060.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
+
+// Metadata holds the XMP packet and the IPTC-IIM records of a file. Fields
+// are nil when the file lacks the respective resource.
+type Metadata struct {
+	XMP  []byte
+	IPTC []byte
+
+	// IPTCDigest is the MD5 digest stored in image resource 1061.
+	IPTCDigest []byte
+}
+
+// ReadMetadata reads image resources 1060, 1028 and 1061.
+func ReadMetadata(r io.ReadSeeker) (*Metadata, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if res := FindResource(f.resources, ResourceXMP); res != nil {
+		m.XMP = res.Data
+	}
+	if res := FindResource(f.resources, ResourceIPTC); res != nil {
+		m.IPTC = res.Data
+	}
+	if res := FindResource(f.resources, ResourceIPTCDigest); res != nil {
+		m.IPTCDigest = res.Data
+	}
+	return m, nil
+}
+
+// Digest returns the MD5 digest of b in the upper case hex format used by
+// photoshop:LegacyIPTCDigest.
+func Digest(b []byte) string {
+	sum := md5.Sum(b)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// DigestStatus is the result of a digest comparison.
+type DigestStatus int
+
+const (
+	DigestMissing  DigestStatus = iota // digest or data not present
+	DigestMatch                        // digest matches the data
+	DigestMismatch                     // data changed after the digest was computed
+)
+
+func (x DigestStatus) String() string {
+	switch x {
+	case DigestMatch:
+		return "match"
+	case DigestMismatch:
+		return "mismatch"
+	default:
+		return "missing"
+	}
+}
+
+func compareDigest(digest string, data []byte) DigestStatus {
+	if digest == "" || strings.Trim(digest, "0") == "" || data == nil {
+		return DigestMissing
+	}
+	if strings.EqualFold(digest, Digest(data)) {
+		return DigestMatch
+	}
+	return DigestMismatch
+}
+
+// Digests reports the state of all metadata digests.
+type Digests struct {
+	XMP          DigestStatus // photoshop:EmbeddedXMPDigest versus resource 1060
+	IPTC         DigestStatus // photoshop:LegacyIPTCDigest versus resource 1028
+	IPTCResource DigestStatus // resource 1061 versus resource 1028
+}
+
+// Verify compares the digests stored in info and in image resource 1061
+// with the current contents of the XMP and IPTC resources. Info is usually
+// decoded from the XMP packet itself, in which case the embedded XMP digest
+// cannot be verified and is reported as missing. Pass info from a sidecar
+// file or an earlier copy to detect changes of the embedded packet.
+func (m *Metadata) Verify(info *ps.PhotoshopInfo) Digests {
+	var x Digests
+	if info != nil {
+		x.XMP = compareDigest(info.EmbeddedXMPDigest, m.XMP)
+		x.IPTC = compareDigest(info.LegacyIPTCDigest, m.IPTC)
+	}
+	if m.IPTCDigest != nil {
+		x.IPTCResource = compareDigest(hex.EncodeToString(m.IPTCDigest), m.IPTC)
+	}
+	return x
+}
+
+// syncPacket sets photoshop:LegacyIPTCDigest in packet to digest. The
+// embedded XMP digest is removed because a packet cannot contain its own
+// digest. The packet is returned unchanged when nothing needs updating.
+//
+// The photoshop model omits both digests on marshal, so the IPTC digest
+// is written as an attribute of the photoshop node instead.
+func syncPacket(packet []byte, digest string) ([]byte, error) {
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	info, err := ps.MakeModel(d)
+	if err != nil {
+		return nil, err
+	}
+	if info.LegacyIPTCDigest == digest && info.EmbeddedXMPDigest == "" {
+		return packet, nil
+	}
+	info.LegacyIPTCDigest = digest
+	info.EmbeddedXMPDigest = ""
+	if n := d.FindNode(ps.NsPhotoshop); n != nil {
+		n.AddStringAttr("photoshop:LegacyIPTCDigest", digest)
+	}
+	return xmp.Marshal(d)
+}
+
+// WriteMetadata copies the file from r to w and replaces the image
+// resources for all non-nil fields of m. Resource 1061 and the legacy IPTC
+// digest in XMP are updated from the resulting IPTC-IIM records, so m
+// should not set IPTCDigest.
+func WriteMetadata(w io.Writer, r io.ReadSeeker, m *Metadata) error {
+	f, err := parse(r)
+	if err != nil {
+		return err
+	}
+	l := f.resources
+	if m.IPTC != nil {
+		l = setResource(l, ResourceIPTC, m.IPTC)
+	}
+	packet := m.XMP
+	if res := FindResource(l, ResourceIPTC); res != nil {
+		digest := Digest(res.Data)
+		sum, _ := hex.DecodeString(digest)
+		l = setResource(l, ResourceIPTCDigest, sum)
+		if packet == nil {
+			if old := FindResource(l, ResourceXMP); old != nil {
+				packet = old.Data
+			}
+		}
+		if packet != nil {
+			if packet, err = syncPacket(packet, digest); err != nil {
+				return err
+			}
+		}
+	}
+	if packet != nil {
+		l = setResource(l, ResourceXMP, packet)
+	}
+	return f.write(w, r, EncodeResources(l))
+}
+
+func (f *file) write(w io.Writer, r io.ReadSeeker, section []byte) error {
+	if int64(len(section)) > 0xFFFFFFFF {
+		return fmt.Errorf("psd: image resource section too large")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, r, f.resOffset); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(section)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(section); err != nil {
+		return err
+	}
+	if _, err := r.Seek(f.resOffset+4+f.resSize, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, r)
+	return err
+}
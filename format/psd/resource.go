@@ -0,0 +1,144 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package psd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Image resource IDs
+const (
+	ResourceIPTC       = 1028 // IPTC-IIM records
+	ResourceXMP        = 1060 // XMP packet
+	ResourceIPTCDigest = 1061 // MD5 digest of the IPTC-IIM records
+)
+
+const sig8BIM = "8BIM"
+
+// Resource is a single image resource block.
+type Resource struct {
+	Signature string // usually 8BIM
+	ID        uint16
+	Name      string
+	Data      []byte
+}
+
+func validSignature(s string) bool {
+	switch s {
+	case sig8BIM, "MeSa", "AgHg", "PHUT", "DCSR":
+		return true
+	}
+	return false
+}
+
+// ParseResources splits an image resource section into its resource
+// blocks. The same layout is used in PSD files, JPEG APP13 segments and
+// TIFF tag 34377.
+func ParseResources(b []byte) ([]*Resource, error) {
+	l := make([]*Resource, 0)
+	for len(b) > 0 {
+		if len(b) < 12 || !validSignature(string(b[:4])) {
+			return nil, fmt.Errorf("psd: invalid image resource block")
+		}
+		res := &Resource{
+			Signature: string(b[:4]),
+			ID:        binary.BigEndian.Uint16(b[4:]),
+		}
+		// name is a Pascal string padded to even size
+		n := int(b[6])
+		nameSize := (n + 2) &^ 1
+		if 6+nameSize+4 > len(b) {
+			return nil, fmt.Errorf("psd: short image resource %d", res.ID)
+		}
+		res.Name = string(b[7 : 7+n])
+		b = b[6+nameSize:]
+		size := int(binary.BigEndian.Uint32(b))
+		if size > len(b)-4 {
+			return nil, fmt.Errorf("psd: image resource %d exceeds section size", res.ID)
+		}
+		res.Data = b[4 : 4+size]
+		b = b[4+size:]
+		if size&1 == 1 && len(b) > 0 {
+			b = b[1:]
+		}
+		l = append(l, res)
+	}
+	return l, nil
+}
+
+// EncodeResources serializes resource blocks into an image resource
+// section.
+func EncodeResources(l []*Resource) []byte {
+	var buf bytes.Buffer
+	for _, res := range l {
+		sig := res.Signature
+		if sig == "" {
+			sig = sig8BIM
+		}
+		name := res.Name
+		if len(name) > 255 {
+			name = name[:255]
+		}
+		buf.WriteString(sig)
+		var hdr [4]byte
+		binary.BigEndian.PutUint16(hdr[:], res.ID)
+		buf.Write(hdr[:2])
+		buf.WriteByte(byte(len(name)))
+		buf.WriteString(name)
+		if len(name)&1 == 0 {
+			buf.WriteByte(0)
+		}
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(res.Data)))
+		buf.Write(hdr[:])
+		buf.Write(res.Data)
+		if len(res.Data)&1 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes()
+}
+
+// FindResource returns the first 8BIM resource with the given ID.
+func FindResource(l []*Resource, id uint16) *Resource {
+	for _, res := range l {
+		if res.ID == id && res.Signature == sig8BIM {
+			return res
+		}
+	}
+	return nil
+}
+
+// setResource replaces the data of the first 8BIM resource with the given
+// ID or appends a new resource. A nil value removes the resource.
+func setResource(l []*Resource, id uint16, data []byte) []*Resource {
+	out := l[:0]
+	found := false
+	for _, res := range l {
+		if res.ID == id && res.Signature == sig8BIM {
+			if found || data == nil {
+				continue
+			}
+			res.Data = data
+			found = true
+		}
+		out = append(out, res)
+	}
+	if !found && data != nil {
+		out = append(out, &Resource{Signature: sig8BIM, ID: id, Data: data})
+	}
+	return out
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package riff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/go-xmp/models/bext"
+	"github.com/mholt/go-xmp/models/ixml"
+	riffinfo "github.com/mholt/go-xmp/models/riff"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// INFO list entries are NUL-terminated strings in sub-chunks named after
+// their FourCC tag.
+type infoEntry struct {
+	id   string
+	data []byte
+}
+
+func parseInfo(b []byte) ([]infoEntry, error) {
+	l := make([]infoEntry, 0)
+	for len(b) >= 8 {
+		id := string(b[:4])
+		size := int(binary.LittleEndian.Uint32(b[4:]))
+		if size > len(b)-8 {
+			return nil, fmt.Errorf("riff: malformed INFO list entry '%s'", id)
+		}
+		l = append(l, infoEntry{id, b[8 : 8+size]})
+		b = b[8+size:]
+		if size&1 == 1 && len(b) > 0 {
+			b = b[1:]
+		}
+	}
+	return l, nil
+}
+
+func decodeInfo(b []byte) (*riffinfo.RiffInfo, error) {
+	l, err := parseInfo(b)
+	if err != nil {
+		return nil, err
+	}
+	m := &riffinfo.RiffInfo{}
+	for _, v := range l {
+		value := strings.TrimSpace(string(bytes.TrimRight(v.data, "\x00")))
+		if value == "" {
+			continue
+		}
+		if err := xmp.SetNativeField(m, v.id, value); err != nil {
+			xmp.Log.Debugf("riff: INFO entry '%s': %v", v.id, err)
+		}
+	}
+	return m, nil
+}
+
+// encodeInfo serializes m into a LIST/INFO payload. Entries of the
+// original list unknown to the model are kept. The result is nil when the
+// list would be empty.
+func encodeInfo(m *riffinfo.RiffInfo, orig []byte) ([]byte, error) {
+	tags, err := xmp.ListNativeFields(m)
+	if err != nil {
+		return nil, fmt.Errorf("riff: %v", err)
+	}
+	l := make([]infoEntry, 0, len(tags))
+	for _, v := range tags {
+		l = append(l, infoEntry{v.Key, append([]byte(v.Value), 0)})
+	}
+	if orig != nil {
+		old, err := parseInfo(orig)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range old {
+			if !m.CanTag(v.id) {
+				l = append(l, v)
+			}
+		}
+	}
+	if len(l) == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(listInfo)
+	for _, v := range l {
+		var hdr [8]byte
+		copy(hdr[:], v.id)
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(len(v.data)))
+		buf.Write(hdr[:])
+		buf.Write(v.data)
+		if len(v.data)&1 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Broadcast Wave extension chunk layout (EBU Tech 3285 v2)
+const (
+	bextDescription         = 0
+	bextOriginator          = 256
+	bextOriginatorReference = 288
+	bextOriginationDate     = 320
+	bextOriginationTime     = 330
+	bextTimeReference       = 338
+	bextVersion             = 346
+	bextUMID                = 348
+	bextLoudness            = 412
+	bextReserved            = 422
+	bextCodingHistory       = 602
+)
+
+func bextString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func decodeBext(b []byte) (*bext.BextInfo, error) {
+	if len(b) < bextCodingHistory {
+		return nil, fmt.Errorf("riff: short bext chunk")
+	}
+	le := binary.LittleEndian
+	m := &bext.BextInfo{
+		Description:          bextString(b[bextDescription:bextOriginator]),
+		Originator:           bextString(b[bextOriginator:bextOriginatorReference]),
+		OriginatorReference:  bextString(b[bextOriginatorReference:bextOriginationDate]),
+		OriginationDate:      bextString(b[bextOriginationDate:bextOriginationTime]),
+		OriginationTime:      bextString(b[bextOriginationTime:bextTimeReference]),
+		TimeReference:        le.Uint64(b[bextTimeReference:]),
+		Version:              int(le.Uint16(b[bextVersion:])),
+		LoudnessValue:        int(int16(le.Uint16(b[bextLoudness:]))),
+		LoudnessRange:        int(int16(le.Uint16(b[bextLoudness+2:]))),
+		MaxTruePeakLevel:     int(int16(le.Uint16(b[bextLoudness+4:]))),
+		MaxMomentaryLoudness: int(int16(le.Uint16(b[bextLoudness+6:]))),
+		MaxShortTermLoudness: int(int16(le.Uint16(b[bextLoudness+8:]))),
+		CodingHistory:        string(bytes.TrimRight(b[bextCodingHistory:], "\x00")),
+	}
+	umid := b[bextUMID:bextLoudness]
+	if bytes.Count(umid[32:], []byte{0}) == 32 {
+		umid = umid[:32]
+	}
+	if bytes.Count(umid, []byte{0}) < len(umid) {
+		m.UMID = strings.ToUpper(hex.EncodeToString(umid))
+	}
+	return m, nil
+}
+
+func putBextString(b []byte, name, value string) {
+	if len(value) > len(b) {
+		xmp.Log.Warnf("riff: truncating bext %s to %d bytes", name, len(b))
+	}
+	copy(b, value)
+}
+
+func encodeBext(m *bext.BextInfo) ([]byte, error) {
+	b := make([]byte, bextCodingHistory, bextCodingHistory+len(m.CodingHistory))
+	le := binary.LittleEndian
+	putBextString(b[bextDescription:bextOriginator], "Description", m.Description)
+	putBextString(b[bextOriginator:bextOriginatorReference], "Originator", m.Originator)
+	putBextString(b[bextOriginatorReference:bextOriginationDate], "OriginatorReference", m.OriginatorReference)
+	putBextString(b[bextOriginationDate:bextOriginationTime], "OriginationDate", m.OriginationDate)
+	putBextString(b[bextOriginationTime:bextTimeReference], "OriginationTime", m.OriginationTime)
+	le.PutUint64(b[bextTimeReference:], m.TimeReference)
+	le.PutUint16(b[bextVersion:], uint16(m.Version))
+	if m.UMID != "" {
+		umid, err := hex.DecodeString(m.UMID)
+		if err != nil || len(umid) > 64 {
+			return nil, fmt.Errorf("riff: invalid bext UMID %s", strconv.Quote(m.UMID))
+		}
+		copy(b[bextUMID:], umid)
+	}
+	for i, v := range []int{
+		m.LoudnessValue,
+		m.LoudnessRange,
+		m.MaxTruePeakLevel,
+		m.MaxMomentaryLoudness,
+		m.MaxShortTermLoudness,
+	} {
+		le.PutUint16(b[bextLoudness+2*i:], uint16(int16(v)))
+	}
+	return append(b, m.CodingHistory...), nil
+}
+
+func encodeIXML(m *ixml.IXML) ([]byte, error) {
+	b, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("riff: iXML: %v", err)
+	}
+	return append([]byte(xml.Header), b...), nil
+}
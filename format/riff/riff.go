@@ -0,0 +1,627 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package riff reads and writes metadata chunks in RIFF containers such as
+// WAV and AVI files, including RF64/BW64 files larger than 4 GB.
+//
+// Supported chunks are _PMX (XMP), LIST/INFO (riffinfo), bext (Broadcast
+// Wave extension) and iXML. All other chunks are copied unchanged. WAV files
+// are rewritten in chunk order, while AVI files keep the position of media
+// chunks because OpenDML indexes use absolute file offsets.
+package riff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mholt/go-xmp/models/bext"
+	"github.com/mholt/go-xmp/models/ixml"
+	riffinfo "github.com/mholt/go-xmp/models/riff"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const (
+	chunkXMP  = "_PMX"
+	chunkList = "LIST"
+	chunkBext = "bext"
+	chunkIXML = "iXML"
+	chunkDS64 = "ds64"
+	chunkJunk = "JUNK"
+	chunkData = "data"
+	chunkFact = "fact"
+	listInfo  = "INFO"
+
+	// sanity limit for chunks we keep in memory
+	maxChunkSize = 1 << 30
+
+	// RF64 marker for chunk sizes stored in the ds64 chunk
+	sizeRF64 = 0xFFFFFFFF
+)
+
+var (
+	ErrNoXMP   = errors.New("riff: no XMP packet found")
+	ErrInvalid = errors.New("riff: invalid file format")
+)
+
+// MaxRIFFSize is the largest form size written as RIFF. WAVE files that
+// grow beyond it are converted to RF64. Lowering it forces the conversion
+// for small files, for example to test RF64 readers.
+var MaxRIFFSize int64 = 0xFFFFFFFF
+
+// Chunk describes a top-level chunk of the first RIFF form.
+type Chunk struct {
+	ID     string
+	Offset int64  // file offset of the chunk header
+	Size   int64  // payload size, taken from ds64 for RF64 files
+	Type   string // list type of LIST chunks
+}
+
+func (c *Chunk) end() int64 {
+	return c.Offset + 8 + c.Size + c.Size&1
+}
+
+// ds64 holds 64bit sizes of RF64 files.
+type ds64 struct {
+	riffSize    uint64
+	dataSize    uint64
+	sampleCount uint64
+	table       []ds64Entry
+}
+
+type ds64Entry struct {
+	id   string
+	size uint64
+}
+
+func (x *ds64) parse(b []byte) error {
+	if len(b) < 28 {
+		return fmt.Errorf("riff: short ds64 chunk")
+	}
+	x.riffSize = binary.LittleEndian.Uint64(b)
+	x.dataSize = binary.LittleEndian.Uint64(b[8:])
+	x.sampleCount = binary.LittleEndian.Uint64(b[16:])
+	n := int(binary.LittleEndian.Uint32(b[24:]))
+	x.table = make([]ds64Entry, 0, n)
+	b = b[28:]
+	for i := 0; i < n && len(b) >= 12; i++ {
+		x.table = append(x.table, ds64Entry{string(b[:4]), binary.LittleEndian.Uint64(b[4:])})
+		b = b[12:]
+	}
+	return nil
+}
+
+func (x *ds64) bytes() []byte {
+	b := make([]byte, 28, 28+12*len(x.table))
+	binary.LittleEndian.PutUint64(b, x.riffSize)
+	binary.LittleEndian.PutUint64(b[8:], x.dataSize)
+	binary.LittleEndian.PutUint64(b[16:], x.sampleCount)
+	binary.LittleEndian.PutUint32(b[24:], uint32(len(x.table)))
+	for _, v := range x.table {
+		var e [12]byte
+		copy(e[:], v.id)
+		binary.LittleEndian.PutUint64(e[4:], v.size)
+		b = append(b, e[:]...)
+	}
+	return b
+}
+
+type file struct {
+	r      io.ReadSeeker
+	size   int64
+	form   string // RIFF, RF64 or BW64
+	typ    string // WAVE, AVI
+	end    int64  // end offset of the first form
+	ds64   *ds64
+	chunks []*Chunk
+}
+
+func parse(r io.ReadSeeker) (*file, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, ErrInvalid
+	}
+	f := &file{
+		r:    r,
+		size: size,
+		form: string(hdr[:4]),
+		typ:  string(hdr[8:]),
+		end:  8 + int64(binary.LittleEndian.Uint32(hdr[4:])),
+	}
+	switch f.form {
+	case "RIFF":
+	case "RF64", "BW64":
+		f.end = size
+	default:
+		return nil, ErrInvalid
+	}
+
+	var b [8]byte
+	for offset := int64(12); offset+8 <= f.end && offset+8 <= size; {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		c := &Chunk{
+			ID:     string(b[:4]),
+			Offset: offset,
+			Size:   int64(binary.LittleEndian.Uint32(b[4:])),
+		}
+		if f.ds64 != nil && c.Size == sizeRF64 {
+			if c.ID == chunkData {
+				c.Size = int64(f.ds64.dataSize)
+			}
+			for _, v := range f.ds64.table {
+				if v.id == c.ID {
+					c.Size = int64(v.size)
+					break
+				}
+			}
+		}
+		if c.end() > size {
+			// truncated recordings are common, keep what is there
+			xmp.Log.Warnf("riff: chunk '%s' at offset %d exceeds file size", c.ID, offset)
+			c.Size = size - offset - 8
+		}
+		switch c.ID {
+		case chunkList:
+			if c.Size >= 4 {
+				var t [4]byte
+				if _, err := io.ReadFull(r, t[:]); err != nil {
+					return nil, err
+				}
+				c.Type = string(t[:])
+			}
+		case chunkDS64:
+			if offset == 12 && f.form != "RIFF" {
+				data, err := f.load(c)
+				if err != nil {
+					return nil, err
+				}
+				f.ds64 = &ds64{}
+				if err := f.ds64.parse(data); err != nil {
+					return nil, err
+				}
+				f.end = 8 + int64(f.ds64.riffSize)
+				if f.end > size {
+					f.end = size
+				}
+			}
+		}
+		f.chunks = append(f.chunks, c)
+		offset = c.end()
+	}
+	if f.form != "RIFF" && f.ds64 == nil {
+		return nil, fmt.Errorf("riff: missing ds64 chunk in %s file", f.form)
+	}
+	if f.end > size {
+		f.end = size
+	}
+	return f, nil
+}
+
+func (f *file) load(c *Chunk) ([]byte, error) {
+	if c.Size > maxChunkSize {
+		return nil, fmt.Errorf("riff: '%s' chunk too large", c.ID)
+	}
+	if _, err := f.r.Seek(c.Offset+8, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, c.Size)
+	if _, err := io.ReadFull(f.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (f *file) find(id, typ string) *Chunk {
+	for _, c := range f.chunks {
+		if c.ID == id && c.Type == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// Chunks returns the list of top-level chunks in the first RIFF form.
+func Chunks(r io.ReadSeeker) ([]*Chunk, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.chunks, nil
+}
+
+// ReadPacket returns the XMP packet stored in the _PMX chunk.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	c := f.find(chunkXMP, "")
+	if c == nil {
+		return nil, ErrNoXMP
+	}
+	b, err := f.load(c)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b, "\x00"), nil
+}
+
+// Read decodes the XMP packet stored in a RIFF file.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and stores packet in a _PMX chunk.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	return WriteMetadata(w, r, &Metadata{XMP: packet})
+}
+
+// Write copies the file from r to w and stores d as its XMP packet.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
+
+// Metadata holds the contents of all supported metadata chunks. Fields are
+// nil when the file lacks the respective chunk.
+type Metadata struct {
+	XMP  []byte
+	Info *riffinfo.RiffInfo
+	Bext *bext.BextInfo
+	IXML *ixml.IXML
+}
+
+// ReadMetadata reads and decodes all supported metadata chunks.
+func ReadMetadata(r io.ReadSeeker) (*Metadata, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if c := f.find(chunkXMP, ""); c != nil {
+		b, err := f.load(c)
+		if err != nil {
+			return nil, err
+		}
+		m.XMP = bytes.TrimRight(b, "\x00")
+	}
+	if c := f.find(chunkList, listInfo); c != nil {
+		b, err := f.load(c)
+		if err != nil {
+			return nil, err
+		}
+		if m.Info, err = decodeInfo(b[4:]); err != nil {
+			return nil, err
+		}
+	}
+	if c := f.find(chunkBext, ""); c != nil {
+		b, err := f.load(c)
+		if err != nil {
+			return nil, err
+		}
+		if m.Bext, err = decodeBext(b); err != nil {
+			return nil, err
+		}
+	}
+	if c := f.find(chunkIXML, ""); c != nil {
+		b, err := f.load(c)
+		if err != nil {
+			return nil, err
+		}
+		m.IXML = &ixml.IXML{}
+		if err := m.IXML.ParseXML(bytes.TrimRight(b, "\x00")); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// WriteMetadata copies the file from r to w and replaces the chunks of all
+// non-nil fields in m. An empty INFO model removes the LIST/INFO chunk.
+func WriteMetadata(w io.Writer, r io.ReadSeeker, m *Metadata) error {
+	f, err := parse(r)
+	if err != nil {
+		return err
+	}
+	l := make([]*update, 0, 4)
+	if m.XMP != nil {
+		l = append(l, &update{id: chunkXMP, data: m.XMP})
+	}
+	if m.Info != nil {
+		var orig []byte
+		if c := f.find(chunkList, listInfo); c != nil {
+			if orig, err = f.load(c); err != nil {
+				return err
+			}
+			orig = orig[4:]
+		}
+		b, err := encodeInfo(m.Info, orig)
+		if err != nil {
+			return err
+		}
+		l = append(l, &update{id: chunkList, typ: listInfo, data: b})
+	}
+	if m.Bext != nil {
+		b, err := encodeBext(m.Bext)
+		if err != nil {
+			return err
+		}
+		l = append(l, &update{id: chunkBext, data: b})
+	}
+	if m.IXML != nil {
+		b, err := encodeIXML(m.IXML)
+		if err != nil {
+			return err
+		}
+		l = append(l, &update{id: chunkIXML, data: b})
+	}
+	return f.write(w, l)
+}
+
+// update replaces the payload of a chunk, nil data removes the chunk.
+type update struct {
+	id   string
+	typ  string
+	data []byte
+	done bool
+}
+
+// part is a chunk in the output file, copied from the source when data
+// is nil.
+type part struct {
+	id   string
+	orig *Chunk
+	data []byte
+}
+
+func (p *part) size() int64 {
+	if p.data == nil && p.orig != nil {
+		return p.orig.Size
+	}
+	return int64(len(p.data))
+}
+
+func (p *part) encodedSize() int64 {
+	n := p.size()
+	return 8 + n + n&1
+}
+
+func (f *file) layout(updates []*update) []*part {
+	match := func(c *Chunk) *update {
+		for _, u := range updates {
+			if u.id == c.ID && u.typ == c.Type {
+				return u
+			}
+		}
+		return nil
+	}
+	for _, u := range updates {
+		u.done = false
+	}
+	parts := make([]*part, 0, len(f.chunks)+len(updates))
+	for _, c := range f.chunks {
+		u := match(c)
+		switch {
+		case u == nil:
+			parts = append(parts, &part{id: c.ID, orig: c})
+		case u.done || u.data == nil:
+			// drop removed chunks and duplicates
+			u.done = true
+		default:
+			parts = append(parts, &part{id: c.ID, data: u.data})
+			u.done = true
+		}
+	}
+	for _, u := range updates {
+		if !u.done && u.data != nil {
+			parts = append(parts, &part{id: u.id, data: u.data})
+		}
+	}
+	return parts
+}
+
+// layoutStatic keeps all chunks at their original offsets. Replaced chunks
+// of different size turn into JUNK and the new chunk is appended.
+func (f *file) layoutStatic(updates []*update) []*part {
+	parts := make([]*part, 0, len(f.chunks)+len(updates))
+	tail := make([]*part, 0, len(updates))
+	for _, u := range updates {
+		u.done = false
+	}
+	for _, c := range f.chunks {
+		var u *update
+		for _, v := range updates {
+			if v.id == c.ID && v.typ == c.Type {
+				u = v
+				break
+			}
+		}
+		switch {
+		case u == nil:
+			parts = append(parts, &part{id: c.ID, orig: c})
+		case !u.done && u.data != nil && int64(len(u.data)) == c.Size:
+			parts = append(parts, &part{id: c.ID, data: u.data})
+			u.done = true
+		default:
+			if !u.done && u.data != nil {
+				tail = append(tail, &part{id: u.id, data: u.data})
+			}
+			parts = append(parts, &part{id: chunkJunk, data: make([]byte, c.Size)})
+			u.done = true
+		}
+	}
+	for _, u := range updates {
+		if !u.done && u.data != nil {
+			tail = append(tail, &part{id: u.id, data: u.data})
+		}
+	}
+	return append(parts, tail...)
+}
+
+// moved returns true when any chunk copied from the source changes offset.
+func moved(parts []*part) bool {
+	offset := int64(12)
+	for _, p := range parts {
+		if p.orig != nil && p.orig.Offset != offset {
+			return true
+		}
+		offset += p.encodedSize()
+	}
+	return false
+}
+
+func formSize(parts []*part) int64 {
+	n := int64(4)
+	for _, p := range parts {
+		n += p.encodedSize()
+	}
+	return n
+}
+
+func (f *file) write(w io.Writer, updates []*update) error {
+	parts := f.layout(updates)
+	if f.typ != "WAVE" && moved(parts) {
+		parts = f.layoutStatic(updates)
+		if f.end < f.size && formSize(parts)+8 != f.end {
+			return fmt.Errorf("riff: cannot resize first form of a multi-form %s file", f.typ)
+		}
+	}
+
+	form, ds := f.form, f.ds64
+	if form == "RIFF" && formSize(parts) > MaxRIFFSize {
+		if f.typ != "WAVE" {
+			return fmt.Errorf("riff: %s file exceeds 4 GB", f.typ)
+		}
+		// convert to RF64, EBU Tech 3306 reserves space in a leading JUNK chunk
+		form, ds = "RF64", &ds64{}
+		for _, p := range parts {
+			if p.id != chunkFact {
+				continue
+			}
+			b := p.data
+			if b == nil {
+				var err error
+				if b, err = f.load(p.orig); err != nil {
+					return err
+				}
+			}
+			if len(b) >= 4 {
+				ds.sampleCount = uint64(binary.LittleEndian.Uint32(b))
+			}
+		}
+		p := &part{id: chunkDS64, data: ds.bytes()}
+		if len(parts) > 0 && parts[0].id == chunkJunk && parts[0].size() == 28 {
+			parts[0] = p
+		} else {
+			parts = append([]*part{p}, parts...)
+		}
+	}
+	size := formSize(parts)
+	if ds != nil {
+		ds.riffSize = uint64(size)
+		for _, p := range parts {
+			if p.id == chunkData {
+				ds.dataSize = uint64(p.size())
+				break
+			}
+		}
+		for _, p := range parts {
+			if p.id == chunkDS64 {
+				p.data = ds.bytes()
+				break
+			}
+		}
+		size = sizeRF64
+	}
+
+	var hdr [12]byte
+	copy(hdr[:], form)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(size))
+	copy(hdr[8:], f.typ)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if err := f.writePart(w, p); err != nil {
+			return err
+		}
+	}
+
+	// trailing forms and data
+	if f.end < f.size {
+		if _, err := f.r.Seek(f.end, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, f.r, f.size-f.end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *file) writePart(w io.Writer, p *part) error {
+	n := p.size()
+	var hdr [8]byte
+	copy(hdr[:], p.id)
+	if n >= sizeRF64 {
+		binary.LittleEndian.PutUint32(hdr[4:], sizeRF64)
+	} else {
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(n))
+	}
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if p.data != nil {
+		if _, err := w.Write(p.data); err != nil {
+			return err
+		}
+	} else {
+		if _, err := f.r.Seek(p.orig.Offset+8, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, f.r, n); err != nil {
+			return err
+		}
+	}
+	if n&1 == 1 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,489 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package tiff reads and writes XMP packets stored in TIFF tag 700
+// (XMLPacket) as defined by XMP Specification Part 3. It supports classic
+// TIFF and BigTIFF in both byte orders, including TIFF-based raw formats
+// like DNG, NEF, CR2 and ARW.
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const (
+	TagXMLPacket = 700
+
+	typeUndefined = 7
+
+	maxIFDs    = 1024
+	maxEntries = 1 << 16
+)
+
+var (
+	ErrNoXMP   = errors.New("tiff: no XMP packet found")
+	ErrInvalid = errors.New("tiff: invalid file format")
+)
+
+var typeSizes = map[uint16]uint64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2,
+	9: 4, 10: 8, 11: 4, 12: 8, 13: 4, 16: 8, 17: 8, 18: 8,
+}
+
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint64
+	value uint64 // offset or inline value
+	pos   int64  // file offset of the entry
+}
+
+func (e entry) size() uint64 {
+	return typeSizes[e.typ] * e.count
+}
+
+type ifd struct {
+	offset  int64
+	ptrPos  int64 // position of the pointer referencing this IFD
+	entries []entry
+	next    uint64
+}
+
+type file struct {
+	r     io.ReadSeeker
+	size  int64
+	order binary.ByteOrder
+	big   bool
+	ifds  []*ifd
+}
+
+func (f *file) readAt(b []byte, off int64) error {
+	if off < 0 || off+int64(len(b)) > f.size {
+		return fmt.Errorf("tiff: offset %d out of range", off)
+	}
+	if _, err := f.r.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(f.r, b)
+	return err
+}
+
+func (f *file) entrySize() int64 {
+	if f.big {
+		return 20
+	}
+	return 12
+}
+
+func (f *file) inlineSize() uint64 {
+	if f.big {
+		return 8
+	}
+	return 4
+}
+
+func (f *file) putOffset(b []byte, v uint64) {
+	if f.big {
+		f.order.PutUint64(b, v)
+	} else {
+		f.order.PutUint32(b, uint32(v))
+	}
+}
+
+func parse(r io.ReadSeeker) (*file, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	f := &file{r: r, size: size}
+	var hdr [16]byte
+	if size < 8 {
+		return nil, ErrInvalid
+	}
+	if err := f.readAt(hdr[:8], 0); err != nil {
+		return nil, err
+	}
+	switch string(hdr[:2]) {
+	case "II":
+		f.order = binary.LittleEndian
+	case "MM":
+		f.order = binary.BigEndian
+	default:
+		return nil, ErrInvalid
+	}
+	var next uint64
+	ptrPos := int64(4)
+	switch f.order.Uint16(hdr[2:]) {
+	case 42:
+		next = uint64(f.order.Uint32(hdr[4:]))
+	case 43:
+		if err := f.readAt(hdr[:16], 0); err != nil {
+			return nil, ErrInvalid
+		}
+		if f.order.Uint16(hdr[4:]) != 8 {
+			return nil, ErrInvalid
+		}
+		f.big = true
+		next = f.order.Uint64(hdr[8:])
+		ptrPos = 8
+	default:
+		return nil, ErrInvalid
+	}
+
+	// walk the IFD chain
+	seen := make(map[uint64]bool)
+	for next != 0 {
+		if seen[next] || len(f.ifds) >= maxIFDs {
+			return nil, fmt.Errorf("tiff: IFD loop detected at offset %d", next)
+		}
+		seen[next] = true
+		d, err := f.readIFD(int64(next))
+		if err != nil {
+			return nil, err
+		}
+		d.ptrPos = ptrPos
+		f.ifds = append(f.ifds, d)
+		ptrPos = d.offset + f.countSize() + int64(len(d.entries))*f.entrySize()
+		next = d.next
+	}
+	if len(f.ifds) == 0 {
+		return nil, ErrInvalid
+	}
+	return f, nil
+}
+
+func (f *file) countSize() int64 {
+	if f.big {
+		return 8
+	}
+	return 2
+}
+
+func (f *file) readIFD(offset int64) (*ifd, error) {
+	var b [8]byte
+	cs := f.countSize()
+	if err := f.readAt(b[:cs], offset); err != nil {
+		return nil, err
+	}
+	var n uint64
+	if f.big {
+		n = f.order.Uint64(b[:])
+	} else {
+		n = uint64(f.order.Uint16(b[:]))
+	}
+	if n > maxEntries {
+		return nil, fmt.Errorf("tiff: too many IFD entries at offset %d", offset)
+	}
+	es := f.entrySize()
+	buf := make([]byte, int64(n)*es+int64(f.inlineSize()))
+	if err := f.readAt(buf, offset+cs); err != nil {
+		return nil, err
+	}
+	d := &ifd{
+		offset:  offset,
+		entries: make([]entry, n),
+	}
+	for i := range d.entries {
+		p := buf[int64(i)*es:]
+		e := entry{
+			tag: f.order.Uint16(p),
+			typ: f.order.Uint16(p[2:]),
+			pos: offset + cs + int64(i)*es,
+		}
+		if f.big {
+			e.count = f.order.Uint64(p[4:])
+			e.value = f.order.Uint64(p[12:])
+		} else {
+			e.count = uint64(f.order.Uint32(p[4:]))
+			e.value = uint64(f.order.Uint32(p[8:]))
+		}
+		d.entries[i] = e
+	}
+	if f.big {
+		d.next = f.order.Uint64(buf[int64(n)*es:])
+	} else {
+		d.next = uint64(f.order.Uint32(buf[int64(n)*es:]))
+	}
+	return d, nil
+}
+
+// find returns the first XMLPacket entry in the IFD chain.
+func (f *file) find() (*ifd, *entry) {
+	for _, d := range f.ifds {
+		for i := range d.entries {
+			if d.entries[i].tag == TagXMLPacket {
+				return d, &d.entries[i]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// checkEntry verifies that the value of e lies within the file.
+func (f *file) checkEntry(e *entry) error {
+	if n := typeSizes[e.typ]; n > 0 && e.count > uint64(f.size)/n {
+		return fmt.Errorf("tiff: tag %d count %d exceeds file size", e.tag, e.count)
+	}
+	size := e.size()
+	if size > f.inlineSize() && (e.value > uint64(f.size) || size > uint64(f.size)-e.value) {
+		return fmt.Errorf("tiff: tag %d size %d at offset %d exceeds file size", e.tag, size, e.value)
+	}
+	return nil
+}
+
+func (f *file) readEntry(e *entry) ([]byte, error) {
+	if err := f.checkEntry(e); err != nil {
+		return nil, err
+	}
+	size := e.size()
+	b := make([]byte, size)
+	if size <= f.inlineSize() {
+		v := make([]byte, 8)
+		pos := e.pos + f.entrySize() - int64(f.inlineSize())
+		if err := f.readAt(v[:f.inlineSize()], pos); err != nil {
+			return nil, err
+		}
+		copy(b, v)
+		return b, nil
+	}
+	if err := f.readAt(b, int64(e.value)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReadPacket returns the XMP packet stored in tag 700.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	_, e := f.find()
+	if e == nil {
+		return nil, ErrNoXMP
+	}
+	return f.readEntry(e)
+}
+
+// Read decodes the XMP packet stored in a TIFF file.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// PacketSize returns the size of the existing XMP packet or zero when the
+// file does not contain XMP.
+func PacketSize(r io.ReadSeeker) (int64, error) {
+	f, err := parse(r)
+	if err != nil {
+		return 0, err
+	}
+	_, e := f.find()
+	if e == nil {
+		return 0, nil
+	}
+	if err := f.checkEntry(e); err != nil {
+		return 0, err
+	}
+	return int64(e.size()), nil
+}
+
+type patch struct {
+	offset int64
+	data   []byte
+}
+
+// WritePacket copies the TIFF file from r to w and stores packet in tag 700.
+// A packet that fits into the space of the existing packet is written in
+// place. Larger packets are appended to the end of the file and the tag is
+// updated to point to the new location. When no XMP tag exists, the first
+// IFD is rewritten at the end of the file with an additional entry.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	f, err := parse(r)
+	if err != nil {
+		return err
+	}
+	var (
+		patches []patch
+		tail    bytes.Buffer
+	)
+	align := func() int64 {
+		pos := f.size + int64(tail.Len())
+		if pos&1 == 1 {
+			tail.WriteByte(0)
+			pos++
+		}
+		return pos
+	}
+	fieldSize := int(f.inlineSize())
+
+	d, e := f.find()
+	if e != nil {
+		if err := f.checkEntry(e); err != nil {
+			return err
+		}
+	}
+	switch {
+	case e != nil && uint64(len(packet)) <= e.size() && e.size() > f.inlineSize():
+		// overwrite in place, zero the remainder
+		data := make([]byte, e.size())
+		copy(data, packet)
+		patches = append(patches, patch{int64(e.value), data})
+		count := make([]byte, fieldSize)
+		f.putOffset(count, uint64(len(packet)))
+		patches = append(patches, patch{e.pos + 4, count})
+
+	case e != nil:
+		// relocate the packet and patch count and offset
+		pos := align()
+		tail.Write(packet)
+		if !f.big && pos+int64(len(packet)) > 0xFFFFFFFF {
+			return fmt.Errorf("tiff: file exceeds 4GB limit of classic TIFF")
+		}
+		b := make([]byte, 2+2*fieldSize)
+		f.order.PutUint16(b, typeUndefined)
+		f.putOffset(b[2:], uint64(len(packet)))
+		f.putOffset(b[2+fieldSize:], uint64(pos))
+		patches = append(patches, patch{e.pos + 2, b})
+
+	default:
+		// rewrite the first IFD with an extra entry
+		d = f.ifds[0]
+		entries := append(make([]entry, 0, len(d.entries)+1), d.entries...)
+		entries = append(entries, entry{
+			tag:   TagXMLPacket,
+			typ:   typeUndefined,
+			count: uint64(len(packet)),
+		})
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+		// inline values are copied verbatim from the original entries
+		raw := make([][]byte, len(entries))
+		for i, v := range entries {
+			if v.tag == TagXMLPacket {
+				continue
+			}
+			raw[i] = make([]byte, f.entrySize())
+			if err := f.readAt(raw[i], v.pos); err != nil {
+				return err
+			}
+		}
+
+		ifdPos := align()
+		ifdSize := f.countSize() + int64(len(entries))*f.entrySize() + int64(f.inlineSize())
+		dataPos := ifdPos + ifdSize
+		if dataPos&1 == 1 {
+			dataPos++
+		}
+		if !f.big && dataPos+int64(len(packet)) > 0xFFFFFFFF {
+			return fmt.Errorf("tiff: file exceeds 4GB limit of classic TIFF")
+		}
+		buf := make([]byte, ifdSize)
+		if f.big {
+			f.order.PutUint64(buf, uint64(len(entries)))
+		} else {
+			f.order.PutUint16(buf, uint16(len(entries)))
+		}
+		for i, v := range entries {
+			p := buf[f.countSize()+int64(i)*f.entrySize():]
+			if raw[i] != nil {
+				copy(p, raw[i])
+				continue
+			}
+			f.order.PutUint16(p, v.tag)
+			f.order.PutUint16(p[2:], v.typ)
+			f.putOffset(p[4:], v.count)
+			f.putOffset(p[4+fieldSize:], uint64(dataPos))
+		}
+		f.putOffset(buf[ifdSize-int64(f.inlineSize()):], d.next)
+		tail.Write(buf)
+		if f.size+int64(tail.Len()) < dataPos {
+			tail.WriteByte(0)
+		}
+		tail.Write(packet)
+
+		ptr := make([]byte, fieldSize)
+		f.putOffset(ptr, uint64(ifdPos))
+		patches = append(patches, patch{d.ptrPos, ptr})
+	}
+
+	return copyPatched(w, f, patches, tail.Bytes())
+}
+
+// Write copies the TIFF file from r to w and stores d in tag 700. When the
+// file already contains a packet, the document is padded to the existing
+// packet size if possible to allow for an in-place update.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	size, err := PacketSize(r)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if size > 0 {
+		enc := xmp.NewEncoder(&buf)
+		enc.SetMaxSize(size)
+		enc.SetFlags(xmp.Xpacket | xmp.Xpadding)
+		switch err := enc.Encode(d); err {
+		case nil:
+			return WritePacket(w, r, buf.Bytes())
+		case xmp.ErrOverflow:
+			buf.Reset()
+		default:
+			return err
+		}
+	}
+	if err := xmp.NewEncoder(&buf).Encode(d); err != nil {
+		return err
+	}
+	return WritePacket(w, r, buf.Bytes())
+}
+
+func copyPatched(w io.Writer, f *file, patches []patch, tail []byte) error {
+	sort.Slice(patches, func(i, j int) bool { return patches[i].offset < patches[j].offset })
+	if _, err := f.r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var pos int64
+	for _, p := range patches {
+		if _, err := io.CopyN(w, f.r, p.offset-pos); err != nil {
+			return err
+		}
+		if _, err := w.Write(p.data); err != nil {
+			return err
+		}
+		pos = p.offset + int64(len(p.data))
+		if _, err := f.r.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if _, err := io.CopyN(w, f.r, f.size-pos); err != nil {
+		return err
+	}
+	_, err := w.Write(tail)
+	return err
+}
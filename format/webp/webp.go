@@ -0,0 +1,335 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package webp reads and writes XMP packets stored in the 'XMP ' chunk of
+// WebP files.
+//
+// Metadata chunks are only allowed in the extended file format, which
+// announces their presence with flags in the VP8X chunk. Writers in this
+// package convert simple lossy and lossless files to the extended format
+// when necessary, using the canvas size of the VP8 or VP8L bitstream. All
+// other chunks are copied unchanged.
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+const (
+	chunkVP8X = "VP8X"
+	chunkVP8  = "VP8 "
+	chunkVP8L = "VP8L"
+	chunkALPH = "ALPH"
+	chunkXMP  = "XMP "
+
+	// VP8X feature flags
+	flagAnimation = 0x02
+	flagXMP       = 0x04
+	flagEXIF      = 0x08
+	flagAlpha     = 0x10
+	flagICC       = 0x20
+
+	// sanity limit for chunks we keep in memory
+	maxChunkSize = 1 << 30
+)
+
+var (
+	ErrNoXMP   = errors.New("webp: no XMP packet found")
+	ErrInvalid = errors.New("webp: invalid file format")
+)
+
+// Chunk describes a chunk of the WebP RIFF form.
+type Chunk struct {
+	ID     string
+	Offset int64 // file offset of the chunk header
+	Size   int64 // payload size without padding
+}
+
+func (c *Chunk) end() int64 {
+	return c.Offset + 8 + c.Size + c.Size&1
+}
+
+type file struct {
+	r      io.ReadSeeker
+	chunks []*Chunk
+}
+
+func parse(r io.ReadSeeker) (*file, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, ErrInvalid
+	}
+	if string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WEBP" {
+		return nil, ErrInvalid
+	}
+	end := 8 + int64(binary.LittleEndian.Uint32(hdr[4:]))
+	if end > size {
+		xmp.Log.Warnf("webp: RIFF size exceeds file size")
+		end = size
+	}
+	f := &file{r: r}
+	var b [8]byte
+	for offset := int64(12); offset+8 <= end; {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		c := &Chunk{
+			ID:     string(b[:4]),
+			Offset: offset,
+			Size:   int64(binary.LittleEndian.Uint32(b[4:])),
+		}
+		if c.Offset+8+c.Size > end {
+			return nil, fmt.Errorf("webp: chunk '%s' at offset %d exceeds file size", c.ID, offset)
+		}
+		f.chunks = append(f.chunks, c)
+		offset = c.end()
+	}
+	if len(f.chunks) == 0 {
+		return nil, ErrInvalid
+	}
+	return f, nil
+}
+
+func (f *file) load(c *Chunk) ([]byte, error) {
+	if c.Size > maxChunkSize {
+		return nil, fmt.Errorf("webp: '%s' chunk too large", c.ID)
+	}
+	if _, err := f.r.Seek(c.Offset+8, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, c.Size)
+	if _, err := io.ReadFull(f.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (f *file) find(id string) *Chunk {
+	for _, c := range f.chunks {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Chunks returns the list of chunks in a WebP file.
+func Chunks(r io.ReadSeeker) ([]*Chunk, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.chunks, nil
+}
+
+// ReadPacket returns the XMP packet stored in the 'XMP ' chunk. The chunk
+// is also returned when the VP8X header lacks the XMP flag, but a warning
+// is logged.
+func ReadPacket(r io.ReadSeeker) ([]byte, error) {
+	f, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	c := f.find(chunkXMP)
+	if c == nil {
+		return nil, ErrNoXMP
+	}
+	if x := f.find(chunkVP8X); x == nil {
+		xmp.Log.Warnf("webp: XMP chunk in simple format file")
+	} else if hdr, err := f.load(x); err == nil && len(hdr) > 0 && hdr[0]&flagXMP == 0 {
+		xmp.Log.Warnf("webp: XMP chunk present but VP8X flag not set")
+	}
+	return f.load(c)
+}
+
+// Read decodes the XMP packet stored in the 'XMP ' chunk.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	packet, err := ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WritePacket copies the file from r to w and stores packet in the 'XMP '
+// chunk at the end of the file. Simple format files are converted to the
+// extended format. A nil packet removes the chunk and clears the flag.
+func WritePacket(w io.Writer, r io.ReadSeeker, packet []byte) error {
+	f, err := parse(r)
+	if err != nil {
+		return err
+	}
+	vp8x, err := f.header()
+	if err != nil {
+		return err
+	}
+	if packet != nil {
+		vp8x[0] |= flagXMP
+	} else {
+		vp8x[0] &^= flagXMP
+	}
+
+	// compute the new RIFF size
+	size := int64(4) + 8 + int64(len(vp8x))
+	for _, c := range f.chunks {
+		if c.ID == chunkVP8X || c.ID == chunkXMP {
+			continue
+		}
+		size += c.end() - c.Offset
+	}
+	if packet != nil {
+		size += 8 + int64(len(packet)) + int64(len(packet)&1)
+	}
+	if size > 0xFFFFFFFF {
+		return fmt.Errorf("webp: file too large")
+	}
+
+	var hdr [12]byte
+	copy(hdr[:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(size))
+	copy(hdr[8:], "WEBP")
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if err := writeChunk(w, chunkVP8X, vp8x); err != nil {
+		return err
+	}
+	for _, c := range f.chunks {
+		if c.ID == chunkVP8X || c.ID == chunkXMP {
+			continue
+		}
+		if _, err := f.r.Seek(c.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, f.r, c.end()-c.Offset); err != nil {
+			return err
+		}
+	}
+	if packet != nil {
+		return writeChunk(w, chunkXMP, packet)
+	}
+	return nil
+}
+
+// Write copies the file from r to w and stores d in the 'XMP ' chunk.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, r, packet)
+}
+
+func writeChunk(w io.Writer, id string, data []byte) error {
+	var hdr [8]byte
+	copy(hdr[:], id)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(data)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if len(data)&1 == 1 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// header returns the payload of the VP8X chunk. For simple format files a
+// new payload is created from the image bitstream.
+func (f *file) header() ([]byte, error) {
+	if c := f.find(chunkVP8X); c != nil {
+		b, err := f.load(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < 10 {
+			return nil, fmt.Errorf("webp: short VP8X chunk")
+		}
+		return b, nil
+	}
+	var (
+		width, height int
+		flags         byte
+	)
+	switch c := f.chunks[0]; c.ID {
+	case chunkVP8:
+		b, err := f.load(c)
+		if err != nil {
+			return nil, err
+		}
+		// frame tag, start code 9d 01 2a, 14 bit width and height
+		if len(b) < 10 || !bytes.Equal(b[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return nil, fmt.Errorf("webp: invalid VP8 bitstream")
+		}
+		width = int(binary.LittleEndian.Uint16(b[6:]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(b[8:]) & 0x3fff)
+	case chunkVP8L:
+		b, err := f.load(c)
+		if err != nil {
+			return nil, err
+		}
+		// signature 0x2f, 14 bit width-1, 14 bit height-1, alpha bit
+		if len(b) < 5 || b[0] != 0x2f {
+			return nil, fmt.Errorf("webp: invalid VP8L bitstream")
+		}
+		v := binary.LittleEndian.Uint32(b[1:])
+		width = int(v&0x3fff) + 1
+		height = int(v>>14&0x3fff) + 1
+		if v>>28&1 == 1 {
+			flags |= flagAlpha
+		}
+	default:
+		return nil, fmt.Errorf("webp: unsupported first chunk '%s'", c.ID)
+	}
+	if f.find(chunkALPH) != nil {
+		flags |= flagAlpha
+	}
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("webp: invalid canvas size")
+	}
+	b := make([]byte, 10)
+	b[0] = flags
+	putUint24(b[4:], uint32(width-1))
+	putUint24(b[7:], uint32(height-1))
+	return b, nil
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package bext implements the Broadcast Wave Format extension chunk as defined
+// by EBU Tech 3285 and XMP Specification Part 3.
+package bext
+
+import (
+	"fmt"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+var (
+	NsBext = xmp.NewNamespace("bext", "http://ns.adobe.com/bwf/bext/1.0/", NewModel)
+)
+
+func init() {
+	xmp.Register(NsBext, xmp.SoundMetadata)
+}
+
+func NewModel(name string) xmp.Model {
+	return &BextInfo{}
+}
+
+func MakeModel(d *xmp.Document) (*BextInfo, error) {
+	m, err := d.MakeModel(NsBext)
+	if err != nil {
+		return nil, err
+	}
+	x, _ := m.(*BextInfo)
+	return x, nil
+}
+
+func FindModel(d *xmp.Document) *BextInfo {
+	if m := d.FindModel(NsBext); m != nil {
+		return m.(*BextInfo)
+	}
+	return nil
+}
+
+// Loudness values (version 2) are stored in 1/100 LU, LUFS or dBTP.
+type BextInfo struct {
+	Description          string `bext:"Description"          xmp:"bext:description"`         // 256 bytes
+	Originator           string `bext:"Originator"           xmp:"bext:originator"`          // 32 bytes
+	OriginatorReference  string `bext:"OriginatorReference"  xmp:"bext:originatorReference"` // 32 bytes
+	OriginationDate      string `bext:"OriginationDate"      xmp:"bext:originationDate"`     // yyyy:mm:dd
+	OriginationTime      string `bext:"OriginationTime"      xmp:"bext:originationTime"`     // hh:mm:ss
+	TimeReference        uint64 `bext:"TimeReference"        xmp:"bext:timeReference"`       // samples since midnight
+	Version              int    `bext:"Version"              xmp:"bext:version"`
+	UMID                 string `bext:"UMID"                 xmp:"bext:umid"` // hex, 64 bytes
+	LoudnessValue        int    `bext:"LoudnessValue"        xmp:"bext:loudnessValue"`
+	LoudnessRange        int    `bext:"LoudnessRange"        xmp:"bext:loudnessRange"`
+	MaxTruePeakLevel     int    `bext:"MaxTruePeakLevel"     xmp:"bext:maxTruePeakLevel"`
+	MaxMomentaryLoudness int    `bext:"MaxMomentaryLoudness" xmp:"bext:maxMomentaryLoudness"`
+	MaxShortTermLoudness int    `bext:"MaxShortTermLoudness" xmp:"bext:maxShortTermLoudness"`
+	CodingHistory        string `bext:"CodingHistory"        xmp:"bext:codingHistory"`
+}
+
+func (x BextInfo) Can(nsName string) bool {
+	return NsBext.GetName() == nsName
+}
+
+func (x BextInfo) Namespaces() xmp.NamespaceList {
+	return xmp.NamespaceList{NsBext}
+}
+
+func (x *BextInfo) SyncModel(d *xmp.Document) error {
+	return nil
+}
+
+func (x *BextInfo) SyncFromXMP(d *xmp.Document) error {
+	return nil
+}
+
+func (x BextInfo) SyncToXMP(d *xmp.Document) error {
+	return nil
+}
+
+func (x *BextInfo) CanTag(tag string) bool {
+	_, err := xmp.GetNativeField(x, tag)
+	return err == nil
+}
+
+func (x *BextInfo) GetTag(tag string) (string, error) {
+	if v, err := xmp.GetNativeField(x, tag); err != nil {
+		return "", fmt.Errorf("%s: %v", NsBext.GetName(), err)
+	} else {
+		return v, nil
+	}
+}
+
+func (x *BextInfo) SetTag(tag, value string) error {
+	if err := xmp.SetNativeField(x, tag, value); err != nil {
+		return fmt.Errorf("%s: %v", NsBext.GetName(), err)
+	}
+	return nil
+}
@@ -364,7 +364,7 @@ var V22_TO_V24_TAGS map[string]string = map[string]string{
 	"TAL": "TALB", //   Album/Movie/Show title
 	"TBP": "TBPM", //   BPM (Beats Per Minute)
 	"TCM": "TCOM", //   Composer
-	"TCO": "TMED", //   Content type
+	"TCO": "TCON", //   Content type
 	"TCR": "TCOP", //   Copyright message
 	"TDA": "TDRC", // # Date, arguably this could also be release date TDRL
 	"TDY": "TDLY", //   Playlist delay
@@ -150,13 +150,13 @@ func (x *Genre) UnmarshalText(data []byte) error {
 			*x = append(*x, g.String())
 			continue
 		}
-		switch value {
+		switch v {
 		case "RX":
 			*x = append(*x, "Remix")
 		case "CR":
 			*x = append(*x, "Cover")
 		default:
-			*x = append(*x, value)
+			*x = append(*x, v)
 		}
 	}
 	return nil
@@ -16,6 +16,7 @@ package models
 
 // register all metadata models
 import (
+	_ "github.com/mholt/go-xmp/models/bext"
 	_ "github.com/mholt/go-xmp/models/cc"
 	_ "github.com/mholt/go-xmp/models/crs"
 	_ "github.com/mholt/go-xmp/models/dc"
@@ -35,6 +36,7 @@ import (
 	_ "github.com/mholt/go-xmp/models/xmp_bj"
 	_ "github.com/mholt/go-xmp/models/xmp_dm"
 	_ "github.com/mholt/go-xmp/models/xmp_mm"
+	_ "github.com/mholt/go-xmp/models/xmp_note"
 	_ "github.com/mholt/go-xmp/models/xmp_rights"
 	_ "github.com/mholt/go-xmp/models/xmp_tpg"
 )
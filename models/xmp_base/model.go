@@ -116,6 +116,13 @@ func (x *XmpBase) SyncModel(d *xmp.Document) error {
 }
 
 func (x *XmpBase) SyncFromXMP(d *xmp.Document) error {
+	// identifier schemes may be decoded as qualifiers
+	for i, v := range x.Identifier {
+		if v.Scheme == "" {
+			q := d.Qualifiers(xmp.Path("xmp:Identifier").AppendIndex(i))
+			x.Identifier[i].Scheme = q.Get(nsXmpIdq.GetName() + ":Scheme")
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,94 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package xmpnote implements the XMP Note namespace as defined by XMP Specification Part 3.
+package xmpnote
+
+import (
+	"fmt"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+var (
+	NsXmpNote = xmp.NewNamespace("xmpNote", "http://ns.adobe.com/xmp/note/", NewModel)
+)
+
+func init() {
+	xmp.Register(NsXmpNote, xmp.XmpMetadata)
+}
+
+func NewModel(name string) xmp.Model {
+	return &XmpNote{}
+}
+
+func MakeModel(d *xmp.Document) (*XmpNote, error) {
+	m, err := d.MakeModel(NsXmpNote)
+	if err != nil {
+		return nil, err
+	}
+	x, _ := m.(*XmpNote)
+	return x, nil
+}
+
+func FindModel(d *xmp.Document) *XmpNote {
+	if m := d.FindModel(NsXmpNote); m != nil {
+		return m.(*XmpNote)
+	}
+	return nil
+}
+
+type XmpNote struct {
+	HasExtendedXMP string `xmp:"xmpNote:HasExtendedXMP"` // MD5 GUID of the extended packet
+}
+
+func (x XmpNote) Can(nsName string) bool {
+	return NsXmpNote.GetName() == nsName
+}
+
+func (x XmpNote) Namespaces() xmp.NamespaceList {
+	return xmp.NamespaceList{NsXmpNote}
+}
+
+func (x *XmpNote) SyncModel(d *xmp.Document) error {
+	return nil
+}
+
+func (x *XmpNote) SyncFromXMP(d *xmp.Document) error {
+	return nil
+}
+
+func (x XmpNote) SyncToXMP(d *xmp.Document) error {
+	return nil
+}
+
+func (x *XmpNote) CanTag(tag string) bool {
+	_, err := xmp.GetNativeField(x, tag)
+	return err == nil
+}
+
+func (x *XmpNote) GetTag(tag string) (string, error) {
+	if v, err := xmp.GetNativeField(x, tag); err != nil {
+		return "", fmt.Errorf("%s: %v", NsXmpNote.GetName(), err)
+	} else {
+		return v, nil
+	}
+}
+
+func (x *XmpNote) SetTag(tag, value string) error {
+	if err := xmp.SetNativeField(x, tag, value); err != nil {
+		return fmt.Errorf("%s: %v", NsXmpNote.GetName(), err)
+	}
+	return nil
+}
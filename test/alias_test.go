@@ -0,0 +1,105 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Alias tests
+//
+
+const aliasTest = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+ <rdf:Description rdf:about=""
+   xmlns:dc="http://purl.org/dc/elements/1.1/"
+   xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+   xmlns:pdf="http://ns.adobe.com/pdf/1.3/"
+   xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+   tiff:Artist="Alice"
+   pdf:Title="PDF Title"
+   photoshop:Marked="True">
+  <dc:title>
+   <rdf:Alt>
+    <rdf:li xml:lang="x-default">Title</rdf:li>
+   </rdf:Alt>
+  </dc:title>
+ </rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+
+func TestAliasFold(T *testing.T) {
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal([]byte(aliasTest), d); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	checkPaths(T, d, map[string]string{
+		"dc:creator[0]":    "Alice",
+		"dc:title":         "Title",
+		"xmpRights:Marked": "True",
+	})
+	l := d.AliasConflicts()
+	if len(l) != 1 {
+		T.Fatalf("expected 1 conflict, got %v", l)
+	}
+	if c := l[0]; c.Alias != "pdf:Title" || c.Base != "dc:title" || c.AliasValue != "PDF Title" || c.BaseValue != "Title" {
+		T.Errorf("wrong conflict %v", c)
+	}
+	if a, ok := xmp.ResolveAlias("tiff:Artist"); !ok || a.Base != "dc:creator" || a.Form != xmp.AliasArrayItem {
+		T.Errorf("wrong alias %v", a)
+	}
+}
+
+func TestAliasEncode(T *testing.T) {
+	d := makeTestDocument(T, "Title")
+	if err := d.SetPath(xmp.PathValue{Path: "dc:creator", Value: "Bob", Flags: xmp.CREATE}); err != nil {
+		T.Fatalf("set path failed: %v", err)
+	}
+
+	// aliases are only written on request
+	buf, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if bytes.Contains(buf, []byte("tiff:Artist")) {
+		T.Errorf("unexpected alias in output")
+	}
+
+	var b bytes.Buffer
+	e := xmp.NewEncoder(&b)
+	e.SetFlags(xmp.Xpacket | xmp.Xaliases)
+	if err := e.Encode(d); err != nil {
+		T.Fatalf("encode failed: %v", err)
+	}
+	d2 := xmp.NewDocument()
+	if err := xmp.Unmarshal(b.Bytes(), d2); err != nil {
+		T.Fatalf("unmarshal failed: %v\n%s", err, b.String())
+	}
+	if !bytes.Contains(b.Bytes(), []byte("Bob")) || !bytes.Contains(b.Bytes(), []byte("tiff:Artist")) {
+		T.Errorf("missing tiff:Artist alias\n%s", b.String())
+	}
+	checkPaths(T, d2, map[string]string{
+		"pdf:Author":      "Bob",
+		"photoshop:Title": "Title",
+		"xmp:Title":       "Title",
+		"dc:creator[0]":   "Bob",
+	})
+	if l := d2.AliasConflicts(); len(l) != 0 {
+		T.Errorf("unexpected conflicts %v", l)
+	}
+}
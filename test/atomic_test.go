@@ -0,0 +1,172 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/go-xmp/xmpfiles"
+)
+
+// Atomic write tests
+//
+
+func TestAtomicWrite(T *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jpg, _ := makeTestJPEG()
+	name := filepath.Join(dir, "photo.jpg")
+	if err := ioutil.WriteFile(name, jpg, 0600); err != nil {
+		T.Fatal(err)
+	}
+	mtime := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		T.Fatal(err)
+	}
+
+	opts := &xmpfiles.WriteOptions{Backup: true, Lock: true}
+	if err := xmpfiles.WriteFile(name, makeTestDocument(T, "atomic"), opts); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		T.Errorf("mode not preserved: %v", fi.Mode())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		T.Errorf("modification time not preserved: %v", fi.ModTime())
+	}
+	if b, err := ioutil.ReadFile(name + ".bak"); err != nil || !bytes.Equal(b, jpg) {
+		T.Errorf("backup mismatch: %v", err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		T.Fatal(err)
+	}
+	d, err := xmpfiles.Read(f)
+	f.Close()
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "atomic")
+
+	// only the file and its backup remain
+	if l, _ := ioutil.ReadDir(dir); len(l) != 2 {
+		T.Errorf("expected 2 files, got %d", len(l))
+	}
+}
+
+func TestAtomicWriteFailure(T *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "photo.xmp")
+	orig := makeTestPacket(T, "orig")
+	if err := ioutil.WriteFile(name, orig, 0644); err != nil {
+		T.Fatal(err)
+	}
+	err = xmpfiles.WriteFileAtomic(name, nil, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return fmt.Errorf("write aborted")
+	})
+	if err == nil {
+		T.Errorf("expected error")
+	}
+	if b, _ := ioutil.ReadFile(name); !bytes.Equal(b, orig) {
+		T.Errorf("original file modified")
+	}
+	if l, _ := ioutil.ReadDir(dir); len(l) != 1 {
+		T.Errorf("temporary file not removed")
+	}
+
+	// a held lock blocks writers
+	if err := ioutil.WriteFile(name+".lock", nil, 0644); err != nil {
+		T.Fatal(err)
+	}
+	opts := &xmpfiles.WriteOptions{Lock: true, LockTimeout: 50 * time.Millisecond}
+	if err := xmpfiles.WriteFile(name, makeTestDocument(T, "new"), opts); err != xmpfiles.ErrLocked {
+		T.Errorf("expected ErrLocked, got %v", err)
+	}
+
+	// a lock left behind by a crashed writer is broken once stale
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(name+".lock", old, old); err != nil {
+		T.Fatal(err)
+	}
+	if err := xmpfiles.WriteFile(name, makeTestDocument(T, "new"), opts); err != nil {
+		T.Errorf("stale lock not broken: %v", err)
+	}
+	if _, err := os.Stat(name + ".lock"); !os.IsNotExist(err) {
+		T.Errorf("lock file not removed")
+	}
+	if l, _ := ioutil.ReadDir(dir); len(l) != 1 {
+		T.Errorf("expected 1 file, got %d", len(l))
+	}
+}
+
+func TestAtomicConcurrentWriters(T *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic")
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "photo.xmp")
+	opts := &xmpfiles.WriteOptions{Lock: true, LockTimeout: 10 * time.Second}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			packet := makeTestPacket(T, fmt.Sprintf("writer %d", i))
+			err := xmpfiles.WriteFileAtomic(name, opts, func(w io.Writer) error {
+				_, err := w.Write(packet)
+				return err
+			})
+			if err != nil {
+				T.Errorf("writer %d failed: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if _, err := xmpfiles.Read(bytes.NewReader(b)); err != nil {
+		T.Errorf("corrupt file: %v", err)
+	}
+	if l, _ := ioutil.ReadDir(dir); len(l) != 1 {
+		T.Errorf("expected 1 file, got %d", len(l))
+	}
+}
@@ -0,0 +1,488 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/bmff"
+	_ "github.com/mholt/go-xmp/models"
+	"github.com/mholt/go-xmp/models/itunes"
+	"github.com/mholt/go-xmp/models/qt"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// ISO BMFF / QuickTime container tests
+//
+
+var bmffMedia = []byte("MEDIA-SAMPLE-DATA")
+
+func bmffBox(typ string, payload ...[]byte) []byte {
+	var b bytes.Buffer
+	size := 8
+	for _, v := range payload {
+		size += len(v)
+	}
+	binary.Write(&b, binary.BigEndian, uint32(size))
+	b.WriteString(typ)
+	for _, v := range payload {
+		b.Write(v)
+	}
+	return b.Bytes()
+}
+
+func bmffU32(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.BigEndian.PutUint32(b[4*i:], x)
+	}
+	return b
+}
+
+// makeTestMovie builds a movie with a single chunk in mdat. Extra boxes are
+// placed between moov and mdat.
+func makeTestMovie(brand string, extra ...[]byte) []byte {
+	ftyp := bmffBox("ftyp", []byte(brand), bmffU32(0), []byte(brand))
+	moov := func(offset uint32) []byte {
+		stco := bmffBox("stco", bmffU32(0, 1, offset))
+		stbl := bmffBox("stbl", stco)
+		trak := bmffBox("trak", bmffBox("mdia", bmffBox("minf", stbl)))
+		return bmffBox("moov", bmffBox("mvhd", make([]byte, 100)), trak)
+	}
+	size := len(ftyp) + len(moov(0))
+	for _, v := range extra {
+		size += len(v)
+	}
+	var b bytes.Buffer
+	b.Write(ftyp)
+	b.Write(moov(uint32(size + 8)))
+	for _, v := range extra {
+		b.Write(v)
+	}
+	b.Write(bmffBox("mdat", bmffMedia))
+	return b.Bytes()
+}
+
+// checkChunkOffset verifies the chunk offset still points to media data.
+func checkChunkOffset(T *testing.T, buf []byte) {
+	top, err := bmff.ReadTopLevel(bytes.NewReader(buf))
+	if err != nil {
+		T.Fatalf("parse failed: %v", err)
+	}
+	for _, b := range top {
+		if b.Type != "moov" {
+			continue
+		}
+		if err := bmff.ReadBox(bytes.NewReader(buf), b); err != nil {
+			T.Fatalf("read moov failed: %v", err)
+		}
+		stco := b.Find("trak", "mdia", "minf", "stbl", "stco")
+		if stco == nil {
+			T.Fatalf("missing stco")
+		}
+		off := binary.BigEndian.Uint32(stco.Data[8:])
+		if int(off)+len(bmffMedia) > len(buf) || !bytes.Equal(buf[off:int(off)+len(bmffMedia)], bmffMedia) {
+			T.Errorf("chunk offset %d does not point to media data", off)
+		}
+		return
+	}
+	T.Errorf("missing moov")
+}
+
+func testBmffRoundtrip(T *testing.T, src []byte) []byte {
+	checkChunkOffset(T, src)
+	var last []byte
+	for _, title := range []string{"first", "a much longer second title"} {
+		var b bytes.Buffer
+		if err := bmff.Write(&b, bytes.NewReader(src), makeTestDocument(T, title)); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		d, err := bmff.Read(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		if v, _ := d.GetPath(xmp.Path("dc:title")); v != title {
+			T.Errorf("invalid title: expected=%s got=%s", title, v)
+		}
+		checkChunkOffset(T, b.Bytes())
+		src = b.Bytes()
+		last = src
+	}
+	return last
+}
+
+func TestMp4Roundtrip(T *testing.T) {
+	src := makeTestMovie("isom")
+	if _, err := bmff.ReadPacket(bytes.NewReader(src)); err != bmff.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	out := testBmffRoundtrip(T, src)
+	if !bytes.Contains(out, bmff.UUIDXMP) {
+		T.Errorf("missing XMP uuid box")
+	}
+}
+
+func TestMp4UuidBeforeMdat(T *testing.T) {
+	packet, _ := xmp.Marshal(makeTestDocument(T, "x"))
+	uuid := bmffBox("uuid", bmff.UUIDXMP, packet)
+	testBmffRoundtrip(T, makeTestMovie("mp42", uuid))
+}
+
+func TestQuickTimeRoundtrip(T *testing.T) {
+	out := testBmffRoundtrip(T, makeTestMovie("qt  "))
+	if !bytes.Contains(out, []byte("XMP_")) {
+		T.Errorf("missing XMP_ atom")
+	}
+}
+
+func TestQuickTimeFreeSpace(T *testing.T) {
+	src := makeTestMovie("qt  ", bmffBox("free", make([]byte, 4096)))
+	var b bytes.Buffer
+	if err := bmff.Write(&b, bytes.NewReader(src), makeTestDocument(T, "free")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if b.Len() != len(src) {
+		T.Errorf("expected free space to absorb the packet, size %d -> %d", len(src), b.Len())
+	}
+	if !bytes.HasSuffix(b.Bytes(), bmffBox("mdat", bmffMedia)) {
+		T.Errorf("media data moved")
+	}
+	checkChunkOffset(T, b.Bytes())
+}
+
+func TestQuickTimeNativeMetadata(T *testing.T) {
+	// QuickTime text list, iTunes items and mdta keys as written by cameras
+	nam := append([]byte{0, 5, 0x55, 0xC4}, "Title"...)
+	data := func(typ uint32, v []byte) []byte {
+		return bmffBox("data", bmffU32(typ, 0), v)
+	}
+	ilst := bmffBox("ilst",
+		bmffBox("\xa9ART", data(1, []byte("Artist"))),
+		bmffBox("trkn", data(0, []byte{0, 0, 0, 3, 0, 12, 0, 0})),
+		bmffBox("tmpo", data(21, []byte{0, 120})),
+		bmffBox("----",
+			bmffBox("mean", bmffU32(0), []byte("com.apple.iTunes")),
+			bmffBox("name", bmffU32(0), []byte("iTunNORM")),
+			data(1, []byte(" 00000001")),
+		),
+	)
+	udta := bmffBox("udta",
+		bmffBox("\xa9nam", nam),
+		bmffBox("meta", bmffU32(0), bmffBox("hdlr", make([]byte, 25)), ilst),
+	)
+	keys := bmffBox("keys", bmffU32(0, 1, 32), []byte("mdtacom.apple.quicktime.make"))
+	meta := bmffBox("meta", bmffBox("hdlr", make([]byte, 25)), keys,
+		bmffBox("ilst", bmffBox("\x00\x00\x00\x01", data(1, []byte("Maker")))),
+	)
+	boxes, err := bmff.ParseBoxes(bmffBox("moov", udta, meta), 0)
+	if err != nil {
+		T.Fatalf("parse failed: %v", err)
+	}
+	m, err := bmff.DecodeMetadata(boxes[0])
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	if m.Udta == nil || m.Udta.Title != "Title" {
+		T.Errorf("invalid udta title: %#v", m.Udta)
+	}
+	if m.ITunes == nil || m.ITunes.Artist != "Artist" || m.ITunes.TrackNumber != 3 || m.ITunes.BeatsPerMin != 120 {
+		T.Errorf("invalid iTunes metadata: %#v", m.ITunes)
+	}
+	if m.ITunes != nil && string(m.ITunes.SoundCheck) != " 00000001" {
+		T.Errorf("invalid iTunes freeform item: %q", m.ITunes.SoundCheck)
+	}
+	if m.Mdta == nil || m.Mdta.Make != "Maker" {
+		T.Errorf("invalid mdta metadata: %#v", m.Mdta)
+	}
+}
+
+func TestQuickTimeNativeRoundtrip(T *testing.T) {
+	src := makeTestMovie("qt  ")
+	m := &bmff.Metadata{
+		Udta:   &qt.QtUserdata{Title: "Clip", RecordingYear: 2018},
+		Mdta:   &qt.QtMetadata{Make: "Canon", Model: "EOS"},
+		ITunes: &itunes.ITunesMetadata{Album: "Album", DiscNumber: xmp.Rational{Num: 1, Den: 2}, IsPodcast: 1},
+	}
+	var b bytes.Buffer
+	if err := bmff.WriteMetadata(&b, bytes.NewReader(src), m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	checkChunkOffset(T, b.Bytes())
+	x, err := bmff.ReadMetadata(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if x.Udta == nil || x.Udta.Title != "Clip" || x.Udta.RecordingYear != 2018 {
+		T.Errorf("invalid udta: %#v", x.Udta)
+	}
+	if x.Mdta == nil || x.Mdta.Make != "Canon" || x.Mdta.Model != "EOS" {
+		T.Errorf("invalid mdta: %#v", x.Mdta)
+	}
+	if x.ITunes == nil || x.ITunes.Album != "Album" || x.ITunes.DiscNumber.String() != "1/2" || x.ITunes.IsPodcast != 1 {
+		T.Errorf("invalid iTunes metadata: %#v", x.ITunes)
+	}
+
+	// removing a value deletes its atom, other atoms survive
+	x.Udta.Title = ""
+	var c bytes.Buffer
+	if err := bmff.WriteMetadata(&c, bytes.NewReader(b.Bytes()), &bmff.Metadata{Udta: x.Udta}); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if bytes.Contains(c.Bytes(), []byte("\xa9nam")) {
+		T.Errorf("title atom not removed")
+	}
+	if y, err := bmff.ReadMetadata(bytes.NewReader(c.Bytes())); err != nil || y.ITunes == nil || y.ITunes.Album != "Album" {
+		T.Errorf("iTunes metadata lost: %v", err)
+	}
+	checkChunkOffset(T, c.Bytes())
+}
+
+func TestQuickTimeNativeKeep(T *testing.T) {
+	m := &bmff.Metadata{
+		Udta:   &qt.QtUserdata{Title: "Clip", RecordingYear: 2018},
+		ITunes: &itunes.ITunesMetadata{Artist: "Artist", Album: "Album"},
+	}
+	var b bytes.Buffer
+	if err := bmff.WriteMetadata(&b, bytes.NewReader(makeTestMovie("qt  ")), m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	src := b.Bytes()
+
+	// an unknown data type and a title that is not valid UTF-8
+	i := bytes.Index(src, []byte("\xa9ART")) - 4
+	artAtom := src[i : i+int(binary.BigEndian.Uint32(src[i:]))]
+	artAtom[19] = 99 // data atom type
+	artAtom = append([]byte{}, artAtom...)
+	i = bytes.Index(src, []byte("Clip"))
+	copy(src[i:], "\xff\xfe\xfd\xfc")
+
+	x, err := bmff.ReadMetadata(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if x.Udta == nil || x.Udta.Title != "" || x.ITunes == nil || x.ITunes.Artist != "" || x.ITunes.Album != "Album" {
+		T.Fatalf("unexpected metadata: %#v %#v", x.Udta, x.ITunes)
+	}
+
+	// unconvertible atoms survive a round trip, cleared fields are removed
+	x.ITunes.Album = ""
+	var c bytes.Buffer
+	if err := bmff.WriteMetadata(&c, bytes.NewReader(src), x); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := c.Bytes()
+	if !bytes.Contains(out, artAtom) {
+		T.Errorf("item with unknown data type not kept")
+	}
+	if !bytes.Contains(out, []byte("\xa9nam\x00\x04\x55\xc4\xff\xfe\xfd\xfc")) {
+		T.Errorf("title with invalid UTF-8 not kept")
+	}
+	if bytes.Contains(out, []byte("\xa9alb")) {
+		T.Errorf("cleared album not removed")
+	}
+	if y, err := bmff.ReadMetadata(bytes.NewReader(out)); err != nil || y.Udta == nil || y.Udta.RecordingYear != 2018 {
+		T.Errorf("udta lost: %v", err)
+	}
+	checkChunkOffset(T, out)
+}
+
+// HEIF item tests
+//
+
+var heifImage = []byte("HEVC-IMAGE-DATA")
+
+func heifInfe(id uint16, typ, contentType, encoding string) []byte {
+	b := []byte{2, 0, 0, 0, byte(id >> 8), byte(id), 0, 0}
+	b = append(b, typ...)
+	b = append(b, 0)
+	if contentType != "" {
+		b = append(b, contentType...)
+		b = append(b, 0)
+	}
+	if encoding != "" {
+		b = append(b, encoding...)
+		b = append(b, 0)
+	}
+	return bmffBox("infe", b)
+}
+
+type heifExtent struct {
+	method  uint16
+	extents [][2]uint32 // offset, length
+}
+
+// heifIloc builds a version 1 iloc box with 4 byte offsets and lengths for
+// items 1 and 2.
+func heifIloc(items ...heifExtent) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{1, 0, 0, 0, 0x44, 0x00})
+	binary.Write(&b, binary.BigEndian, uint16(len(items)))
+	for i, v := range items {
+		binary.Write(&b, binary.BigEndian, uint16(i+1))
+		binary.Write(&b, binary.BigEndian, v.method)
+		binary.Write(&b, binary.BigEndian, uint16(0))
+		binary.Write(&b, binary.BigEndian, uint16(len(v.extents)))
+		for _, e := range v.extents {
+			b.Write(bmffU32(e[0], e[1]))
+		}
+	}
+	return bmffBox("iloc", b.Bytes())
+}
+
+// makeTestHEIF builds a HEIC file with an image item and an optional XMP
+// item. When idat is true the packet is stored in meta/idat, otherwise it is
+// split into two extents in mdat.
+func makeTestHEIF(packet []byte, idat bool) []byte {
+	return makeTestHEIFWith(packet, idat, "")
+}
+
+// makeTestHEIFWith builds the file of makeTestHEIF with an XMP item in the
+// given content encoding.
+func makeTestHEIFWith(packet []byte, idat bool, encoding string) []byte {
+	ftyp := bmffBox("ftyp", []byte("heic"), bmffU32(0), []byte("mif1heic"))
+	hdlr := bmffBox("hdlr", bmffU32(0, 0), []byte("pict"), make([]byte, 13))
+	pitm := bmffBox("pitm", bmffU32(0), []byte{0, 1})
+	iinf := []byte{0, 0, 0, 0, 0, 1}
+	iinf = append(iinf, heifInfe(1, "hvc1", "", "")...)
+	if packet != nil {
+		iinf[5] = 2
+		iinf = append(iinf, heifInfe(2, "mime", "application/rdf+xml", encoding)...)
+	}
+	meta := func(offset uint32) []byte {
+		items := []heifExtent{{0, [][2]uint32{{offset, uint32(len(heifImage))}}}}
+		var extra []byte
+		switch {
+		case packet == nil:
+		case idat:
+			items = append(items, heifExtent{1, [][2]uint32{{0, uint32(len(packet))}}})
+			extra = bmffBox("idat", packet)
+		default:
+			n := uint32(len(packet) / 2)
+			start := offset + uint32(len(heifImage))
+			items = append(items, heifExtent{0, [][2]uint32{{start, n}, {start + n, uint32(len(packet)) - n}}})
+		}
+		return bmffBox("meta", bmffU32(0), hdlr, pitm, heifIloc(items...), bmffBox("iinf", iinf), extra)
+	}
+	offset := uint32(len(ftyp) + len(meta(0)) + 8)
+	data := heifImage
+	if packet != nil && !idat {
+		data = append(append([]byte{}, heifImage...), packet...)
+	}
+	var b bytes.Buffer
+	b.Write(ftyp)
+	b.Write(meta(offset))
+	b.Write(bmffBox("mdat", data))
+	return b.Bytes()
+}
+
+// checkHEIFImage verifies the image item location after a rewrite.
+func checkHEIFImage(T *testing.T, buf []byte) {
+	i := bytes.Index(buf, []byte("iloc"))
+	if i < 0 {
+		T.Fatalf("missing iloc")
+	}
+	// version 1 iloc with 4 byte offsets, first item has one extent
+	p := buf[i+4+4+2+2+2+2+2+2:]
+	off := binary.BigEndian.Uint32(p)
+	if int(off)+len(heifImage) > len(buf) || !bytes.Equal(buf[off:int(off)+len(heifImage)], heifImage) {
+		T.Errorf("item offset %d does not point to image data", off)
+	}
+}
+
+func TestHEIFItem(T *testing.T) {
+	for _, idat := range []bool{false, true} {
+		src := makeTestHEIF(makeTestPacket(T, "heif"), idat)
+		checkHEIFImage(T, src)
+		d, err := bmff.Read(bytes.NewReader(src))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		if v, _ := d.GetPath(xmp.Path("dc:title")); v != "heif" {
+			T.Errorf("invalid title: %s", v)
+		}
+		for _, title := range []string{"first", "a much longer second title"} {
+			var b bytes.Buffer
+			if err := bmff.Write(&b, bytes.NewReader(src), makeTestDocument(T, title)); err != nil {
+				T.Fatalf("write failed: %v", err)
+			}
+			src = b.Bytes()
+			d, err := bmff.Read(bytes.NewReader(src))
+			if err != nil {
+				T.Fatalf("read failed: %v", err)
+			}
+			if v, _ := d.GetPath(xmp.Path("dc:title")); v != title {
+				T.Errorf("invalid title: expected=%s got=%s", title, v)
+			}
+			checkHEIFImage(T, src)
+		}
+		if n := bytes.Count(src, []byte("a much longer")); idat && n != 1 {
+			T.Errorf("old idat packet not removed")
+		}
+	}
+}
+
+func TestHEIFDeflateItem(T *testing.T) {
+	src := makeTestHEIFWith(deflate(makeTestPacket(T, "deflate")), true, "deflate")
+	d, err := bmff.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "deflate" {
+		T.Errorf("invalid title: %s", v)
+	}
+
+	// a small item must not inflate to an unbounded packet
+	src = makeTestHEIFWith(deflate(make([]byte, 64<<20+1)), true, "deflate")
+	if _, err := bmff.ReadPacket(bytes.NewReader(src)); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		T.Errorf("expected inflate limit error, got %v", err)
+	}
+}
+
+func TestHEIFNewItem(T *testing.T) {
+	src := makeTestHEIF(nil, false)
+	if _, err := bmff.ReadPacket(bytes.NewReader(src)); err != bmff.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	var b bytes.Buffer
+	if err := bmff.Write(&b, bytes.NewReader(src), makeTestDocument(T, "new")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := b.Bytes()
+	checkHEIFImage(T, out)
+	if !bytes.Contains(out, []byte("cdsc\x00\x02\x00\x01\x00\x01")) {
+		T.Errorf("missing cdsc reference to primary item")
+	}
+	top, err := bmff.ReadTopLevel(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("parse failed: %v", err)
+	}
+	if err := bmff.ReadBox(bytes.NewReader(out), top[1]); err != nil {
+		T.Fatalf("read meta failed: %v", err)
+	}
+	items, err := bmff.ReadItems(top[1])
+	if err != nil || len(items) != 2 || items[1].ID != 2 || items[1].ContentType != "application/rdf+xml" {
+		T.Fatalf("invalid item list")
+	}
+	d, err := bmff.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "new" {
+		T.Errorf("invalid title: %s", v)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Fidelity tests
+//
+
+const fidelityTest = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+	`<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="Other Toolkit 2.0">
+	<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+		<rdf:Description rdf:about=""
+				xmlns:xap="http://ns.adobe.com/xap/1.0/"
+				xmlns:ex="http://example.com/ns/"
+				xap:CreatorTool='Tool'
+				ex:flag="on">
+			<ex:note>keep   this</ex:note>
+			<xap:CreateDate>2018-01-02T03:04:05Z</xap:CreateDate>
+		</rdf:Description>
+		<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+			<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Title</rdf:li></rdf:Alt></dc:title>
+			<dc:subject>
+				<rdf:Bag>
+					<rdf:li>one</rdf:li>
+					<rdf:li>two</rdf:li>
+				</rdf:Bag>
+			</dc:subject>
+		</rdf:Description>
+	</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+func decodePreserved(T *testing.T, src string) *xmp.Document {
+	d := xmp.NewDocument()
+	dec := xmp.NewDecoder(strings.NewReader(src))
+	dec.SetFlags(xmp.Dpreserve)
+	if err := dec.Decode(d); err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	return d
+}
+
+func TestFidelityUnchanged(T *testing.T) {
+	d := decodePreserved(T, fidelityTest)
+	buf, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if string(buf) != fidelityTest {
+		T.Errorf("output differs from source\n%s", string(buf))
+	}
+
+	// without Dpreserve the document is written in encoder style
+	d2 := xmp.NewDocument()
+	if err := xmp.Unmarshal([]byte(fidelityTest), d2); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	buf, err = xmp.Marshal(d2)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if string(buf) == fidelityTest {
+		T.Errorf("expected encoder style output")
+	}
+}
+
+func TestFidelityChanged(T *testing.T) {
+	d := decodePreserved(T, fidelityTest)
+	for _, v := range []xmp.PathValue{
+		{Path: "dc:title", Value: "New", Flags: xmp.REPLACE},
+		{Path: "xmp:CreatorTool", Value: "New Tool", Flags: xmp.REPLACE},
+		{Path: "xmp:CreateDate", Flags: xmp.DELETE},
+		{Path: "xmp:Rating", Value: "3", Flags: xmp.CREATE},
+	} {
+		if err := d.SetPath(v); err != nil {
+			T.Fatalf("set path %s failed: %v", v.Path, err)
+		}
+	}
+	buf, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	out := string(buf)
+
+	// untouched properties keep their source form
+	for _, v := range []string{
+		"\t\t\t<dc:subject>\n\t\t\t\t<rdf:Bag>\n\t\t\t\t\t<rdf:li>one</rdf:li>",
+		"\t\t\t<ex:note>keep   this</ex:note>\n\t\t\t<xap:Rating>",
+		`ex:flag="on">`,
+		`x:xmptk="Other Toolkit 2.0"`,
+		`xap:CreatorTool='New Tool'`,
+		"\t\t\t<xap:Rating>3</xap:Rating>\n\t\t</rdf:Description>",
+		"\t\t\t<dc:title>\n\t\t\t\t<rdf:Alt>",
+	} {
+		if !strings.Contains(out, v) {
+			T.Errorf("missing %q in output\n%s", v, out)
+		}
+	}
+	if strings.Contains(out, "CreateDate") {
+		T.Errorf("deleted property in output\n%s", out)
+	}
+	if !strings.HasPrefix(out, "<?xpacket begin=\"\ufeff\"") {
+		T.Errorf("packet wrapper not preserved")
+	}
+
+	d2 := xmp.NewDocument()
+	if err := xmp.Unmarshal(buf, d2); err != nil {
+		T.Fatalf("unmarshal failed: %v\n%s", err, out)
+	}
+	checkPaths(T, d2, map[string]string{
+		"dc:title":        "New",
+		"dc:subject[1]":   "two",
+		"xmp:CreatorTool": "New Tool",
+		"xmp:Rating":      "3",
+		"ex:flag":         "on",
+		"ex:note":         "keep   this",
+		"xmp:CreateDate":  "",
+	})
+}
+
+func TestFidelityNewNamespace(T *testing.T) {
+	src := `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description rdf:about="" xmlns:ex="http://example.com/ns/" ex:a="1"/></rdf:RDF>`
+	d := decodePreserved(T, src)
+	if err := d.SetPath(xmp.PathValue{Path: "dc:format", Value: "image/png", Flags: xmp.CREATE}); err != nil {
+		T.Fatalf("set path failed: %v", err)
+	}
+	var b bytes.Buffer
+	e := xmp.NewEncoder(&b)
+	e.SetFlags(0)
+	if err := e.Encode(d); err != nil {
+		T.Fatalf("encode failed: %v", err)
+	}
+	out := b.String()
+	if !strings.HasPrefix(out, `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description rdf:about="" xmlns:ex="http://example.com/ns/" ex:a="1">`) {
+		T.Errorf("source not preserved\n%s", out)
+	}
+	d2 := xmp.NewDocument()
+	if err := xmp.Unmarshal(b.Bytes(), d2); err != nil {
+		T.Fatalf("unmarshal failed: %v\n%s", err, out)
+	}
+	checkPaths(T, d2, map[string]string{
+		"dc:format": "image/png",
+		"ex:a":      "1",
+	})
+}
+
+func TestFidelityUnwrapped(T *testing.T) {
+	src := `<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="Other Toolkit 2.0">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="2"/>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+	d := decodePreserved(T, src)
+	buf, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if string(buf) != src {
+		T.Errorf("output differs from unwrapped source\n%s", string(buf))
+	}
+}
+
+func TestFidelitySameModel(T *testing.T) {
+	src, err := ioutil.ReadFile("../samples/RAW_SONY_RX100.xmp")
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	d := decodePreserved(T, string(src))
+	d2 := xmp.NewDocument()
+	if err := xmp.Unmarshal(src, d2); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	if d.IsDirty() != d2.IsDirty() {
+		T.Errorf("dirty state differs from plain decode")
+	}
+	l, err := d.ListPaths()
+	if err != nil {
+		T.Fatalf("list paths failed: %v", err)
+	}
+	l2, err := d2.ListPaths()
+	if err != nil {
+		T.Fatalf("list paths failed: %v", err)
+	}
+	if len(l) != len(l2) {
+		T.Fatalf("expected %d paths as in plain decode, got %d", len(l2), len(l))
+	}
+	for i := range l {
+		if l[i].Path != l2[i].Path || l[i].Value != l2[i].Value {
+			T.Errorf("path %d: expected %s=%q, got %s=%q", i, l2[i].Path, l2[i].Value, l[i].Path, l[i].Value)
+		}
+	}
+
+	// models are synced when the document is written
+	buf, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if !bytes.Equal(buf, src) {
+		T.Errorf("output differs from source")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"image/gif"
+	"testing"
+
+	xmpgif "github.com/mholt/go-xmp/format/gif"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// GIF application extension tests
+//
+
+// 1x1 pixel GIF87a with a two color global table
+var testGIF = []byte("GIF87a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff" +
+	"\x21\xf9\x04\x00\x00\x00\x00\x00" +
+	"\x2c\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02\x44\x01\x00" +
+	"\x3b")
+
+func TestGIFRoundtrip(T *testing.T) {
+	if _, err := xmpgif.ReadPacket(bytes.NewReader(testGIF)); err != xmpgif.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := xmpgif.Write(&buf, bytes.NewReader(testGIF), makeTestDocument(T, "first")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := buf.Bytes()
+	if !bytes.HasPrefix(out, []byte("GIF89a")) {
+		T.Errorf("header not upgraded")
+	}
+	if !bytes.HasSuffix(out, []byte("\x03\x02\x01\x00\x00\x3b")) {
+		T.Errorf("missing magic trailer before GIF trailer")
+	}
+	// standard decoders must skip the extension
+	if _, err := gif.DecodeAll(bytes.NewReader(out)); err != nil {
+		T.Errorf("decode failed: %v", err)
+	}
+	d, err := xmpgif.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "first" {
+		T.Errorf("invalid title: %s", v)
+	}
+
+	// replace in place
+	buf = bytes.Buffer{}
+	if err := xmpgif.Write(&buf, bytes.NewReader(out), makeTestDocument(T, "second")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out = buf.Bytes()
+	if n := bytes.Count(out, []byte("XMP DataXMP")); n != 1 {
+		T.Errorf("expected a single XMP extension, got %d", n)
+	}
+	if _, err := gif.DecodeAll(bytes.NewReader(out)); err != nil {
+		T.Errorf("decode failed: %v", err)
+	}
+	d, err = xmpgif.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "second" {
+		T.Errorf("invalid title: %s", v)
+	}
+}
+
+func TestGIFScanPackets(T *testing.T) {
+	var buf bytes.Buffer
+	// end marker with extra whitespace in front of the magic trailer
+	packet := makeTestPacket(T, "scan")
+	packet = bytes.Replace(packet, []byte(`<?xpacket end="w"?>`), []byte(`<?xpacket end="w" ?>`), 1)
+	if err := xmpgif.WritePacket(&buf, bytes.NewReader(testGIF), packet); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	l, err := xmp.ScanPackets(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("scan failed: %v", err)
+	}
+	if len(l) != 1 || !bytes.HasSuffix(l[0], []byte("?>")) {
+		T.Fatalf("packet includes trailer bytes")
+	}
+	if !bytes.Equal(bytes.TrimSpace(l[0]), bytes.TrimSpace(packet)) {
+		T.Errorf("packet mismatch")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/id3"
+	id3model "github.com/mholt/go-xmp/models/id3"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// ID3v2 tag tests
+//
+
+var mp3Audio = []byte("\xff\xfb\x90\x64AUDIO-FRAMES")
+
+func id3Syncsafe(v int) []byte {
+	return []byte{byte(v>>21) & 0x7f, byte(v>>14) & 0x7f, byte(v>>7) & 0x7f, byte(v) & 0x7f}
+}
+
+func id3Unsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for _, v := range b {
+		out = append(out, v)
+		if v == 0xff {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+func id3Frame(version int, id string, flags uint16, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(id)
+	switch version {
+	case 2:
+		b.Write([]byte{byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))})
+	case 3:
+		binary.Write(&b, binary.BigEndian, uint32(len(data)))
+		binary.Write(&b, binary.BigEndian, flags)
+	case 4:
+		b.Write(id3Syncsafe(len(data)))
+		binary.Write(&b, binary.BigEndian, flags)
+	}
+	b.Write(data)
+	return b.Bytes()
+}
+
+func makeTestMP3(version int, flags byte, body ...[]byte) []byte {
+	var tag bytes.Buffer
+	for _, v := range body {
+		tag.Write(v)
+	}
+	var b bytes.Buffer
+	b.Write([]byte{'I', 'D', '3', byte(version), 0, flags})
+	b.Write(id3Syncsafe(tag.Len()))
+	b.Write(tag.Bytes())
+	b.Write(mp3Audio)
+	return b.Bytes()
+}
+
+func checkMP3Audio(T *testing.T, buf []byte) {
+	if !bytes.HasSuffix(buf, mp3Audio) {
+		T.Errorf("audio data corrupted")
+	}
+}
+
+func TestID3Packet(T *testing.T) {
+	packet, err := ioutil.ReadFile("../samples/bluesquare.mp3.xmp")
+	if err != nil {
+		T.Fatalf("cannot read sample: %v", err)
+	}
+	// v2.3 tag with extended header and tag-level unsynchronisation
+	frames := append(
+		id3Frame(3, "TIT2", 0, []byte("\x00Blue Square")),
+		id3Frame(3, "PRIV", 0, append([]byte("XMP\x00"), packet...))...,
+	)
+	frames = append(frames, id3Frame(3, "PRIV", 0, []byte("sync\x00\xff\xe0\xff"))...)
+	ext := []byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 0}
+	src := makeTestMP3(3, 0xc0, id3Unsync(append(ext, frames...)), make([]byte, 64))
+
+	b, err := id3.ReadPacket(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read packet failed: %v", err)
+	}
+	if !bytes.Equal(b, packet) {
+		T.Errorf("packet mismatch")
+	}
+	if _, err := id3.Read(bytes.NewReader(src)); err != nil {
+		T.Errorf("read failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := id3.Write(&buf, bytes.NewReader(src), makeTestDocument(T, "new title")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	d, err := id3.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "new title" {
+		T.Errorf("invalid title: got=%s", v)
+	}
+	tag, err := id3.ReadTag(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read tag failed: %v", err)
+	}
+	if len(tag.FindAll("PRIV")) != 2 || tag.Find("TIT2") == nil {
+		T.Errorf("frames not preserved: %d frames", len(tag.Frames))
+	}
+	if f := tag.FindAll("PRIV")[1]; !bytes.Equal(f.Data, []byte("sync\x00\xff\xe0\xff")) {
+		T.Errorf("unsynchronised frame not restored: %x", f.Data)
+	}
+	if tag.Size != int64(len(src)-len(mp3Audio)) {
+		T.Errorf("smaller tag not padded to original size: %d", tag.Size)
+	}
+	checkMP3Audio(T, buf.Bytes())
+
+	// files without tag
+	if _, err := id3.ReadPacket(bytes.NewReader(mp3Audio)); err != id3.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	buf.Reset()
+	if err := id3.Write(&buf, bytes.NewReader(mp3Audio), makeTestDocument(T, "created")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if d, err := id3.Read(bytes.NewReader(buf.Bytes())); err != nil {
+		T.Errorf("read failed: %v", err)
+	} else if v, _ := d.GetPath(xmp.Path("dc:title")); v != "created" {
+		T.Errorf("invalid title: got=%s", v)
+	}
+	checkMP3Audio(T, buf.Bytes())
+}
+
+func TestID3Frames(T *testing.T) {
+	utf16 := []byte{0x01, 0xff, 0xfe, 'A', 0, 0xe9, 0, 0, 0, 0xff, 0xfe, 'B', 0}
+	src := makeTestMP3(4, 0,
+		id3Frame(4, "TIT2", 0, []byte("\x03Gr\xc3\xbc\xc3\x9fe")),
+		id3Frame(4, "TPE1", 0, utf16),
+		id3Frame(4, "TRCK", 0x0003, append(id3Syncsafe(5), []byte("\x003/12")...)),
+		id3Frame(4, "TXXX", 0, []byte("\x00CATALOG\x00ABC-1")),
+		id3Frame(4, "COMM", 0, []byte("\x00engiTunNORM\x00 000001")),
+		id3Frame(4, "COMM", 0, []byte("\x00eng\x00A comment")),
+		id3Frame(4, "USLT", 0, []byte("\x03eng\x00La la la")),
+		id3Frame(4, "APIC", 0, []byte("\x00image/png\x00\x03Cover\x00\x89PNG")),
+		id3Frame(4, "PRIV", 0, []byte("com.example\x00\x01\x02")),
+		make([]byte, 32),
+	)
+	m, err := id3.ReadMetadata(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if m.TitleDescription != "Grüße" {
+		T.Errorf("invalid UTF-8 title: %q", m.TitleDescription)
+	}
+	if m.LeadPerformer != "Aé/B" {
+		T.Errorf("invalid UTF-16 artist: %q", m.LeadPerformer)
+	}
+	if m.TrackNumber.Track != 3 || m.TrackNumber.Total != 12 {
+		T.Errorf("invalid track: %v", m.TrackNumber)
+	}
+	if len(m.Extension) != 1 || m.Extension[0].Key != "CATALOG" || m.Extension[0].Value != "ABC-1" {
+		T.Errorf("invalid user text: %v", m.Extension)
+	}
+	if m.Comments != "A comment" {
+		T.Errorf("invalid comment: %q", m.Comments)
+	}
+	if len(m.UnsynchronizedLyrics) != 1 || m.UnsynchronizedLyrics[0] != "La la la" {
+		T.Errorf("invalid lyrics: %v", m.UnsynchronizedLyrics)
+	}
+	if len(m.AttachedPicture) != 1 || m.AttachedPicture[0].Type != 3 || string(m.AttachedPicture[0].Data) != "\x89PNG" {
+		T.Errorf("invalid picture: %v", m.AttachedPicture)
+	}
+	if len(m.Private) != 1 || m.Private[0].Owner != "com.example" {
+		T.Errorf("invalid private data: %v", m.Private)
+	}
+
+	m.TitleDescription = "Новая песня"
+	m.LeadPerformer = ""
+	m.Comments = "Changed"
+	m.AttachedPicture = nil
+	var buf bytes.Buffer
+	if err := id3.WriteMetadata(&buf, bytes.NewReader(src), m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	tag, err := id3.ReadTag(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read tag failed: %v", err)
+	}
+	if tag.Version != 4 || tag.Find("TPE1") != nil || tag.Find("APIC") != nil {
+		T.Errorf("unexpected frames after write")
+	}
+	if f := tag.Find("TIT2"); f == nil || f.Data[0] != 3 {
+		T.Errorf("expected UTF-8 title frame")
+	}
+	if n := len(tag.FindAll("COMM")); n != 2 {
+		T.Errorf("expected 2 comments, got %d", n)
+	}
+	m2 := tag.Model()
+	if m2.TitleDescription != m.TitleDescription || m2.Comments != "Changed" || m2.TrackNumber != m.TrackNumber {
+		T.Errorf("roundtrip mismatch: %q %q %v", m2.TitleDescription, m2.Comments, m2.TrackNumber)
+	}
+	checkMP3Audio(T, buf.Bytes())
+}
+
+func TestID3v22Upgrade(T *testing.T) {
+	src := makeTestMP3(2, 0,
+		id3Frame(2, "TT2", 0, []byte("\x00Old Song")),
+		id3Frame(2, "TCO", 0, []byte("\x00Rock")),
+		id3Frame(2, "PIC", 0, []byte("\x00JPG\x03\x00\xff\xd8")),
+	)
+	m, err := id3.ReadMetadata(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if m.TitleDescription != "Old Song" || m.ContentType.String() != "Rock" {
+		T.Errorf("invalid v2.2 text frames: %q %q", m.TitleDescription, m.ContentType)
+	}
+	if len(m.AttachedPicture) != 1 || m.AttachedPicture[0].Mimetype != "image/jpeg" {
+		T.Errorf("invalid v2.2 picture: %v", m.AttachedPicture)
+	}
+	m.Band = "Band"
+	var buf bytes.Buffer
+	if err := id3.WriteMetadata(&buf, bytes.NewReader(src), m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	tag, err := id3.ReadTag(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read tag failed: %v", err)
+	}
+	if tag.Version != 4 || tag.Find("TIT2") == nil || tag.Find("TCON") == nil || tag.Find("TPE2") == nil || tag.Find("APIC") == nil {
+		T.Errorf("v2.2 tag not upgraded")
+	}
+	if !reflectPictures(tag.Model().AttachedPicture, m.AttachedPicture) {
+		T.Errorf("picture mismatch after upgrade")
+	}
+	checkMP3Audio(T, buf.Bytes())
+}
+
+func reflectPictures(a, b id3model.AttachedPictureArray) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Mimetype != b[i].Mimetype || a[i].Type != b[i].Type || !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestID3ShortTag(T *testing.T) {
+	// the header claims a 256 MB tag in a file of a few bytes
+	src := append([]byte{'I', 'D', '3', 4, 0, 0}, id3Syncsafe(1<<28-1)...)
+	src = append(src, id3Frame(4, "TIT2", 0, []byte("\x03short"))...)
+	if _, err := id3.ReadTag(bytes.NewReader(src)); err == nil {
+		T.Errorf("expected error for short tag")
+	}
+}
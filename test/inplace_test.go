@@ -0,0 +1,191 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/png"
+	"github.com/mholt/go-xmp/format/psd"
+	"github.com/mholt/go-xmp/xmp"
+	"github.com/mholt/go-xmp/xmpfiles"
+)
+
+// In-place packet update tests
+//
+
+// memFile is a fixed size in-memory file.
+type memFile struct {
+	*bytes.Reader
+	buf []byte
+}
+
+func newMemFile(b []byte) *memFile {
+	return &memFile{Reader: bytes.NewReader(b), buf: b}
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > int64(len(f.buf)) {
+		return 0, errors.New("write beyond end of file")
+	}
+	return copy(f.buf[off:], b), nil
+}
+
+func makePaddedPacket(T *testing.T, title string, size int64, enc xmp.Encoding) []byte {
+	packet, err := xmp.MarshalSize(makeTestDocument(T, title), size, enc)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if int64(len(packet)) != size {
+		T.Fatalf("expected %d bytes, got %d", size, len(packet))
+	}
+	return packet
+}
+
+func checkTitle(T *testing.T, d *xmp.Document, title string) {
+	v, err := d.GetPath(xmp.Path("dc:title"))
+	if err != nil {
+		T.Fatalf("get path failed: %v", err)
+	}
+	if v != title {
+		T.Errorf("expected title %q, got %q", title, v)
+	}
+}
+
+func TestInPlaceUnknownFormat(T *testing.T) {
+	for _, enc := range []xmp.Encoding{xmp.EncodingUTF8, xmp.EncodingUTF16BE, xmp.EncodingUTF32LE} {
+		src := []byte("\x06\x06\xed\xf5\xd8\x1d\x46\xe5")
+		src = append(src, makePaddedPacket(T, "old", 4096*int64(enc.UnitSize()), enc)...)
+		src = append(src, "\x00tail"...)
+		size := len(src)
+
+		f := newMemFile(src)
+		if err := xmpfiles.UpdateInPlace(f, makeTestDocument(T, "new title")); err != nil {
+			T.Fatalf("%v: update failed: %v", enc, err)
+		}
+		if len(src) != size || !bytes.HasSuffix(src, []byte("\x00tail")) {
+			T.Errorf("%v: file bytes moved", enc)
+		}
+		l, err := xmp.ScanPacketInfo(bytes.NewReader(src), int64(len(src)))
+		if err != nil || len(l) != 1 {
+			T.Fatalf("%v: scan failed: %v", enc, err)
+		}
+		if l[0].Encoding != enc || l[0].Offset != 8 || !l[0].Writable {
+			T.Errorf("%v: wrong packet info %+v", enc, l[0])
+		}
+		packet, err := xmp.ReadPacketAt(bytes.NewReader(src), l[0])
+		if err != nil {
+			T.Fatalf("%v: read failed: %v", enc, err)
+		}
+		d := xmp.NewDocument()
+		if err := xmp.Unmarshal(packet, d); err != nil {
+			T.Fatalf("%v: unmarshal failed: %v", enc, err)
+		}
+		checkTitle(T, d, "new title")
+	}
+}
+
+func TestInPlaceKnownFormat(T *testing.T) {
+	src := makeTestPSD(&psd.Resource{ID: 1060, Data: makePaddedPacket(T, "old", 2048, xmp.EncodingUTF8)})
+	size := len(src)
+	if err := xmpfiles.UpdateInPlace(newMemFile(src), makeTestDocument(T, "psd")); err != nil {
+		T.Fatalf("update failed: %v", err)
+	}
+	if len(src) != size {
+		T.Errorf("file size changed")
+	}
+	d, err := psd.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "psd")
+
+	// png stores a CRC over the packet
+	var buf bytes.Buffer
+	if err := png.WritePacket(&buf, bytes.NewReader(makeTestPNG()), makePaddedPacket(T, "old", 2048, xmp.EncodingUTF8)); err != nil {
+		T.Fatalf("png write failed: %v", err)
+	}
+	if err := xmpfiles.UpdateInPlace(newMemFile(buf.Bytes()), makeTestDocument(T, "png")); err != xmpfiles.ErrInPlace {
+		T.Errorf("expected ErrInPlace, got %v", err)
+	}
+}
+
+func TestInPlaceErrors(T *testing.T) {
+	packet := makePaddedPacket(T, "old", 1024, xmp.EncodingUTF8)
+	orig := append([]byte{}, packet...)
+
+	// too large
+	f := newMemFile(packet)
+	large := makeTestDocument(T, string(bytes.Repeat([]byte("x"), 2000)))
+	if err := xmp.WritePacketAt(f, &xmp.PacketInfo{Length: 1024, Writable: true}, large); err != xmp.ErrOverflow {
+		T.Errorf("expected ErrOverflow, got %v", err)
+	}
+	if !bytes.Equal(packet, orig) {
+		T.Errorf("packet modified on error")
+	}
+
+	// read-only
+	ro := bytes.Replace(packet, []byte(`end="w"`), []byte(`end="r"`), 1)
+	if err := xmpfiles.UpdateInPlace(newMemFile(ro), makeTestDocument(T, "new")); err != xmp.ErrReadOnly {
+		T.Errorf("expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestInPlaceLittleEndian(T *testing.T) {
+	for _, enc := range []xmp.Encoding{xmp.EncodingUTF16LE, xmp.EncodingUTF32LE} {
+		src := []byte("\n\x00\x00\x00")
+		src = append(src, makePaddedPacket(T, "old", 1024*int64(enc.UnitSize()), enc)...)
+		orig := append([]byte{}, src...)
+
+		// a big-endian packet one byte early must not be written
+		be := xmp.EncodingUTF16BE
+		if enc == xmp.EncodingUTF32LE {
+			be = xmp.EncodingUTF32BE
+		}
+		p := &xmp.PacketInfo{Offset: 3, Length: int64(len(src) - 4), Writable: true, Encoding: be}
+		if err := xmp.WritePacketAt(newMemFile(src), p, makeTestDocument(T, "new")); err != xmp.ErrPacketMismatch {
+			T.Errorf("%v: expected ErrPacketMismatch, got %v", enc, err)
+		}
+		p = &xmp.PacketInfo{Offset: 4, Length: int64(len(src) - 8), Writable: true, Encoding: enc}
+		if err := xmp.WritePacketAt(newMemFile(src), p, makeTestDocument(T, "new")); err != xmp.ErrPacketMismatch {
+			T.Errorf("%v: expected ErrPacketMismatch for wrong length, got %v", enc, err)
+		}
+		if !bytes.Equal(src, orig) {
+			T.Fatalf("%v: file modified on error", enc)
+		}
+
+		if err := xmpfiles.UpdateInPlace(newMemFile(src), makeTestDocument(T, "new")); err != nil {
+			T.Fatalf("%v: update failed: %v", enc, err)
+		}
+		l, err := xmp.ScanPacketInfo(bytes.NewReader(src), int64(len(src)))
+		if err != nil || len(l) != 1 {
+			T.Fatalf("%v: scan failed: %v", enc, err)
+		}
+		if l[0].Encoding != enc || l[0].Offset != 4 || l[0].Length != int64(len(src)-4) {
+			T.Errorf("%v: wrong packet info %+v", enc, l[0])
+		}
+		packet, err := xmp.ReadPacketAt(bytes.NewReader(src), l[0])
+		if err != nil {
+			T.Fatalf("%v: read failed: %v", enc, err)
+		}
+		d := xmp.NewDocument()
+		if err := xmp.Unmarshal(packet, d); err != nil {
+			T.Fatalf("%v: unmarshal failed: %v", enc, err)
+		}
+		checkTitle(T, d, "new")
+	}
+}
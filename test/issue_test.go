@@ -0,0 +1,146 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Decode issue tests
+//
+
+const issueTest = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+ <rdf:Description rdf:about=""
+   xmlns:dc="http://purl.org/dc/elements/1.1/"
+   xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+   xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+   xmp:Rating="bad">
+  <dc:title>
+   <rdf:Alt>
+    <rdf:li xml:lang="x-default">Title</rdf:li>
+   </rdf:Alt>
+  </dc:title>
+  <tiff:Orientation>upside</tiff:Orientation>
+ </rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+
+func decodeIssues(src string, flags int) (*xmp.Document, []*xmp.DecodeIssue, error) {
+	d := xmp.NewDocument()
+	dec := xmp.NewDecoder(strings.NewReader(src))
+	dec.SetFlags(flags)
+	err := dec.Decode(d)
+	return d, dec.Issues(), err
+}
+
+func TestDecodeIssueDefault(T *testing.T) {
+	_, _, err := decodeIssues(issueTest, 0)
+	var x *xmp.DecodeIssue
+	if !errors.As(err, &x) {
+		T.Fatalf("expected decode issue, got %v", err)
+	}
+	if x.Severity != xmp.SeverityError || x.Path != "xmp:Rating" || x.Namespace != "http://ns.adobe.com/xap/1.0/" {
+		T.Errorf("wrong issue %#v", x)
+	}
+	if x.Line != 3 || x.Column != 2 {
+		T.Errorf("wrong position %d:%d", x.Line, x.Column)
+	}
+	if !errors.Is(err, xmp.ErrInvalidValue) {
+		T.Errorf("expected ErrInvalidValue, got %v", err)
+	}
+}
+
+func TestDecodeIssueLenient(T *testing.T) {
+	d, l, err := decodeIssues(issueTest, xmp.Dlenient)
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	checkTitle(T, d, "Title")
+	if len(l) != 2 {
+		T.Fatalf("expected 2 issues, got %v", l)
+	}
+	x := l[1]
+	if x.Path != "tiff:Orientation" || x.Line != 13 || x.Column != 3 {
+		T.Errorf("wrong issue %v", x)
+	}
+	if !errors.Is(x, xmp.ErrInvalidValue) || !errors.Is(x, strconv.ErrSyntax) {
+		T.Errorf("wrong cause %v", x)
+	}
+	if !strings.HasPrefix(x.Error(), "xmp: line 13 col 3: tiff:Orientation: ") {
+		T.Errorf("wrong message %q", x.Error())
+	}
+}
+
+func TestDecodeIssueStrict(T *testing.T) {
+	// structured qualifiers are dropped with a warning
+	_, l, err := decodeIssues(strings.Replace(qualifierTest, "<ex:note>translated</ex:note>",
+		"<ex:note><rdf:Bag><rdf:li>a</rdf:li></rdf:Bag></ex:note>", 1), 0)
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	if len(l) != 1 || l[0].Severity != xmp.SeverityWarning || !errors.Is(l[0], xmp.ErrDroppedQualifier) {
+		T.Fatalf("expected dropped qualifier warning, got %v", l)
+	}
+	if l[0].Path != "dc:title[x-default]" {
+		T.Errorf("wrong path %s", l[0].Path)
+	}
+
+	// strict mode fails on warnings
+	_, _, err = decodeIssues(strings.Replace(qualifierTest, "<ex:note>translated</ex:note>",
+		"<ex:note><rdf:Bag><rdf:li>a</rdf:li></rdf:Bag></ex:note>", 1), xmp.Dstrict)
+	if !errors.Is(err, xmp.ErrDroppedQualifier) {
+		T.Errorf("expected ErrDroppedQualifier, got %v", err)
+	}
+}
+
+func TestDecodeIssueNestedPath(T *testing.T) {
+	src := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+ <rdf:Description rdf:about=""
+   xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"
+   xmlns:stEvt="http://ns.adobe.com/xap/1.0/sType/ResourceEvent#">
+  <xmpMM:History>
+   <rdf:Seq>
+    <rdf:li stEvt:action="created"/>
+    <rdf:li rdf:parseType="Resource">
+     <stEvt:action>saved</stEvt:action>
+     <stEvt:bogus>x</stEvt:bogus>
+    </rdf:li>
+   </rdf:Seq>
+  </xmpMM:History>
+ </rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+	_, l, err := decodeIssues(src, xmp.Dlenient)
+	if err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	if len(l) != 1 {
+		T.Fatalf("expected 1 issue, got %v", l)
+	}
+	x := l[0]
+	if x.Path != "xmpMM:History[1]/stEvt:bogus" || !errors.Is(x, xmp.ErrUnknownField) {
+		T.Errorf("wrong issue %v", x)
+	}
+	if x.Line != 11 || x.Column != 6 {
+		T.Errorf("wrong position %d:%d", x.Line, x.Column)
+	}
+}
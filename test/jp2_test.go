@@ -0,0 +1,100 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/bmff"
+	"github.com/mholt/go-xmp/format/jp2"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// JPEG 2000 box tests
+//
+
+var jp2Codestream = []byte("\xff\x4f\xff\x51CODESTREAM\xff\xd9")
+
+func makeTestJP2(extra ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x00\x00\x00\x0cjP  \r\n\x87\n")
+	b.Write(bmffBox("ftyp", []byte("jp2 "), bmffU32(0), []byte("jp2 ")))
+	b.Write(bmffBox("jp2h", bmffBox("ihdr", make([]byte, 14))))
+	for _, v := range extra {
+		b.Write(v)
+	}
+	// open-ended codestream box
+	b.Write(bmffU32(0))
+	b.WriteString("jp2c")
+	b.Write(jp2Codestream)
+	return b.Bytes()
+}
+
+func TestJP2Roundtrip(T *testing.T) {
+	src := makeTestJP2()
+	if _, err := jp2.ReadPacket(bytes.NewReader(src)); err != jp2.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	for _, title := range []string{"first", "a much longer second title"} {
+		var b bytes.Buffer
+		if err := jp2.Write(&b, bytes.NewReader(src), makeTestDocument(T, title)); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		src = b.Bytes()
+		d, err := jp2.Read(bytes.NewReader(src))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		if v, _ := d.GetPath(xmp.Path("dc:title")); v != title {
+			T.Errorf("invalid title: expected=%s got=%s", title, v)
+		}
+	}
+	if !bytes.HasSuffix(src, jp2Codestream) {
+		T.Errorf("codestream not preserved")
+	}
+	if i, j := bytes.Index(src, bmff.UUIDXMP), bytes.Index(src, []byte("jp2c")); i < 0 || i > j || bytes.Count(src, bmff.UUIDXMP) != 1 {
+		T.Errorf("XMP box must precede the codestream")
+	}
+	if _, err := jp2.ReadPacket(bytes.NewReader([]byte("not a jp2 file"))); err != jp2.ErrInvalid {
+		T.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestJP2XMLBox(T *testing.T) {
+	src := makeTestJP2(bmffBox("xml ", makeTestPacket(T, "xml")), bmffBox("xml ", []byte("<other/>")))
+	d, err := jp2.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "xml" {
+		T.Errorf("invalid title: %s", v)
+	}
+	var b bytes.Buffer
+	if err := jp2.Write(&b, bytes.NewReader(src), makeTestDocument(T, "uuid")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := b.Bytes()
+	if bytes.Count(out, []byte("xml ")) != 1 || !bytes.Contains(out, []byte("<other/>")) {
+		T.Errorf("only XMP xml boxes must be removed")
+	}
+	d, err = jp2.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "uuid" {
+		T.Errorf("invalid title: %s", v)
+	}
+}
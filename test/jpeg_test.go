@@ -0,0 +1,184 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/jpeg"
+	_ "github.com/mholt/go-xmp/models"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// JPEG container tests
+//
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	size := len(payload) + 2
+	return append([]byte{0xFF, marker, byte(size >> 8), byte(size)}, payload...)
+}
+
+// a minimal JPEG-like file with JFIF, a quantization table and image data
+func makeTestJPEG() ([]byte, [][]byte) {
+	segs := [][]byte{
+		jpegSegment(0xE0, []byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00")),
+		jpegSegment(0xDB, bytes.Repeat([]byte{0x10}, 65)),
+		jpegSegment(0xFE, []byte("a comment")),
+	}
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	for _, v := range segs {
+		b.Write(v)
+	}
+	b.Write(jpegSegment(0xDA, []byte{0x01, 0x01, 0x00, 0x00, 0x3F, 0x00}))
+	b.Write([]byte{0x12, 0x34, 0xFF, 0x00, 0x56, 0xFF, 0xD9})
+	return b.Bytes(), segs
+}
+
+func makeTestDocument(T *testing.T, title string) *xmp.Document {
+	d := xmp.NewDocument()
+	if err := d.SetPath(xmp.PathValue{
+		Path:  xmp.Path("dc:title"),
+		Value: title,
+		Flags: xmp.CREATE,
+	}); err != nil {
+		T.Fatalf("set path failed: %v", err)
+	}
+	return d
+}
+
+func TestJpegRoundtrip(T *testing.T) {
+	src, segs := makeTestJPEG()
+	if _, err := jpeg.ReadPacket(bytes.NewReader(src)); err != jpeg.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+
+	// insert a new packet
+	var b1 bytes.Buffer
+	if err := jpeg.Write(&b1, bytes.NewReader(src), makeTestDocument(T, "first")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	d, err := jpeg.Read(bytes.NewReader(b1.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "first" {
+		T.Errorf("invalid title: expected=first got=%s", v)
+	}
+	for _, v := range segs {
+		if !bytes.Contains(b1.Bytes(), v) {
+			T.Errorf("segment %x not preserved", v[:2])
+		}
+	}
+	if !bytes.HasSuffix(b1.Bytes(), src[len(src)-20:]) {
+		T.Errorf("image data not preserved")
+	}
+
+	// replace the existing packet
+	var b2 bytes.Buffer
+	if err := jpeg.Write(&b2, bytes.NewReader(b1.Bytes()), makeTestDocument(T, "second")); err != nil {
+		T.Fatalf("rewrite failed: %v", err)
+	}
+	d, err = jpeg.Read(bytes.NewReader(b2.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "second" {
+		T.Errorf("invalid title: expected=second got=%s", v)
+	}
+	if n := bytes.Count(b2.Bytes(), []byte("http://ns.adobe.com/xap/1.0/\x00")); n != 1 {
+		T.Errorf("expected a single XMP segment, found %d", n)
+	}
+	if l1, l2 := len(b1.Bytes())-len(b2.Bytes()), len("first")-len("second"); l1 != l2 {
+		T.Errorf("unexpected size difference %d", l1)
+	}
+}
+
+func TestJpegExtendedXMP(T *testing.T) {
+	src, _ := makeTestJPEG()
+	d := makeTestDocument(T, "large")
+	large := strings.Repeat("0123456789abcdef", 10000)
+	if err := d.SetPath(xmp.PathValue{
+		Path:      xmp.Path("jpegtest:Data"),
+		Value:     large,
+		Namespace: "http://ns.example.com/jpegtest/1.0/",
+		Flags:     xmp.CREATE,
+	}); err != nil {
+		T.Fatalf("set path failed: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := jpeg.Write(&b, bytes.NewReader(src), d); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if n := bytes.Count(b.Bytes(), []byte("http://ns.adobe.com/xmp/extension/\x00")); n < 3 {
+		T.Errorf("expected at least 3 extension segments, found %d", n)
+	}
+	packet, _, err := jpeg.ReadPackets(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Contains(packet, []byte("HasExtendedXMP")) {
+		T.Errorf("main packet lacks xmpNote:HasExtendedXMP")
+	}
+
+	x, err := jpeg.Read(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := x.GetPath(xmp.Path("dc:title")); v != "large" {
+		T.Errorf("invalid title: expected=large got=%s", v)
+	}
+	if v, _ := x.GetPath(xmp.Path("jpegtest:Data")); v != large {
+		T.Errorf("extended property not merged: got %d bytes", len(v))
+	}
+	if v, _ := x.GetPath(xmp.Path("xmpNote:HasExtendedXMP")); v != "" {
+		T.Errorf("expected HasExtendedXMP to be removed, got %s", v)
+	}
+
+	// corrupt a byte inside the extended packet
+	buf := b.Bytes()
+	i := bytes.LastIndex(buf, []byte("0123456789abcdef"))
+	buf[i] = 'X'
+	if _, err := jpeg.Read(bytes.NewReader(buf)); err != jpeg.ErrChecksum {
+		T.Errorf("expected checksum error, got %v", err)
+	}
+}
+
+func TestJpegExtendedSize(T *testing.T) {
+	guid := strings.Repeat("A", 32)
+	for _, size := range []uint32{0xFFFFFFF0, 1 << 20} {
+		payload := []byte("http://ns.adobe.com/xmp/extension/\x00" + guid)
+		payload = append(payload, byte(size>>24), byte(size>>16), byte(size>>8), byte(size), 0, 0, 0, 0)
+		payload = append(payload, "chunk"...)
+		src, _ := makeTestJPEG()
+		main := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), makeTestPacket(T, "main")...)
+		segs := append(jpegSegment(0xE1, main), jpegSegment(0xE1, payload)...)
+		src = append(src[:2:2], append(segs, src[2:]...)...)
+		_, ext, err := jpeg.ReadPackets(bytes.NewReader(src))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		p, ok := ext[guid]
+		if !ok {
+			T.Fatalf("missing extended packet")
+		}
+		if _, err := p.Bytes(guid); err == nil {
+			T.Errorf("size %d: expected error for short extended packet", size)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/jxl"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// JPEG XL container tests
+//
+
+var jxlCodestream = []byte("\xff\x0aCODESTREAM")
+
+func makeTestJXL(extra ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x00\x00\x00\x0cJXL \r\n\x87\n")
+	b.Write(bmffBox("ftyp", []byte("jxl "), bmffU32(0), []byte("jxl ")))
+	for _, v := range extra {
+		b.Write(v)
+	}
+	b.Write(bmffBox("jxlc", jxlCodestream))
+	return b.Bytes()
+}
+
+func TestJXLRoundtrip(T *testing.T) {
+	for _, src := range [][]byte{makeTestJXL(), jxlCodestream} {
+		if _, err := jxl.ReadPacket(bytes.NewReader(src)); err != jxl.ErrNoXMP {
+			T.Errorf("expected ErrNoXMP, got %v", err)
+		}
+		for _, title := range []string{"first", "a much longer second title"} {
+			var b bytes.Buffer
+			if err := jxl.Write(&b, bytes.NewReader(src), makeTestDocument(T, title)); err != nil {
+				T.Fatalf("write failed: %v", err)
+			}
+			src = b.Bytes()
+			d, err := jxl.Read(bytes.NewReader(src))
+			if err != nil {
+				T.Fatalf("read failed: %v", err)
+			}
+			if v, _ := d.GetPath(xmp.Path("dc:title")); v != title {
+				T.Errorf("invalid title: expected=%s got=%s", title, v)
+			}
+		}
+		if !bytes.HasSuffix(src, jxlCodestream) {
+			T.Errorf("codestream not preserved")
+		}
+		if i, j := bytes.Index(src, []byte("xml ")), bytes.Index(src, []byte("jxlc")); i < 0 || i > j || bytes.Count(src, []byte("xml ")) != 1 {
+			T.Errorf("XMP box must precede the codestream")
+		}
+	}
+}
+
+func TestJXLBrotli(T *testing.T) {
+	// a stand-in decoder that treats box contents as uncompressed
+	defer func() { jxl.BrotliReader = nil }()
+	src := makeTestJXL(bmffBox("brob", []byte("xml "), makeTestPacket(T, "brob")))
+	if _, err := jxl.ReadPacket(bytes.NewReader(src)); err != jxl.ErrBrotli {
+		T.Errorf("expected ErrBrotli, got %v", err)
+	}
+	jxl.BrotliReader = func(r io.Reader) io.Reader { return r }
+	d, err := jxl.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "brob" {
+		T.Errorf("invalid title: %s", v)
+	}
+	var b bytes.Buffer
+	if err := jxl.Write(&b, bytes.NewReader(src), makeTestDocument(T, "plain")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if bytes.Contains(b.Bytes(), []byte("brob")) {
+		T.Errorf("compressed XMP box not removed")
+	}
+}
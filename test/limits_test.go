@@ -0,0 +1,135 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Decoder limit tests
+//
+
+func makeLimitPacket(attrs, body string) string {
+	return `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+ <rdf:Description rdf:about="" xmlns:ex="http://example.com/ns/"` + attrs + `>
+` + body + `
+ </rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+}
+
+// makeNodeIDBomb returns a packet whose rdf:nodeID references double the
+// number of nodes on each level.
+func makeNodeIDBomb(levels int) string {
+	var b strings.Builder
+	b.WriteString(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:ex="http://example.com/ns/">`)
+	b.WriteString(`<rdf:Description rdf:about=""><ex:root rdf:nodeID="n0"/></rdf:Description>`)
+	for i := 0; i < levels; i++ {
+		fmt.Fprintf(&b, `<rdf:Description rdf:nodeID="n%d"><ex:a rdf:nodeID="n%d"/><ex:b rdf:nodeID="n%d"/></rdf:Description>`, i, i+1, i+1)
+	}
+	fmt.Fprintf(&b, `<rdf:Description rdf:nodeID="n%d"><ex:leaf>x</ex:leaf></rdf:Description>`, levels)
+	b.WriteString(`</rdf:RDF>`)
+	return b.String()
+}
+
+func TestDecodeLimits(T *testing.T) {
+	items := strings.Repeat("<rdf:li>item</rdf:li>", 5)
+	tests := []struct {
+		limit  string
+		limits xmp.Limits
+		src    string
+	}{
+		{"MaxBytes", xmp.Limits{MaxBytes: 100}, makeLimitPacket("", "")},
+		{"MaxDepth", xmp.Limits{MaxDepth: 8}, makeLimitPacket("",
+			strings.Repeat(`<ex:s rdf:parseType="Resource">`, 10)+strings.Repeat("</ex:s>", 10))},
+		{"MaxNodes", xmp.Limits{MaxNodes: 6}, makeLimitPacket("", "<ex:bag><rdf:Bag>"+items+"</rdf:Bag></ex:bag>")},
+		{"MaxAttrs", xmp.Limits{MaxAttrs: 4}, makeLimitPacket(` ex:a="1" ex:b="2" ex:c="3"`, "")},
+		{"MaxArrayItems", xmp.Limits{MaxArrayItems: 3}, makeLimitPacket("", "<ex:bag><rdf:Bag>"+items+"</rdf:Bag></ex:bag>")},
+		{"MaxValueLen", xmp.Limits{MaxValueLen: 16}, makeLimitPacket("", "<ex:text>"+strings.Repeat("x", 17)+"</ex:text>")},
+		{"MaxValueLen", xmp.Limits{MaxValueLen: 16}, makeLimitPacket(` ex:a="`+strings.Repeat("x", 17)+`"`, "")},
+		{"MaxNodes", xmp.DefaultLimits, makeNodeIDBomb(40)},
+	}
+	for _, v := range tests {
+		dec := xmp.NewDecoder(strings.NewReader(v.src))
+		dec.SetLimits(v.limits)
+		err := dec.Decode(xmp.NewDocument())
+		if !errors.Is(err, xmp.ErrLimitExceeded) {
+			T.Errorf("%s: expected ErrLimitExceeded, got %v", v.limit, err)
+			continue
+		}
+		var le *xmp.LimitError
+		if !errors.As(err, &le) || le.Limit != v.limit {
+			T.Errorf("%s: wrong error %v", v.limit, err)
+		}
+	}
+
+	// positions point to the offending element
+	dec := xmp.NewDecoder(strings.NewReader(makeLimitPacket("", "<ex:bag><rdf:Bag>"+items+"</rdf:Bag></ex:bag>")))
+	dec.SetLimits(xmp.Limits{MaxArrayItems: 3})
+	var le *xmp.LimitError
+	if err := dec.Decode(xmp.NewDocument()); !errors.As(err, &le) || le.Line != 4 || le.Column != 81 {
+		T.Errorf("wrong position in %v", err)
+	}
+
+	// regular packets decode within the default limits
+	dec = xmp.NewDecoder(strings.NewReader(styleTest))
+	dec.SetLimits(xmp.DefaultLimits)
+	d := xmp.NewDocument()
+	if err := dec.Decode(d); err != nil {
+		T.Fatalf("decode failed: %v", err)
+	}
+	checkPaths(T, d, styleTestPaths)
+
+	// small bombs stay within the limits
+	dec = xmp.NewDecoder(strings.NewReader(makeNodeIDBomb(4)))
+	dec.SetLimits(xmp.DefaultLimits)
+	if err := dec.Decode(xmp.NewDocument()); err != nil {
+		T.Errorf("decode failed: %v", err)
+	}
+}
+
+func TestDecodeNodeIDReferences(T *testing.T) {
+	// fan-out bombs are bounded by MaxNodes
+	dec := xmp.NewDecoder(strings.NewReader(makeNodeIDBomb(20)))
+	dec.SetLimits(xmp.Limits{MaxNodes: 1000})
+	var le *xmp.LimitError
+	if err := dec.Decode(xmp.NewDocument()); !errors.Is(err, xmp.ErrLimitExceeded) || !errors.As(err, &le) || le.Limit != "MaxNodes" {
+		T.Errorf("expected MaxNodes LimitError, got %v", err)
+	}
+
+	// without a node limit all copies are made
+	dec = xmp.NewDecoder(strings.NewReader(makeNodeIDBomb(17)))
+	dec.SetLimits(xmp.Limits{})
+	if err := dec.Decode(xmp.NewDocument()); err != nil {
+		T.Errorf("unlimited decode failed: %v", err)
+	}
+
+	// cyclic references
+	src := `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:ex="http://example.com/ns/">
+<rdf:Description rdf:about=""><ex:root rdf:nodeID="a"/></rdf:Description>
+<rdf:Description rdf:nodeID="a"><ex:next rdf:nodeID="b"/></rdf:Description>
+<rdf:Description rdf:nodeID="b"><ex:next rdf:nodeID="a"/></rdf:Description>
+</rdf:RDF>`
+	err := xmp.Unmarshal([]byte(src), xmp.NewDocument())
+	if err == nil || !strings.Contains(err.Error(), "cyclic") {
+		T.Errorf("expected cyclic reference error, got %v", err)
+	}
+}
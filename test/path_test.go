@@ -413,6 +413,32 @@ func TestPathReplace(T *testing.T) {
 	}
 }
 
+func TestPathReplaceDefaultAlt(T *testing.T) {
+	d := xmp.NewDocument()
+	c := &dc.DublinCore{
+		Title: xmp.NewAltString("old"),
+	}
+	d.AddModel(c)
+
+	// the default item has no language, x-default addresses it on paths
+	if i := c.Title.Index("x-default"); i != -1 {
+		T.Errorf("invalid index: expected=-1 got=%d", i)
+	}
+	if err := d.SetPath(xmp.PathValue{
+		Path:  xmp.Path("dc:title[x-default]"),
+		Value: "new",
+		Flags: xmp.REPLACE,
+	}); err != nil {
+		T.Errorf("path set failed: %v", err)
+	}
+	if l := len(c.Title); l != 1 {
+		T.Errorf("invalid length: expected=1 got=%d", l)
+	}
+	if s := c.Title.Default(); s != "new" {
+		T.Errorf("invalid default: expected=new got=%s", s)
+	}
+}
+
 func TestPathReplaceLong(T *testing.T) {
 	d := xmp.NewDocument()
 	mm := &xmpmm.XmpMM{
@@ -0,0 +1,334 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/go-xmp/format/pdf"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// PDF object reader and incremental update tests
+//
+
+// pdfBuilder assembles PDF revisions with classic cross-reference tables.
+type pdfBuilder struct {
+	buf     bytes.Buffer
+	offsets map[int]int
+	prev    int
+}
+
+func newPDFBuilder() *pdfBuilder {
+	b := &pdfBuilder{offsets: make(map[int]int), prev: -1}
+	b.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	return b
+}
+
+func (b *pdfBuilder) object(num int, body string) {
+	b.offsets[num] = b.buf.Len()
+	fmt.Fprintf(&b.buf, "%d 0 obj\n%s\nendobj\n", num, body)
+}
+
+func (b *pdfBuilder) stream(num int, dict string, data []byte) {
+	b.offsets[num] = b.buf.Len()
+	fmt.Fprintf(&b.buf, "%d 0 obj\n<<%s /Length %d>>\nstream\n", num, dict, len(data))
+	b.buf.Write(data)
+	b.buf.WriteString("\nendstream\nendobj\n")
+}
+
+func (b *pdfBuilder) xref(trailer string) []byte {
+	nums := make([]int, 0, len(b.offsets))
+	for num := range b.offsets {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	start := b.buf.Len()
+	b.buf.WriteString("xref\n")
+	if b.prev < 0 {
+		b.buf.WriteString("0 1\n0000000000 65535 f\r\n")
+	}
+	for _, num := range nums {
+		fmt.Fprintf(&b.buf, "%d 1\n%010d 00000 n\r\n", num, b.offsets[num])
+	}
+	if b.prev >= 0 {
+		trailer += fmt.Sprintf(" /Prev %d", b.prev)
+	}
+	fmt.Fprintf(&b.buf, "trailer\n<<%s>>\nstartxref\n%d\n%%%%EOF\n", trailer, start)
+	b.prev = start
+	b.offsets = make(map[int]int)
+	return b.buf.Bytes()
+}
+
+func deflate(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func makeTestPacket(T *testing.T, title string) []byte {
+	packet, err := xmp.Marshal(makeTestDocument(T, title))
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	return packet
+}
+
+func checkPDFTitle(T *testing.T, buf []byte, title string) {
+	d, err := pdf.Read(bytes.NewReader(buf))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != title {
+		T.Errorf("invalid title: expected=%s got=%s", title, v)
+	}
+}
+
+func TestPDFIncrementalRead(T *testing.T) {
+	b := newPDFBuilder()
+	b.object(1, "<< /Type /Catalog /Pages 2 0 R /Metadata 3 0 R >>")
+	b.object(2, "<< /Type /Pages /Kids [] /Count 0 >>")
+	b.stream(3, "/Type /Metadata /Subtype /XML", makeTestPacket(T, "stale"))
+	b.xref("/Size 4 /Root 1 0 R")
+	b.stream(3, "/Type /Metadata /Subtype /XML", makeTestPacket(T, "current"))
+	src := b.xref("/Size 4 /Root 1 0 R")
+
+	// both revisions are visible to a packet scanner
+	if n := bytes.Count(src, []byte("<?xpacket begin")); n != 2 {
+		T.Errorf("expected 2 packets, found %d", n)
+	}
+	checkPDFTitle(T, src, "current")
+
+	var buf bytes.Buffer
+	if err := pdf.Write(&buf, bytes.NewReader(src), makeTestDocument(T, "updated")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), src) {
+		T.Errorf("original revision was modified")
+	}
+	checkPDFTitle(T, buf.Bytes(), "updated")
+	if !bytes.Contains(buf.Bytes()[len(src):], []byte("/Prev ")) {
+		T.Errorf("missing /Prev in update trailer")
+	}
+}
+
+func TestPDFInfo(T *testing.T) {
+	b := newPDFBuilder()
+	b.object(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	b.object(2, "<< /Type /Pages /Kids [] /Count 0 >>")
+	b.object(3, "<< /Title <FEFF004700720020006600FC0072> /Author (Jane \\(Doe\\)) "+
+		"/CreationDate (D:20180401123000+02'00') /Trapped /True /Custom (keep) >>")
+	src := b.xref("/Size 4 /Root 1 0 R /Info 3 0 R")
+
+	m, err := pdf.ReadMetadata(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if m.XMP != nil {
+		T.Errorf("unexpected XMP packet")
+	}
+	if m.Info == nil {
+		T.Fatalf("missing Info dictionary")
+	}
+	if v := m.Info.Title.Default(); v != "Gr für" {
+		T.Errorf("invalid title: %q", v)
+	}
+	if len(m.Info.Author) != 1 || m.Info.Author[0] != "Jane (Doe)" {
+		T.Errorf("invalid author: %v", m.Info.Author)
+	}
+	created := time.Date(2018, 4, 1, 10, 30, 0, 0, time.UTC)
+	if !m.Info.CreationDate.Value().Equal(created) {
+		T.Errorf("invalid creation date: %v", m.Info.CreationDate)
+	}
+	if !m.Info.Trapped || m.Info.PDFVersion != "1.4" {
+		T.Errorf("invalid trapped flag or version: %v %s", m.Info.Trapped, m.Info.PDFVersion)
+	}
+
+	m.Info.Title = xmp.NewAltString("Grüße")
+	m.Info.Producer = "go-xmp"
+	m.XMP = makeTestPacket(T, "with metadata")
+	var buf bytes.Buffer
+	if err := pdf.WriteMetadata(&buf, bytes.NewReader(src), m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	checkPDFTitle(T, buf.Bytes(), "with metadata")
+	m2, err := pdf.ReadMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if m2.Info.Title.Default() != "Grüße" || m2.Info.Producer != "go-xmp" {
+		T.Errorf("invalid info after update: %v %s", m2.Info.Title, m2.Info.Producer)
+	}
+	if !m2.Info.CreationDate.Value().Equal(created) {
+		T.Errorf("creation date changed: %v", m2.Info.CreationDate)
+	}
+	if !bytes.Contains(buf.Bytes()[len(src):], []byte("/Custom (keep)")) {
+		T.Errorf("unknown Info entry was dropped")
+	}
+}
+
+// makeXRefStreamPDF creates a PDF 1.5 file with catalog and Info stored in
+// an object stream and a predicted cross-reference stream.
+func makeXRefStreamPDF(T *testing.T) []byte {
+	catalog := "<< /Type /Catalog /Pages 2 0 R /Metadata 3 0 R >>"
+	return makeXRefStreamPDFWith(T, int64(len(catalog)), "/Predictor 12 /Columns 6")
+}
+
+// makeXRefStreamPDFWith creates the file of makeXRefStreamPDF with the
+// given Info offset in the object stream and cross-reference stream
+// DecodeParms.
+func makeXRefStreamPDFWith(T *testing.T, infoOffset int64, params string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	offsets := make(map[int]int)
+	catalog := "<< /Type /Catalog /Pages 2 0 R /Metadata 3 0 R >>"
+	header := fmt.Sprintf("1 0 4 %d ", infoOffset)
+	objs := catalog + "<< /Title (Object Stream) >>"
+	offsets[2] = buf.Len()
+	buf.WriteString("2 0 obj\n<< /Type /Pages /Kids [] /Count 0 >>\nendobj\n")
+	offsets[3] = buf.Len()
+	meta := deflate(makeTestPacket(T, "xref stream"))
+	fmt.Fprintf(&buf, "3 0 obj\n<< /Type /Metadata /Subtype /XML /Filter /FlateDecode /Length %d >>\nstream\n", len(meta))
+	buf.Write(meta)
+	buf.WriteString("\nendstream\nendobj\n")
+	offsets[5] = buf.Len()
+	objstm := deflate([]byte(header + objs))
+	fmt.Fprintf(&buf, "5 0 obj\n<< /Type /ObjStm /N 2 /First %d /Filter /FlateDecode /Length %d >>\nstream\n", len(header), len(objstm))
+	buf.Write(objstm)
+	buf.WriteString("\nendstream\nendobj\n")
+	offsets[6] = buf.Len()
+
+	// rows of type, 4 byte offset, 1 byte index using the PNG Up predictor
+	rows := [][]byte{
+		{0, 0, 0, 0, 0, 0xff},
+		{2, 0, 0, 0, 5, 0},
+		{1, 0, 0, 0, byte(offsets[2]), 0},
+		{1, 0, 0, byte(offsets[3] >> 8), byte(offsets[3]), 0},
+		{2, 0, 0, 0, 5, 1},
+		{1, 0, 0, byte(offsets[5] >> 8), byte(offsets[5]), 0},
+		{1, 0, 0, byte(offsets[6] >> 8), byte(offsets[6]), 0},
+	}
+	var data []byte
+	prev := make([]byte, 6)
+	for _, row := range rows {
+		data = append(data, 2)
+		for i := range row {
+			data = append(data, row[i]-prev[i])
+		}
+		prev = row
+	}
+	xref := deflate(data)
+	fmt.Fprintf(&buf, "6 0 obj\n<< /Type /XRef /Size 7 /W [1 4 1] /Root 1 0 R /Info 4 0 R "+
+		"/Filter /FlateDecode /DecodeParms << %s >> /Length %d >>\nstream\n", params, len(xref))
+	buf.Write(xref)
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", offsets[6])
+	return buf.Bytes()
+}
+
+func TestPDFXRefStream(T *testing.T) {
+	src := makeXRefStreamPDF(T)
+	m, err := pdf.ReadMetadata(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if m.Info == nil || m.Info.Title.Default() != "Object Stream" {
+		T.Errorf("invalid Info from object stream: %v", m.Info)
+	}
+	checkPDFTitle(T, src, "xref stream")
+
+	var buf bytes.Buffer
+	if err := pdf.Write(&buf, bytes.NewReader(src), makeTestDocument(T, "new stream")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	update := buf.Bytes()[len(src):]
+	if !bytes.Contains(update, []byte("/Type /XRef")) || bytes.Contains(update, []byte("trailer")) {
+		T.Errorf("expected cross-reference stream in update")
+	}
+	checkPDFTitle(T, buf.Bytes(), "new stream")
+}
+
+func TestPDFReconstruct(T *testing.T) {
+	b := newPDFBuilder()
+	b.object(1, "<< /Type /Catalog /Pages 2 0 R /Metadata 3 0 R >>")
+	b.object(2, "<< /Type /Pages /Kids [] /Count 0 >>")
+	b.stream(3, "/Type /Metadata /Subtype /XML", makeTestPacket(T, "damaged"))
+	src := b.xref("/Size 4 /Root 1 0 R")
+	// shift all objects so the cross-reference table points to wrong offsets
+	src = append([]byte("%PDF-1.4\n%garbage\n"), bytes.TrimPrefix(src, []byte("%PDF-1.4\n"))...)
+	src = []byte(strings.Replace(string(src), "startxref\n", "startxref\n9", 1))
+	checkPDFTitle(T, src, "damaged")
+
+	var buf bytes.Buffer
+	if err := pdf.Write(&buf, bytes.NewReader(src), makeTestDocument(T, "repaired")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	update := buf.Bytes()[len(src):]
+	if bytes.Contains(update, []byte("/Prev")) || !bytes.Contains(update, []byte("0000000000 65535 f")) {
+		T.Errorf("expected full cross-reference table after reconstruction")
+	}
+	checkPDFTitle(T, buf.Bytes(), "repaired")
+	if _, err := pdf.ReadPacket(bytes.NewReader([]byte("not a pdf"))); err != pdf.ErrInvalid {
+		T.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestPDFSelfLength(T *testing.T) {
+	b := newPDFBuilder()
+	b.object(1, "<< /Type /Catalog /Pages 2 0 R /Metadata 3 0 R >>")
+	b.object(2, "<< /Type /Pages /Kids [] /Count 0 >>")
+	b.object(3, "<< /Type /Metadata /Subtype /XML /Length 3 0 R >>\nstream\n"+
+		string(makeTestPacket(T, "self length"))+"\nendstream")
+	src := b.xref("/Size 4 /Root 1 0 R")
+	checkPDFTitle(T, src, "self length")
+}
+
+func TestPDFMalformed(T *testing.T) {
+	// negative object offset in the object stream header
+	src := makeXRefStreamPDFWith(T, -5, "/Predictor 12 /Columns 6")
+	if m, err := pdf.ReadMetadata(bytes.NewReader(src)); err == nil && m.Info != nil {
+		T.Errorf("expected no Info for negative object offset")
+	}
+
+	// out of range predictor parameters
+	for _, params := range []string{
+		"/Predictor 12 /Columns 6 /Colors 1000000000",
+		"/Predictor 12 /Columns 6 /BitsPerComponent 3",
+		"/Predictor 12 /Columns 4611686018427387904",
+		"/Predictor 12 /Columns -1",
+	} {
+		src := makeXRefStreamPDFWith(T, 50, params)
+		if _, err := pdf.ReadPacket(bytes.NewReader(src)); err == nil {
+			T.Errorf("%s: expected error", params)
+		}
+	}
+
+	// inflated stream data is limited
+	b := newPDFBuilder()
+	b.object(1, "<< /Type /Catalog /Pages 2 0 R /Metadata 3 0 R >>")
+	b.object(2, "<< /Type /Pages /Kids [] /Count 0 >>")
+	b.stream(3, "/Type /Metadata /Subtype /XML /Filter /FlateDecode", deflate(make([]byte, 64<<20+1)))
+	src = b.xref("/Size 4 /Root 1 0 R")
+	if _, err := pdf.ReadPacket(bytes.NewReader(src)); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		T.Errorf("expected inflate limit error, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/png"
+	_ "github.com/mholt/go-xmp/models"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// PNG container tests
+//
+
+func pngChunk(typ string, data []byte) []byte {
+	b := make([]byte, 12+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], typ)
+	copy(b[8:], data)
+	binary.BigEndian.PutUint32(b[8+len(data):], crc32.ChecksumIEEE(b[4:8+len(data)]))
+	return b
+}
+
+func makeTestPNG(extra ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	b.Write(pngChunk("IHDR", []byte{0, 0, 0, 1, 0, 0, 0, 1, 8, 2, 0, 0, 0}))
+	b.Write(pngChunk("tEXt", []byte("Comment\x00hello")))
+	for _, v := range extra {
+		b.Write(v)
+	}
+	b.Write(pngChunk("IDAT", []byte("not really deflated")))
+	b.Write(pngChunk("IEND", nil))
+	return b.Bytes()
+}
+
+func TestPngRoundtrip(T *testing.T) {
+	src := makeTestPNG()
+	if _, err := png.ReadPacket(bytes.NewReader(src)); err != png.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	var b bytes.Buffer
+	if err := png.Write(&b, bytes.NewReader(src), makeTestDocument(T, "first")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := b.Bytes()
+	if i, j := bytes.Index(out, []byte("iTXtXML:com.adobe.xmp")), bytes.Index(out, []byte("IDAT")); i < 0 || i > j {
+		T.Errorf("XMP chunk must precede IDAT")
+	}
+	if !bytes.Contains(out, pngChunk("tEXt", []byte("Comment\x00hello"))) {
+		T.Errorf("tEXt chunk not preserved")
+	}
+	d, err := png.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "first" {
+		T.Errorf("invalid title: expected=first got=%s", v)
+	}
+}
+
+func TestPngCompressed(T *testing.T) {
+	packet, err := xmp.Marshal(makeTestDocument(T, "compressed"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	var z bytes.Buffer
+	z.WriteString("XML:com.adobe.xmp\x00\x01\x00\x00\x00")
+	zw := zlib.NewWriter(&z)
+	zw.Write(packet)
+	zw.Close()
+	src := makeTestPNG(pngChunk("iTXt", z.Bytes()))
+
+	d, err := png.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "compressed" {
+		T.Errorf("invalid title: expected=compressed got=%s", v)
+	}
+
+	// rewrite keeps compression
+	var b bytes.Buffer
+	if err := png.Write(&b, bytes.NewReader(src), makeTestDocument(T, "updated")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if !bytes.Contains(b.Bytes(), []byte("XML:com.adobe.xmp\x00\x01\x00")) {
+		T.Errorf("expected compressed iTXt chunk")
+	}
+	if bytes.Count(b.Bytes(), []byte("XML:com.adobe.xmp")) != 1 {
+		T.Errorf("expected a single XMP chunk")
+	}
+	d, err = png.Read(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "updated" {
+		T.Errorf("invalid title: expected=updated got=%s", v)
+	}
+
+	// corrupt CRC
+	src[bytes.Index(src, []byte("XML:com.adobe.xmp"))+30] ^= 0xFF
+	if _, err := png.ReadPacket(bytes.NewReader(src)); err == nil {
+		T.Errorf("expected error on corrupted chunk")
+	}
+}
+
+func TestPngLimits(T *testing.T) {
+	// chunk length beyond the end of input
+	src := makeTestPNG()
+	hdr := []byte("\x3f\xff\xff\xffiTXtXML:com.adobe.xmp\x00")
+	src = append(src[:len(src)-12], hdr...)
+	if _, err := png.ReadPacket(bytes.NewReader(src)); err == nil {
+		T.Errorf("expected error for truncated chunk")
+	}
+
+	// compressed packet inflating beyond the limit
+	var z bytes.Buffer
+	z.WriteString("XML:com.adobe.xmp\x00\x01\x00\x00\x00")
+	zw := zlib.NewWriter(&z)
+	zw.Write(make([]byte, 65<<20))
+	zw.Close()
+	src = makeTestPNG(pngChunk("iTXt", z.Bytes()))
+	if _, err := png.ReadPacket(bytes.NewReader(src)); err == nil {
+		T.Errorf("expected error for oversized packet")
+	}
+}
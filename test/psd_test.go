@@ -0,0 +1,189 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/psd"
+	"github.com/mholt/go-xmp/models/ps"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Photoshop image resource tests
+//
+
+var psdImageData = []byte("\x00\x00LAYERS\x00\x00IMAGE-DATA")
+
+func makeTestPSD(resources ...*psd.Resource) []byte {
+	var b bytes.Buffer
+	b.WriteString("8BPS")
+	binary.Write(&b, binary.BigEndian, uint16(1))
+	b.Write(make([]byte, 6))
+	binary.Write(&b, binary.BigEndian, uint16(3)) // channels
+	binary.Write(&b, binary.BigEndian, uint32(1)) // height
+	binary.Write(&b, binary.BigEndian, uint32(1)) // width
+	binary.Write(&b, binary.BigEndian, uint16(8)) // depth
+	binary.Write(&b, binary.BigEndian, uint16(3)) // RGB
+	binary.Write(&b, binary.BigEndian, uint32(0)) // color mode data
+	section := psd.EncodeResources(resources)
+	binary.Write(&b, binary.BigEndian, uint32(len(section)))
+	b.Write(section)
+	b.Write(psdImageData)
+	return b.Bytes()
+}
+
+// IPTC-IIM record 2 with object name
+var testIPTC = []byte("\x1c\x02\x00\x00\x02\x00\x04\x1c\x02\x05\x00\x05Title")
+
+func TestPSDResources(T *testing.T) {
+	src := makeTestPSD(
+		&psd.Resource{ID: 1005, Data: make([]byte, 16)},
+		&psd.Resource{ID: 1028, Name: "IPTC", Data: testIPTC},
+		&psd.Resource{ID: 1060, Data: makeTestPacket(T, "psd")},
+	)
+	l, err := psd.ReadResources(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if len(l) != 3 || l[1].Name != "IPTC" || !bytes.Equal(l[1].Data, testIPTC) {
+		T.Errorf("invalid resources")
+	}
+	d, err := psd.Read(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "psd" {
+		T.Errorf("invalid title: %s", v)
+	}
+
+	// writing XMP adds the IPTC digest to XMP and as resource 1061
+	var buf bytes.Buffer
+	if err := psd.Write(&buf, bytes.NewReader(src), makeTestDocument(T, "updated")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), psdImageData) {
+		T.Errorf("image data corrupted")
+	}
+	m, err := psd.ReadMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	d = xmp.NewDocument()
+	if err := xmp.Unmarshal(m.XMP, d); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "updated" {
+		T.Errorf("invalid title: %s", v)
+	}
+	info := ps.FindModel(d)
+	if info == nil || info.LegacyIPTCDigest != psd.Digest(testIPTC) {
+		T.Fatalf("missing legacy IPTC digest")
+	}
+	if x := m.Verify(info); x.IPTC != psd.DigestMatch || x.IPTCResource != psd.DigestMatch || x.XMP != psd.DigestMissing {
+		T.Errorf("unexpected digest state: %+v", x)
+	}
+	if len(m.IPTCDigest) != 16 {
+		T.Errorf("invalid IPTC digest resource")
+	}
+}
+
+func TestPSDDigestMismatch(T *testing.T) {
+	d := makeTestDocument(T, "digest")
+	info, _ := ps.MakeModel(d)
+	info.LegacyIPTCDigest = psd.Digest([]byte("old IPTC"))
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	src := makeTestPSD(
+		&psd.Resource{ID: 1028, Data: testIPTC},
+		&psd.Resource{ID: 1060, Data: packet},
+	)
+	m, err := psd.ReadMetadata(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	sidecar := &ps.PhotoshopInfo{
+		EmbeddedXMPDigest: psd.Digest(packet),
+		LegacyIPTCDigest:  info.LegacyIPTCDigest,
+	}
+	if x := m.Verify(sidecar); x.IPTC != psd.DigestMismatch || x.XMP != psd.DigestMatch || x.IPTCResource != psd.DigestMissing {
+		T.Errorf("unexpected digest state: %+v", x)
+	}
+
+	// replacing the IPTC records brings all digests back in sync
+	iptc := append(testIPTC, []byte("\x1c\x02\x78\x00\x04Text")...)
+	var buf bytes.Buffer
+	if err := psd.WriteMetadata(&buf, bytes.NewReader(src), &psd.Metadata{IPTC: iptc}); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	m, err = psd.ReadMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	d = xmp.NewDocument()
+	if err := xmp.Unmarshal(m.XMP, d); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	if x := m.Verify(ps.FindModel(d)); x.IPTC != psd.DigestMatch || x.IPTCResource != psd.DigestMatch {
+		T.Errorf("digests not updated: %+v", x)
+	}
+	if !bytes.Equal(m.IPTC, iptc) {
+		T.Errorf("IPTC records not replaced")
+	}
+	if _, err := psd.ReadPacket(bytes.NewReader(makeTestPSD())); err != psd.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+}
+
+func TestPSDDigestOmit(T *testing.T) {
+	// the photoshop model never writes digests on its own
+	d := makeTestDocument(T, "omit")
+	info, _ := ps.MakeModel(d)
+	info.LegacyIPTCDigest = psd.Digest(testIPTC)
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if bytes.Contains(packet, []byte("LegacyIPTCDigest")) {
+		T.Errorf("unexpected legacy IPTC digest in marshalled model")
+	}
+
+	// only the PSD writer adds it
+	src := makeTestPSD(&psd.Resource{ID: 1028, Data: testIPTC})
+	var buf bytes.Buffer
+	if err := psd.Write(&buf, bytes.NewReader(src), d); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	m, err := psd.ReadMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Contains(m.XMP, []byte(psd.Digest(testIPTC))) {
+		T.Errorf("missing legacy IPTC digest in written packet")
+	}
+}
+
+func TestPSDTruncatedResources(T *testing.T) {
+	src := makeTestPSD()
+	src = src[:len(src)-len(psdImageData)]
+	binary.BigEndian.PutUint32(src[len(src)-4:], 1<<30-1)
+	if _, err := psd.ReadPacket(bytes.NewReader(src)); err != psd.ErrInvalid {
+		T.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
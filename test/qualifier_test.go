@@ -0,0 +1,124 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/mholt/go-xmp/models/xmp_base"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Qualifier tests
+//
+
+const qualifierTest = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+ <rdf:Description rdf:about=""
+   xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+   xmlns:xmpidq="http://ns.adobe.com/xmp/Identifier/qual/1.0/"
+   xmlns:dc="http://purl.org/dc/elements/1.1/"
+   xmlns:ex="http://example.com/ns/">
+  <xmp:Identifier>
+   <rdf:Bag>
+    <rdf:li rdf:parseType="Resource">
+     <rdf:value>978-3-16-148410-0</rdf:value>
+     <xmpidq:Scheme>ISBN</xmpidq:Scheme>
+    </rdf:li>
+    <rdf:li>plain</rdf:li>
+   </rdf:Bag>
+  </xmp:Identifier>
+  <dc:title>
+   <rdf:Alt>
+    <rdf:li xml:lang="x-default" rdf:parseType="Resource">
+     <rdf:value>Title</rdf:value>
+     <ex:note>translated</ex:note>
+    </rdf:li>
+   </rdf:Alt>
+  </dc:title>
+  <ex:simple>
+   <rdf:Description rdf:value="value" ex:source="camera"/>
+  </ex:simple>
+ </rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+
+func checkPaths(T *testing.T, d *xmp.Document, paths map[string]string) {
+	for path, value := range paths {
+		v, err := d.GetPath(xmp.Path(path))
+		if err != nil {
+			T.Errorf("%s: %v", path, err)
+			continue
+		}
+		if v != value {
+			T.Errorf("%s: expected %q, got %q", path, value, v)
+		}
+	}
+}
+
+func TestQualifiers(T *testing.T) {
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal([]byte(qualifierTest), d); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	expect := map[string]string{
+		"xmp:Identifier[0]/?xmpidq:Scheme": "ISBN",
+		"dc:title":                         "Title",
+		"dc:title[x-default]/?ex:note":     "translated",
+		"ex:simple":                        "value",
+		"ex:simple/?ex:source":             "camera",
+	}
+	checkPaths(T, d, expect)
+	if _, err := d.GetPath(xmp.Path("xmp:Identifier[1]/?xmpidq:Scheme")); err == nil {
+		T.Errorf("expected missing qualifier")
+	}
+	if m := xmpbase.FindModel(d); m == nil || m.Identifier[0].ID != "978-3-16-148410-0" || m.Identifier[0].Scheme != "ISBN" {
+		T.Errorf("identifier model not populated")
+	}
+
+	// set and remove qualifiers
+	if err := d.SetPath(xmp.PathValue{Path: "xmp:Identifier[1]/?xmpidq:Scheme", Value: "URN", Flags: xmp.CREATE}); err != nil {
+		T.Fatalf("set failed: %v", err)
+	}
+	if err := d.SetPath(xmp.PathValue{Path: "ex:simple/?ex:source", Flags: xmp.DELETE}); err != nil {
+		T.Fatalf("delete failed: %v", err)
+	}
+	if err := d.SetQualifier("ex:simple", "unknown:q", "x"); err == nil {
+		T.Errorf("expected error for unknown qualifier namespace")
+	}
+	delete(expect, "ex:simple/?ex:source")
+	expect["xmp:Identifier[1]/?xmpidq:Scheme"] = "URN"
+
+	// round-trip
+	buf, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	d2 := xmp.NewDocument()
+	if err := xmp.Unmarshal(buf, d2); err != nil {
+		T.Fatalf("unmarshal failed: %v\n%s", err, string(buf))
+	}
+	checkPaths(T, d2, expect)
+	if l := d2.Qualifiers("ex:simple"); len(l) != 0 {
+		T.Errorf("expected no qualifiers, got %v", l)
+	}
+	l, err := d2.ListPaths()
+	if err != nil {
+		T.Fatalf("list failed: %v", err)
+	}
+	if l.Find("dc:title[x-default]/?ex:note") == nil {
+		T.Errorf("qualifier missing in path list")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// RDF/XML grammar tests
+//
+
+const rdfGrammarTest = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+  xmlns:dc="http://purl.org/dc/elements/1.1/"
+  xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+  xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"
+  xmlns:stRef="http://ns.adobe.com/xap/1.0/sType/ResourceRef#"
+  xmlns:stEvt="http://ns.adobe.com/xap/1.0/sType/ResourceEvent#"
+  xmlns:ex="http://example.com/ns/">
+ <rdf:Description rdf:about="" rdf:ID="main" xmp:CreatorTool="tool">
+  <dc:title>
+   <rdf:Alt>
+    <rdf:li xml:lang="x-default">Title</rdf:li>
+   </rdf:Alt>
+  </dc:title>
+  <xmp:BaseURL rdf:resource="http://example.com/base"/>
+  <xmpMM:DerivedFrom rdf:nodeID="ref"/>
+  <xmpMM:History>
+   <rdf:Seq>
+    <rdf:li stEvt:action="created" stEvt:softwareAgent="agent 1"/>
+    <rdf:li>
+     <stEvt:ResourceEvent stEvt:action="saved">
+      <stEvt:softwareAgent>agent 2</stEvt:softwareAgent>
+     </stEvt:ResourceEvent>
+    </rdf:li>
+    <rdf:li rdf:parseType="Resource">
+     <stEvt:action>converted</stEvt:action>
+    </rdf:li>
+   </rdf:Seq>
+  </xmpMM:History>
+  <ex:literal rdf:parseType="Literal"><ex:b>bold</ex:b></ex:literal>
+  <ex:typed rdf:datatype="http://www.w3.org/2001/XMLSchema#integer">42</ex:typed>
+ </rdf:Description>
+ <rdf:Description rdf:nodeID="ref">
+  <stRef:documentID>xmp.did:1234</stRef:documentID>
+ </rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+
+func TestRDFGrammar(T *testing.T) {
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal([]byte(rdfGrammarTest), d); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	for path, value := range map[string]string{
+		"dc:title":                             "Title",
+		"xmp:CreatorTool":                      "tool",
+		"xmp:BaseURL":                          "http://example.com/base",
+		"xmpMM:DerivedFrom/stRef:documentID":   "xmp.did:1234",
+		"xmpMM:History[0]/stEvt:action":        "created",
+		"xmpMM:History[0]/stEvt:softwareAgent": "agent 1",
+		"xmpMM:History[1]/stEvt:action":        "saved",
+		"xmpMM:History[1]/stEvt:softwareAgent": "agent 2",
+		"xmpMM:History[2]/stEvt:action":        "converted",
+		"ex:typed":                             "42",
+	} {
+		v, err := d.GetPath(xmp.Path(path))
+		if err != nil {
+			T.Errorf("%s: %v", path, err)
+			continue
+		}
+		if v != value {
+			T.Errorf("%s: expected %q, got %q", path, value, v)
+		}
+	}
+	if v, _ := d.GetPath(xmp.Path("ex:literal")); !strings.Contains(v, ">bold</b>") {
+		T.Errorf("wrong literal value %q", v)
+	}
+	if _, err := xmp.Marshal(d); err != nil {
+		T.Errorf("marshal failed: %v", err)
+	}
+}
+
+func TestRDFTypedNode(T *testing.T) {
+	src := `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:ex="http://example.com/ns/">
+ <rdf:Description rdf:about="">
+  <ex:s><ex:Thing ex:a="1"/></ex:s>
+ </rdf:Description>
+</rdf:RDF>`
+	typ := `<rdf:type rdf:resource="http://example.com/ns/Thing">`
+	packet := []byte(src)
+	for i := 0; i < 2; i++ {
+		d := xmp.NewDocument()
+		if err := xmp.Unmarshal(packet, d); err != nil {
+			T.Fatalf("round %d: unmarshal failed: %v", i, err)
+		}
+		if v, _ := d.GetPath(xmp.Path("ex:s/ex:a")); v != "1" {
+			T.Errorf("round %d: wrong field value %q", i, v)
+		}
+		var err error
+		if packet, err = xmp.Marshal(d); err != nil {
+			T.Fatalf("round %d: marshal failed: %v", i, err)
+		}
+		if !strings.Contains(string(packet), typ) {
+			T.Errorf("round %d: type lost in %s", i, packet)
+		}
+	}
+}
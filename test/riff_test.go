@@ -0,0 +1,269 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/riff"
+	"github.com/mholt/go-xmp/models/bext"
+	"github.com/mholt/go-xmp/models/ixml"
+	riffinfo "github.com/mholt/go-xmp/models/riff"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// RIFF / WAV / RF64 container tests
+//
+
+var riffSamples = []byte("AUDIO-SAMPLES")
+
+func riffChunk(id string, payload ...[]byte) []byte {
+	var b bytes.Buffer
+	size := 0
+	for _, v := range payload {
+		size += len(v)
+	}
+	b.WriteString(id)
+	binary.Write(&b, binary.LittleEndian, uint32(size))
+	for _, v := range payload {
+		b.Write(v)
+	}
+	if size&1 == 1 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func makeTestWAV(form, typ string, chunks ...[]byte) []byte {
+	var body bytes.Buffer
+	body.WriteString(typ)
+	for _, v := range chunks {
+		body.Write(v)
+	}
+	var b bytes.Buffer
+	b.WriteString(form)
+	binary.Write(&b, binary.LittleEndian, uint32(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func checkRiffSamples(T *testing.T, buf []byte) {
+	chunks, err := riff.Chunks(bytes.NewReader(buf))
+	if err != nil {
+		T.Fatalf("parse failed: %v", err)
+	}
+	for _, c := range chunks {
+		if c.ID == "data" || c.ID == "movi" {
+			if c.Size != int64(len(riffSamples)) || !bytes.Equal(buf[c.Offset+8:c.Offset+8+c.Size], riffSamples) {
+				T.Errorf("sample data corrupted")
+			}
+			return
+		}
+	}
+	T.Errorf("missing sample data")
+}
+
+func TestRiffRoundtrip(T *testing.T) {
+	src := makeTestWAV("RIFF", "WAVE",
+		riffChunk("fmt ", make([]byte, 16)),
+		riffChunk("data", riffSamples),
+	)
+	if _, err := riff.ReadPacket(bytes.NewReader(src)); err != riff.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	for _, title := range []string{"first", "a much longer second title"} {
+		var b bytes.Buffer
+		if err := riff.Write(&b, bytes.NewReader(src), makeTestDocument(T, title)); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		d, err := riff.Read(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		if v, _ := d.GetPath(xmp.Path("dc:title")); v != title {
+			T.Errorf("invalid title: expected=%s got=%s", title, v)
+		}
+		if size := binary.LittleEndian.Uint32(b.Bytes()[4:]); int(size)+8 != b.Len() {
+			T.Errorf("invalid RIFF size %d for file size %d", size, b.Len())
+		}
+		checkRiffSamples(T, b.Bytes())
+		src = b.Bytes()
+	}
+}
+
+func TestRiffMetadata(T *testing.T) {
+	info := riffChunk("LIST", []byte("INFO"),
+		riffChunk("INAM", []byte("Take 1\x00")),
+		riffChunk("IXYZ", []byte("unknown\x00")),
+	)
+	src := makeTestWAV("RIFF", "WAVE",
+		riffChunk("fmt ", make([]byte, 16)),
+		info,
+		riffChunk("data", riffSamples),
+	)
+	m, err := riff.ReadMetadata(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if m.Info == nil || len(m.Info.Title) != 1 || m.Info.Title[0].Value != "Take 1" {
+		T.Fatalf("invalid INFO list: %#v", m.Info)
+	}
+
+	m.Info.Artist = "Recordist"
+	m.Bext = &bext.BextInfo{
+		Description:     "Scene 5",
+		Originator:      "Recorder",
+		OriginationDate: "2018-04-01",
+		OriginationTime: "12:30:00",
+		TimeReference:   1<<32 + 48000,
+		Version:         2,
+		UMID:            "060A2B340101010501010D4313000000A1B2C3D4E5F60718293A4B5C6D7E8F90",
+		LoudnessValue:   -2300,
+		CodingHistory:   "A=PCM,F=48000,W=24,M=mono\r\n",
+	}
+	m.IXML = &ixml.IXML{Version: "2.0", Project: "Feature", SceneName: "5", Take: 1}
+	var b bytes.Buffer
+	if err := riff.WriteMetadata(&b, bytes.NewReader(src), m); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	checkRiffSamples(T, b.Bytes())
+	if !bytes.Contains(b.Bytes(), []byte("IXYZ")) {
+		T.Errorf("unknown INFO entry lost")
+	}
+
+	x, err := riff.ReadMetadata(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if x.Info == nil || x.Info.Artist != "Recordist" || len(x.Info.Title) != 1 {
+		T.Errorf("invalid INFO list: %#v", x.Info)
+	}
+	if x.Bext == nil || *x.Bext != *m.Bext {
+		T.Errorf("invalid bext chunk: %#v", x.Bext)
+	}
+	if x.IXML == nil || x.IXML.Project != "Feature" || x.IXML.Take != 1 {
+		T.Errorf("invalid iXML chunk: %#v", x.IXML)
+	}
+
+	// an empty INFO model removes the list
+	var c bytes.Buffer
+	if err := riff.WriteMetadata(&c, bytes.NewReader(src), &riff.Metadata{Info: &riffinfo.RiffInfo{}}); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	if bytes.Contains(c.Bytes(), []byte("INAM")) {
+		T.Errorf("INFO list not removed")
+	}
+}
+
+func TestRF64Roundtrip(T *testing.T) {
+	ds64 := make([]byte, 28)
+	src := makeTestWAV("RF64", "WAVE",
+		riffChunk("ds64", ds64),
+		riffChunk("fmt ", make([]byte, 16)),
+		riffChunk("data", riffSamples),
+	)
+	// mark sizes as stored in ds64
+	binary.LittleEndian.PutUint32(src[4:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint64(src[20:], uint64(len(src)-8))
+	binary.LittleEndian.PutUint64(src[28:], uint64(len(riffSamples)))
+	i := bytes.Index(src, []byte("data"))
+	binary.LittleEndian.PutUint32(src[i+4:], 0xFFFFFFFF)
+
+	var b bytes.Buffer
+	if err := riff.Write(&b, bytes.NewReader(src), makeTestDocument(T, "rf64")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := b.Bytes()
+	if string(out[:4]) != "RF64" || binary.LittleEndian.Uint32(out[4:]) != 0xFFFFFFFF {
+		T.Errorf("invalid RF64 header")
+	}
+	if size := binary.LittleEndian.Uint64(out[20:]); int(size)+8 != len(out) {
+		T.Errorf("invalid ds64 RIFF size %d for file size %d", size, len(out))
+	}
+	checkRiffSamples(T, out)
+	d, err := riff.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "rf64" {
+		T.Errorf("invalid title %s", v)
+	}
+}
+
+func TestRF64Convert(T *testing.T) {
+	fact := make([]byte, 4)
+	binary.LittleEndian.PutUint32(fact, 1234)
+	src := makeTestWAV("RIFF", "WAVE",
+		riffChunk("JUNK", make([]byte, 28)),
+		riffChunk("fmt ", make([]byte, 16)),
+		riffChunk("fact", fact),
+		riffChunk("data", riffSamples),
+	)
+	defer func(v int64) { riff.MaxRIFFSize = v }(riff.MaxRIFFSize)
+	riff.MaxRIFFSize = int64(len(src))
+
+	var b bytes.Buffer
+	if err := riff.Write(&b, bytes.NewReader(src), makeTestDocument(T, "converted")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := b.Bytes()
+	if string(out[:4]) != "RF64" || binary.LittleEndian.Uint32(out[4:]) != 0xFFFFFFFF {
+		T.Fatalf("expected RF64 header, got %q", out[:4])
+	}
+	if string(out[12:16]) != "ds64" {
+		T.Fatalf("expected ds64 in place of JUNK, got %q", out[12:16])
+	}
+	ds64 := out[20:]
+	if size := binary.LittleEndian.Uint64(ds64); int(size)+8 != len(out) {
+		T.Errorf("invalid ds64 RIFF size %d for file size %d", size, len(out))
+	}
+	if size := binary.LittleEndian.Uint64(ds64[8:]); size != uint64(len(riffSamples)) {
+		T.Errorf("invalid ds64 data size: expected=%d got=%d", len(riffSamples), size)
+	}
+	if n := binary.LittleEndian.Uint64(ds64[16:]); n != 1234 {
+		T.Errorf("invalid ds64 sample count: expected=1234 got=%d", n)
+	}
+	checkRiffSamples(T, out)
+}
+
+func TestAviStaticLayout(T *testing.T) {
+	packet, _ := xmp.Marshal(makeTestDocument(T, "x"))
+	src := makeTestWAV("RIFF", "AVI ",
+		riffChunk("LIST", []byte("hdrl"), riffChunk("avih", make([]byte, 56))),
+		riffChunk("_PMX", packet),
+		riffChunk("movi", riffSamples),
+	)
+	var b bytes.Buffer
+	if err := riff.Write(&b, bytes.NewReader(src), makeTestDocument(T, "a much longer title")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := b.Bytes()
+	if i, j := bytes.Index(src, []byte("movi")), bytes.Index(out, []byte("movi")); i != j {
+		T.Errorf("movi chunk moved from %d to %d", i, j)
+	}
+	if !bytes.Contains(out, []byte("JUNK")) {
+		T.Errorf("missing JUNK chunk in place of old packet")
+	}
+	checkRiffSamples(T, out)
+	d, err := riff.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "a much longer title" {
+		T.Errorf("invalid title %s", v)
+	}
+}
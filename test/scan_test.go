@@ -0,0 +1,177 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Packet scanner tests
+//
+
+// makeScanPacket returns a packet with a large description and the given
+// trailer flag.
+func makeScanPacket(T *testing.T, size int, end string) []byte {
+	d := xmp.NewDocument()
+	if err := d.SetPath(xmp.PathValue{
+		Path:  xmp.Path("dc:description"),
+		Value: strings.Repeat("x", size),
+		Flags: xmp.CREATE,
+	}); err != nil {
+		T.Fatalf("set path failed: %v", err)
+	}
+	packet, err := xmp.Marshal(d)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	if end != "w" {
+		packet = bytes.Replace(packet, []byte(`<?xpacket end="w"?>`), []byte(`<?xpacket end="`+end+`"?>`), 1)
+	}
+	return packet
+}
+
+func TestScanLargePacket(T *testing.T) {
+	packet := makeScanPacket(T, 200000, "w")
+	file := append([]byte("garbage"), packet...)
+	file = append(file, "more garbage"...)
+
+	l, err := xmp.ScanPackets(bytes.NewReader(file))
+	if err != nil {
+		T.Fatalf("scan failed: %v", err)
+	}
+	if len(l) != 1 || !bytes.Equal(l[0], packet) {
+		T.Fatalf("expected packet of %d bytes, got %d packets", len(packet), len(l))
+	}
+
+	info, err := xmp.ScanPacketInfo(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		T.Fatalf("scan info failed: %v", err)
+	}
+	if len(info) != 1 {
+		T.Fatalf("expected 1 packet, got %d", len(info))
+	}
+	p := info[0]
+	if p.Offset != 7 || p.Length != int64(len(packet)) {
+		T.Errorf("wrong position: offset=%d length=%d", p.Offset, p.Length)
+	}
+	if !p.Writable || p.Encoding != xmp.EncodingUTF8 {
+		T.Errorf("wrong flags: writable=%v encoding=%v", p.Writable, p.Encoding)
+	}
+	b, err := xmp.ReadPacketAt(bytes.NewReader(file), p)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(b, packet) {
+		T.Errorf("packet mismatch")
+	}
+}
+
+func TestScanPacketInfo(T *testing.T) {
+	ro := makeScanPacket(T, 10, "r")
+	padded := bytes.Replace(makeScanPacket(T, 10, "w"), []byte("\n<?xpacket end"), []byte(strings.Repeat(" ", 99)+"\n<?xpacket end"), 1)
+	utf16 := xmp.EncodingUTF16LE.Encode(padded)
+	utf32 := xmp.EncodingUTF32BE.Encode(ro)
+
+	var file []byte
+	offsets := make([]int64, 0, 4)
+	for _, v := range [][]byte{ro, padded, utf16, utf32} {
+		file = append(file, "\x00\x01\x02"...)
+		offsets = append(offsets, int64(len(file)))
+		file = append(file, v...)
+	}
+	// a truncated packet is ignored
+	file = append(file, ro[:len(ro)/2]...)
+
+	l, err := xmp.ScanPacketInfo(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		T.Fatalf("scan failed: %v", err)
+	}
+	if len(l) != 4 {
+		T.Fatalf("expected 4 packets, got %d", len(l))
+	}
+	expect := []struct {
+		length   int
+		padding  int64
+		writable bool
+		enc      xmp.Encoding
+	}{
+		{len(ro), 1, false, xmp.EncodingUTF8},
+		{len(padded), 100, true, xmp.EncodingUTF8},
+		{len(utf16), 200, true, xmp.EncodingUTF16LE},
+		{len(utf32), 4, false, xmp.EncodingUTF32BE},
+	}
+	for i, v := range expect {
+		p := l[i]
+		if p.Offset != offsets[i] || p.Length != int64(v.length) {
+			T.Errorf("packet %d: wrong position offset=%d length=%d", i, p.Offset, p.Length)
+		}
+		if p.Padding != v.padding {
+			T.Errorf("packet %d: expected padding %d, got %d", i, v.padding, p.Padding)
+		}
+		if p.Writable != v.writable {
+			T.Errorf("packet %d: expected writable=%v", i, v.writable)
+		}
+		if p.Encoding != v.enc {
+			T.Errorf("packet %d: expected encoding %v, got %v", i, v.enc, p.Encoding)
+		}
+		b, err := xmp.ReadPacketAt(bytes.NewReader(file), p)
+		if err != nil {
+			T.Fatalf("packet %d: read failed: %v", i, err)
+		}
+		d := xmp.NewDocument()
+		if err := xmp.Unmarshal(b, d); err != nil {
+			T.Errorf("packet %d: unmarshal failed: %v", i, err)
+		}
+	}
+}
+
+func TestScanLittleEndianAfterZeros(T *testing.T) {
+	packet := makeScanPacket(T, 10, "w")
+	bom := bytes.Replace(packet, []byte(`begin=""`), []byte("begin=\"\ufeff\""), 1)
+	tests := []struct {
+		enc    xmp.Encoding
+		prefix string
+		src    []byte
+	}{
+		{xmp.EncodingUTF16LE, "\n\x00", bom},
+		{xmp.EncodingUTF16LE, "\n\x00", packet},
+		{xmp.EncodingUTF16LE, "\x00", bom},
+		{xmp.EncodingUTF16LE, "\x00\x00\x00\x00", bom},
+		{xmp.EncodingUTF16LE, "\x00\x00\x00\x00", packet},
+		{xmp.EncodingUTF32LE, "\n\x00\x00\x00", bom},
+		{xmp.EncodingUTF32LE, "\n\x00\x00\x00", packet},
+		{xmp.EncodingUTF32LE, "\x00\x00", bom},
+		{xmp.EncodingUTF32LE, "\x00\x00\x00\x00", bom},
+		{xmp.EncodingUTF32LE, "\x00\x00\x00\x00", packet},
+	}
+	for _, v := range tests {
+		file := append([]byte(v.prefix), v.enc.Encode(v.src)...)
+		l, err := xmp.ScanPacketInfo(bytes.NewReader(file), int64(len(file)))
+		if err != nil {
+			T.Fatalf("%v %q: scan failed: %v", v.enc, v.prefix, err)
+		}
+		if len(l) != 1 {
+			T.Fatalf("%v %q: expected 1 packet, got %d", v.enc, v.prefix, len(l))
+		}
+		p := l[0]
+		if p.Encoding != v.enc || p.Offset != int64(len(v.prefix)) || p.Length != int64(len(file)-len(v.prefix)) {
+			T.Errorf("%v %q: wrong packet encoding=%v offset=%d length=%d", v.enc, v.prefix, p.Encoding, p.Offset, p.Length)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/go-xmp/xmp"
+	"github.com/mholt/go-xmp/xmpfiles"
+)
+
+// Sidecar resolution tests
+//
+
+func writeTestFile(T *testing.T, name string, b []byte) {
+	if err := ioutil.WriteFile(name, b, 0644); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+}
+
+func makeTestDocumentWith(T *testing.T, values map[string]string) *xmp.Document {
+	d := xmp.NewDocument()
+	for k, v := range values {
+		if err := d.SetPath(xmp.PathValue{Path: xmp.Path(k), Value: v, Flags: xmp.CREATE}); err != nil {
+			T.Fatalf("set path failed: %v", err)
+		}
+	}
+	return d
+}
+
+func TestFindSidecar(T *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raw := filepath.Join(dir, "IMG_1234.CR2")
+	writeTestFile(T, raw, []byte("raw"))
+	if _, err := xmpfiles.FindSidecar(raw); err != xmpfiles.ErrNoSidecar {
+		T.Errorf("expected ErrNoSidecar, got %v", err)
+	}
+	writeTestFile(T, filepath.Join(dir, "IMG_1234.XMP"), makeTestPacket(T, "a"))
+	if p, err := xmpfiles.FindSidecar(raw); err != nil || filepath.Base(p) != "IMG_1234.XMP" {
+		T.Errorf("expected IMG_1234.XMP, got %q %v", p, err)
+	}
+	writeTestFile(T, filepath.Join(dir, "IMG_1234.cr2.xmp"), makeTestPacket(T, "b"))
+	if p, err := xmpfiles.FindSidecar(raw); err != nil || filepath.Base(p) != "IMG_1234.cr2.xmp" {
+		T.Errorf("expected IMG_1234.cr2.xmp, got %q %v", p, err)
+	}
+
+	if p := xmpfiles.SidecarPath(raw, xmpfiles.ReplaceExt); p != filepath.Join(dir, "IMG_1234.xmp") {
+		T.Errorf("wrong sidecar path %s", p)
+	}
+	if p := xmpfiles.SidecarPath(raw, xmpfiles.AppendExt); p != raw+".xmp" {
+		T.Errorf("wrong sidecar path %s", p)
+	}
+}
+
+func TestSidecarReconcile(T *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecar")
+	if err != nil {
+		T.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jpg, _ := makeTestJPEG()
+	var buf bytes.Buffer
+	embedded := makeTestDocumentWith(T, map[string]string{
+		"dc:title":        "embedded",
+		"xmp:CreatorTool": "camera",
+	})
+	if err := xmpfiles.Write(&buf, bytes.NewReader(jpg), embedded); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	name := filepath.Join(dir, "photo.jpg")
+	writeTestFile(T, name, buf.Bytes())
+
+	// embedded only
+	d, err := xmpfiles.ReadWithSidecar(name, xmpfiles.DefaultSidecarPolicy)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "embedded")
+
+	// without sidecar the media file owns the data
+	p, err := xmpfiles.WriteWithSidecar(name, makeTestDocument(T, "updated"), xmpfiles.DefaultSidecarPolicy)
+	if err != nil || p != name {
+		T.Fatalf("expected write to %s, got %s: %v", name, p, err)
+	}
+	d, err = xmpfiles.ReadWithSidecar(name, xmpfiles.DefaultSidecarPolicy)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "updated")
+
+	// restore embedded metadata and add a sidecar
+	writeTestFile(T, name, buf.Bytes())
+	sidecar := makeTestDocumentWith(T, map[string]string{
+		"dc:title":  "sidecar",
+		"xmp:Label": "red",
+	})
+	packet, err := xmp.Marshal(sidecar)
+	if err != nil {
+		T.Fatalf("marshal failed: %v", err)
+	}
+	writeTestFile(T, filepath.Join(dir, "Photo.XMP"), packet)
+
+	for _, v := range []struct {
+		prec  xmpfiles.Precedence
+		title string
+	}{
+		{xmpfiles.PreferSidecar, "sidecar"},
+		{xmpfiles.PreferEmbedded, "embedded"},
+	} {
+		policy := xmpfiles.DefaultSidecarPolicy
+		policy.Precedence = v.prec
+		d, err := xmpfiles.ReadWithSidecar(name, policy)
+		if err != nil {
+			T.Fatalf("read failed: %v", err)
+		}
+		checkTitle(T, d, v.title)
+		for path, value := range map[string]string{"xmp:CreatorTool": "camera", "xmp:Label": "red"} {
+			if s, _ := d.GetPath(xmp.Path(path)); s != value {
+				T.Errorf("%s: expected %q, got %q", path, value, s)
+			}
+		}
+	}
+
+	// an existing sidecar owns the data
+	p, err = xmpfiles.WriteWithSidecar(name, makeTestDocument(T, "new"), xmpfiles.DefaultSidecarPolicy)
+	if err != nil || filepath.Base(p) != "Photo.XMP" {
+		T.Fatalf("expected write to sidecar, got %s: %v", p, err)
+	}
+	if b, _ := ioutil.ReadFile(name); !bytes.Equal(b, buf.Bytes()) {
+		T.Errorf("media file modified")
+	}
+
+	// raw files are never modified
+	raw := filepath.Join(dir, "IMG_0001.NEF")
+	writeTestFile(T, raw, makeTestTIFF(binary.LittleEndian, false))
+	policy := xmpfiles.DefaultSidecarPolicy
+	policy.Convention = xmpfiles.AppendExt
+	p, err = xmpfiles.WriteWithSidecar(raw, makeTestDocument(T, "raw"), policy)
+	if err != nil || p != raw+".xmp" {
+		T.Fatalf("expected new sidecar, got %s: %v", p, err)
+	}
+	d, err = xmpfiles.ReadWithSidecar(raw, policy)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	checkTitle(T, d, "raw")
+}
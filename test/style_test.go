@@ -0,0 +1,178 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// Serialization style tests
+//
+
+const styleTest = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+ <rdf:Description rdf:about=""
+   xmlns:dc="http://purl.org/dc/elements/1.1/"
+   xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+   xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"
+   xmlns:stRef="http://ns.adobe.com/xap/1.0/sType/ResourceRef#"
+   xmlns:ex="http://example.com/ns/"
+   xmp:CreatorTool="Tool"
+   xmpMM:DocumentID="uuid:11111111-2222-3333-4444-555555555555">
+  <dc:title>
+   <rdf:Alt>
+    <rdf:li xml:lang="x-default">Title</rdf:li>
+   </rdf:Alt>
+  </dc:title>
+  <xmpMM:DerivedFrom rdf:parseType="Resource">
+   <stRef:documentID>uuid:aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee</stRef:documentID>
+  </xmpMM:DerivedFrom>
+  <ex:simple>text</ex:simple>
+  <ex:struct rdf:parseType="Resource">
+   <ex:field>value</ex:field>
+  </ex:struct>
+ </rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+
+var styleTestPaths = map[string]string{
+	"dc:title":                           "Title",
+	"xmp:CreatorTool":                    "Tool",
+	"xmpMM:DocumentID":                   "uuid:11111111-2222-3333-4444-555555555555",
+	"xmpMM:DerivedFrom/stRef:documentID": "uuid:aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee",
+	"ex:simple":                          "text",
+	"ex:struct/ex:field":                 "value",
+}
+
+func encodeStyle(T *testing.T, d *xmp.Document, flags int, enc xmp.Encoding) []byte {
+	var b bytes.Buffer
+	e := xmp.NewEncoder(&b)
+	e.SetFlags(flags)
+	e.SetEncoding(enc)
+	if err := e.Encode(d); err != nil {
+		T.Fatalf("encode failed: %v", err)
+	}
+	return b.Bytes()
+}
+
+func TestEncodeStyles(T *testing.T) {
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal([]byte(styleTest), d); err != nil {
+		T.Fatalf("unmarshal failed: %v", err)
+	}
+	type check struct {
+		s   string
+		min int
+		max int
+	}
+	tests := []struct {
+		name   string
+		flags  int
+		checks []check
+	}{
+		{"default", xmp.Xpacket, []check{
+			{"<?xpacket", 2, 2},
+			{"<x:xmpmeta", 1, 1},
+			{"rdf:parseType=\"Resource\"", 1, -1},
+		}},
+		{"canonical", xmp.Xcanonical, []check{
+			{"<?xpacket", 0, 0},
+			{"<xmp:CreatorTool>Tool</xmp:CreatorTool>", 1, 1},
+			{"<xmpMM:DocumentID>", 1, 1},
+			{"xmp:CreatorTool=", 0, 0},
+		}},
+		{"compact", xmp.Xcompact, []check{
+			{"xmp:CreatorTool=\"Tool\"", 1, 1},
+			{"ex:simple=\"text\"", 1, 1},
+			{"<ex:simple>", 0, 0},
+			{"<ex:struct", 1, 1},
+		}},
+		{"single", xmp.Xsingle | xmp.Xcompact, []check{
+			{"<rdf:Description", 1, 1},
+			{"xmlns:ex=", 1, 1},
+			{"rdf:about=", 1, 1},
+		}},
+		{"nested", xmp.Xnested | xmp.Xnometa, []check{
+			{"<x:xmpmeta", 0, 0},
+			{"rdf:parseType=\"Resource\"", 0, 0},
+			{"<ex:struct><rdf:Description>", 1, 1},
+		}},
+	}
+	for _, v := range tests {
+		buf := encodeStyle(T, d, v.flags, xmp.EncodingUTF8)
+		for _, c := range v.checks {
+			n := bytes.Count(buf, []byte(c.s))
+			if n < c.min || (c.max >= 0 && n > c.max) {
+				T.Errorf("%s: found %q %d times\n%s", v.name, c.s, n, string(buf))
+			}
+		}
+		d2 := xmp.NewDocument()
+		if err := xmp.Unmarshal(buf, d2); err != nil {
+			T.Errorf("%s: unmarshal failed: %v\n%s", v.name, err, string(buf))
+			continue
+		}
+		checkPaths(T, d2, styleTestPaths)
+	}
+}
+
+func TestEncodeWide(T *testing.T) {
+	d := makeTestDocument(T, "Wide")
+	for _, enc := range []xmp.Encoding{
+		xmp.EncodingUTF16BE,
+		xmp.EncodingUTF16LE,
+		xmp.EncodingUTF32BE,
+		xmp.EncodingUTF32LE,
+	} {
+		buf := encodeStyle(T, d, xmp.Xpacket, enc)
+		if len(buf)%enc.UnitSize() != 0 {
+			T.Errorf("%v: invalid length %d", enc, len(buf))
+		}
+		l, err := xmp.ScanPacketInfo(bytes.NewReader(buf), int64(len(buf)))
+		if err != nil || len(l) != 1 {
+			T.Errorf("%v: scan failed: %v", enc, err)
+			continue
+		}
+		if l[0].Encoding != enc {
+			T.Errorf("%v: wrong encoding %v", enc, l[0].Encoding)
+		}
+		packet, err := xmp.ReadPacketAt(bytes.NewReader(buf), l[0])
+		if err != nil {
+			T.Errorf("%v: read failed: %v", enc, err)
+			continue
+		}
+		d2 := xmp.NewDocument()
+		if err := xmp.Unmarshal(packet, d2); err != nil {
+			T.Errorf("%v: unmarshal failed: %v", enc, err)
+			continue
+		}
+		checkTitle(T, d2, "Wide")
+	}
+
+	// padding fills the size limit
+	var b bytes.Buffer
+	e := xmp.NewEncoder(&b)
+	e.SetFlags(xmp.Xpacket | xmp.Xpadding)
+	e.SetEncoding(xmp.EncodingUTF16LE)
+	e.SetMaxSize(4096)
+	if err := e.Encode(d); err != nil {
+		T.Fatalf("encode failed: %v", err)
+	}
+	if b.Len() != 4096 {
+		T.Errorf("expected 4096 bytes, got %d", b.Len())
+	}
+}
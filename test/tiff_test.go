@@ -0,0 +1,203 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/tiff"
+	_ "github.com/mholt/go-xmp/models"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// TIFF container tests
+//
+
+var tiffPixels = []byte("PIXELDATA")
+
+// a minimal TIFF file with image data and a single IFD holding image
+// width and length
+func makeTestTIFF(order binary.ByteOrder, big bool) []byte {
+	var b bytes.Buffer
+	if order == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+	u16 := func(v uint16) { binary.Write(&b, order, v) }
+	u32 := func(v uint32) { binary.Write(&b, order, v) }
+	u64 := func(v uint64) { binary.Write(&b, order, v) }
+	if big {
+		u16(43)
+		u16(8)
+		u16(0)
+		u64(uint64(16 + len(tiffPixels) + 1))
+	} else {
+		u16(42)
+		u32(uint32(8 + len(tiffPixels) + 1))
+	}
+	b.Write(tiffPixels)
+	b.WriteByte(0)
+	if big {
+		u64(2)
+		for _, tag := range []uint16{256, 257} {
+			u16(tag)
+			u16(3)
+			u64(1)
+			u16(100)
+			u16(0)
+			u32(0)
+		}
+		u64(0)
+	} else {
+		u16(2)
+		for _, tag := range []uint16{256, 257} {
+			u16(tag)
+			u16(3)
+			u32(1)
+			u16(100)
+			u16(0)
+		}
+		u32(0)
+	}
+	return b.Bytes()
+}
+
+func testTiffRoundtrip(T *testing.T, order binary.ByteOrder, big bool) {
+	src := makeTestTIFF(order, big)
+	if _, err := tiff.ReadPacket(bytes.NewReader(src)); err != tiff.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+
+	// add a new tag
+	var b1 bytes.Buffer
+	if err := tiff.Write(&b1, bytes.NewReader(src), makeTestDocument(T, "first")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	d, err := tiff.Read(bytes.NewReader(b1.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "first" {
+		T.Errorf("invalid title: expected=first got=%s", v)
+	}
+	if !bytes.Contains(b1.Bytes()[:len(src)], tiffPixels) {
+		T.Errorf("image data not preserved")
+	}
+
+	// update in place with a shorter value
+	var b2 bytes.Buffer
+	if err := tiff.Write(&b2, bytes.NewReader(b1.Bytes()), makeTestDocument(T, "2nd")); err != nil {
+		T.Fatalf("rewrite failed: %v", err)
+	}
+	if l1, l2 := b1.Len(), b2.Len(); l1 != l2 {
+		T.Errorf("expected in-place update, size changed from %d to %d", l1, l2)
+	}
+	d, err = tiff.Read(bytes.NewReader(b2.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "2nd" {
+		T.Errorf("invalid title: expected=2nd got=%s", v)
+	}
+
+	// relocate a larger packet
+	var b3 bytes.Buffer
+	long := strings.Repeat("long title ", 100) + "end"
+	if err := tiff.Write(&b3, bytes.NewReader(b2.Bytes()), makeTestDocument(T, long)); err != nil {
+		T.Fatalf("rewrite failed: %v", err)
+	}
+	if b3.Len() <= b2.Len() {
+		T.Errorf("expected relocated packet to grow the file")
+	}
+	d, err = tiff.Read(bytes.NewReader(b3.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != long {
+		T.Errorf("invalid title after relocation: got=%s", v)
+	}
+}
+
+func TestTiffRoundtrip(T *testing.T) {
+	testTiffRoundtrip(T, binary.LittleEndian, false)
+	testTiffRoundtrip(T, binary.BigEndian, false)
+	testTiffRoundtrip(T, binary.LittleEndian, true)
+	testTiffRoundtrip(T, binary.BigEndian, true)
+}
+
+// corrupt tag 700 entries must fail without allocating the claimed size
+func TestTiffCorruptCount(T *testing.T) {
+	for _, big := range []bool{false, true} {
+		var b bytes.Buffer
+		src := makeTestTIFF(binary.LittleEndian, big)
+		if err := tiff.Write(&b, bytes.NewReader(src), makeTestDocument(T, "title")); err != nil {
+			T.Fatalf("write failed: %v", err)
+		}
+		valid := b.Bytes()
+		pos := bytes.LastIndex(valid, []byte{0xbc, 0x02, 0x07, 0x00})
+		if pos < 0 {
+			T.Fatalf("tag 700 not found")
+		}
+		put := func(b []byte, v uint64) {
+			if big {
+				binary.LittleEndian.PutUint64(b, v)
+			} else {
+				binary.LittleEndian.PutUint32(b, uint32(v))
+			}
+		}
+		field := 4
+		if big {
+			field = 8
+		}
+		corpus := make([][]byte, 0)
+		for _, v := range []struct{ count, offset uint64 }{
+			{0xFFFFFFFF, 0},
+			{0x80000001, 0},
+			{uint64(len(valid)) + 1, 0},
+			{100, uint64(len(valid)) - 50},
+			{100, 1<<64 - 10},
+		} {
+			c := append([]byte{}, valid...)
+			put(c[pos+4:], v.count)
+			if v.offset > 0 {
+				put(c[pos+4+field:], v.offset)
+			}
+			corpus = append(corpus, c)
+		}
+		for i, c := range corpus {
+			if _, err := tiff.PacketSize(bytes.NewReader(c)); err == nil {
+				T.Errorf("big=%v %d: expected PacketSize error", big, i)
+			}
+			if _, err := tiff.ReadPacket(bytes.NewReader(c)); err == nil {
+				T.Errorf("big=%v %d: expected ReadPacket error", big, i)
+			}
+			var out bytes.Buffer
+			if err := tiff.Write(&out, bytes.NewReader(c), makeTestDocument(T, "new")); err == nil {
+				T.Errorf("big=%v %d: expected Write error", big, i)
+			}
+		}
+
+		// truncated files must not panic
+		for n := range valid {
+			var out bytes.Buffer
+			tiff.ReadPacket(bytes.NewReader(valid[:n]))
+			tiff.Write(&out, bytes.NewReader(valid[:n]), makeTestDocument(T, "new"))
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/webp"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// WebP container tests
+//
+
+func webpChunk(id string, data []byte) []byte {
+	b := make([]byte, 8+len(data)+len(data)&1)
+	copy(b, id)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	copy(b[8:], data)
+	return b
+}
+
+func makeTestWebP(chunks ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	for _, v := range chunks {
+		b.Write(v)
+	}
+	buf := b.Bytes()
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-8))
+	return buf
+}
+
+// lossless 3x2 pixel bitstream header with alpha
+var testVP8L = []byte{0x2f, 0x02, 0x40, 0x00, 0x10, 0xaa, 0xbb}
+
+func TestWebPSimple(T *testing.T) {
+	src := makeTestWebP(webpChunk("VP8L", testVP8L))
+	if _, err := webp.ReadPacket(bytes.NewReader(src)); err != webp.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := webp.Write(&buf, bytes.NewReader(src), makeTestDocument(T, "webp")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := buf.Bytes()
+	if int(binary.LittleEndian.Uint32(out[4:])) != len(out)-8 {
+		T.Errorf("invalid RIFF size")
+	}
+	l, err := webp.Chunks(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("parse failed: %v", err)
+	}
+	if len(l) != 3 || l[0].ID != "VP8X" || l[1].ID != "VP8L" || l[2].ID != "XMP " {
+		T.Fatalf("invalid chunk order")
+	}
+	vp8x := out[l[0].Offset+8 : l[0].Offset+18]
+	if vp8x[0] != 0x14 {
+		T.Errorf("invalid VP8X flags: %#x", vp8x[0])
+	}
+	if !bytes.Equal(vp8x[4:], []byte{2, 0, 0, 1, 0, 0}) {
+		T.Errorf("invalid canvas size: %x", vp8x[4:])
+	}
+	d, err := webp.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "webp" {
+		T.Errorf("invalid title: %s", v)
+	}
+
+	// removing the packet clears the flag
+	buf = bytes.Buffer{}
+	if err := webp.WritePacket(&buf, bytes.NewReader(out), nil); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out = buf.Bytes()
+	if _, err := webp.ReadPacket(bytes.NewReader(out)); err != webp.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+	if out[20]&0x04 != 0 {
+		T.Errorf("XMP flag not cleared")
+	}
+}
+
+func TestWebPExtended(T *testing.T) {
+	vp8x := []byte{0x20, 0, 0, 0, 9, 0, 0, 9, 0, 0}
+	src := makeTestWebP(
+		webpChunk("VP8X", vp8x),
+		webpChunk("ICCP", []byte("profile")),
+		webpChunk("VP8L", testVP8L),
+		webpChunk("XMP ", makeTestPacket(T, "old")),
+		webpChunk("EXIF", []byte("exif")),
+	)
+	var buf bytes.Buffer
+	if err := webp.Write(&buf, bytes.NewReader(src), makeTestDocument(T, "new")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	out := buf.Bytes()
+	l, err := webp.Chunks(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("parse failed: %v", err)
+	}
+	var ids []string
+	for _, c := range l {
+		ids = append(ids, c.ID)
+	}
+	if len(ids) != 5 || ids[1] != "ICCP" || ids[3] != "EXIF" || ids[4] != "XMP " {
+		T.Errorf("invalid chunk order: %v", ids)
+	}
+	if out[20] != 0x24 || !bytes.Equal(out[24:30], vp8x[4:]) {
+		T.Errorf("VP8X not preserved: %x", out[20:30])
+	}
+	d, err := webp.Read(bytes.NewReader(out))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "new" {
+		T.Errorf("invalid title: %s", v)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mholt/go-xmp/format/psd"
+	"github.com/mholt/go-xmp/xmp"
+	"github.com/mholt/go-xmp/xmpfiles"
+)
+
+// Format registry tests
+//
+
+func TestRegistryDetect(T *testing.T) {
+	jpg, _ := makeTestJPEG()
+	cases := map[string][]byte{
+		"jpeg": jpg,
+		"png":  makeTestPNG(),
+		"gif":  testGIF,
+		"webp": makeTestWebP(webpChunk("VP8L", testVP8L)),
+		"psd":  makeTestPSD(),
+		"jp2":  makeTestJP2(),
+		"jxl":  makeTestJXL(),
+		"bmff": makeTestMovie("isom"),
+		"riff": makeTestWAV("RIFF", "WAVE"),
+		"xmp":  makeTestPacket(T, "sidecar"),
+	}
+	for name, src := range cases {
+		h, err := xmpfiles.Detect(bytes.NewReader(src))
+		if err != nil {
+			T.Errorf("%s: detect failed: %v", name, err)
+			continue
+		}
+		if h.Name() != name {
+			T.Errorf("%s: detected as %s", name, h.Name())
+		}
+	}
+	if _, err := xmpfiles.Detect(bytes.NewReader([]byte("unknown"))); err != xmpfiles.ErrUnknownFormat {
+		T.Errorf("expected ErrUnknownFormat, got %v", err)
+	}
+}
+
+func TestRegistryReadWrite(T *testing.T) {
+	src := makeTestPSD(&psd.Resource{ID: 1060, Data: makeTestPacket(T, "psd")})
+	l, err := xmpfiles.ReadPackets(bytes.NewReader(src))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	p := l[0]
+	if p.Offset < 0 || !bytes.Equal(src[p.Offset:p.Offset+p.Length], p.Data) {
+		T.Errorf("invalid packet offset %d", p.Offset)
+	}
+	h := xmpfiles.Lookup("psd")
+	if ok, err := h.CanUpdateInPlace(bytes.NewReader(src), int(p.Length)); err != nil || !ok {
+		T.Errorf("expected in-place update to be possible: %v", err)
+	}
+	if ok, _ := h.CanUpdateInPlace(bytes.NewReader(src), int(p.Length)+1); ok {
+		T.Errorf("larger packet must not fit in place")
+	}
+	if ok, _ := xmpfiles.Lookup("png").CanUpdateInPlace(bytes.NewReader(makeTestPNG()), 10); ok {
+		T.Errorf("png has no packet to update")
+	}
+
+	var buf bytes.Buffer
+	if err := xmpfiles.Write(&buf, bytes.NewReader(src), makeTestDocument(T, "updated")); err != nil {
+		T.Fatalf("write failed: %v", err)
+	}
+	d, err := xmpfiles.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "updated" {
+		T.Errorf("invalid title: %s", v)
+	}
+	if _, err := xmpfiles.Read(bytes.NewReader(makeTestPSD())); err != xmpfiles.ErrNoXMP {
+		T.Errorf("expected ErrNoXMP, got %v", err)
+	}
+
+	// unknown formats are scanned
+	raw := append([]byte("UNKNOWN FORMAT"), makeTestPacket(T, "scan")...)
+	d, err = xmpfiles.Read(bytes.NewReader(raw))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "scan" {
+		T.Errorf("invalid title: %s", v)
+	}
+}
+
+func TestRegistryReadSidecar(T *testing.T) {
+	f, err := os.Open("../samples/16_9.xmp")
+	if err != nil {
+		T.Fatalf("open failed: %v", err)
+	}
+	defer f.Close()
+	if h, err := xmpfiles.Detect(f); err != nil || h.Name() != "xmp" {
+		T.Fatalf("expected xmp handler, got %v", err)
+	}
+	d, err := xmpfiles.Read(f)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if len(d.Namespaces()) == 0 {
+		T.Errorf("no namespaces decoded")
+	}
+	l, err := xmpfiles.ReadPackets(f)
+	if err != nil || len(l) != 1 || l[0].Offset != 0 {
+		T.Errorf("read packets failed: %v", err)
+	}
+}
+
+func TestRegistryReadXMLDecl(T *testing.T) {
+	// darktable writes sidecars with an XML declaration and no wrapper
+	src := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="XMP Core 4.4.0-Exiv2">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:Rating="3"/>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+	r := strings.NewReader(src)
+	if h, err := xmpfiles.Detect(r); err != nil || h.Name() != "xmp" {
+		T.Fatalf("expected xmp handler, got %v", err)
+	}
+	d, err := xmpfiles.Read(r)
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("xmp:Rating")); v != "3" {
+		T.Errorf("invalid rating: expected=3 got=%s", v)
+	}
+	l, err := xmpfiles.ReadPackets(r)
+	if err != nil || len(l) != 1 || string(l[0].Data) != src {
+		T.Errorf("read packets failed: %v", err)
+	}
+}
+
+func TestRegistryDuplicatePacket(T *testing.T) {
+	// a copy of the packet in another resource makes the offset ambiguous
+	packet := makePaddedPacket(T, "psd", 2048, xmp.EncodingUTF8)
+	src := makeTestPSD(
+		&psd.Resource{ID: 1000, Data: packet},
+		&psd.Resource{ID: 1060, Data: packet},
+	)
+	l, err := xmpfiles.ReadPackets(bytes.NewReader(src))
+	if err != nil || len(l) != 1 {
+		T.Fatalf("read failed: %v", err)
+	}
+	if l[0].Offset != -1 {
+		T.Errorf("expected unknown offset, got %d", l[0].Offset)
+	}
+	if ok, err := xmpfiles.Lookup("psd").CanUpdateInPlace(bytes.NewReader(src), 100); err != nil || ok {
+		T.Errorf("expected no in-place update: %v", err)
+	}
+	if err := xmpfiles.UpdateInPlace(newMemFile(src), makeTestDocument(T, "new")); err != xmpfiles.ErrInPlace {
+		T.Errorf("expected ErrInPlace, got %v", err)
+	}
+}
+
+// testHandler claims files starting with TEST and returns a fixed packet.
+type testHandler struct {
+	packet []byte
+}
+
+func (h *testHandler) Name() string            { return "test" }
+func (h *testHandler) Detect(head []byte) bool { return bytes.HasPrefix(head, []byte("TEST")) }
+
+func (h *testHandler) ReadPackets(r io.ReadSeeker) ([]*xmpfiles.Packet, error) {
+	return []*xmpfiles.Packet{{Offset: -1, Length: int64(len(h.packet)), Data: h.packet}}, nil
+}
+
+func (h *testHandler) Read(r io.ReadSeeker) (*xmp.Document, error) {
+	d := xmp.NewDocument()
+	return d, xmp.Unmarshal(h.packet, d)
+}
+
+func (h *testHandler) Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	return nil
+}
+
+func (h *testHandler) CanUpdateInPlace(r io.ReadSeeker, size int) (bool, error) {
+	return false, nil
+}
+
+func TestRegistryCustomHandler(T *testing.T) {
+	xmpfiles.Register(&testHandler{packet: makeTestPacket(T, "custom")})
+	d, err := xmpfiles.Read(bytes.NewReader([]byte("TEST FILE")))
+	if err != nil {
+		T.Fatalf("read failed: %v", err)
+	}
+	if v, _ := d.GetPath(xmp.Path("dc:title")); v != "custom" {
+		T.Errorf("invalid title: %s", v)
+	}
+	if xmpfiles.Lookup("test") == nil {
+		T.Errorf("lookup failed")
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// AliasForm describes how an alias property maps onto its base property.
+type AliasForm int
+
+const (
+	AliasSimple      AliasForm = iota // alias and base are simple values
+	AliasArrayItem                    // alias is the first item of the base array
+	AliasDefaultLang                  // alias is the x-default item of the base alt-text
+	AliasArray                        // alias and base are equal arrays
+)
+
+// Alias maps an alias property onto its base property as defined by ISO
+// 16684-1 section 6.2.4 and the Adobe XMP SDK.
+type Alias struct {
+	Alias Path
+	Base  Path
+	Form  AliasForm
+}
+
+// AliasConflict reports an alias whose value differs from its base.
+type AliasConflict struct {
+	Alias      Path
+	Base       Path
+	AliasValue string
+	BaseValue  string
+}
+
+func (x AliasConflict) Error() string {
+	return fmt.Sprintf("xmp: alias %s=%q conflicts with %s=%q", x.Alias, x.AliasValue, x.Base, x.BaseValue)
+}
+
+var aliases = struct {
+	m    sync.RWMutex
+	list []Alias
+}{
+	list: []Alias{
+		{"xmp:Author", "dc:creator", AliasArrayItem},
+		{"xmp:Authors", "dc:creator", AliasArray},
+		{"xmp:Description", "dc:description", AliasDefaultLang},
+		{"xmp:Format", "dc:format", AliasSimple},
+		{"xmp:Keywords", "dc:subject", AliasArray},
+		{"xmp:Locale", "dc:language", AliasArrayItem},
+		{"xmp:Title", "dc:title", AliasDefaultLang},
+		{"xmpRights:Copyright", "dc:rights", AliasDefaultLang},
+		{"pdf:Author", "dc:creator", AliasArrayItem},
+		{"pdf:BaseURL", "xmp:BaseURL", AliasSimple},
+		{"pdf:CreationDate", "xmp:CreateDate", AliasSimple},
+		{"pdf:Creator", "xmp:CreatorTool", AliasSimple},
+		{"pdf:ModDate", "xmp:ModifyDate", AliasSimple},
+		{"pdf:Subject", "dc:description", AliasDefaultLang},
+		{"pdf:Title", "dc:title", AliasDefaultLang},
+		{"photoshop:Author", "dc:creator", AliasArrayItem},
+		{"photoshop:Caption", "dc:description", AliasDefaultLang},
+		{"photoshop:Copyright", "dc:rights", AliasDefaultLang},
+		{"photoshop:Keywords", "dc:subject", AliasArray},
+		{"photoshop:Marked", "xmpRights:Marked", AliasSimple},
+		{"photoshop:Title", "dc:title", AliasDefaultLang},
+		{"photoshop:WebStatement", "xmpRights:WebStatement", AliasSimple},
+		{"tiff:Artist", "dc:creator", AliasArrayItem},
+		{"tiff:Copyright", "dc:rights", AliasDefaultLang},
+		{"tiff:DateTime", "xmp:ModifyDate", AliasSimple},
+		{"tiff:ImageDescription", "dc:description", AliasDefaultLang},
+		{"tiff:Software", "xmp:CreatorTool", AliasSimple},
+		// not an SDK alias, but the same value per the MWG guidelines
+		{"exif:DateTimeOriginal", "photoshop:DateCreated", AliasSimple},
+	},
+}
+
+// RegisterAlias adds an alias or replaces the existing alias for the same
+// property.
+func RegisterAlias(a Alias) {
+	aliases.m.Lock()
+	defer aliases.m.Unlock()
+	for i, v := range aliases.list {
+		if v.Alias == a.Alias {
+			aliases.list[i] = a
+			return
+		}
+	}
+	aliases.list = append(aliases.list, a)
+}
+
+// Aliases returns all registered aliases.
+func Aliases() []Alias {
+	aliases.m.RLock()
+	defer aliases.m.RUnlock()
+	return append([]Alias(nil), aliases.list...)
+}
+
+// ResolveAlias returns the base of an alias property.
+func ResolveAlias(p Path) (Alias, bool) {
+	for _, v := range Aliases() {
+		if v.Alias == p {
+			return v, true
+		}
+	}
+	return Alias{}, false
+}
+
+// AliasConflicts returns the aliases found during decoding whose value
+// differs from the value of their base property.
+func (d *Document) AliasConflicts() []AliasConflict {
+	return d.aliasConflicts
+}
+
+// getValue returns the value of p or an empty string. Model fields that
+// are omitted from output are included since models often keep aliases
+// in such fields.
+func (d *Document) getValue(p Path) string {
+	ns, err := p.Namespace(d)
+	if err != nil {
+		return ""
+	}
+	n := d.FindNode(ns)
+	if n == nil {
+		return ""
+	}
+	if n.Model != nil {
+		if v, err := getModelPath(n.Model, p, true); err == nil && v != "" {
+			return v
+		}
+	}
+	v, _ := d.GetPath(p)
+	return v
+}
+
+// getList returns the items of the array at p.
+func (d *Document) getList(p Path) []string {
+	var l []string
+	for i := 0; ; i++ {
+		v := d.getValue(p.AppendIndex(i))
+		if v == "" {
+			return l
+		}
+		l = append(l, v)
+	}
+}
+
+// baseValue returns the value of a's base in the form of the alias.
+func (d *Document) baseValue(a Alias) string {
+	switch a.Form {
+	case AliasArrayItem:
+		return d.getValue(a.Base.AppendIndex(0))
+	case AliasArray:
+		return strings.Join(d.getList(a.Base), "; ")
+	default:
+		return d.getValue(a.Base)
+	}
+}
+
+// foldAliases copies alias values into missing base properties and records
+// conflicting values. Aliases are kept, so models that expose them still
+// see their values.
+func (d *Document) foldAliases() {
+	d.aliasConflicts = nil
+	for _, a := range Aliases() {
+		var value string
+		var items []string
+		if a.Form == AliasArray {
+			items = d.getList(a.Alias)
+			value = strings.Join(items, "; ")
+		} else {
+			value = d.getValue(a.Alias)
+		}
+		if value == "" {
+			continue
+		}
+		base := d.baseValue(a)
+		switch {
+		case base == "":
+			if len(items) == 0 {
+				items = []string{value}
+			}
+			flags := CREATE | NOFAIL
+			if a.Form == AliasArray {
+				flags |= APPEND
+			}
+			for _, v := range items {
+				if err := d.SetPath(PathValue{Path: a.Base, Value: v, Flags: flags}); err != nil {
+					Log.Debugf("xmp: folding alias %s failed: %v", a.Alias, err)
+				}
+			}
+		case base != value:
+			c := AliasConflict{a.Alias, a.Base, value, base}
+			Log.Debugf("%v", c)
+			d.aliasConflicts = append(d.aliasConflicts, c)
+		}
+	}
+}
+
+// encodeAliases writes alias properties with the values of their base
+// properties.
+func (e *Encoder) encodeAliases(d *Document) {
+	for _, a := range Aliases() {
+		value := d.baseValue(a)
+		if value == "" {
+			continue
+		}
+		ns, err := a.Alias.Namespace(d)
+		if err != nil {
+			continue
+		}
+		var n *Node
+		if a.Form == AliasArray {
+			base := findValueNode(e.root, a.Base)
+			if base == nil {
+				continue
+			}
+			n = copyNode(base)
+			n.XMLName = NewName(a.Alias.String())
+		} else {
+			if a.Form != AliasSimple {
+				// other items of the base array are lost
+				value = d.getValue(a.Base.AppendIndex(0))
+				if a.Form == AliasDefaultLang {
+					value = d.getValue(a.Base)
+				}
+			}
+			n = NewNode(NewName(a.Alias.String()))
+			n.Value = value
+		}
+		parent := e.root.Nodes.FindNode(ns)
+		if parent == nil {
+			parent = e.root.AddNode(NewNode(ns.XMLName("")))
+		}
+		for _, v := range parent.Nodes {
+			if v.XMLName.Local == n.XMLName.Local {
+				parent.RemoveNode(v)
+				v.Close()
+				break
+			}
+		}
+		parent.AppendNode(n)
+	}
+}
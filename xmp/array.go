@@ -134,6 +134,17 @@ func (a AltString) Index(lang string) int {
 	return -1
 }
 
+// langIndex works like Index but also matches x-default to a default item
+// without language, the way GetLang reports it.
+func (a AltString) langIndex(lang string) int {
+	for i, v := range a {
+		if v.GetLang() == lang {
+			return i
+		}
+	}
+	return -1
+}
+
 func (a AltString) Get(lang string) string {
 	if lang == "" {
 		return a.Default()
@@ -625,6 +636,7 @@ func UnmarshalArray(d *Decoder, node *Node, typ ArrayType, out interface{}) erro
 		}
 
 		val := reflect.New(itemType)
+		seg := fmt.Sprintf("[%d]", i)
 		if itemType == reflect.TypeOf(AltItem{}) {
 			// Special unmarshalling for AltItems with lang attributes
 			//
@@ -640,7 +652,7 @@ func UnmarshalArray(d *Decoder, node *Node, typ ArrayType, out interface{}) erro
 				}
 			}
 			if err := d.DecodeElement(&i.Value, n); err != nil {
-				return err
+				return nestError(seg, n, err)
 			}
 		} else {
 			// custom unmarshal for other types
@@ -648,7 +660,7 @@ func UnmarshalArray(d *Decoder, node *Node, typ ArrayType, out interface{}) erro
 			// LogDebugf("++++ Array unmarshal custom type=%v\n", val.Type())
 			//
 			if err := d.unmarshal(val.Elem(), nil, n); err != nil {
-				return err
+				return nestError(seg, n, err)
 			}
 		}
 		if sliceValue.Kind() == reflect.Array {
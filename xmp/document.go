@@ -36,6 +36,15 @@ type Document struct {
 
 	// local namespace map for tracking unknown namespaces
 	extNsMap map[string]*Namespace
+
+	// qualifiers by canonical path of the qualified value
+	qualifiers map[Path]QualifierList
+
+	// aliases whose values differ from their base property
+	aliasConflicts []AliasConflict
+
+	// source layout recorded in Dpreserve mode
+	layout *layout
 }
 
 // high-level XMP document interface
@@ -65,6 +74,8 @@ func (d *Document) Close() {
 		v.Close()
 	}
 	d.nodes = nil
+	d.qualifiers = nil
+	d.layout = nil
 }
 
 // cross-model sync, must be explicitly called to merge across models
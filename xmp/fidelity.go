@@ -0,0 +1,545 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Byte-preserving encoding
+//
+// Documents decoded with the Dpreserve flag keep their source bytes and
+// a map of where each top-level property was found. While decoding, the
+// encoder output of every property is recorded as its fingerprint from a
+// separate copy of the document, so the decoded models stay unsynced.
+// When such a document is encoded again, only properties whose output
+// differs from the fingerprint are written. Everything else, including
+// property order, namespace prefixes, whitespace and the packet wrapper,
+// is copied from the source.
+
+// layout is the recorded structure of a source packet.
+type layout struct {
+	src        []byte
+	start, end int  // bounds of the outermost element
+	wrapped    bool // src carries an xpacket wrapper
+	props      map[string]*srcProp
+	descs      []*srcDesc
+	prefixes   map[string]string // namespace URI to prefix above rdf:Description
+	base       map[string]string // property fingerprints after decoding
+
+	// whitespace style
+	newline    bool
+	indent     string // rdf:Description indentation
+	propIndent string // property indentation
+}
+
+// srcDesc is a rdf:Description node in the source.
+type srcDesc struct {
+	name        string // element name as written
+	indent      string
+	prefixes    map[string]string // namespace URI to prefix on this node
+	tagEnd      int // offset after the start tag
+	contentEnd  int // offset after the last property element
+	selfClosing bool
+}
+
+// srcProp is a top-level property in the source.
+type srcProp struct {
+	desc         *srcDesc
+	attr         bool
+	ws           int // start of leading whitespace
+	start, end   int // bounds of the element or attribute
+	vstart, vend int // bounds of an attribute value
+}
+
+// edit replaces src[start:end] with text.
+type edit struct {
+	start, end int
+	text       string
+}
+
+// property is a top-level property in the encoder output tree.
+type property struct {
+	key  string
+	attr Attr
+	node *Node
+}
+
+// isSimple returns true when p can be written as attribute.
+func (p property) isSimple() bool {
+	return p.node == nil || len(p.node.Attr) == 0 && len(p.node.Nodes) == 0 && p.node.Model == nil
+}
+
+func (p property) value() string {
+	if p.node == nil {
+		return p.attr.Value
+	}
+	return p.node.Value
+}
+
+func (p property) uri() string {
+	return p.key[:strings.IndexByte(p.key, ' ')]
+}
+
+func (p property) fingerprint() string {
+	if p.node == nil {
+		return "@" + p.attr.Value
+	}
+	b, err := xml.Marshal(p.node)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func propKey(uri, local string) string {
+	return uri + " " + local
+}
+
+func isXMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// lastLine returns the whitespace after the last line break in ws.
+func lastLine(ws []byte) string {
+	if i := bytes.LastIndexByte(ws, '\n'); i > -1 {
+		return string(ws[i+1:])
+	}
+	return string(ws)
+}
+
+// newLayout records the layout of src. It returns nil when src uses a form
+// that cannot be preserved, e.g. typed nodes or repeated properties. The
+// fingerprints are taken from a second decode of src, so syncing its models
+// leaves the document decoded by d untouched.
+func (d *Decoder) newLayout(src []byte) *layout {
+	l := scanLayout(src)
+	if l == nil {
+		return nil
+	}
+	x := NewDocument()
+	defer x.Close()
+	dec := NewDecoder(bytes.NewReader(src))
+	dec.SetFlags(d.flags &^ Dpreserve)
+	dec.SetVersion(d.version)
+	dec.SetLimits(d.limits)
+	if err := dec.Decode(x); err != nil {
+		return nil
+	}
+	e := NewEncoder(io.Discard)
+	err := e.buildTree(x)
+	defer e.root.Close()
+	if err != nil {
+		return nil
+	}
+	l.base = make(map[string]string)
+	for _, p := range e.properties() {
+		l.base[p.key] = p.fingerprint()
+	}
+	return l
+}
+
+func scanLayout(src []byte) *layout {
+	l := &layout{
+		src:      src,
+		props:    make(map[string]*srcProp),
+		prefixes: make(map[string]string),
+	}
+	dec := xml.NewDecoder(bytes.NewReader(src))
+	var (
+		depth, rdfDepth int
+		desc            *srcDesc
+		prop            *srcProp
+		haveStyle       bool
+	)
+	lastWS := -1
+	for {
+		off := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		ws := off
+		if lastWS > -1 {
+			ws = lastWS
+		}
+		lastWS = -1
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if rdfDepth == 0 || depth <= rdfDepth {
+				addPrefixes(l.prefixes, t)
+			}
+			switch {
+			case depth == 1:
+				l.start = off
+				if t.Name.Space == nsRDF.GetURI() && t.Name.Local == "RDF" {
+					rdfDepth = depth
+				}
+			case rdfDepth == 0 && depth == 2 && t.Name.Space == nsRDF.GetURI() && t.Name.Local == "RDF":
+				rdfDepth = depth
+			case rdfDepth > 0 && depth == rdfDepth+1:
+				if t.Name.Space != nsRDF.GetURI() || t.Name.Local != "Description" {
+					return nil
+				}
+				if desc = l.scanDesc(t, off, int(dec.InputOffset())); desc == nil {
+					return nil
+				}
+				desc.indent = lastLine(src[ws:off])
+				if !haveStyle {
+					l.newline = bytes.IndexByte(src[ws:off], '\n') > -1
+					l.indent = desc.indent
+					l.propIndent = desc.indent + " "
+				}
+			case desc != nil && depth == rdfDepth+2:
+				prop = &srcProp{desc: desc, ws: ws, start: off}
+				if !l.addProp(propKey(t.Name.Space, t.Name.Local), prop) {
+					return nil
+				}
+				if !haveStyle {
+					haveStyle = true
+					l.newline = bytes.IndexByte(src[ws:off], '\n') > -1
+					l.propIndent = lastLine(src[ws:off])
+				}
+			}
+
+		case xml.EndElement:
+			end := int(dec.InputOffset())
+			switch {
+			case prop != nil && depth == rdfDepth+2:
+				prop.end = end
+				desc.contentEnd = end
+				prop = nil
+			case desc != nil && depth == rdfDepth+1:
+				desc = nil
+			case depth == 1:
+				l.end = end
+			}
+			depth--
+			if depth == 0 {
+				tail := src[l.end:]
+				l.wrapped = bytes.Contains(src[:l.start], []byte("<?xpacket begin")) &&
+					bytes.Contains(tail, []byte("<?xpacket end"))
+				if rdfDepth == 0 || len(l.descs) == 0 {
+					return nil
+				}
+				return l
+			}
+
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 {
+				lastWS = ws
+			}
+		}
+	}
+	return nil
+}
+
+func (l *layout) addProp(key string, p *srcProp) bool {
+	if _, ok := l.props[key]; ok {
+		return false
+	}
+	l.props[key] = p
+	return true
+}
+
+// scanDesc records a rdf:Description start tag at src[start:end] and its
+// property attributes.
+func (l *layout) scanDesc(t xml.StartElement, start, end int) *srcDesc {
+	src := l.src
+	i := start + 1
+	for i < end && !isXMLSpace(src[i]) && src[i] != '/' && src[i] != '>' {
+		i++
+	}
+	desc := &srcDesc{
+		name:        string(src[start+1 : i]),
+		prefixes:    make(map[string]string),
+		tagEnd:      end,
+		contentEnd:  end,
+		selfClosing: bytes.HasSuffix(src[start:end], []byte("/>")),
+	}
+
+	// match attributes as written with the decoded attributes
+	var n int
+	for {
+		ws := i
+		for i < end && isXMLSpace(src[i]) {
+			i++
+		}
+		if i >= end || src[i] == '/' || src[i] == '>' {
+			break
+		}
+		p := &srcProp{desc: desc, attr: true, ws: ws, start: i}
+		for i < end && src[i] != '=' && !isXMLSpace(src[i]) {
+			i++
+		}
+		for i < end && isXMLSpace(src[i]) {
+			i++
+		}
+		if i >= end || src[i] != '=' {
+			return nil
+		}
+		i++
+		for i < end && isXMLSpace(src[i]) {
+			i++
+		}
+		if i >= end || (src[i] != '"' && src[i] != '\'') {
+			return nil
+		}
+		q := src[i]
+		i++
+		p.vstart = i
+		for i < end && src[i] != q {
+			i++
+		}
+		if i >= end || n >= len(t.Attr) {
+			return nil
+		}
+		p.vend = i
+		i++
+		p.end = i
+
+		a := t.Attr[n]
+		n++
+		switch a.Name.Space {
+		case "", "xmlns", nsRDF.GetURI(), nsXML.GetURI():
+			continue
+		}
+		if !l.addProp(propKey(a.Name.Space, a.Name.Local), p) {
+			return nil
+		}
+	}
+	if n != len(t.Attr) {
+		return nil
+	}
+	addPrefixes(desc.prefixes, t)
+	l.descs = append(l.descs, desc)
+	return desc
+}
+
+func addPrefixes(m map[string]string, t xml.StartElement) {
+	for _, a := range t.Attr {
+		if _, ok := m[a.Value]; !ok && a.Name.Space == "xmlns" {
+			m[a.Value] = a.Name.Local
+		}
+	}
+}
+
+// prefix returns the source prefix for uri in scope of desc.
+func (l *layout) prefix(desc *srcDesc, uri string) (string, bool) {
+	if p, ok := desc.prefixes[uri]; ok {
+		return p, true
+	}
+	p, ok := l.prefixes[uri]
+	return p, ok
+}
+
+// target returns the rdf:Description new properties in namespace uri are
+// added to. This is the first one declaring the namespace or the last one.
+func (l *layout) target(uri string) *srcDesc {
+	for _, v := range l.descs {
+		if _, ok := v.prefixes[uri]; ok {
+			return v
+		}
+	}
+	return l.descs[len(l.descs)-1]
+}
+
+// properties returns the top-level properties of the output tree.
+func (e *Encoder) properties() []property {
+	var l []property
+	for _, n := range e.root.Nodes {
+		for _, v := range n.Attr {
+			if !isProperty(v.Name.Local) {
+				continue
+			}
+			if ns := e.findNs(v.Name); ns != nil {
+				l = append(l, property{key: propKey(ns.GetURI(), stripPrefix(v.Name.Local)), attr: v})
+			}
+		}
+		for _, v := range n.Nodes {
+			if ns := e.findNs(v.XMLName); ns != nil {
+				l = append(l, property{key: propKey(ns.GetURI(), stripPrefix(v.XMLName.Local)), node: v})
+			}
+		}
+	}
+	return l
+}
+
+// encodePreserved writes the source of l with changed properties replaced.
+// Everything outside the outermost element, including the presence of a
+// packet wrapper, is copied from the source.
+func (e *Encoder) encodePreserved(l *layout) error {
+	var edits []edit
+	inserts := make(map[*srcDesc][]string)
+	seen := make(map[string]bool)
+
+	for _, p := range e.properties() {
+		seen[p.key] = true
+		fp := p.fingerprint()
+		base, inBase := l.base[p.key]
+		if inBase && fp == base {
+			continue
+		}
+		src, ok := l.props[p.key]
+		switch {
+		case !ok:
+			desc := l.target(p.uri())
+			inserts[desc] = append(inserts[desc], e.marshalProperty(p, l, desc))
+		case src.attr && p.isSimple():
+			var b bytes.Buffer
+			xml.EscapeText(&b, []byte(p.value()))
+			edits = append(edits, edit{src.vstart, src.vend, b.String()})
+		case src.attr:
+			edits = append(edits, edit{src.ws, src.end, ""})
+			inserts[src.desc] = append(inserts[src.desc], e.marshalProperty(p, l, src.desc))
+		default:
+			edits = append(edits, edit{src.start, src.end, e.marshalProperty(p, l, src.desc)})
+		}
+	}
+
+	// remove deleted properties
+	for key, src := range l.props {
+		if _, ok := l.base[key]; ok && !seen[key] {
+			edits = append(edits, edit{src.ws, src.end, ""})
+		}
+	}
+
+	// add new properties
+	sep := ""
+	if l.newline {
+		sep = "\n"
+	}
+	for _, desc := range l.descs {
+		items := inserts[desc]
+		if len(items) == 0 {
+			continue
+		}
+		var b strings.Builder
+		for _, v := range items {
+			b.WriteString(sep + l.propIndent + v)
+		}
+		if desc.selfClosing {
+			b.WriteString(sep + desc.indent + "</" + desc.name + ">")
+			edits = append(edits, edit{desc.tagEnd - 2, desc.tagEnd, ">" + b.String()})
+		} else {
+			edits = append(edits, edit{desc.contentEnd, desc.contentEnd, b.String()})
+		}
+	}
+
+	// output
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var body bytes.Buffer
+	pos := l.start
+	for _, v := range edits {
+		body.Write(l.src[pos:v.start])
+		body.WriteString(v.text)
+		pos = v.end
+	}
+	body.Write(l.src[pos:l.end])
+
+	// bytes around the outermost element are kept as in the source, so an
+	// unwrapped source stays unwrapped. Only clearing Xpacket removes the
+	// wrapper of a wrapped source.
+	if l.wrapped && e.flags&Xpacket == 0 {
+		_, err := e.cw.Write(body.Bytes())
+		return err
+	}
+	for _, b := range [][]byte{l.src[:l.start], body.Bytes(), l.src[l.end:]} {
+		if _, err := e.cw.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalProperty writes p as property element in the source style.
+func (e *Encoder) marshalProperty(p property, l *layout, desc *srcDesc) string {
+	var n *Node
+	if p.node != nil {
+		n = copyNode(p.node)
+	} else {
+		n = NewNode(p.attr.Name)
+		n.Value = p.attr.Value
+	}
+	defer n.Close()
+
+	// use source prefixes and declare namespaces unknown to the source
+	decl := make(map[string]string)
+	e.remapNames(n, l, desc, decl)
+	prefixes := make([]string, 0, len(decl))
+	for k := range decl {
+		prefixes = append(prefixes, k)
+	}
+	sort.Strings(prefixes)
+	for _, v := range prefixes {
+		n.Attr = append(n.Attr, Attr{Name: xml.Name{Local: "xmlns:" + v}, Value: decl[v]})
+	}
+
+	var b bytes.Buffer
+	enc := xml.NewEncoder(&b)
+	if l.newline {
+		unit := strings.TrimPrefix(l.propIndent, l.indent)
+		if unit == "" || unit == l.propIndent {
+			unit = " "
+		}
+		enc.Indent(l.propIndent, unit)
+	}
+	if err := enc.Encode(n); err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(b.String(), l.propIndent)
+}
+
+func (e *Encoder) remapNames(n *Node, l *layout, desc *srcDesc, decl map[string]string) {
+	n.XMLName.Local = e.remapName(n.XMLName.Local, l, desc, decl)
+	for i := range n.Attr {
+		n.Attr[i].Name.Local = e.remapName(n.Attr[i].Name.Local, l, desc, decl)
+	}
+	for _, v := range n.Nodes {
+		e.remapNames(v, l, desc, decl)
+	}
+}
+
+func (e *Encoder) remapName(name string, l *layout, desc *srcDesc, decl map[string]string) string {
+	if !hasPrefix(name) {
+		return name
+	}
+	prefix := getPrefix(name)
+	switch prefix {
+	case "xml", "xmlns":
+		return name
+	}
+	ns := e.findNs(NewName(name))
+	if prefix == nsRDF.GetName() {
+		ns = nsRDF
+	}
+	if ns == nil {
+		return name
+	}
+	if p, ok := l.prefix(desc, ns.GetURI()); ok {
+		return p + ":" + stripPrefix(name)
+	}
+	decl[prefix] = ns.GetURI()
+	return name
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+var ErrReadOnly = errors.New("xmp: packet is read-only")
+
+// ErrPacketMismatch is returned by WritePacketAt when the file does not
+// hold the described packet at its offset.
+var ErrPacketMismatch = errors.New("xmp: packet does not match file contents")
+
+// ReadWriterAt is a file that supports in-place packet updates.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// MarshalSize encodes d as a packet of exactly size bytes in the given
+// encoding. The space between the document and the packet trailer is
+// filled with whitespace padding. ErrOverflow is returned when the
+// document does not fit.
+func MarshalSize(d *Document, size int64, enc Encoding) ([]byte, error) {
+	var b bytes.Buffer
+	e := NewEncoder(&b)
+	e.SetFlags(0)
+	if err := e.Encode(d); err != nil {
+		return nil, err
+	}
+	if size <= 0 || size%int64(enc.UnitSize()) != 0 {
+		return nil, ErrOverflow
+	}
+	return makePacket(b.Bytes(), size, enc)
+}
+
+// makePacket wraps the UTF-8 encoded body into a packet in encoding enc.
+// When size is positive, whitespace padding fills the packet up to size
+// bytes.
+func makePacket(body []byte, size int64, enc Encoding) ([]byte, error) {
+	header := xmp_packet_header
+	if enc != EncodingUTF8 {
+		// multi-byte encodings carry a byte order mark
+		header = bytes.Replace(header, []byte(`begin=""`), []byte("begin=\"\ufeff\""), 1)
+	}
+	header = enc.Encode(header)
+	body = enc.Encode(body)
+	footer := enc.Encode(xmp_packet_footer)
+
+	n := int64(enc.UnitSize())
+	var pad int64
+	if size > 0 {
+		if pad = size - int64(len(header)+len(body)+len(footer)); pad < 0 {
+			return nil, ErrOverflow
+		}
+	}
+	packet := make([]byte, 0, int64(len(header)+len(body)+len(footer))+pad)
+	packet = append(packet, header...)
+	packet = append(packet, body...)
+	space, newline := enc.Encode([]byte(" ")), enc.Encode([]byte("\n"))
+	for i := int64(0); i < pad/n; i++ {
+		if i%80 == 0 {
+			packet = append(packet, newline...)
+		} else {
+			packet = append(packet, space...)
+		}
+	}
+	return append(packet, footer...), nil
+}
+
+// WritePacketAt overwrites the packet described by p with d. The new packet
+// keeps the length and encoding of the original, so no other file bytes
+// move. Before writing, the packet header at p.Offset is decoded in
+// p.Encoding. ErrPacketMismatch is returned unless it starts a packet of
+// length p.Length whose begin attribute is empty or a byte order mark in
+// that encoding. It fails with ErrReadOnly for packets marked end="r" and with
+// ErrOverflow when d does not fit into the original packet.
+func WritePacketAt(f ReadWriterAt, p *PacketInfo, d *Document) error {
+	if !p.Writable {
+		return ErrReadOnly
+	}
+	if err := checkPacketAt(f, p); err != nil {
+		return err
+	}
+	packet, err := MarshalSize(d, p.Length, p.Encoding)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(packet, p.Offset)
+	return err
+}
+
+// checkPacketAt verifies that r holds the packet described by p.
+func checkPacketAt(r io.ReaderAt, p *PacketInfo) error {
+	size := p.Offset + p.Length
+	hdr, err := readAt(r, size, p.Offset, maxHeaderSize*int64(p.Encoding.UnitSize()))
+	if err != nil {
+		return err
+	}
+	begin, ok := beginAttr(p.Encoding.Decode(hdr))
+	if !ok || (len(begin) > 0 && string(begin) != "\ufeff") {
+		return ErrPacketMismatch
+	}
+	old, err := scanPacket(r, size, p.Offset, p.Encoding)
+	if err != nil {
+		return err
+	}
+	if old == nil || old.Length != p.Length || !old.Writable {
+		return ErrPacketMismatch
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Decode issues
+//
+// Problems found while decoding properties are reported as DecodeIssue.
+// By default errors stop decoding and warnings are only logged. With the
+// Dstrict flag the decoder stops at the first issue of any severity, with
+// Dlenient it skips malformed properties and keeps decoding. All issues
+// are available from Decoder.Issues.
+
+var (
+	ErrInvalidValue     = errors.New("xmp: invalid property value")
+	ErrUnknownField     = errors.New("xmp: unknown struct field")
+	ErrDroppedQualifier = errors.New("xmp: unsupported qualifier dropped")
+)
+
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (x Severity) String() string {
+	switch x {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("severity %d", int(x))
+	}
+}
+
+// DecodeIssue describes a problem with a single property. It matches its
+// kind (one of the Err* values above) and its cause with errors.Is.
+type DecodeIssue struct {
+	Severity  Severity
+	Line      int    // 1-based line of the XML element, 0 when unknown
+	Column    int    // 1-based column of the XML element, 0 when unknown
+	Path      Path   // property path
+	Namespace string // property namespace URI
+	Kind      error
+	Err       error // cause
+}
+
+func (x *DecodeIssue) Error() string {
+	var b strings.Builder
+	b.WriteString("xmp: ")
+	if x.Line > 0 {
+		fmt.Fprintf(&b, "line %d col %d: ", x.Line, x.Column)
+	}
+	if x.Path != "" {
+		b.WriteString(x.Path.String())
+		b.WriteString(": ")
+	}
+	if x.Err != nil {
+		b.WriteString(strings.TrimPrefix(x.Err.Error(), "xmp: "))
+	} else if x.Kind != nil {
+		b.WriteString(strings.TrimPrefix(x.Kind.Error(), "xmp: "))
+	}
+	return b.String()
+}
+
+func (x *DecodeIssue) Unwrap() error {
+	return x.Err
+}
+
+func (x *DecodeIssue) Is(target error) bool {
+	return x.Kind != nil && x.Kind == target
+}
+
+// Issues returns the problems found by the last call to Decode.
+func (d *Decoder) Issues() []*DecodeIssue {
+	return d.issues
+}
+
+// report records an issue and returns it when decoding must stop.
+func (d *Decoder) report(x *DecodeIssue) error {
+	// nested properties report their issue before it is passed up
+	if n := len(d.issues); n == 0 || d.issues[n-1] != x {
+		d.issues = append(d.issues, x)
+	}
+	switch {
+	case d.flags&Dstrict > 0:
+		return x
+	case d.flags&Dlenient > 0:
+		return nil
+	case x.Severity == SeverityError:
+		return x
+	}
+	Log.Warn(x.Error())
+	return nil
+}
+
+// newIssue creates an issue for the property name found in node n.
+func (d *Decoder) newIssue(sev Severity, kind error, n *Node, name xml.Name, err error) *DecodeIssue {
+	x := &DecodeIssue{
+		Severity: sev,
+		Path:     Path(name.Local),
+		Kind:     kind,
+		Err:      err,
+	}
+	if ns := d.findNs(name); ns != nil {
+		x.Namespace = ns.GetURI()
+	}
+	if off, ok := d.offsets[n]; ok && d.lines != nil {
+		x.Line, x.Column = d.lines.pos(off)
+	}
+	return x
+}
+
+// propertyIssue classifies an error returned while unmarshalling a model
+// property.
+func (d *Decoder) propertyIssue(n *Node, name xml.Name, err error) *DecodeIssue {
+	if x, ok := err.(*DecodeIssue); ok {
+		return x
+	}
+	kind := ErrInvalidValue
+	if errors.Is(err, ErrUnknownField) {
+		kind = ErrUnknownField
+	}
+	pe, nested := err.(*nestedError)
+	if nested {
+		err = pe.err
+		if _, ok := d.offsets[pe.node]; ok {
+			n = pe.node
+		}
+	}
+	x := d.newIssue(SeverityError, kind, n, name, err)
+	if nested {
+		x.Path = joinPath(x.Path, pe.path)
+	}
+	return x
+}
+
+// nestedError carries the path of a failed struct field or array item
+// below a top-level property up to propertyIssue.
+type nestedError struct {
+	path Path  // path relative to the top-level property
+	node *Node // innermost failed node
+	err  error
+}
+
+func (e *nestedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *nestedError) Unwrap() error {
+	return e.err
+}
+
+// nestError prefixes the path of err with the field or array index
+// segment seg of node n.
+func nestError(seg string, n *Node, err error) error {
+	if e, ok := err.(*nestedError); ok {
+		e.path = joinPath(Path(seg), e.path)
+		return e
+	}
+	if _, ok := err.(*DecodeIssue); ok {
+		return err
+	}
+	return &nestedError{path: Path(seg), node: n, err: err}
+}
+
+// joinPath appends the relative path rel to x.
+func joinPath(x, rel Path) Path {
+	if rel == "" {
+		return x
+	}
+	if strings.HasPrefix(string(rel), "[") {
+		return x + rel
+	}
+	return x + "/" + rel
+}
+
+// lineReader records line breaks for converting input offsets into line
+// and column numbers. It also enforces the MaxBytes limit.
+type lineReader struct {
+	r     io.Reader
+	n     int64
+	max   int64
+	lines []int64
+}
+
+func (r *lineReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if r.max > 0 && r.n+int64(n) > r.max {
+		n = int(r.max - r.n)
+		err = &LimitError{Limit: "MaxBytes", Max: r.max}
+	}
+	for i, c := range b[:n] {
+		if c == '\n' {
+			r.lines = append(r.lines, r.n+int64(i))
+		}
+	}
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *lineReader) pos(off int64) (int, int) {
+	i := sort.Search(len(r.lines), func(i int) bool { return r.lines[i] >= off })
+	if i == 0 {
+		return 1, int(off) + 1
+	}
+	return i + 1, int(off - r.lines[i-1])
+}
+
+// parse reads the XML node tree into root and records element offsets.
+func (d *Decoder) parse(root *Node) error {
+	for {
+		off := d.d.InputOffset()
+		t, err := d.d.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			return d.parseNode(root, start, off, 1)
+		}
+	}
+}
+
+func (d *Decoder) parseNode(n *Node, start xml.StartElement, off int64, depth int) error {
+	if err := d.checkElement(start, off, depth); err != nil {
+		return err
+	}
+	d.offsets[n] = off
+	isArray := isArrayName(start.Name)
+	var nodes []*Node
+	for {
+		off := d.d.InputOffset()
+		t, err := d.d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.CharData:
+			if max := d.limits.MaxValueLen; max > 0 && len(t) > max {
+				return d.limitError("MaxValueLen", int64(max), off)
+			}
+			n.Value = strings.TrimSpace(string(t))
+		case xml.StartElement:
+			if max := d.limits.MaxArrayItems; isArray && max > 0 && len(nodes) >= max {
+				return d.limitError("MaxArrayItems", int64(max), off)
+			}
+			x := NewNode(emptyName)
+			nodes = append(nodes, x)
+			if err := d.parseNode(x, t, off, depth+1); err != nil {
+				n.Nodes = nodes
+				return err
+			}
+		case xml.EndElement:
+			n.XMLName = start.Name
+			n.Attr.From(start.Attr)
+			n.Nodes = nodes
+			return nil
+		}
+	}
+}
@@ -266,7 +266,7 @@ func (d *Document) UnmarshalJSON(data []byte) error {
 	for _, n := range root.Nodes {
 		// process attributes
 		for _, v := range n.Attr {
-			if err := dec.decodeAttribute(&dec.nodes, v); err != nil {
+			if err := dec.decodeAttribute(&dec.nodes, n, v); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,107 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// ErrLimitExceeded matches every LimitError with errors.Is.
+var ErrLimitExceeded = errors.New("xmp: decode limit exceeded")
+
+// Limits restricts the resources a Decoder uses for untrusted input. Zero
+// values mean unlimited.
+type Limits struct {
+	MaxBytes      int64 // input size
+	MaxDepth      int   // element nesting depth
+	MaxNodes      int   // elements, including copies of rdf:nodeID references
+	MaxAttrs      int   // attributes per element
+	MaxArrayItems int   // items per rdf:Bag, rdf:Seq or rdf:Alt
+	MaxValueLen   int   // bytes per text or attribute value
+}
+
+// DefaultLimits are generous enough for real-world packets including
+// embedded thumbnails.
+var DefaultLimits = Limits{
+	MaxBytes:      16 << 20,
+	MaxDepth:      64,
+	MaxNodes:      1 << 20,
+	MaxAttrs:      256,
+	MaxArrayItems: 1 << 16,
+	MaxValueLen:   8 << 20,
+}
+
+// LimitError is returned when decoding exceeds one of the Limits. It
+// matches ErrLimitExceeded with errors.Is.
+type LimitError struct {
+	Limit  string // name of the exceeded Limits field
+	Max    int64
+	Line   int // 1-based position of the offending element, 0 when unknown
+	Column int
+}
+
+func (e *LimitError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("xmp: decode limit exceeded: %s %d at line %d col %d", e.Limit, e.Max, e.Line, e.Column)
+	}
+	return fmt.Sprintf("xmp: decode limit exceeded: %s %d", e.Limit, e.Max)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// SetLimits restricts the resources used by Decode.
+func (d *Decoder) SetLimits(l Limits) {
+	d.limits = l
+	d.lines.max = l.MaxBytes
+}
+
+func (d *Decoder) limitError(limit string, max int64, off int64) *LimitError {
+	e := &LimitError{Limit: limit, Max: max}
+	if off >= 0 {
+		e.Line, e.Column = d.lines.pos(off)
+	}
+	return e
+}
+
+// checkElement verifies an element against the limits before it is added
+// to the node tree.
+func (d *Decoder) checkElement(start xml.StartElement, off int64, depth int) error {
+	l := d.limits
+	d.count++
+	switch {
+	case l.MaxDepth > 0 && depth > l.MaxDepth:
+		return d.limitError("MaxDepth", int64(l.MaxDepth), off)
+	case l.MaxNodes > 0 && d.count > l.MaxNodes:
+		return d.limitError("MaxNodes", int64(l.MaxNodes), off)
+	case l.MaxAttrs > 0 && len(start.Attr) > l.MaxAttrs:
+		return d.limitError("MaxAttrs", int64(l.MaxAttrs), off)
+	}
+	if l.MaxValueLen > 0 {
+		for _, a := range start.Attr {
+			if len(a.Value) > l.MaxValueLen {
+				return d.limitError("MaxValueLen", int64(l.MaxValueLen), off)
+			}
+		}
+	}
+	return nil
+}
+
+func isArrayName(n xml.Name) bool {
+	return isRDF(n, "Bag") || isRDF(n, "Seq") || isRDF(n, "Alt")
+}
@@ -37,7 +37,13 @@ type MarshalerAttr interface {
 const (
 	Xpacket = 1 << iota
 	Xpadding
-	eMode = Xpacket | Xpadding
+	Xaliases   // write alias properties with values of their base
+	Xcompact   // write simple properties as attributes
+	Xcanonical // write all properties as elements (overrides Xcompact)
+	Xsingle    // merge all namespaces into a single rdf:Description
+	Xnested    // use nested rdf:Description instead of rdf:parseType="Resource"
+	Xnometa    // omit the x:xmpmeta wrapper
+	eMode      = Xpacket | Xpadding | Xaliases | Xcompact | Xcanonical | Xsingle | Xnested | Xnometa
 )
 
 type Encoder struct {
@@ -49,6 +55,9 @@ type Encoder struct {
 	intNsMap map[string]*Namespace
 	extNsMap map[string]*Namespace
 	flags    int
+	encoding Encoding
+	prefix   string
+	indent   string
 }
 
 var ErrOverflow = errors.New("xmp: document exceeds size limit")
@@ -113,7 +122,14 @@ func (e *Encoder) SetFlags(flags int) {
 	e.flags = flags & eMode
 }
 
+// SetEncoding selects the character encoding of the output. Packets in
+// UTF-16 and UTF-32 carry a byte order mark in their header.
+func (e *Encoder) SetEncoding(enc Encoding) {
+	e.encoding = enc
+}
+
 func (e *Encoder) Indent(prefix, indent string) {
+	e.prefix, e.indent = prefix, indent
 	e.e.Indent(prefix, indent)
 }
 
@@ -128,32 +144,99 @@ func Marshal(d *Document) ([]byte, error) {
 func MarshalIndent(d *Document, prefix, indent string) ([]byte, error) {
 	var b bytes.Buffer
 	enc := NewEncoder(&b)
-	enc.e.Indent(prefix, indent)
+	enc.Indent(prefix, indent)
 	if err := enc.Encode(d); err != nil {
 		return nil, err
 	}
 	return b.Bytes(), nil
 }
 
-// encode to separate rdf:Description objects per namespace
+// Encode writes d as XMP. By default each namespace is written to its own
+// rdf:Description, the serialization form can be changed with SetFlags.
 func (e *Encoder) Encode(d *Document) error {
 
 	if d == nil {
 		return nil
 	}
 
-	// sync individual models to establish correct XMP entries
-	if err := d.syncToXMP(); err != nil {
+	if e.encoding != EncodingUTF8 {
+		return e.encodeWide(d)
+	}
+
+	err := e.buildTree(d)
+	defer e.root.Close()
+	if err != nil {
 		return err
 	}
 
+	// keep the source layout of documents decoded in Dpreserve mode unless
+	// a different style was requested
+	if d.layout != nil && e.flags&(Xcompact|Xcanonical|Xsingle|Xnested|Xnometa) == 0 {
+		return e.encodePreserved(d.layout)
+	}
+
+	// 4  output XML
+
+	// 4.1 write packet header
+	if e.flags&Xpacket > 0 {
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	// 4.2 add top-level XMP namespace and toolkit as attributes
+	start := xml.StartElement{
+		Name: xml.Name{Local: "x:xmpmeta"},
+		Attr: make([]xml.Attr, 0),
+	}
+	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "xmlns:x"}, Value: "adobe:ns:meta/"})
+	tk := d.toolkit
+	if tk == "" {
+		tk = XMP_TOOLKIT_VERSION
+	}
+	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "x:xmptk"}, Value: tk})
+	if e.flags&Xnometa == 0 {
+		if err := e.e.EncodeToken(start); err != nil {
+			return err
+		}
+	}
+
+	// 4.3 add document tree
+	e.root.XMLName = xml.Name{Local: "rdf:RDF"}
+	e.root.Attr = []Attr{nsRDF.GetAttr()}
+	if err := e.e.Encode(e.root); err != nil {
+		return err
+	}
+
+	if e.flags&Xnometa == 0 {
+		if err := e.e.EncodeToken(start.End()); err != nil {
+			return err
+		}
+	}
+	if err := e.e.Flush(); err != nil {
+		return err
+	}
+
+	// 4.4 write footer including optional padding
+	if e.flags&Xpacket > 0 {
+		return e.writeFooter()
+	}
+	return nil
+}
+
+// buildTree creates the output node tree for d in e.root.
+func (e *Encoder) buildTree(d *Document) error {
 	// reset nodes and map
 	e.root = NewNode(xml.Name{})
-	defer e.root.Close()
 	e.nsTagMap = make(map[string]string)
 	e.intNsMap = d.intNsMap
 	e.extNsMap = d.extNsMap
 
+	// sync individual models to establish correct XMP entries
+	if err := d.syncToXMP(); err != nil {
+		return err
+	}
+
 	// 1  build output node tree (model -> nodes+attr with one root node per
 	//    XMP namespace)
 	for _, n := range d.nodes {
@@ -183,6 +266,16 @@ func (e *Encoder) Encode(d *Document) error {
 		node.Attr = append(node.Attr, n.Attr...)
 	}
 
+	// 1.4 attach qualifiers to their values
+	if err := e.encodeQualifiers(d); err != nil {
+		return err
+	}
+
+	// 1.5 optionally add alias properties
+	if e.flags&Xaliases > 0 {
+		e.encodeAliases(d)
+	}
+
 	// 2  collect root-node namespaces
 	for _, n := range e.root.Nodes {
 		l := make([]Attr, 0)
@@ -209,68 +302,62 @@ func (e *Encoder) Encode(d *Document) error {
 	}
 	e.root.Nodes = nl
 
-	// 4  output XML
+	// 3.1 apply the selected serialization style
+	e.applyStyle()
+	return nil
+}
 
-	// 4.1 write packet header
-	if e.flags&Xpacket > 0 {
-		if _, err := e.cw.Write(xmp_packet_header); err != nil {
-			return err
+func (e *Encoder) writeHeader() error {
+	_, err := e.cw.Write(xmp_packet_header)
+	return err
+}
+
+func (e *Encoder) writeFooter() error {
+	if e.flags&Xpadding > 0 && e.cw.limit > 0 {
+		pad := e.cw.limit - e.cw.n - 20
+
+		for i := int64(0); i < pad; i++ {
+			if i%80 == 0 {
+				if _, err := e.cw.Write([]byte("\n")); err != nil {
+					return err
+				}
+			} else {
+				if _, err := e.cw.Write([]byte(" ")); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
-	// 4.2 add top-level XMP namespace and toolkit as attributes
-	start := xml.StartElement{
-		Name: xml.Name{Local: "x:xmpmeta"},
-		Attr: make([]xml.Attr, 0),
-	}
-	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "xmlns:x"}, Value: "adobe:ns:meta/"})
-	tk := d.toolkit
-	if tk == "" {
-		tk = XMP_TOOLKIT_VERSION
-	}
-	start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "x:xmptk"}, Value: tk})
-	if err := e.e.EncodeToken(start); err != nil {
-		return err
-	}
+	_, err := e.cw.Write(xmp_packet_footer)
+	return err
+}
 
-	// 4.3 add document tree
-	e.root.XMLName = xml.Name{Local: "rdf:RDF"}
-	e.root.Attr = []Attr{nsRDF.GetAttr()}
-	if err := e.e.Encode(e.root); err != nil {
+// encodeWide encodes d in UTF-8 and transcodes the result into the
+// multi-byte output encoding.
+func (e *Encoder) encodeWide(d *Document) error {
+	var b bytes.Buffer
+	enc := NewEncoder(&b)
+	enc.flags = e.flags &^ (Xpacket | Xpadding)
+	enc.version = e.version
+	enc.Indent(e.prefix, e.indent)
+	if err := enc.Encode(d); err != nil {
 		return err
 	}
-
-	if err := e.e.EncodeToken(start.End()); err != nil {
+	if e.flags&Xpacket == 0 {
+		_, err := e.cw.Write(e.encoding.Encode(b.Bytes()))
 		return err
 	}
-	if err := e.e.Flush(); err != nil {
-		return err
+	var size int64
+	if e.flags&Xpadding > 0 && e.cw.limit > 0 {
+		size = e.cw.limit - e.cw.n
 	}
-
-	// 4.4 write footer including optional padding
-	if e.flags&Xpacket > 0 {
-		if e.flags&Xpadding > 0 && e.cw.limit > 0 {
-			pad := e.cw.limit - e.cw.n - 20
-
-			for i := int64(0); i < pad; i++ {
-				if i%80 == 0 {
-					if _, err := e.cw.Write([]byte("\n")); err != nil {
-						return err
-					}
-				} else {
-					if _, err := e.cw.Write([]byte(" ")); err != nil {
-						return err
-					}
-				}
-			}
-		}
-
-		if _, err := e.cw.Write(xmp_packet_footer); err != nil {
-			return err
-		}
+	packet, err := makePacket(b.Bytes(), size, e.encoding)
+	if err != nil {
+		return err
 	}
-
-	return nil
+	_, err = e.cw.Write(packet)
+	return err
 }
 
 func (e *Encoder) EncodeElement(v interface{}, node *Node) error {
@@ -391,6 +391,10 @@ func (n *Node) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 }
 
 func (n *Node) GetPath(path Path) (string, error) {
+	// struct fields may be wrapped into a nested rdf:Description
+	if path.Len() > 0 && len(n.Nodes) == 1 && n.Nodes[0].XMLName == rdfDescription {
+		return n.Nodes[0].GetPath(path)
+	}
 	name, path := path.PopFront()
 	name, idx, lang := parsePathSegment(name)
 	if idx < -1 {
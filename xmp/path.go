@@ -252,6 +252,9 @@ func (d *Document) GetPath(path Path) (string, error) {
 	if !path.IsXmpPath() {
 		return "", fmt.Errorf("xmp: invalid path '%s'", path.String())
 	}
+	if base, name, ok := splitQualifierPath(path); ok {
+		return d.getQualifierPath(base, name)
+	}
 	ns, err := path.Namespace(d)
 	if err != nil {
 		return "", err
@@ -279,6 +282,12 @@ func (d *Document) GetPath(path Path) (string, error) {
 }
 
 func GetModelPath(v Model, path Path) (string, error) {
+	return getModelPath(v, path, false)
+}
+
+// getModelPath optionally includes fields that are hidden from output
+// with the omit flag, e.g. legacy alias fields kept by some models.
+func getModelPath(v Model, path Path, omitted bool) (string, error) {
 	val := derefIndirect(v)
 	l := path.Len()
 	for n, walker := path.PopFront(); n != ""; n, walker = walker.PopFront() {
@@ -304,7 +313,7 @@ func GetModelPath(v Model, path Path) (string, error) {
 		if (fv.Kind() == reflect.Interface || fv.Kind() == reflect.Ptr) && fv.IsNil() {
 			return "", nil
 		}
-		if finfo.flags&fOmit > 0 || (finfo.flags&fEmpty == 0 && isEmptyValue(fv)) {
+		if (!omitted && finfo.flags&fOmit > 0) || (finfo.flags&fEmpty == 0 && isEmptyValue(fv)) {
 			return "", nil
 		}
 
@@ -359,7 +368,10 @@ func GetModelPath(v Model, path Path) (string, error) {
 
 			case AltString:
 				if lang != "" {
-					return arr.Get(lang), nil
+					if i := arr.langIndex(lang); i > -1 {
+						return arr[i].Value, nil
+					}
+					return "", nil
 				}
 				return arr.Default(), nil
 			default:
@@ -448,6 +460,9 @@ func (d *Document) SetPath(desc PathValue) error {
 	if !path.IsXmpPath() {
 		return fmt.Errorf("xmp: invalid path '%s'", path.String())
 	}
+	if base, name, ok := splitQualifierPath(path); ok {
+		return d.setQualifierPath(base, name, value, flags)
+	}
 
 	ns, err := path.Namespace(d)
 	if ns == nil || err != nil {
@@ -744,7 +759,9 @@ func SetModelPath(v Model, path Path, value string, flags SyncFlags) error {
 					arr.Add(lang, value)
 				case flags&(REPLACE|CREATE) > 0 && value != "":
 					// replace entire AltString with a new version
-					if lang != "" {
+					if i := arr.langIndex(lang); lang != "" && i > -1 {
+						(*arr)[i].Value = value
+					} else if lang != "" {
 						arr.Set(lang, value)
 					} else {
 						*arr = NewAltString(value)
@@ -994,6 +1011,7 @@ func (d *Document) ListPaths() (PathValueList, error) {
 		}
 		l = append(l, r...)
 	}
+	l = append(l, d.listQualifierPaths()...)
 	sort.Sort(byPath(l))
 	return l.Unique(), nil
 }
@@ -0,0 +1,423 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Qualifier is a named value attached to a property value or array item,
+// such as xmpidq:Scheme on xmp:Identifier items. The xml:lang qualifier of
+// alternative array items is handled by AltString and not listed here.
+//
+// Qualifiers are addressed by appending a `?name` segment to the path of
+// the qualified value, for example `xmp:Identifier[0]/?xmpidq:Scheme`.
+type Qualifier struct {
+	Name  string // prefixed name like "xmpidq:Scheme"
+	Value string
+}
+
+type QualifierList []Qualifier
+
+func (x QualifierList) Index(name string) int {
+	for i, v := range x {
+		if v.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (x QualifierList) Get(name string) string {
+	if i := x.Index(name); i > -1 {
+		return x[i].Value
+	}
+	return ""
+}
+
+// Set adds or replaces a qualifier. An empty value removes it.
+func (x *QualifierList) Set(name, value string) {
+	i := x.Index(name)
+	switch {
+	case value == "" && i > -1:
+		*x = append((*x)[:i], (*x)[i+1:]...)
+	case value == "":
+	case i > -1:
+		(*x)[i].Value = value
+	default:
+		*x = append(*x, Qualifier{Name: name, Value: value})
+	}
+}
+
+// splitQualifierPath splits a path like `xmp:Identifier[0]/?xmpidq:Scheme`
+// into the canonical path of the qualified value and the qualifier name.
+func splitQualifierPath(path Path) (Path, string, bool) {
+	s := path.String()
+	i := strings.LastIndex(s, "/?")
+	if i < 0 {
+		return path, "", false
+	}
+	return canonicalPath(Path(s[:i])), s[i+2:], true
+}
+
+// canonicalPath returns path with an explicit namespace prefix on every
+// segment, so paths to the same value compare equal.
+func canonicalPath(path Path) Path {
+	l := make([]string, 0, path.Len())
+	for walker := path; walker.Len() > 0; {
+		prefix := walker.PeekNamespacePrefix()
+		var seg string
+		seg, walker = walker.PopFront()
+		if strings.HasPrefix(seg, "[") {
+			l = append(l, seg)
+		} else {
+			l = append(l, prefix+":"+seg)
+		}
+	}
+	return Path(strings.Join(l, "/"))
+}
+
+// Qualifiers returns the qualifiers of the value at path.
+func (d *Document) Qualifiers(path Path) QualifierList {
+	l := d.qualifiers[canonicalPath(path)]
+	return append(QualifierList(nil), l...)
+}
+
+// SetQualifier adds or replaces a qualifier of the value at path. An empty
+// value removes the qualifier. The qualifier namespace must be known.
+func (d *Document) SetQualifier(path Path, name, value string) error {
+	if !hasPrefix(name) || d.findNsByPrefix(getPrefix(name)) == nil {
+		return fmt.Errorf("xmp: unknown namespace for qualifier '%s'", name)
+	}
+	path = canonicalPath(path)
+	if d.qualifiers == nil {
+		d.qualifiers = make(map[Path]QualifierList)
+	}
+	l := d.qualifiers[path]
+	l.Set(name, value)
+	if len(l) == 0 {
+		delete(d.qualifiers, path)
+	} else {
+		d.qualifiers[path] = l
+	}
+	d.SetDirty()
+	return nil
+}
+
+func (d *Document) getQualifierPath(path Path, name string) (string, error) {
+	l := d.qualifiers[path]
+	if i := l.Index(name); i > -1 {
+		return l[i].Value, nil
+	}
+	return "", fmt.Errorf("xmp: path '%s/?%s' not found", path, name)
+}
+
+func (d *Document) setQualifierPath(path Path, name, value string, flags SyncFlags) error {
+	exists := d.qualifiers[path].Index(name) > -1
+	switch {
+	case value == "" && flags&DELETE > 0,
+		value != "" && exists && flags&REPLACE > 0,
+		value != "" && !exists && flags&(CREATE|APPEND|UNIQUE) > 0:
+		return d.SetQualifier(path, name, value)
+	case flags&NOFAIL > 0:
+		return nil
+	default:
+		return fmt.Errorf("xmp: flags %d do not permit to set qualifier '%s/?%s'", flags, path, name)
+	}
+}
+
+func (d *Document) listQualifierPaths() PathValueList {
+	l := make(PathValueList, 0)
+	for path, v := range d.qualifiers {
+		for _, q := range v {
+			l.Add(Path(path.String()+"/?"+q.Name), q.Value)
+		}
+	}
+	return l
+}
+
+// Decoding
+//
+// Qualified values are serialized as a struct whose rdf:value field holds
+// the value and whose other fields are the qualifiers. The decoder moves
+// qualifiers into the document and replaces the struct with a simple value
+// so models see the plain value.
+
+func (d *Decoder) shortName(n xml.Name) string {
+	d.translate(&n)
+	return n.Local
+}
+
+// decodeQualifiers collects qualifiers from all properties of the
+// top-level nodes below root. It runs before names are translated.
+func (d *Decoder) decodeQualifiers(root *Node) error {
+	for _, desc := range root.Nodes {
+		for _, p := range desc.Nodes {
+			if err := d.decodePropertyQualifiers(p, Path(d.shortName(p.XMLName))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) decodePropertyQualifiers(p *Node, path Path) error {
+	l, err := d.collapseValue(p, path)
+	if err != nil {
+		return err
+	}
+	if len(l) > 0 {
+		d.qualifiers[canonicalPath(path)] = l
+		return nil
+	}
+	if p.IsArray() {
+		arr := p.Nodes[0]
+		for i, v := range arr.Nodes {
+			itemPath := path.AppendIndex(i)
+			if isRDF(arr.XMLName, "Alt") {
+				if lang := v.GetAttr(nsXML.GetURI(), "lang"); len(lang) > 0 {
+					itemPath = path.AppendIndexString(lang[0].Value)
+				}
+			}
+			if err := d.decodePropertyQualifiers(v, itemPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	holder := p
+	if len(p.Nodes) == 1 && isRDF(p.Nodes[0].XMLName, "Description") {
+		holder = p.Nodes[0]
+	}
+	for _, v := range holder.Nodes {
+		if v.XMLName.Space == nsRDF.GetURI() {
+			continue
+		}
+		if err := d.decodePropertyQualifiers(v, Path(path.String()+"/"+d.shortName(v.XMLName))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collapseValue replaces a qualified value by its rdf:value and returns
+// the qualifiers.
+func (d *Decoder) collapseValue(p *Node, path Path) (QualifierList, error) {
+	holder := p
+	if len(p.Nodes) == 1 && isRDF(p.Nodes[0].XMLName, "Description") {
+		holder = p.Nodes[0]
+	}
+
+	// find the value
+	var (
+		value string
+		found bool
+		lang  []Attr
+	)
+	for _, v := range holder.Nodes {
+		if isRDF(v.XMLName, "value") {
+			value, found = v.Value, true
+			lang = v.GetAttr(nsXML.GetURI(), "lang")
+		}
+	}
+	if v, ok := rdfAttr(holder, "value"); ok {
+		value, found = v, true
+	}
+	if !found {
+		return nil, nil
+	}
+
+	// collect qualifiers from fields and property attributes
+	l := make(QualifierList, 0)
+	for _, v := range holder.Nodes {
+		if isRDF(v.XMLName, "value") {
+			continue
+		}
+		if len(v.Nodes) > 0 {
+			x := d.newIssue(SeverityWarning, ErrDroppedQualifier, v, p.XMLName, fmt.Errorf("xmp: dropping structured qualifier %s", d.shortName(v.XMLName)))
+			x.Path = path
+			if err := d.report(x); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		l = append(l, Qualifier{Name: d.shortName(v.XMLName), Value: v.Value})
+	}
+	for _, v := range holder.Attr {
+		switch v.Name.Space {
+		case nsRDF.GetURI(), nsXML.GetURI(), "xmlns":
+			if v.Name.Space == nsXML.GetURI() && len(lang) == 0 {
+				lang = append(lang, v)
+			}
+			continue
+		}
+		l = append(l, Qualifier{Name: d.shortName(v.Name), Value: v.Value})
+	}
+
+	// turn the property into a simple value
+	attr := make(AttrList, 0, len(p.Attr))
+	for _, v := range p.Attr {
+		switch v.Name.Space {
+		case nsXML.GetURI():
+			lang = nil
+			attr = append(attr, v)
+		case "xmlns":
+			attr = append(attr, v)
+		}
+	}
+	attr = append(attr, lang...)
+	for _, v := range p.Nodes {
+		v.Close()
+	}
+	p.Nodes = nil
+	p.Value = value
+	p.Attr = attr
+	return l, nil
+}
+
+// Encoding
+//
+// The encoder turns simple values with qualifiers into rdf:parseType
+// Resource structs holding rdf:value and the qualifiers.
+
+func (e *Encoder) encodeQualifiers(d *Document) error {
+	paths := make([]string, 0, len(d.qualifiers))
+	for path := range d.qualifiers {
+		paths = append(paths, path.String())
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		n := findValueNode(e.root, Path(path))
+		if n == nil {
+			Log.Debugf("xmp: dropping qualifiers of missing value %s", path)
+			continue
+		}
+		if err := attachQualifiers(n, d.qualifiers[Path(path)]); err != nil {
+			return fmt.Errorf("xmp: %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// fields returns the struct fields of n.
+func fields(n *Node) NodeList {
+	if len(n.Nodes) == 1 && n.Nodes[0].FullName() == "rdf:Description" {
+		return n.Nodes[0].Nodes
+	}
+	return n.Nodes
+}
+
+// findValueNode returns the node in the output tree at path.
+func findValueNode(root *Node, path Path) *Node {
+	var (
+		n    *Node
+		list NodeList
+	)
+	for _, v := range root.Nodes {
+		list = append(list, v.Nodes...)
+	}
+	for _, seg := range strings.Split(path.String(), "/") {
+		if strings.HasPrefix(seg, "[") {
+			seg = "_" + seg
+		} else {
+			n = nil
+			name, _, _ := parsePathSegment(seg)
+			for _, v := range list {
+				if v.XMLName.Local == name || v.FullName() == name {
+					n = v
+					break
+				}
+			}
+		}
+		if n == nil {
+			return nil
+		}
+		_, idx, lang := parsePathSegment(seg)
+		if idx > -1 || lang != "" {
+			if !n.IsArray() {
+				return nil
+			}
+			items := n.Nodes[0].Nodes
+			n = nil
+			for i, v := range items {
+				if lang != "" {
+					if a := v.GetAttr("", "lang"); len(a) > 0 && a[0].Value == lang {
+						n = v
+						break
+					}
+				} else if i == idx {
+					n = v
+					break
+				}
+			}
+			if n == nil {
+				return nil
+			}
+		}
+		list = fields(n)
+	}
+	return n
+}
+
+func attachQualifiers(n *Node, l QualifierList) error {
+	holder := n
+	if len(n.Nodes) == 1 && n.Nodes[0].FullName() == "rdf:Description" {
+		holder = n.Nodes[0]
+	}
+	var qualified bool
+	for _, v := range holder.Nodes {
+		if v.FullName() == "rdf:value" {
+			qualified = true
+		}
+	}
+	if !qualified {
+		if len(n.Nodes) > 0 {
+			return fmt.Errorf("qualifiers on structs and arrays are not supported")
+		}
+		v := NewNode(xml.Name{Local: "rdf:value"})
+		v.Value = n.Value
+		n.Value = ""
+		n.Nodes = NodeList{v}
+		n.AddAttr(rdfResourceAttr)
+		holder = n
+	}
+	for _, q := range l {
+		if hasField(holder, q.Name) {
+			continue
+		}
+		x := NewNode(xml.Name{Local: q.Name})
+		x.Value = q.Value
+		holder.Nodes = append(holder.Nodes, x)
+	}
+	return nil
+}
+
+// hasField returns true when the model already wrote the qualifier.
+func hasField(n *Node, name string) bool {
+	for _, v := range n.Nodes {
+		if v.FullName() == name {
+			return true
+		}
+	}
+	for _, v := range n.Attr {
+		if v.Name.Local == name {
+			return true
+		}
+	}
+	return false
+}
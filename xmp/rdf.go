@@ -0,0 +1,307 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+)
+
+// RDF/XML normalization
+//
+// The decoder understands the canonical XMP serialization where rdf:RDF
+// holds rdf:Description nodes, structs are nested rdf:Description nodes or
+// rdf:parseType="Resource" properties and arrays are rdf:Bag, rdf:Seq or
+// rdf:Alt nodes with rdf:li items. ISO 16684-1 section 7 allows more RDF
+// forms, which normalizeRDF rewrites into the canonical form before
+// decoding:
+//
+//   - typed nodes like <stEvt:ResourceEvent> become rdf:Description nodes
+//     with an rdf:type property holding the type URI, model structs
+//     ignore it since their type is given by the schema
+//   - blank nodes referenced with rdf:nodeID are copied to the referencing
+//     property
+//   - rdf:ID, rdf:nodeID and rdf:datatype attributes are removed
+//   - rdf:parseType="Literal" contents are kept as XML text value
+//   - empty property elements with rdf:resource take the URI as value
+//   - property attributes on rdf:li are kept as struct fields
+
+func isRDF(name xml.Name, local string) bool {
+	return name.Space == nsRDF.GetURI() && name.Local == local
+}
+
+func rdfAttr(n *Node, local string) (string, bool) {
+	for _, v := range n.Attr {
+		if isRDF(v.Name, local) {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
+func removeRDFAttr(n *Node, names ...string) {
+	l := n.Attr[:0]
+	for _, v := range n.Attr {
+		keep := true
+		for _, name := range names {
+			if isRDF(v.Name, name) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			l = append(l, v)
+		}
+	}
+	n.Attr = l
+}
+
+// hasPropertyAttr returns true when n has attributes other than RDF and
+// XML syntax attributes.
+func hasPropertyAttr(n *Node) bool {
+	for _, v := range n.Attr {
+		switch v.Name.Space {
+		case nsRDF.GetURI(), nsXML.GetURI(), "xmlns":
+			continue
+		}
+		if v.Name.Space == "" && v.Name.Local == "xmlns" {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+type rdfNormalizer struct {
+	blank    map[string]*Node // top-level node elements with rdf:nodeID
+	refs     map[string]bool  // nodeIDs referenced by property elements
+	resolved map[string]*Node // normalized blank nodes
+	active   map[string]bool  // blank nodes being resolved
+	budget   int              // remaining nodes for reference copies, negative for unlimited
+	limit    func(n *Node) error
+	err      error
+}
+
+// normalizeRDF rewrites the node elements below root (the rdf:RDF node)
+// into canonical XMP form. Each blank node is resolved once and copied
+// into its referencing properties. Cyclic references are an error. When
+// the copies exceed budget nodes, normalizeRDF returns the error limit
+// creates for the referencing property element. A negative budget is
+// unlimited.
+func normalizeRDF(root *Node, budget int, limit func(n *Node) error) error {
+	r := &rdfNormalizer{
+		blank:    make(map[string]*Node),
+		refs:     make(map[string]bool),
+		resolved: make(map[string]*Node),
+		active:   make(map[string]bool),
+		budget:   budget,
+		limit:    limit,
+	}
+	for _, n := range root.Nodes {
+		if id, ok := rdfAttr(n, "nodeID"); ok {
+			r.blank[id] = n
+		}
+		for _, v := range n.Nodes {
+			r.collectRefs(v)
+		}
+	}
+
+	// blank nodes referenced from a property are not top-level resources
+	l := make(NodeList, 0, len(root.Nodes))
+	for _, n := range root.Nodes {
+		if id, ok := rdfAttr(n, "nodeID"); ok && r.refs[id] {
+			continue
+		}
+		l = append(l, n)
+	}
+	for _, n := range l {
+		r.nodeElement(n)
+		removeRDFAttr(n, "ID", "nodeID")
+	}
+	root.Nodes = l
+	for _, v := range r.resolved {
+		v.Close()
+	}
+	return r.err
+}
+
+// resolve returns the normalized blank node id or nil when it is unknown
+// or cannot be resolved.
+func (r *rdfNormalizer) resolve(id string) *Node {
+	if x, ok := r.resolved[id]; ok {
+		return x
+	}
+	b, ok := r.blank[id]
+	if !ok {
+		return nil
+	}
+	if r.active[id] {
+		r.err = fmt.Errorf("xmp: invalid XML format: cyclic rdf:nodeID reference %q", id)
+		return nil
+	}
+	r.active[id] = true
+	x := copyNode(b)
+	removeRDFAttr(x, "nodeID", "about", "ID")
+	r.nodeElement(x)
+	delete(r.active, id)
+	if r.err != nil {
+		x.Close()
+		return nil
+	}
+	r.resolved[id] = x
+	return x
+}
+
+// charge accounts for copying the blank node x into property n.
+func (r *rdfNormalizer) charge(n, x *Node) bool {
+	if r.budget < 0 {
+		return true
+	}
+	if r.budget -= countNodes(x); r.budget < 0 {
+		r.err = r.limit(n)
+		return false
+	}
+	return true
+}
+
+func countNodes(n *Node) int {
+	c := 1
+	for _, v := range n.Nodes {
+		c += countNodes(v)
+	}
+	return c
+}
+
+func (r *rdfNormalizer) collectRefs(n *Node) {
+	if id, ok := rdfAttr(n, "nodeID"); ok && len(n.Nodes) == 0 {
+		r.refs[id] = true
+	}
+	for _, v := range n.Nodes {
+		r.collectRefs(v)
+	}
+}
+
+// nodeElement normalizes a node element and its property elements.
+func (r *rdfNormalizer) nodeElement(n *Node) {
+	switch {
+	case isRDF(n.XMLName, "Bag"), isRDF(n.XMLName, "Seq"), isRDF(n.XMLName, "Alt"):
+		for _, v := range n.Nodes {
+			r.propertyElement(v)
+		}
+		return
+	case !isRDF(n.XMLName, "Description"):
+		// typed node, the type becomes an rdf:type property
+		t := NewNode(xml.Name{Space: nsRDF.GetURI(), Local: "type"})
+		t.AddAttr(Attr{Name: xml.Name{Space: nsRDF.GetURI(), Local: "resource"}, Value: n.XMLName.Space + n.XMLName.Local})
+		n.Nodes = append(NodeList{t}, n.Nodes...)
+		n.XMLName = xml.Name{Space: nsRDF.GetURI(), Local: "Description"}
+	}
+	for _, v := range n.Nodes {
+		// rdf:type keeps its URI as resource
+		if _, ok := rdfAttr(v, "resource"); ok && isRDF(v.XMLName, "type") {
+			continue
+		}
+		r.propertyElement(v)
+	}
+}
+
+// propertyElement normalizes a property element and its value.
+func (r *rdfNormalizer) propertyElement(n *Node) {
+	removeRDFAttr(n, "ID", "datatype")
+
+	parseType, _ := rdfAttr(n, "parseType")
+	switch parseType {
+	case "Literal":
+		var buf bytes.Buffer
+		for _, v := range n.Nodes {
+			if b, err := xml.Marshal(v); err == nil {
+				buf.Write(b)
+			}
+			v.Close()
+		}
+		if buf.Len() > 0 {
+			n.Value = buf.String()
+		}
+		n.Nodes = nil
+		removeRDFAttr(n, "parseType")
+		return
+	case "Resource":
+		for _, v := range n.Nodes {
+			r.propertyElement(v)
+		}
+		return
+	}
+
+	// resolve blank node references
+	if id, ok := rdfAttr(n, "nodeID"); ok && len(n.Nodes) == 0 {
+		removeRDFAttr(n, "nodeID")
+		if r.err != nil {
+			return
+		}
+		if x := r.resolve(id); x != nil && r.charge(n, x) {
+			n.Nodes = NodeList{copyNode(x)}
+		}
+		return
+	}
+	removeRDFAttr(n, "nodeID")
+
+	// URI values of empty property elements
+	if uri, ok := rdfAttr(n, "resource"); ok && len(n.Nodes) == 0 {
+		removeRDFAttr(n, "resource")
+		if !hasPropertyAttr(n) {
+			n.Value = uri
+		}
+		return
+	}
+
+	// the value is a single node element, otherwise text or empty
+	if len(n.Nodes) == 1 && isNodeElement(n.Nodes[0]) {
+		v := n.Nodes[0]
+		r.nodeElement(v)
+		removeRDFAttr(v, "about", "ID", "nodeID")
+		return
+	}
+
+	// struct fields written without rdf:parseType="Resource"
+	for _, v := range n.Nodes {
+		r.propertyElement(v)
+	}
+}
+
+// isNodeElement distinguishes node elements from struct fields that some
+// writers nest directly into a property element. Typed nodes are named
+// after a type, which by convention starts with an upper case letter.
+func isNodeElement(n *Node) bool {
+	if n.XMLName.Space == nsRDF.GetURI() {
+		return isRDF(n.XMLName, "Description") || isRDF(n.XMLName, "Bag") ||
+			isRDF(n.XMLName, "Seq") || isRDF(n.XMLName, "Alt")
+	}
+	if n.Value != "" || len(n.Nodes) == 0 && !hasPropertyAttr(n) {
+		return false
+	}
+	c := n.XMLName.Local
+	return c != "" && c[0] >= 'A' && c[0] <= 'Z'
+}
+
+// collectNamespaces returns all namespace declarations in the tree.
+func collectNamespaces(n *Node, fn func(prefix, uri string)) {
+	for _, v := range n.GetAttr("xmlns", "") {
+		fn(v.Name.Local, v.Value)
+	}
+	for _, v := range n.Nodes {
+		collectNamespaces(v, fn)
+	}
+}
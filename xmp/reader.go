@@ -44,6 +44,7 @@ func Scan(r io.Reader) (*Document, error) {
 func ScanPackets(r io.Reader) ([][]byte, error) {
 	packets := make([][]byte, 0)
 	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxPacketSize)
 	s.Split(splitPacket)
 	for s.Scan() {
 		b := s.Bytes()
@@ -63,11 +64,21 @@ func ScanPackets(r io.Reader) ([][]byte, error) {
 }
 
 var packet_start = []byte("<?xpacket begin")
-var packet_end = []byte("<?xpacket end")       // plus suffix `"w"?>`
+var packet_end = []byte("<?xpacket end") // plus suffix `="w"?>`
+var packet_close = []byte("?>")
 var magic = []byte("W5M0MpCehiHzreSzNTczkc9d") // len 24
 
+// maximum size of packets returned by ScanPackets
+const maxPacketSize = 1 << 30
+
+// maximum distance between the packet end marker and its closing `?>`
+const maxPacketEndSuffix = 32
+
 func isXmpPacket(b []byte) bool {
-	return bytes.Index(b[:51], magic) > -1
+	if len(b) > 51 {
+		b = b[:51]
+	}
+	return bytes.Index(b, magic) > -1
 }
 
 func splitPacket(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -80,12 +91,28 @@ func splitPacket(data []byte, atEOF bool) (advance int, token []byte, err error)
 		return len(data), nil, nil
 	}
 	end := bytes.Index(data[start:], packet_end)
-	last := start + end + len(packet_end) + 6
-	if end == -1 || last > len(data) {
+	if end == -1 {
 		if atEOF {
 			return len(data), nil, nil
 		}
 		return 0, nil, nil
 	}
+	// the packet ends at the closing `?>` of the end processing
+	// instruction; bytes following it may belong to the container
+	// (e.g. the GIF application extension trailer)
+	suffix := start + end + len(packet_end)
+	window := data[suffix:]
+	if len(window) > maxPacketEndSuffix {
+		window = window[:maxPacketEndSuffix]
+	}
+	n := bytes.Index(window, packet_close)
+	if n == -1 {
+		if !atEOF && len(window) < maxPacketEndSuffix {
+			return 0, nil, nil
+		}
+		// malformed end marker, skip this packet
+		return suffix, nil, nil
+	}
+	last := suffix + n + len(packet_close)
 	return last, data[start:last], nil
 }
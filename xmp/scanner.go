@@ -0,0 +1,395 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encoding is the character encoding of an XMP packet.
+type Encoding int
+
+const (
+	EncodingUTF8 Encoding = iota
+	EncodingUTF16BE
+	EncodingUTF16LE
+	EncodingUTF32BE
+	EncodingUTF32LE
+)
+
+var encodings = []Encoding{
+	EncodingUTF8,
+	EncodingUTF16BE,
+	EncodingUTF16LE,
+	EncodingUTF32BE,
+	EncodingUTF32LE,
+}
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingUTF16BE:
+		return "UTF-16BE"
+	case EncodingUTF16LE:
+		return "UTF-16LE"
+	case EncodingUTF32BE:
+		return "UTF-32BE"
+	case EncodingUTF32LE:
+		return "UTF-32LE"
+	default:
+		return "UTF-8"
+	}
+}
+
+// UnitSize returns the size of a single code unit in bytes.
+func (e Encoding) UnitSize() int {
+	switch e {
+	case EncodingUTF16BE, EncodingUTF16LE:
+		return 2
+	case EncodingUTF32BE, EncodingUTF32LE:
+		return 4
+	default:
+		return 1
+	}
+}
+
+// Encode converts UTF-8 text to the encoding.
+func (e Encoding) Encode(b []byte) []byte {
+	if e == EncodingUTF8 {
+		return b
+	}
+	n := e.UnitSize()
+	out := make([]byte, 0, len(b)*n)
+	put := func(v uint32) {
+		switch e {
+		case EncodingUTF16BE:
+			out = append(out, byte(v>>8), byte(v))
+		case EncodingUTF16LE:
+			out = append(out, byte(v), byte(v>>8))
+		case EncodingUTF32BE:
+			out = append(out, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		case EncodingUTF32LE:
+			out = append(out, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+		}
+	}
+	for _, r := range string(b) {
+		if n == 2 && r >= 0x10000 {
+			r1, r2 := utf16.EncodeRune(r)
+			put(uint32(r1))
+			put(uint32(r2))
+			continue
+		}
+		put(uint32(r))
+	}
+	return out
+}
+
+// unit returns the code unit at the start of b.
+func (e Encoding) unit(b []byte) uint32 {
+	switch e {
+	case EncodingUTF16BE:
+		return uint32(b[0])<<8 | uint32(b[1])
+	case EncodingUTF16LE:
+		return uint32(b[1])<<8 | uint32(b[0])
+	case EncodingUTF32BE:
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	case EncodingUTF32LE:
+		return uint32(b[3])<<24 | uint32(b[2])<<16 | uint32(b[1])<<8 | uint32(b[0])
+	default:
+		return uint32(b[0])
+	}
+}
+
+// Decode converts text in the encoding to UTF-8. Trailing partial code
+// units are dropped.
+func (e Encoding) Decode(b []byte) []byte {
+	if e == EncodingUTF8 {
+		return b
+	}
+	n := e.UnitSize()
+	out := make([]byte, 0, len(b)/n)
+	var buf [utf8.UTFMax]byte
+	switch n {
+	case 2:
+		units := make([]uint16, 0, len(b)/2)
+		for ; len(b) >= 2; b = b[2:] {
+			units = append(units, uint16(e.unit(b)))
+		}
+		for _, r := range utf16.Decode(units) {
+			out = append(out, buf[:utf8.EncodeRune(buf[:], r)]...)
+		}
+	case 4:
+		for ; len(b) >= 4; b = b[4:] {
+			out = append(out, buf[:utf8.EncodeRune(buf[:], rune(e.unit(b)))]...)
+		}
+	}
+	return out
+}
+
+// PacketInfo describes the position and properties of an XMP packet in a
+// file.
+type PacketInfo struct {
+	Offset   int64    // offset of the packet header
+	Length   int64    // length up to and including the packet trailer
+	Padding  int64    // whitespace bytes preceding the packet trailer
+	Writable bool     // trailer is end="w"
+	Encoding Encoding // character encoding of the packet
+}
+
+const (
+	scanChunkSize = 1 << 20
+
+	// maximum distance of the closing `?>` from the packet trailer start
+	maxTrailerSize = 32
+
+	// the packet header must contain the magic id within this many units
+	maxHeaderSize = 128
+)
+
+// ScanPacketInfo searches the first size bytes of r for XMP packets in any
+// of the supported encodings. The scan reads the file in chunks, so files
+// and packets of any size are supported. Truncated packets are ignored.
+func ScanPacketInfo(r io.ReaderAt, size int64) ([]*PacketInfo, error) {
+	starts := make([][]byte, len(encodings))
+	for i, e := range encodings {
+		starts[i] = e.Encode(packet_start)
+	}
+	l := make([]*PacketInfo, 0)
+	for pos := int64(0); pos < size; {
+		start, i, err := findFirst(r, size, pos, starts)
+		if err != nil {
+			return nil, err
+		}
+		if start < 0 {
+			break
+		}
+		cands, err := packetCandidates(r, size, start, starts)
+		if err != nil {
+			return nil, err
+		}
+		var p *PacketInfo
+		for _, c := range cands {
+			if p, err = scanPacket(r, size, c.off, encodings[c.i]); err != nil {
+				return nil, err
+			}
+			if p != nil {
+				break
+			}
+		}
+		if p == nil {
+			pos = start + int64(len(starts[i]))
+			continue
+		}
+		l = append(l, p)
+		pos = p.Offset + p.Length
+	}
+	return l, nil
+}
+
+// ReadPacketAt reads the packet described by p and converts it to UTF-8.
+func ReadPacketAt(r io.ReaderAt, p *PacketInfo) ([]byte, error) {
+	b := make([]byte, p.Length)
+	if _, err := r.ReadAt(b, p.Offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return p.Encoding.Decode(b), nil
+}
+
+type packetCandidate struct {
+	off int64 // header offset
+	i   int   // index of the matching pattern
+}
+
+// packetCandidates returns the possible packet headers near start, the
+// first match of any pattern. Zero bytes before a little-endian header
+// also match the big-endian pattern up to three bytes earlier and a
+// big-endian header matches the little-endian pattern up to three bytes
+// later, so the encoding of plain ASCII headers is ambiguous. Candidates
+// whose begin attribute holds the byte order mark come first, followed by
+// candidates aligned to their code unit size.
+func packetCandidates(r io.ReaderAt, size, start int64, patterns [][]byte) ([]packetCandidate, error) {
+	b, err := readAt(r, size, start, 3+maxHeaderSize*4)
+	if err != nil {
+		return nil, err
+	}
+	var l []packetCandidate
+	for k := 0; k < 4 && k < len(b); k++ {
+		for i, v := range patterns {
+			if bytes.HasPrefix(b[k:], v) {
+				l = append(l, packetCandidate{start + int64(k), i})
+			}
+		}
+	}
+	rank := func(c packetCandidate) int {
+		switch {
+		case hasBOM(encodings[c.i].Decode(b[c.off-start:])):
+			return 0
+		case c.off%int64(encodings[c.i].UnitSize()) == 0:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(l, func(i, j int) bool { return rank(l[i]) < rank(l[j]) })
+	return l, nil
+}
+
+// hasBOM reports whether the begin attribute of the UTF-8 packet header
+// hdr starts with the byte order mark.
+func hasBOM(hdr []byte) bool {
+	v, _ := beginAttr(hdr)
+	r, _ := utf8.DecodeRune(v)
+	return r == '\uFEFF'
+}
+
+// beginAttr returns the value of the begin attribute of the UTF-8 packet
+// header hdr. It returns false when hdr is no packet header.
+func beginAttr(hdr []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(hdr, packet_start) {
+		return nil, false
+	}
+	v := bytes.TrimLeft(hdr[len(packet_start):], " \t\r\n")
+	if len(v) == 0 || v[0] != '=' {
+		return nil, false
+	}
+	v = bytes.TrimLeft(v[1:], " \t\r\n")
+	if len(v) == 0 || (v[0] != '"' && v[0] != '\'') {
+		return nil, false
+	}
+	i := bytes.IndexByte(v[1:], v[0])
+	if i < 0 {
+		return nil, false
+	}
+	return v[1 : i+1], true
+}
+
+// scanPacket inspects a packet that starts at offset start. It returns nil
+// when the header lacks the packet id or the packet is truncated.
+func scanPacket(r io.ReaderAt, size, start int64, enc Encoding) (*PacketInfo, error) {
+	n := int64(enc.UnitSize())
+
+	// the header must carry the magic packet id
+	hdr, err := readAt(r, size, start, maxHeaderSize*n)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(enc.Decode(hdr), magic) {
+		return nil, nil
+	}
+
+	// find the trailer and its closing `?>`
+	end := enc.Encode(packet_end)
+	trailer, _, err := findFirst(r, size, start, [][]byte{end})
+	if err != nil || trailer < 0 {
+		return nil, err
+	}
+	suffix, err := readAt(r, size, trailer+int64(len(end)), maxTrailerSize*n)
+	if err != nil {
+		return nil, err
+	}
+	text := enc.Decode(suffix)
+	i := bytes.Index(text, packet_close)
+	if i < 0 {
+		return nil, nil
+	}
+	attr := strings.Trim(string(text[:i]), " \t\r\n=\"'")
+	p := &PacketInfo{
+		Offset:   start,
+		Length:   trailer - start + int64(len(end)) + int64(len(enc.Encode(text[:i+len(packet_close)]))),
+		Writable: attr != "r",
+		Encoding: enc,
+	}
+
+	// count whitespace preceding the trailer
+	for pos := trailer; pos > start; {
+		from := pos - 4096
+		if from < start {
+			from = start
+		}
+		// keep unit alignment relative to the packet start
+		from += (pos - from) % n
+		b, err := readAt(r, size, from, pos-from)
+		if err != nil {
+			return nil, err
+		}
+		k := int64(len(b))
+		for k >= n && isSpace(enc.unit(b[k-n:])) {
+			k -= n
+		}
+		p.Padding += int64(len(b)) - k
+		if k > 0 {
+			break
+		}
+		pos = from
+	}
+	return p, nil
+}
+
+func isSpace(c uint32) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// readAt reads up to n bytes at offset off.
+func readAt(r io.ReaderAt, size, off, n int64) ([]byte, error) {
+	if off+n > size {
+		n = size - off
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	b := make([]byte, n)
+	m, err := r.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b[:m], nil
+}
+
+// findFirst returns the offset of the first occurrence of any pattern at or
+// after pos together with the index of the matching pattern, or -1.
+func findFirst(r io.ReaderAt, size, pos int64, patterns [][]byte) (int64, int, error) {
+	overlap := 0
+	for _, v := range patterns {
+		if len(v) > overlap {
+			overlap = len(v)
+		}
+	}
+	overlap--
+	chunk := int64(scanChunkSize + overlap)
+	for pos < size {
+		b, err := readAt(r, size, pos, chunk)
+		if err != nil {
+			return -1, 0, err
+		}
+		best, which := -1, 0
+		for i, v := range patterns {
+			if j := bytes.Index(b, v); j >= 0 && (best < 0 || j < best) {
+				best, which = j, i
+			}
+		}
+		if best >= 0 {
+			return pos + int64(best), which, nil
+		}
+		if int64(len(b)) < chunk {
+			break
+		}
+		pos += int64(len(b) - overlap)
+	}
+	return -1, 0, nil
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmp
+
+// isProperty returns true when name is an XMP property name and not part
+// of the RDF/XML syntax.
+func isProperty(name string) bool {
+	if !hasPrefix(name) {
+		return false
+	}
+	switch getPrefix(name) {
+	case "xmlns", "rdf", "xml", "x":
+		return false
+	}
+	return true
+}
+
+// isResource returns true when properties of n may be written as
+// child elements, i.e. n is a rdf:Description or a parseType=Resource node.
+func isResource(n *Node) bool {
+	return n.XMLName == rdfDescription || hasResourceAttr(n)
+}
+
+func hasResourceAttr(n *Node) bool {
+	for _, v := range n.Attr {
+		if v.Name.Local == rdfResourceAttr.Name.Local && v.Value == rdfResourceAttr.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAttrs separates property attributes from RDF/XML syntax attributes.
+func splitAttrs(l AttrList) (props, syntax AttrList) {
+	for _, v := range l {
+		if isProperty(v.Name.Local) {
+			props = append(props, v)
+		} else {
+			syntax = append(syntax, v)
+		}
+	}
+	return
+}
+
+// applyStyle rewrites the output tree into the serialization form selected
+// by the encoder flags.
+func (e *Encoder) applyStyle() {
+	for _, n := range e.root.Nodes {
+		if e.flags&Xcanonical > 0 {
+			canonicalize(n)
+		}
+		if e.flags&Xnested > 0 {
+			nestResources(n)
+		}
+		if e.flags&(Xcompact|Xcanonical) == Xcompact {
+			compact(n)
+		}
+	}
+	if e.flags&Xsingle > 0 {
+		mergeDescriptions(e.root)
+	}
+}
+
+// canonicalize turns all property attributes into child elements. Empty
+// property elements that carry struct fields as attributes become
+// parseType=Resource nodes.
+func canonicalize(n *Node) {
+	if n.Model != nil {
+		return
+	}
+	props, syntax := splitAttrs(n.Attr)
+	if len(props) > 0 {
+		l := make(NodeList, 0, len(props)+len(n.Nodes))
+		for _, v := range props {
+			c := NewNode(v.Name)
+			c.Value = v.Value
+			l = append(l, c)
+		}
+		n.Nodes = append(l, n.Nodes...)
+		n.Attr = syntax
+		if !isResource(n) {
+			n.AddAttr(rdfResourceAttr)
+		}
+	}
+	for _, v := range n.Nodes {
+		canonicalize(v)
+	}
+}
+
+// compact turns simple properties of rdf:Description nodes into attributes.
+func compact(n *Node) {
+	if n.Model != nil {
+		return
+	}
+	if n.XMLName == rdfDescription {
+		l := make(NodeList, 0, len(n.Nodes))
+		for _, v := range n.Nodes {
+			if isSimpleProperty(v) && len(n.GetAttr("", stripPrefix(v.XMLName.Local))) == 0 {
+				n.AddAttr(Attr{Name: v.XMLName, Value: v.Value})
+				v.Close()
+				continue
+			}
+			l = append(l, v)
+		}
+		n.Nodes = l
+	}
+	for _, v := range n.Nodes {
+		compact(v)
+	}
+}
+
+func isSimpleProperty(n *Node) bool {
+	return isProperty(n.XMLName.Local) && n.Model == nil && n.Value != "" &&
+		len(n.Attr) == 0 && len(n.Nodes) == 0
+}
+
+// nestResources replaces parseType=Resource nodes with properties wrapped
+// into a nested rdf:Description.
+func nestResources(n *Node) {
+	if n.Model != nil {
+		return
+	}
+	for _, v := range n.Nodes {
+		nestResources(v)
+	}
+	if n.XMLName == rdfDescription || !hasResourceAttr(n) {
+		return
+	}
+	props, syntax := splitAttrs(n.Attr)
+	desc := NewNode(rdfDescription)
+	desc.Attr = props
+	desc.Nodes = n.Nodes
+	n.Nodes = NodeList{desc}
+	n.Attr = nil
+	for _, v := range syntax {
+		if v != rdfResourceAttr {
+			n.Attr = append(n.Attr, v)
+		}
+	}
+}
+
+// mergeDescriptions merges all top-level rdf:Description nodes into one.
+func mergeDescriptions(root *Node) {
+	if len(root.Nodes) < 2 {
+		return
+	}
+	desc := NewNode(rdfDescription)
+	var ns, about, props AttrList
+	seen := make(map[string]bool)
+	for _, n := range root.Nodes {
+		for _, v := range n.Attr {
+			switch {
+			case getPrefix(v.Name.Local) == "xmlns":
+				if !seen[v.Name.Local] {
+					seen[v.Name.Local] = true
+					ns = append(ns, v)
+				}
+			case v.Name.Local == aboutAttr.Name.Local:
+				if len(about) == 0 {
+					about = append(about, v)
+				}
+			default:
+				props = append(props, v)
+			}
+		}
+		desc.Nodes = append(desc.Nodes, n.Nodes...)
+		n.Nodes = nil
+		n.Close()
+	}
+	desc.Attr = append(append(ns, about...), props...)
+	root.Nodes = NodeList{desc}
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
@@ -33,22 +34,43 @@ type UnmarshalerAttr interface {
 	UnmarshalXMPAttr(d *Decoder, a Attr) error
 }
 
+const (
+	Dpreserve = 1 << iota // record the source layout for byte-preserving encoding
+	Dstrict               // stop at the first decode issue, including warnings
+	Dlenient              // skip malformed properties and keep decoding
+	dMode     = Dpreserve | Dstrict | Dlenient
+)
+
 type Decoder struct {
 	d        *xml.Decoder
+	r        io.Reader
+	lines    *lineReader
+	flags    int
 	toolkit  string
 	about    string
 	nodes    NodeList
 	intNsMap map[string]*Namespace
 	extNsMap map[string]*Namespace
 	version  Version
+
+	qualifiers map[Path]QualifierList
+	offsets    map[*Node]int64
+	issues     []*DecodeIssue
+	limits     Limits
+	count      int // decoded elements
 }
 
 func NewDecoder(r io.Reader) *Decoder {
+	lr := &lineReader{r: r}
 	return &Decoder{
-		d:        xml.NewDecoder(r),
+		d:        xml.NewDecoder(lr),
+		r:        lr,
+		lines:    lr,
 		nodes:    make(NodeList, 0),
 		intNsMap: make(map[string]*Namespace),
 		extNsMap: make(map[string]*Namespace),
+
+		qualifiers: make(map[Path]QualifierList),
 	}
 }
 
@@ -56,6 +78,10 @@ func (d *Decoder) SetVersion(v Version) {
 	d.version = v
 }
 
+func (d *Decoder) SetFlags(flags int) {
+	d.flags = flags & dMode
+}
+
 func Unmarshal(data []byte, d *Document) error {
 	return NewDecoder(bytes.NewReader(data)).Decode(d)
 }
@@ -74,11 +100,29 @@ func (d *Decoder) Decode(x *Document) error {
 		return nil
 	}
 
+	// 0  keep the source for byte-preserving output
+	var src []byte
+	if d.flags&Dpreserve > 0 {
+		var err error
+		if src, err = io.ReadAll(d.r); err != nil {
+			return err
+		}
+		d.d = xml.NewDecoder(bytes.NewReader(src))
+	}
+
 	// 1  parse node tree from XML
+	d.issues = nil
+	d.count = 0
+	d.offsets = make(map[*Node]int64)
+	defer func() { d.offsets = nil }()
 	root := NewNode(emptyName)
 	gc := root
 	defer gc.Close()
-	if err := d.d.Decode(root); err != nil {
+	if err := d.parse(root); err != nil {
+		var le *LimitError
+		if errors.As(err, &le) {
+			return le
+		}
 		return fmt.Errorf("xmp: parsing xml failed: %v", err)
 	}
 
@@ -100,14 +144,32 @@ func (d *Decoder) Decode(x *Document) error {
 		return fmt.Errorf("xmp: invalid XML format: missing rdf:RDF node, found %s:%s", root.Namespace(), root.Name())
 	}
 
-	// 3  extract document namespaces
-	for _, n := range root.Nodes {
-		for _, v := range n.GetAttr("xmlns", "") {
-			d.addNamespace(v.Name.Local, v.Value)
+	// 3  extract document namespaces, declarations may appear on any node
+	collectNamespaces(gc, d.addNamespace)
+
+	// 4  rewrite alternative RDF forms into canonical XMP, nodes copied for
+	//    rdf:nodeID references count against the node limit
+	budget := -1
+	if max := d.limits.MaxNodes; max > 0 {
+		budget = max - d.count
+	}
+	err := normalizeRDF(root, budget, func(n *Node) error {
+		off, ok := d.offsets[n]
+		if !ok {
+			off = -1
 		}
+		return d.limitError("MaxNodes", int64(d.limits.MaxNodes), off)
+	})
+	if err != nil {
+		return err
 	}
 
-	// 4  walk node tree and create model instances
+	// 5  move qualifiers out of qualified values
+	if err := d.decodeQualifiers(root); err != nil {
+		return err
+	}
+
+	// 6  walk node tree and create model instances
 	for _, n := range root.Nodes {
 		// we expect outer nodes
 		if n.FullName() != "rdf:Description" {
@@ -123,7 +185,7 @@ func (d *Decoder) Decode(x *Document) error {
 				continue
 			}
 
-			if err := d.decodeAttribute(&d.nodes, v); err != nil {
+			if err := d.decodeAttribute(&d.nodes, n, v); err != nil {
 				return err
 			}
 		}
@@ -142,7 +204,15 @@ func (d *Decoder) Decode(x *Document) error {
 	x.nodes = d.nodes
 	x.intNsMap = d.intNsMap
 	x.extNsMap = d.extNsMap
-	return x.syncFromXMP()
+	x.qualifiers = d.qualifiers
+	if err := x.syncFromXMP(); err != nil {
+		return err
+	}
+	x.foldAliases()
+	if src != nil {
+		x.layout = d.newLayout(src)
+	}
+	return nil
 }
 
 func (d *Decoder) decodeNode(ctx *NodeList, src *Node) error {
@@ -160,7 +230,10 @@ func (d *Decoder) decodeNode(ctx *NodeList, src *Node) error {
 	if node.Model != nil {
 		finfo, field := d.findStructField(derefIndirect(node.Model), name)
 		if field.IsValid() {
-			return d.unmarshal(field, finfo, src)
+			if err := d.unmarshal(field, finfo, src); err != nil {
+				return d.report(d.propertyIssue(src, src.XMLName, err))
+			}
+			return nil
 		} else {
 			storeNode = finfo == nil || finfo.flags&fOmit == 0
 		}
@@ -179,7 +252,8 @@ func (d *Decoder) decodeNode(ctx *NodeList, src *Node) error {
 	return nil
 }
 
-func (d *Decoder) decodeAttribute(ctx *NodeList, src Attr) error {
+// decodeAttribute decodes the property attribute src of node owner.
+func (d *Decoder) decodeAttribute(ctx *NodeList, owner *Node, src Attr) error {
 
 	d.translate(&src.Name)
 	if skipField(src.Name) {
@@ -197,7 +271,7 @@ func (d *Decoder) decodeAttribute(ctx *NodeList, src Attr) error {
 		finfo, field := d.findStructField(derefIndirect(node.Model), src.Name.Local)
 		if field.IsValid() {
 			if err := d.unmarshalAttr(field, finfo, src); err != nil {
-				return err
+				return d.report(d.propertyIssue(owner, src.Name, err))
 			}
 		} else {
 			// capture the field as external attribute
@@ -249,10 +323,10 @@ func (d *Decoder) unmarshal(val reflect.Value, finfo *fieldInfo, src *Node) erro
 			}
 			if finfo, field := d.findStructField(val, a.Name.Local); field.IsValid() {
 				if err := d.unmarshalAttr(field, finfo, a); err != nil {
-					return err
+					return nestError(a.Name.Local, src, err)
 				}
 			} else {
-				return fmt.Errorf("xmp: unmarshal model %s: field for attr %s not found in type %v", src.FullName(), a.Name.Local, val.Type())
+				return nestError(a.Name.Local, src, fmt.Errorf("xmp: unmarshal model %s: field for attr %s not found in type %v: %w", src.FullName(), a.Name.Local, val.Type(), ErrUnknownField))
 			}
 		}
 
@@ -271,17 +345,17 @@ func (d *Decoder) unmarshal(val reflect.Value, finfo *fieldInfo, src *Node) erro
 				}
 				if finfo, field := d.findStructField(val, name); field.IsValid() {
 					if err := d.unmarshal(field, finfo, n); err != nil {
-						return err
+						return nestError(name, n, err)
 					}
 				} else {
-					return fmt.Errorf("xmp: unmarshal model %s: struct field %s not found (not stored)", src.FullName(), name)
+					return nestError(name, n, fmt.Errorf("xmp: unmarshal model %s: struct field %s not found (not stored): %w", src.FullName(), name, ErrUnknownField))
 				}
 			}
 		}
 	} else {
 		// otherwise set simple value directly
 		if err := setValue(val, src.Value); err != nil {
-			return fmt.Errorf("xmp: unmarshal %s: %v", finfo.String(), err)
+			return fmt.Errorf("xmp: unmarshal %s: %w", finfo.String(), err)
 		}
 	}
 
@@ -317,7 +391,7 @@ func (d *Decoder) unmarshalAttr(val reflect.Value, finfo *fieldInfo, src Attr) e
 		// Recur to read element into slice.
 		if err := d.unmarshalAttr(val.Index(n), nil, src); err != nil {
 			val.SetLen(n)
-			return fmt.Errorf("xmp: unmarshal %s: %v", finfo.String(), err)
+			return fmt.Errorf("xmp: unmarshal %s: %w", finfo.String(), err)
 		}
 		return nil
 	}
@@ -524,7 +598,7 @@ func skipField(n xml.Name) bool {
 	}
 
 	switch n.Local {
-	case "rdf:parseType", "rdf:type", "xml:lang":
+	case "rdf:parseType", "rdf:type", "xml:lang", "rdf:about", "rdf:ID", "rdf:nodeID":
 		return true
 	default:
 		return false
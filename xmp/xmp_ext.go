@@ -74,12 +74,12 @@ func (x Extension) MarshalXMP(e *Encoder, node *Node, m Model) error {
 }
 
 func (x *Extension) UnmarshalXMPAttr(d *Decoder, a Attr) error {
-	return d.decodeAttribute(&x.Nodes, a)
+	return d.decodeAttribute(&x.Nodes, nil, a)
 }
 
 func (x *Extension) UnmarshalXMP(d *Decoder, src *Node, m Model) error {
 	for _, v := range src.Attr {
-		if err := d.decodeAttribute(&x.Nodes, v); err != nil {
+		if err := d.decodeAttribute(&x.Nodes, src, v); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,239 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmpfiles
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// ErrLocked is returned when the lock file of another writer is still
+// present after WriteOptions.LockTimeout.
+var ErrLocked = errors.New("xmpfiles: file is locked by another writer")
+
+// default age after which a lock file is considered abandoned
+const defaultStaleLock = 10 * time.Minute
+
+// WriteOptions controls atomic file writes.
+type WriteOptions struct {
+	Backup      bool          // keep the previous file contents as name.bak
+	Lock        bool          // serialize writers through a name.lock file
+	LockTimeout time.Duration // time to wait for a lock, one second when zero
+	StaleLock   time.Duration // age of abandoned lock files, ten minutes when zero
+}
+
+// WriteFile stores d as XMP metadata of the file name. The file is
+// rewritten atomically, see WriteFileAtomic.
+func WriteFile(name string, d *xmp.Document, opts *WriteOptions) error {
+	return writeEmbedded(name, d, opts)
+}
+
+// WriteFileAtomic replaces the file name with the output of write. The
+// output goes to a temporary file in the same directory that is synced to
+// disk and renamed over the original, so readers see either the old or the
+// new file but never a partial one. Mode and modification time of an
+// existing file are preserved. With opts.Lock set an advisory lock file is
+// created next to name. It works on network file systems where flock is
+// unreliable, but only excludes writers that use the same protocol.
+//
+// The lock file records host, process id and time of its writer. A writer
+// that crashes leaves the lock behind, it is removed by the next writer
+// once its modification time is older than opts.StaleLock. Writes must
+// therefore finish within that time. A lock can also be deleted by hand
+// after checking that the recorded process is gone.
+func WriteFileAtomic(name string, opts *WriteOptions, write func(w io.Writer) error) error {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+	if opts.Lock {
+		unlock, err := lockFile(name, opts.LockTimeout, opts.StaleLock)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return writeAtomic(name, opts, write)
+}
+
+func writeAtomic(name string, opts *WriteOptions, write func(w io.Writer) error) error {
+	mode := os.FileMode(0644)
+	fi, err := os.Stat(name)
+	switch {
+	case err == nil:
+		mode = fi.Mode().Perm()
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	dir, base := filepath.Split(name)
+	tmp, err := ioutil.TempFile(filepath.Join(dir, "."), "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op after a successful rename
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if fi != nil {
+		if err := os.Chtimes(tmp.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+			return err
+		}
+		if opts.Backup {
+			if err := backup(name, mode); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// backup stores the current contents of name in name.bak.
+func backup(name string, mode os.FileMode) error {
+	bak := name + ".bak"
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(name, bak) == nil {
+		return nil
+	}
+	// file systems without hard links
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeAtomic(bak, &WriteOptions{}, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// syncDir persists the directory entry of a renamed file. Not all
+// platforms support this, so errors are ignored.
+func syncDir(dir string) {
+	f, err := os.Open(filepath.Join(dir, "."))
+	if err != nil {
+		return
+	}
+	f.Sync()
+	f.Close()
+}
+
+// lockFile creates name.lock exclusively and returns a function that
+// removes it again. Locks older than stale are broken.
+func lockFile(name string, timeout, stale time.Duration) (func(), error) {
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	if stale <= 0 {
+		stale = defaultStaleLock
+	}
+	lock := name + ".lock"
+	host, _ := os.Hostname()
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%s %d %s\n", host, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > stale {
+			breakLock(lock, fi)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// breakLock removes the stale lock file described by fi. The file is moved
+// aside first, so a concurrent writer that broke the same lock and created
+// a new one does not lose it.
+func breakLock(lock string, fi os.FileInfo) {
+	tmp := fmt.Sprintf("%s.stale%d", lock, os.Getpid())
+	if os.Rename(lock, tmp) != nil {
+		return
+	}
+	if moved, err := os.Stat(tmp); err == nil && !os.SameFile(fi, moved) {
+		// restore the fresh lock unless yet another writer holds one
+		os.Link(tmp, lock)
+	}
+	os.Remove(tmp)
+}
+
+func writeEmbedded(name string, d *xmp.Document, opts *WriteOptions) error {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+	if opts.Lock {
+		unlock, err := lockFile(name, opts.LockTimeout, opts.StaleLock)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	// open under the lock so concurrent updates are not lost
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeAtomic(name, opts, func(w io.Writer) error {
+		// close before the rename, some platforms cannot replace open files
+		defer src.Close()
+		return Write(w, src, d)
+	})
+}
+
+func writeSidecar(name string, d *xmp.Document, opts *WriteOptions) error {
+	b, err := xmp.MarshalIndent(d, "", " ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(name, opts, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
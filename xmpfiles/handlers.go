@@ -0,0 +1,313 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmpfiles
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/mholt/go-xmp/format/bmff"
+	"github.com/mholt/go-xmp/format/gif"
+	"github.com/mholt/go-xmp/format/id3"
+	"github.com/mholt/go-xmp/format/jp2"
+	"github.com/mholt/go-xmp/format/jpeg"
+	"github.com/mholt/go-xmp/format/jxl"
+	"github.com/mholt/go-xmp/format/pdf"
+	"github.com/mholt/go-xmp/format/png"
+	"github.com/mholt/go-xmp/format/psd"
+	"github.com/mholt/go-xmp/format/riff"
+	"github.com/mholt/go-xmp/format/tiff"
+	"github.com/mholt/go-xmp/format/webp"
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// handler adapts the functions of a format package to the Handler
+// interface.
+type handler struct {
+	name        string
+	detect      func(head []byte) bool
+	readPacket  func(r io.ReadSeeker) ([]byte, error)
+	read        func(r io.ReadSeeker) (*xmp.Document, error)
+	write       func(w io.Writer, r io.ReadSeeker, d *xmp.Document) error
+	errNoXMP    error
+	inPlaceSafe bool // container has no checksum or length covering the packet
+}
+
+func (h *handler) Name() string {
+	return h.name
+}
+
+func (h *handler) Detect(head []byte) bool {
+	return h.detect(head)
+}
+
+func (h *handler) mapError(err error) error {
+	if err != nil && err == h.errNoXMP {
+		return ErrNoXMP
+	}
+	return err
+}
+
+// ReadPackets returns the main packet only. Format packages do not report
+// packet offsets, so the offset is located by a byte search.
+func (h *handler) ReadPackets(r io.ReadSeeker) ([]*Packet, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	packet, err := h.readPacket(r)
+	if err != nil {
+		return nil, h.mapError(err)
+	}
+	p := &Packet{Length: int64(len(packet)), Data: packet}
+	if p.Offset, err = locate(r, packet); err != nil {
+		return nil, err
+	}
+	return []*Packet{p}, nil
+}
+
+func (h *handler) Read(r io.ReadSeeker) (*xmp.Document, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	d, err := h.read(r)
+	return d, h.mapError(err)
+}
+
+func (h *handler) Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return h.write(w, r, d)
+}
+
+func (h *handler) CanUpdateInPlace(r io.ReadSeeker, size int) (bool, error) {
+	if !h.inPlaceSafe {
+		return false, nil
+	}
+	l, err := h.ReadPackets(r)
+	if err == ErrNoXMP {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(l) == 0 {
+		return false, nil
+	}
+	p := l[0]
+	return p.Offset >= 0 && int64(size) <= p.Length && writable(p.Data), nil
+}
+
+// writable returns false for packets marked read-only with end="r".
+func writable(packet []byte) bool {
+	i := bytes.LastIndex(packet, []byte("<?xpacket end="))
+	if i < 0 {
+		return true
+	}
+	v := packet[i+len("<?xpacket end="):]
+	return len(v) < 2 || v[1] != 'r'
+}
+
+func hasPrefix(head []byte, s string) bool {
+	return bytes.HasPrefix(head, []byte(s))
+}
+
+// isXMP detects plain XMP files such as sidecars, optionally starting with
+// an XML declaration.
+func isXMP(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if hasPrefix(head, "<?xml") {
+		i := bytes.Index(head, []byte("?>"))
+		if i < 0 {
+			return false
+		}
+		head = bytes.TrimLeft(head[i+2:], " \t\r\n")
+	}
+	for _, v := range []string{"<?xpacket", "<x:xmpmeta", "<rdf:RDF"} {
+		if hasPrefix(head, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTIFF(head []byte) bool {
+	for _, v := range []string{"II*\x00", "MM\x00*", "II+\x00", "MM\x00+"} {
+		if hasPrefix(head, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func isRIFF(head []byte) bool {
+	if len(head) < 12 {
+		return false
+	}
+	switch string(head[:4]) {
+	case "RIFF", "RF64", "BW64":
+		return string(head[8:12]) != "WEBP"
+	}
+	return false
+}
+
+func isBMFF(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+	switch string(head[4:8]) {
+	case "ftyp", "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+func init() {
+	Register(&handler{
+		name:   "xmp",
+		detect: isXMP,
+		readPacket: func(r io.ReadSeeker) ([]byte, error) {
+			return ioutil.ReadAll(r)
+		},
+		read: func(r io.ReadSeeker) (*xmp.Document, error) {
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			return decode(b)
+		},
+		write: func(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+			b, err := xmp.MarshalIndent(d, "", " ")
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(b)
+			return err
+		},
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:        "jpeg",
+		detect:      func(head []byte) bool { return hasPrefix(head, "\xff\xd8\xff") },
+		readPacket:  func(r io.ReadSeeker) ([]byte, error) { return jpeg.ReadPacket(r) },
+		read:        func(r io.ReadSeeker) (*xmp.Document, error) { return jpeg.Read(r) },
+		write:       func(w io.Writer, r io.ReadSeeker, d *xmp.Document) error { return jpeg.Write(w, r, d) },
+		errNoXMP:    jpeg.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:        "tiff",
+		detect:      isTIFF,
+		readPacket:  tiff.ReadPacket,
+		read:        tiff.Read,
+		write:       tiff.Write,
+		errNoXMP:    tiff.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:       "png",
+		detect:     func(head []byte) bool { return hasPrefix(head, "\x89PNG\r\n\x1a\n") },
+		readPacket: func(r io.ReadSeeker) ([]byte, error) { return png.ReadPacket(r) },
+		read:       func(r io.ReadSeeker) (*xmp.Document, error) { return png.Read(r) },
+		write:      func(w io.Writer, r io.ReadSeeker, d *xmp.Document) error { return png.Write(w, r, d) },
+		errNoXMP:   png.ErrNoXMP,
+	})
+	Register(&handler{
+		name:        "gif",
+		detect:      func(head []byte) bool { return hasPrefix(head, "GIF87a") || hasPrefix(head, "GIF89a") },
+		readPacket:  func(r io.ReadSeeker) ([]byte, error) { return gif.ReadPacket(r) },
+		read:        func(r io.ReadSeeker) (*xmp.Document, error) { return gif.Read(r) },
+		write:       gif.Write,
+		errNoXMP:    gif.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name: "webp",
+		detect: func(head []byte) bool {
+			return len(head) >= 12 && hasPrefix(head, "RIFF") && string(head[8:12]) == "WEBP"
+		},
+		readPacket:  webp.ReadPacket,
+		read:        webp.Read,
+		write:       webp.Write,
+		errNoXMP:    webp.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:        "riff",
+		detect:      isRIFF,
+		readPacket:  riff.ReadPacket,
+		read:        riff.Read,
+		write:       riff.Write,
+		errNoXMP:    riff.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:        "bmff",
+		detect:      isBMFF,
+		readPacket:  bmff.ReadPacket,
+		read:        bmff.Read,
+		write:       bmff.Write,
+		errNoXMP:    bmff.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:        "jp2",
+		detect:      func(head []byte) bool { return hasPrefix(head, "\x00\x00\x00\x0cjP  \r\n\x87\n") },
+		readPacket:  jp2.ReadPacket,
+		read:        jp2.Read,
+		write:       jp2.Write,
+		errNoXMP:    jp2.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name: "jxl",
+		detect: func(head []byte) bool {
+			return hasPrefix(head, "\x00\x00\x00\x0cJXL \r\n\x87\n") || hasPrefix(head, "\xff\x0a")
+		},
+		readPacket:  jxl.ReadPacket,
+		read:        jxl.Read,
+		write:       jxl.Write,
+		errNoXMP:    jxl.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:        "psd",
+		detect:      func(head []byte) bool { return hasPrefix(head, "8BPS") },
+		readPacket:  psd.ReadPacket,
+		read:        psd.Read,
+		write:       psd.Write,
+		errNoXMP:    psd.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:        "pdf",
+		detect:      func(head []byte) bool { return hasPrefix(head, "%PDF-") },
+		readPacket:  pdf.ReadPacket,
+		read:        pdf.Read,
+		write:       pdf.Write,
+		errNoXMP:    pdf.ErrNoXMP,
+		inPlaceSafe: true,
+	})
+	Register(&handler{
+		name:       "id3",
+		detect:     func(head []byte) bool { return hasPrefix(head, "ID3") },
+		readPacket: func(r io.ReadSeeker) ([]byte, error) { return id3.ReadPacket(r) },
+		read:       func(r io.ReadSeeker) (*xmp.Document, error) { return id3.Read(r) },
+		write:      func(w io.Writer, r io.ReadSeeker, d *xmp.Document) error { return id3.Write(w, r, d) },
+		errNoXMP:   id3.ErrNoXMP,
+	})
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package xmpfiles
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+var ErrNoSidecar = errors.New("xmpfiles: no sidecar file found")
+
+// Convention is a sidecar file naming scheme.
+type Convention int
+
+const (
+	ReplaceExt Convention = iota // IMG_1234.xmp as used by Lightroom and ACR
+	AppendExt                    // IMG_1234.CR2.xmp as used by darktable and digiKam
+)
+
+// Precedence selects the side that wins when sidecar and embedded metadata
+// contain different values for the same property.
+type Precedence int
+
+const (
+	PreferSidecar Precedence = iota
+	PreferEmbedded
+)
+
+// Owner selects the side that receives metadata updates.
+type Owner int
+
+const (
+	// OwnerAuto writes to an existing sidecar, to the media file when it
+	// has a writable format and to a new sidecar otherwise.
+	OwnerAuto Owner = iota
+	OwnerSidecar
+	OwnerEmbedded
+)
+
+// SidecarPolicy controls how sidecar and embedded metadata are combined.
+type SidecarPolicy struct {
+	Precedence Precedence
+	Owner      Owner
+	Convention Convention    // naming of new sidecar files
+	Flags      xmp.SyncFlags // merge flags, CREATE|REPLACE|NOFAIL when zero
+	Write      *WriteOptions // options for atomic writes
+}
+
+var DefaultSidecarPolicy = SidecarPolicy{
+	Precedence: PreferSidecar,
+	Owner:      OwnerAuto,
+	Convention: ReplaceExt,
+}
+
+// raw camera formats are never modified, their metadata lives in sidecars
+var rawExtensions = map[string]bool{
+	".3fr": true, ".arw": true, ".cr2": true, ".cr3": true, ".crw": true,
+	".dcr": true, ".erf": true, ".iiq": true, ".kdc": true, ".mef": true,
+	".mos": true, ".mrw": true, ".nef": true, ".nrw": true, ".orf": true,
+	".pef": true, ".raf": true, ".rw2": true, ".rwl": true, ".sr2": true,
+	".srf": true, ".srw": true, ".x3f": true,
+}
+
+// SidecarPath returns the name of a new sidecar for the media file name
+// under the given convention.
+func SidecarPath(name string, c Convention) string {
+	if c == AppendExt {
+		return name + ".xmp"
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".xmp"
+}
+
+// FindSidecar returns the path of an existing sidecar for the media file
+// name. Both naming conventions are matched without regard to case. A
+// sidecar carrying the full media file name is preferred because a
+// sidecar without extension may be shared by several media files, for
+// example a raw file and its JPEG preview.
+func FindSidecar(name string) (string, error) {
+	dir, base := filepath.Split(name)
+	l, err := ioutil.ReadDir(filepath.Join(dir, "."))
+	if err != nil {
+		return "", err
+	}
+	candidates := []string{
+		base + ".xmp",
+		strings.TrimSuffix(base, filepath.Ext(base)) + ".xmp",
+	}
+	for _, c := range candidates {
+		// exact match first, then case variants
+		for _, fold := range []bool{false, true} {
+			for _, fi := range l {
+				if fi.IsDir() || fi.Name() == base {
+					continue
+				}
+				if fi.Name() == c || fold && strings.EqualFold(fi.Name(), c) {
+					return filepath.Join(dir, fi.Name()), nil
+				}
+			}
+		}
+	}
+	return "", ErrNoSidecar
+}
+
+// ReadWithSidecar reads embedded and sidecar metadata of the media file
+// name and merges both according to policy. It returns ErrNoXMP when
+// neither side holds metadata.
+func ReadWithSidecar(name string, policy SidecarPolicy) (*xmp.Document, error) {
+	embedded, err := readEmbedded(name)
+	if err != nil {
+		return nil, err
+	}
+	var sidecar *xmp.Document
+	path, err := FindSidecar(name)
+	switch err {
+	case nil:
+		if sidecar, err = readSidecar(path); err != nil {
+			return nil, err
+		}
+	case ErrNoSidecar:
+	default:
+		return nil, err
+	}
+	return Reconcile(embedded, sidecar, policy)
+}
+
+// Reconcile merges embedded and sidecar metadata. Values from the side
+// preferred by policy override values from the other side. Either document
+// may be nil.
+func Reconcile(embedded, sidecar *xmp.Document, policy SidecarPolicy) (*xmp.Document, error) {
+	base, top := embedded, sidecar
+	if policy.Precedence == PreferEmbedded {
+		base, top = sidecar, embedded
+	}
+	switch {
+	case base == nil && top == nil:
+		return nil, ErrNoXMP
+	case base == nil:
+		return top, nil
+	case top == nil:
+		return base, nil
+	}
+	flags := policy.Flags
+	if flags == 0 {
+		flags = xmp.CREATE | xmp.REPLACE | xmp.NOFAIL
+	}
+	if err := base.Merge(top, flags); err != nil {
+		return nil, err
+	}
+	return base, nil
+}
+
+// WriteWithSidecar stores d in the sidecar or the media file name,
+// whichever owns the metadata under policy. It returns the name of the
+// written file.
+func WriteWithSidecar(name string, d *xmp.Document, policy SidecarPolicy) (string, error) {
+	path, err := FindSidecar(name)
+	if err != nil && err != ErrNoSidecar {
+		return "", err
+	}
+	owner := policy.Owner
+	if owner == OwnerAuto {
+		owner = OwnerSidecar
+		if path == "" && isWritable(name) {
+			owner = OwnerEmbedded
+		}
+	}
+	if owner == OwnerEmbedded {
+		return name, writeEmbedded(name, d, policy.Write)
+	}
+	if path == "" {
+		path = SidecarPath(name, policy.Convention)
+	}
+	return path, writeSidecar(path, d, policy.Write)
+}
+
+// isWritable returns true when the media file has a known format that is
+// not a raw camera format.
+func isWritable(name string) bool {
+	if rawExtensions[strings.ToLower(filepath.Ext(name))] {
+		return false
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	h, err := Detect(f)
+	return err == nil && h.Name() != "xmp"
+}
+
+// readEmbedded returns the embedded metadata of the media file or nil.
+func readEmbedded(name string) (*xmp.Document, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h, err := Detect(f)
+	switch err {
+	case nil:
+	case ErrUnknownFormat:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	d, err := h.Read(f)
+	if err == ErrNoXMP {
+		return nil, nil
+	}
+	return d, err
+}
+
+func readSidecar(name string) (*xmp.Document, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return decode(b)
+}
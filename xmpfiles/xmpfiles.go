@@ -0,0 +1,365 @@
+// Copyright (c) 2017-2018 Alexander Eichhorn
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package xmpfiles provides a common interface to the container formats in
+// the format packages and a registry that selects the handler for a file by
+// sniffing its leading magic bytes.
+//
+// All formats of this module are registered by default. Other packages can
+// add their own formats with Register. Handlers registered later take
+// precedence, so custom handlers can replace builtin ones.
+package xmpfiles
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/mholt/go-xmp/xmp"
+)
+
+// number of leading file bytes passed to Handler.Detect
+const HeaderSize = 64
+
+var (
+	ErrNoXMP         = errors.New("xmpfiles: no XMP packet found")
+	ErrUnknownFormat = errors.New("xmpfiles: unknown file format")
+	ErrInPlace       = errors.New("xmpfiles: packet cannot be updated in place")
+)
+
+// Packet is an XMP packet embedded in a file.
+type Packet struct {
+	Offset int64 // file offset of the packet, -1 when unknown
+	Length int64 // length of the packet in the file
+	Data   []byte
+}
+
+// Handler reads and writes XMP in a single container format.
+type Handler interface {
+	// Name returns a short format name such as "jpeg".
+	Name() string
+
+	// Detect returns true when head, the first HeaderSize bytes of a file
+	// or less for short files, belongs to the handled format.
+	Detect(head []byte) bool
+
+	// ReadPackets returns the XMP packets of the file, the main packet
+	// first. Packets that are not stored as contiguous raw bytes, for
+	// example compressed ones, have an offset of -1.
+	//
+	// The built-in handlers return only the main packet. Its offset is
+	// found by searching the file for the packet bytes and is -1 when they
+	// occur more than once, for example in PDF incremental updates or a
+	// JPEG thumbnail carrying the same packet.
+	ReadPackets(r io.ReadSeeker) ([]*Packet, error)
+
+	// Read decodes the XMP metadata of the file.
+	Read(r io.ReadSeeker) (*xmp.Document, error)
+
+	// Write copies the file from r to w and stores d as its XMP metadata.
+	Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error
+
+	// CanUpdateInPlace reports whether a packet of the given size can
+	// overwrite the main packet of the file without changing any other
+	// bytes.
+	CanUpdateInPlace(r io.ReadSeeker, size int) (bool, error)
+}
+
+type registry struct {
+	handlers []Handler
+	m        sync.RWMutex
+}
+
+var handlers registry
+
+// Register adds a handler to the registry.
+func Register(h Handler) {
+	handlers.m.Lock()
+	defer handlers.m.Unlock()
+	handlers.handlers = append(handlers.handlers, h)
+}
+
+// Handlers returns all registered handlers in detection order.
+func Handlers() []Handler {
+	handlers.m.RLock()
+	defer handlers.m.RUnlock()
+	l := make([]Handler, len(handlers.handlers))
+	for i, h := range handlers.handlers {
+		l[len(l)-1-i] = h
+	}
+	return l
+}
+
+// Lookup returns the handler registered under name or nil.
+func Lookup(name string) Handler {
+	for _, h := range Handlers() {
+		if h.Name() == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// Detect returns the handler for the file in r based on its magic bytes.
+func Detect(r io.ReadSeeker) (Handler, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head := make([]byte, HeaderSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head = head[:n]
+	for _, h := range Handlers() {
+		if h.Detect(head) {
+			return h, nil
+		}
+	}
+	return nil, ErrUnknownFormat
+}
+
+// ReadPackets returns the XMP packets of the file in r as reported by its
+// handler. Files of unknown format are scanned for all packets.
+func ReadPackets(r io.ReadSeeker) ([]*Packet, error) {
+	h, err := Detect(r)
+	switch err {
+	case nil:
+		return h.ReadPackets(r)
+	case ErrUnknownFormat:
+		return scan(r)
+	default:
+		return nil, err
+	}
+}
+
+// Read decodes the XMP metadata of the file in r. Files of unknown format
+// are scanned for packets and the first packet is decoded.
+func Read(r io.ReadSeeker) (*xmp.Document, error) {
+	h, err := Detect(r)
+	switch err {
+	case nil:
+		return h.Read(r)
+	case ErrUnknownFormat:
+		l, err := scan(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(l) == 0 {
+			return nil, ErrNoXMP
+		}
+		return decode(l[0].Data)
+	default:
+		return nil, err
+	}
+}
+
+// Write copies the file from r to w and stores d as its XMP metadata.
+func Write(w io.Writer, r io.ReadSeeker, d *xmp.Document) error {
+	h, err := Detect(r)
+	if err != nil {
+		return err
+	}
+	return h.Write(w, r, d)
+}
+
+// File is a random access file such as *os.File.
+type File interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.WriterAt
+}
+
+// UpdateInPlace overwrites the main XMP packet of f with d without moving
+// any other file bytes. The new packet has the same length and encoding as
+// the old one with the remainder filled by padding. Files of unknown format
+// such as INDD or AI have their first packet updated.
+//
+// Unlike WriteFile the update is not atomic, a crash during the write can
+// leave a partial packet behind. When f has a Sync method such as
+// *os.File, the packet is synced to disk before UpdateInPlace returns.
+//
+// ErrInPlace is returned when the container does not permit in-place
+// updates, xmp.ErrReadOnly for read-only packets, xmp.ErrOverflow when d
+// does not fit into the existing packet and xmp.ErrPacketMismatch when the
+// scanned packet cannot be verified before writing.
+func UpdateInPlace(f File, d *xmp.Document) error {
+	h, err := Detect(f)
+	if err != nil && err != ErrUnknownFormat {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	l, err := xmp.ScanPacketInfo(f, size)
+	if err != nil {
+		return err
+	}
+	if len(l) == 0 {
+		return ErrNoXMP
+	}
+	p := l[0]
+	if h != nil {
+		if p, err = mainPacket(h, f, l); err != nil {
+			return err
+		}
+		ok, err := h.CanUpdateInPlace(f, int(p.Length))
+		if err != nil {
+			return err
+		}
+		if !ok && p.Writable {
+			return ErrInPlace
+		}
+	}
+	if err := xmp.WritePacketAt(f, p, d); err != nil {
+		return err
+	}
+	if s, ok := f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// mainPacket returns the scanned packet that lies inside the main packet
+// reported by the handler.
+func mainPacket(h Handler, r io.ReadSeeker, l []*xmp.PacketInfo) (*xmp.PacketInfo, error) {
+	packets, err := h.ReadPackets(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) == 0 {
+		return nil, ErrNoXMP
+	}
+	main := packets[0]
+	if main.Offset < 0 {
+		return nil, ErrInPlace
+	}
+	for _, p := range l {
+		if p.Offset >= main.Offset && p.Offset+p.Length <= main.Offset+main.Length {
+			return p, nil
+		}
+	}
+	return nil, ErrInPlace
+}
+
+func decode(packet []byte) (*xmp.Document, error) {
+	d := xmp.NewDocument()
+	if err := xmp.Unmarshal(packet, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// scan searches the file for XMP packets.
+func scan(r io.ReadSeeker) ([]*Packet, error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return scanAt(r, ra)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	l, err := xmp.ScanPackets(r)
+	if err == io.EOF {
+		return nil, ErrNoXMP
+	}
+	if err != nil {
+		return nil, err
+	}
+	packets := make([]*Packet, 0, len(l))
+	for _, v := range l {
+		p := &Packet{Offset: -1, Length: int64(len(v)), Data: v}
+		if p.Offset, err = locate(r, v); err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// scanAt searches the file for XMP packets in any encoding.
+func scanAt(r io.ReadSeeker, ra io.ReaderAt) ([]*Packet, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	l, err := xmp.ScanPacketInfo(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) == 0 {
+		return nil, ErrNoXMP
+	}
+	packets := make([]*Packet, 0, len(l))
+	for _, v := range l {
+		b, err := xmp.ReadPacketAt(ra, v)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, &Packet{Offset: v.Offset, Length: v.Length, Data: b})
+	}
+	return packets, nil
+}
+
+// locate returns the offset of packet in the file or -1 when the packet is
+// not stored as is or occurs more than once, so the offset is ambiguous.
+func locate(r io.ReadSeeker, packet []byte) (int64, error) {
+	if len(packet) == 0 {
+		return -1, nil
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return -1, err
+	}
+	size := 1 << 16
+	if size < 2*len(packet) {
+		size = 2 * len(packet)
+	}
+	buf := make([]byte, size)
+	var (
+		base  int64 // file offset of buf[0]
+		n     int   // valid bytes in buf
+		found int64 = -1
+		count int
+	)
+	for {
+		m, err := io.ReadFull(r, buf[n:])
+		n += m
+		for i, start := 0, 0; ; {
+			if i = bytes.Index(buf[start:n], packet); i < 0 {
+				break
+			}
+			found = base + int64(start+i)
+			count++
+			start += i + 1
+		}
+		if count > 1 {
+			return -1, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return found, nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		// keep a tail that may hold the start of a match
+		keep := len(packet) - 1
+		copy(buf, buf[n-keep:n])
+		base += int64(n - keep)
+		n = keep
+	}
+}